@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hadydotai/opdlang/logging"
+)
+
+// artifactPath is where a file made from source goes in the artifacts
+// directory, kind is the subdirectory for that sort of file. Sources inside
+// the project keep their directories so same-named files don't collide
+func artifactPath(kind, source, ext string) (string, error) {
+	name := filepath.Clean(source)
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+		name = filepath.Base(name)
+	}
+	path := filepath.Join(opts.Artifacts, kind, strings.TrimSuffix(name, filepath.Ext(name))+ext)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create artifacts directory: %w", err)
+	}
+	return path, nil
+}
+
+type CleanCommand struct {
+	DryRun bool `long:"dry-run" description:"Print what would be removed without removing it"`
+}
+
+var cleanCommand CleanCommand
+
+func (cmd *CleanCommand) Execute(args []string) error {
+	dir := opts.Artifacts
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		fmt.Printf("nothing to clean, %s doesn't exist\n", dir)
+		return nil
+	}
+
+	// Sources never go in there, finding one means the directory was set to
+	// somewhere that isn't ours to remove
+	var files int
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if filepath.Ext(path) == sourceExt {
+			return fmt.Errorf("refusing to clean %s, it holds the source file %s", dir, path)
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("would remove %s, %d files\n", dir, files)
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", dir, err)
+	}
+	logging.Log(logging.LogLevelInfo, "Removed artifacts", "dir", dir, "files", files)
+	fmt.Printf("removed %s, %d files\n", dir, files)
+	return nil
+}
+
+func init() {
+	flagsparser.AddCommand(
+		"clean",
+		"Remove the artifacts directory",
+		"Removes the directory compiled bytecode and core files go to, .opd unless --artifacts-dir says otherwise",
+		&cleanCommand,
+	)
+}
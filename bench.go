@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"testing"
+
+	"hadydotai/opdlang/lang"
+)
+
+// benchmark is a program timed by `internals bench`, each one leans on a
+// different part of the VM
+type benchmark struct {
+	name   string
+	source string
+}
+
+var benchmarks = []benchmark{
+	{"arith", `
+var sum = 0
+for i = 1 to 20000 do
+	sum = sum + i * 3 % 7 - 1
+end
+`},
+	{"compare", `
+var i = 0
+var hits = 0
+while i < 20000 do
+	if i % 3 == 0 then hits += 1 end
+	i += 1
+end
+`},
+	{"calls", `
+fn fib(n) do
+	var r = n
+	if n > 1 then r = fib(n - 1) + fib(n - 2) end
+	r
+end
+val x = fib(18)
+`},
+	{"arrays", `
+val xs = array(0..2000)
+for i = 0 to 1999 do
+	xs[i] = xs[i] * 1000
+end
+var total = 0
+for x in xs do total += x end
+`},
+	{"strings", `
+var s = ""
+for i = 1 to 500 do
+	s = s + "x"
+end
+`},
+}
+
+type BenchCommand struct {
+	Run string `long:"run" description:"Only run the benchmarks whose name matches this regexp"`
+}
+
+var benchCommand BenchCommand
+
+func (cmd *BenchCommand) Execute(args []string) error {
+	filter, err := regexp.Compile(cmd.Run)
+	if err != nil {
+		return fmt.Errorf("invalid --run pattern: %w", err)
+	}
+	for _, bench := range benchmarks {
+		if !filter.MatchString(bench.name) {
+			continue
+		}
+		program, err := lang.Parse(bench.name, bench.source)
+		if err != nil {
+			return err
+		}
+		compiler := lang.NewCompiler()
+		if _, err := compiler.CompileProgram(program); err != nil {
+			return fmt.Errorf("%s: %w", bench.name, err)
+		}
+
+		var failed error
+		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				vm := lang.NewVM(compiler.Code, lang.DefaultStackSize, lang.DefaultLocalsSize, false)
+				lang.RegisterBuiltins(vm)
+				vm.SetOutput(io.Discard)
+				vm.RegisterStrings(compiler.Strings)
+				vm.RegisterConstants(compiler.Constants)
+				vm.Run()
+				<-vm.StateChan
+				if err := vm.Err(); err != nil {
+					failed = err
+					b.FailNow()
+				}
+			}
+		})
+		if failed != nil {
+			return fmt.Errorf("%s: %w", bench.name, failed)
+		}
+		fmt.Printf("\033[1;33m%-10s\033[0m %s %s\n", bench.name, result.String(), result.MemString())
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hadydotai/opdlang/lang"
+)
+
+// sourceExt is the extension source files are discovered by
+const sourceExt = ".dl"
+
+type CheckCommand struct {
+	Args struct {
+		Patterns []string `positional-arg-name:"PATTERNS"`
+	} `positional-args:"yes"`
+}
+
+var checkCommand CheckCommand
+
+func (cmd *CheckCommand) Execute(args []string) error {
+	patterns := cmd.Args.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		found, err := discoverSources(pattern)
+		if err != nil {
+			return err
+		}
+		files = append(files, found...)
+	}
+
+	counts := map[string]int{}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read source file %s: %w", file, err)
+		}
+		for _, diag := range lang.Check(file, string(source)) {
+			counts[diag.Severity]++
+			color := "33"
+			if diag.Severity == lang.SeverityError {
+				color = "31"
+			}
+			fmt.Printf("\033[1;%sm%s\033[0m %v\n", color, diag.Severity, diag.Err)
+		}
+	}
+
+	fmt.Printf("checked %d files, %d errors, %d warnings\n",
+		len(files), counts[lang.SeverityError], counts[lang.SeverityWarning])
+	if counts[lang.SeverityError] > 0 {
+		return fmt.Errorf("check failed")
+	}
+	return nil
+}
+
+// discoverSources expands a pattern into source files. A path ending in
+// /... is searched recursively, a directory gives the sources directly in
+// it and anything else is taken as a file
+func discoverSources(pattern string) ([]string, error) {
+	root, recursive := strings.CutSuffix(pattern, "/...")
+	if pattern == "..." {
+		root, recursive = ".", true
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (!recursive || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == sourceExt {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func init() {
+	flagsparser.AddCommand(
+		"check",
+		"Check source files for errors without running them",
+		"Parses and compiles every source file matched by PATTERNS, ./... by default, and prints a summary of the diagnostics",
+		&checkCommand,
+	)
+}
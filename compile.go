@@ -1,17 +1,41 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"hadydotai/opdlang/lang"
 	"hadydotai/opdlang/logging"
+	"hadydotai/opdlang/telemetry"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type CompileCommand struct {
-	Output       string `short:"o" long:"output" description:"Output file and path of the compiled bytecode file" required:"yes"`
-	DumpBytecode bool   `short:"d" long:"dump" description:"Dump a visual analysis of the bytecode for inspection"`
-	StepDebug    bool   `short:"s" long:"stepdebug" description:"Start execution in the step debugger"`
-	Run          bool   `short:"r" long:"run" description:"Run the compiled bytecode file"`
+	Output       string        `short:"o" long:"output" description:"Output file and path of the compiled bytecode file, build/ in the artifacts directory by default"`
+	DumpBytecode bool          `short:"d" long:"dump" description:"Dump a visual analysis of the bytecode for inspection"`
+	StepDebug    bool          `short:"s" long:"stepdebug" description:"Start execution in the step debugger"`
+	Run          bool          `short:"r" long:"run" description:"Run the compiled bytecode file"`
+	ExplainParse bool          `long:"explain-parse" description:"Print every expression fully parenthesized to show how it was grouped"`
+	Sandbox      bool          `long:"sandbox" description:"Compile and run untrusted code, builtins that read the environment or input fail and resource limits apply"`
+	Typecheck    bool          `long:"typecheck" description:"Reject operations on values of the wrong type before running"`
+	Strict       bool          `long:"strict" description:"Make warnings about the program, like declaring a variable twice, errors"`
+	OTLPEndpoint string        `long:"otlp-endpoint" description:"Send spans for operations and function calls and run counters to this OTLP/HTTP collector URL"`
+	OTLPService  string        `long:"otlp-service" description:"Service name to report to the OTLP collector" default:"opdlang"`
+	Events       string        `long:"events" description:"Write a stream of compile and run events for CI" choice:"jsonl"`
+	EventsFD     uint          `long:"events-fd" description:"File descriptor the event stream is written to" default:"2"`
+	VMAssert     bool          `long:"vm-assert" description:"Check the VM's invariants before every instruction, for catching compiler bugs"`
+	Checked      bool          `long:"checked" description:"Make integer overflow a runtime error instead of wrapping around, like #pragma checked"`
+	Fuel         int           `long:"max-instructions" description:"Stop the program with an error once it has run this many instructions, 0 for no limit beyond the sandbox's"`
+	Report       string        `long:"report" description:"Write how each operation went, its status, duration and outputs, to this file once the program is done, JSON when it ends in .json and text otherwise"`
+	NoCache      bool          `long:"no-cache" description:"Run every operation, even ones whose inputs haven't changed since they last succeeded"`
+	Core         string        `long:"core" description:"Write a core file here when the program stops with a runtime error, open it with debug --core"`
+	Timeout      time.Duration `long:"timeout" description:"Stop the program with an error once it has run this long, like 500ms or 2m, 0 for no limit"`
+	DebugListen  string        `long:"debug-listen" description:"Run the program under the remote debugger served on this address, like 127.0.0.1:4000, until interrupted"`
+	DebugToken   string        `long:"debug-token" env:"OPDLANG_DEBUG_TOKEN" description:"Token remote debugger clients authenticate with to step and set breakpoints"`
+	DebugRead    string        `long:"debug-read-token" env:"OPDLANG_DEBUG_READ_TOKEN" description:"Token remote debugger clients authenticate with to only look at the state"`
 	Args         struct {
 		Files []string `positional-arg-name:"FILES" required:"yes"`
 	} `positional-args:"yes"`
@@ -20,25 +44,56 @@ type CompileCommand struct {
 var compileCommand CompileCommand
 
 func (cmd *CompileCommand) Execute(args []string) error {
-	logging.Log(logging.LogLevelInfo, "Compiling single file", "file-input", cmd.Args.Files[0], "file-output", cmd.Output)
 	//TODO(@hadydotai): supporting only one input file for now
 	sourceFile := cmd.Args.Files[0]
+	if cmd.Output == "" {
+		output, err := artifactPath("build", sourceFile, ".bc")
+		if err != nil {
+			return err
+		}
+		cmd.Output = output
+	}
+	logging.Log(logging.LogLevelInfo, "Compiling single file", "file-input", sourceFile, "file-output", cmd.Output)
+	events, err := openEventStream(cmd.Events, cmd.EventsFD)
+	if err != nil {
+		return err
+	}
+	events.emit(event{Event: "compile-start", File: sourceFile})
+
 	source, err := os.ReadFile(sourceFile)
 	if err != nil {
-		return fmt.Errorf("failed to read source file %s: %w", sourceFile, err)
+		return events.diagnostics(sourceFile, fmt.Errorf("failed to read source file %s: %w", sourceFile, err))
 	}
 
 	program, err := lang.Parse(sourceFile, string(source))
 	if err != nil {
-		return err
+		return events.diagnostics(sourceFile, err)
+	}
+
+	if cmd.ExplainParse {
+		lang.ExplainParse(os.Stdout, program, string(source))
+	}
+
+	if cmd.Typecheck {
+		if err := lang.Typecheck(program); err != nil {
+			return events.diagnostics(sourceFile, fmt.Errorf("failed to compile source file %s: %w", sourceFile, err))
+		}
 	}
 
 	logging.Log(logging.LogLevelDebug, "Compilation started")
 	compiler := lang.NewCompiler()
+	compiler.Strict = cmd.Strict
+	if cmd.Sandbox {
+		compiler.SetBudget(lang.SandboxBudget)
+	}
 	bytecode, err := compiler.CompileProgram(program)
 	if err != nil {
-		return fmt.Errorf("failed to compile source file %s: %w", sourceFile, err)
+		return events.diagnostics(sourceFile, fmt.Errorf("failed to compile source file %s: %w", sourceFile, err))
+	}
+	for _, warning := range compiler.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
 	}
+	events.warnings(sourceFile, compiler.Warnings)
 
 	logging.Log(logging.LogLevelDebug, "Committing output to disk")
 	err = os.WriteFile(cmd.Output, bytecode, 0644)
@@ -49,25 +104,109 @@ func (cmd *CompileCommand) Execute(args []string) error {
 	logging.Log(logging.LogLevelInfo, "Successfully compiled", "file-input", cmd.Args.Files[0], "file-output", cmd.Output)
 
 	if cmd.Run {
-		vm := lang.NewVM(compiler.Code, 1024, 1024, cmd.StepDebug)
+		vm := lang.NewVM(compiler.Code, lang.DefaultStackSize, lang.DefaultLocalsSize, cmd.StepDebug || cmd.DebugListen != "")
 		lang.RegisterBuiltins(vm)
+		vm.SetPromptMode(opts.promptMode())
+		vm.SetCheckedArithmetic(compiler.Checked || cmd.Checked)
+		vm.SetPromoteOnOverflow(compiler.Promote)
+		if cmd.Sandbox {
+			vm.EnableSandbox(lang.SandboxLimits)
+		} else {
+			path, err := artifactPath("runs", sourceFile, ".json")
+			if err != nil {
+				return err
+			}
+			runs, err := openRunDB(path, cmd.NoCache)
+			if err != nil {
+				return err
+			}
+			vm.SetRunStore(runs)
+		}
+		if cmd.Fuel > 0 {
+			vm.SetInstructionLimit(cmd.Fuel)
+		}
+		if cmd.VMAssert {
+			vm.EnableAsserts()
+		}
+		if opts.LogFormat == logging.LogFormatJSON {
+			vm.SetProgressSink(&lang.JSONProgressSink{Out: os.Stderr})
+		}
+
+		var trace *lang.Telemetry
+		if cmd.OTLPEndpoint != "" || events != nil || cmd.Report != "" {
+			trace = lang.NewTelemetry(compiler)
+			vm.SetTelemetry(trace)
+		}
+		if events != nil {
+			trace.Listener = events.operations
+			vm.SetOutput(io.MultiWriter(os.Stdout, events))
+		}
+		started := time.Now()
 
 		// Register source map and strings
 		for pc, line := range compiler.GetSourceMap() {
 			vm.RegisterSourceMap(pc, line)
 		}
 		vm.RegisterStrings(compiler.Strings)
+		vm.RegisterConstants(compiler.Constants)
 
-		if cmd.StepDebug {
+		if cmd.DebugListen != "" {
+			access := lang.DebugAccess{ControlToken: cmd.DebugToken, ReadToken: cmd.DebugRead}
+			if err := serveDebugger(vm, cmd.DebugListen, access); err != nil {
+				return err
+			}
+		} else if cmd.StepDebug {
 			repl := NewREPL(vm, compiler)
 			vm.SetLineBreakpoint(1, true)
 			repl.sourceCode = string(source)
 			repl.Start()
 		} else {
+			if cmd.Core != "" {
+				vm.KeepTail(lang.DefaultCoreTail)
+			}
 			logging.Log(logging.LogLevelInfo, "Running compiled output")
-			vm.Run()
-			// Wait for final state (after all operations complete)
-			<-vm.StateChan
+			stop := forwardInterrupts(vm)
+			// Wait for final state (after all operations complete). The
+			// timeout is released right away, os.Exit below skips defers
+			if cmd.Timeout > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), cmd.Timeout)
+				vm.RunContext(ctx)
+				<-vm.StateChan
+				cancel()
+			} else {
+				vm.Run()
+				<-vm.StateChan
+			}
+			stop()
+			if cmd.Core != "" && vm.Err() != nil {
+				if err := writeCore(cmd.Core, vm, compiler, sourceFile, string(source)); err != nil {
+					return err
+				}
+			}
+		}
+		if trace != nil {
+			trace.Finish()
+		}
+		if cmd.Report != "" {
+			if err := writeReport(cmd.Report, vm.OperationResults(trace)); err != nil {
+				return err
+			}
+		}
+		events.runFinished(vm.Err(), started)
+
+		if cmd.OTLPEndpoint != "" {
+			exporter := &telemetry.OTLPExporter{Endpoint: cmd.OTLPEndpoint, Service: cmd.OTLPService}
+			if err := exporter.Export(trace, started); err != nil {
+				return err
+			}
+		}
+		if code := vm.ExitCode(); code != 0 {
+			if cmd.DumpBytecode {
+				compiler.DebugPrint()
+			}
+			// The program's own status or a runtime error's, for shell
+			// pipelines
+			os.Exit(code)
 		}
 	}
 
@@ -77,6 +216,26 @@ func (cmd *CompileCommand) Execute(args []string) error {
 	return nil
 }
 
+// forwardInterrupts hands SIGINT and SIGTERM to the program's on_interrupt
+// handler. Without one, or on a second signal while it runs, the process
+// exits with 128 plus the signal's number like it would have uncaught
+func forwardInterrupts(vm *lang.VM) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			status := 128 + int(sig.(syscall.Signal))
+			if !vm.Interrupt(status) {
+				os.Exit(status)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
 func init() {
 	flagsparser.AddCommand(
 		"compile",
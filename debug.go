@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"hadydotai/opdlang/lang"
+	"hadydotai/opdlang/logging"
+)
+
+type DebugCommand struct {
+	Core string `long:"core" description:"Core file written by compile --core to open" required:"yes"`
+}
+
+var debugCommand DebugCommand
+
+func (cmd *DebugCommand) Execute(args []string) error {
+	core, err := lang.ReadCore(cmd.Core)
+	if err != nil {
+		return err
+	}
+
+	// The debugger works off the compiler's view of the program, the source
+	// in the core has to compile back to the same bytecode
+	program, err := lang.Parse(core.Filename, core.Source)
+	if err != nil {
+		return fmt.Errorf("failed to parse the source in core %s: %w", cmd.Core, err)
+	}
+	compiler := lang.NewCompiler()
+	compiler.LangVersion = core.LangVersion
+	if _, err := compiler.CompileProgram(program); err != nil {
+		return fmt.Errorf("failed to compile the source in core %s: %w", cmd.Core, err)
+	}
+	if !bytes.Equal(compiler.Code, core.Bytecode) {
+		return fmt.Errorf("core %s was written by a different build of %s, its source compiles to other bytecode", cmd.Core, core.Filename)
+	}
+
+	vm := lang.NewVM(compiler.Code, lang.DefaultStackSize, lang.DefaultLocalsSize, true)
+	lang.RegisterBuiltins(vm)
+	vm.SetPromptMode(opts.promptMode())
+	vm.SetCheckedArithmetic(compiler.Checked || core.Checked)
+	vm.SetPromoteOnOverflow(compiler.Promote)
+	for pc, line := range compiler.GetSourceMap() {
+		vm.RegisterSourceMap(pc, line)
+	}
+	vm.RegisterStrings(compiler.Strings)
+	vm.RegisterConstants(compiler.Constants)
+	if err := vm.Restore(core); err != nil {
+		return err
+	}
+
+	logging.Log(logging.LogLevelInfo, "Opened core", "file", cmd.Core, "steps", vm.StepCount())
+	fmt.Printf("%s stopped at line %d: %s\n", core.Filename, vm.State().SourceLine, core.Err)
+	repl := NewREPL(vm, compiler)
+	repl.sourceCode = core.Source
+	repl.Start()
+	return nil
+}
+
+// writeCore writes the post-mortem of a program stopped by a runtime error
+func writeCore(path string, vm *lang.VM, compiler *lang.Compiler, filename, source string) error {
+	core, err := vm.Core()
+	if err != nil {
+		return err
+	}
+	core.Filename, core.Source, core.LangVersion = filename, source, compiler.LangVersion
+	if err := lang.WriteCore(path, core); err != nil {
+		return err
+	}
+	logging.Log(logging.LogLevelInfo, "Wrote core", "file", path, "steps", len(core.Steps))
+	return nil
+}
+
+// serveDebugger serves the remote debugger for vm on addr until the process
+// is interrupted
+func serveDebugger(vm *lang.VM, addr string, access lang.DebugAccess) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to serve the debugger: %w", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	logging.Log(logging.LogLevelInfo, "Serving the remote debugger", "address", listener.Addr().String())
+	fmt.Fprintf(os.Stderr, "debugger listening on %s\n", listener.Addr())
+	return lang.ServeDebugger(vm, listener, access)
+}
+
+func init() {
+	flagsparser.AddCommand(
+		"debug",
+		"Open a core file in the step debugger",
+		"Opens the core a failed run wrote with compile --core, positioned at the failing instruction with the last recorded steps to step back through",
+		&debugCommand,
+	)
+}
@@ -0,0 +1,273 @@
+// Package e2e drives the opdlang binary end to end. TestMain builds the
+// binary once, every case in testdata is run against it and what comes out
+// is compared with what the case expects
+//
+//	go test ./e2e [-run TestCases/pattern] [-update]
+//
+// A case is a file of sections, each starting with a `-- name --` line.
+// Lines before the first section are directives and # comments:
+//
+//	# prints a greeting
+//	args compile hello.dl -o hello.bc -r -lnone
+//	exit 0
+//
+// env NAME=value lines add to the few environment variables the binary
+// gets, there can be as many as the case needs. A case can have more than
+// one args line, the ones before the last set up for it, like writing a
+// core file to debug, and only the last is checked.
+//
+// The stdin section is fed to the binary, stdout and stderr are compared
+// with what it printed when the case has them, with terminal escapes taken
+// out. Every other section is a file written to the directory the binary
+// runs in
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected output of the cases with what the binary printed")
+
+// caseTimeout is how long a command of a case gets before it's counted as
+// hanging
+const caseTimeout = 10 * time.Second
+
+// escapes are terminal colors and cursor movement, cases don't spell them out
+var escapes = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// binary is the opdlang binary TestMain built
+var binary string
+
+// section is a named part of a case file
+type section struct {
+	name string
+	data string
+}
+
+type testCase struct {
+	path string
+	// notes are the comment lines at the top, kept when the case is updated
+	notes []string
+	// setup are the commands run before args, in order
+	setup    [][]string
+	args     []string
+	env      []string
+	exit     int
+	sections []section
+}
+
+func (tc *testCase) section(name string) (string, bool) {
+	for _, s := range tc.sections {
+		if s.name == name {
+			return s.data, true
+		}
+	}
+	return "", false
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "opdlang-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	binary = filepath.Join(dir, "opdlang")
+	build := exec.Command("go", "build", "-o", binary, "..")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build the binary: %v\n", err)
+		os.RemoveAll(dir)
+		os.Exit(2)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestCases(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".txt")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc, err := readCase(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			problems, err := tc.run(t.TempDir(), *update)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// run runs the case in workdir and reports how the binary's behaviour
+// differs from the expected one, with update the case file is rewritten to
+// expect it instead
+func (tc *testCase) run(workdir string, update bool) ([]string, error) {
+	for _, s := range tc.sections {
+		switch s.name {
+		case "stdin", "stdout", "stderr":
+			continue
+		}
+		path := filepath.Join(workdir, s.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(s.data), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	// What the setup commands print and exit with isn't checked, a core
+	// file is written by a program that failed
+	for _, args := range tc.setup {
+		if _, _, _, err := tc.command(workdir, args, ""); err != nil {
+			return nil, fmt.Errorf("setup %s: %w", strings.Join(args, " "), err)
+		}
+	}
+	stdin, _ := tc.section("stdin")
+	stdout, stderr, exit, err := tc.command(workdir, tc.args, stdin)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return []string{fmt.Sprintf("timed out after %s", caseTimeout)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	got := map[string]string{"stdout": stdout, "stderr": stderr}
+
+	if update {
+		tc.exit = exit
+		for i, s := range tc.sections {
+			if output, ok := got[s.name]; ok {
+				tc.sections[i].data = output
+			}
+		}
+		return nil, tc.write()
+	}
+
+	var problems []string
+	if exit != tc.exit {
+		problems = append(problems, fmt.Sprintf("exit code %d, want %d", exit, tc.exit))
+	}
+	for _, name := range []string{"stdout", "stderr"} {
+		if want, ok := tc.section(name); ok && got[name] != want {
+			problems = append(problems, fmt.Sprintf("%s differs\n--- got\n%s--- want\n%s", name, got[name], want))
+		}
+	}
+	return problems, nil
+}
+
+// command runs the binary with args in workdir, what it printed comes back
+// with terminal escapes taken out
+func (tc *testCase) command(workdir string, args []string, stdin string) (stdout, stderr string, exit int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), caseTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Dir = workdir
+	// Nothing in the environment should change what the binary prints
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH"), "HOME=" + workdir, "LANG=C"}, tc.env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if ctx.Err() != nil {
+			return "", "", 0, ctx.Err()
+		}
+		if !errors.As(err, &exitErr) {
+			return "", "", 0, err
+		}
+		exit = exitErr.ExitCode()
+	}
+	return escapes.ReplaceAllString(out.String(), ""), escapes.ReplaceAllString(errOut.String(), ""), exit, nil
+}
+
+// readCase parses a case file, see the package comment for the format
+func readCase(path string) (*testCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tc := &testCase{path: path}
+	var current *section
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(trimmed, "-- "); ok && strings.HasSuffix(name, " --") {
+			tc.sections = append(tc.sections, section{name: strings.TrimSuffix(name, " --")})
+			current = &tc.sections[len(tc.sections)-1]
+			continue
+		}
+		if current != nil {
+			current.data += line
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			tc.notes = append(tc.notes, trimmed)
+			continue
+		}
+		directive, value, _ := strings.Cut(trimmed, " ")
+		switch directive {
+		case "":
+		case "args":
+			if tc.args != nil {
+				tc.setup = append(tc.setup, tc.args)
+			}
+			tc.args = strings.Fields(value)
+		case "env":
+			tc.env = append(tc.env, value)
+		case "exit":
+			if tc.exit, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("%s: invalid exit code %s", path, value)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown directive %s", path, directive)
+		}
+	}
+	if len(tc.args) == 0 {
+		return nil, fmt.Errorf("%s: no args to run the binary with", path)
+	}
+	return tc, nil
+}
+
+// write saves the case back to its file
+func (tc *testCase) write() error {
+	var b strings.Builder
+	for _, note := range tc.notes {
+		fmt.Fprintln(&b, note)
+	}
+	for _, args := range tc.setup {
+		fmt.Fprintf(&b, "args %s\n", strings.Join(args, " "))
+	}
+	fmt.Fprintf(&b, "args %s\n", strings.Join(tc.args, " "))
+	for _, env := range tc.env {
+		fmt.Fprintf(&b, "env %s\n", env)
+	}
+	fmt.Fprintf(&b, "exit %d\n", tc.exit)
+	for _, s := range tc.sections {
+		fmt.Fprintf(&b, "-- %s --\n%s", s.name, s.data)
+	}
+	return os.WriteFile(tc.path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"hadydotai/opdlang/lang"
+)
+
+// event is one line of the --events stream, only the fields that matter to
+// the kind of event are set
+type event struct {
+	Event       string   `json:"event"`
+	Time        string   `json:"time"`
+	File        string   `json:"file,omitempty"`
+	Operation   string   `json:"operation,omitempty"`
+	Output      string   `json:"output,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Diagnostics []string `json:"diagnostics,omitempty"`
+	DurationMS  int64    `json:"duration_ms,omitempty"`
+}
+
+// eventStream writes the events of a compile and run for CI wrappers to
+// follow, a nil stream drops everything
+type eventStream struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// openEventStream opens the stream on the file descriptor the events go
+// to, nil when no stream was asked for
+func openEventStream(format string, fd uint) (*eventStream, error) {
+	if format == "" {
+		return nil, nil
+	}
+	file := os.NewFile(uintptr(fd), "events")
+	if file == nil {
+		return nil, fmt.Errorf("invalid events file descriptor %d", fd)
+	}
+	return &eventStream{out: file}, nil
+}
+
+func (s *eventStream) emit(e event) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(s.out, string(line))
+}
+
+// diagnostics reports the error compiling stopped at and hands it back
+func (s *eventStream) diagnostics(file string, err error) error {
+	s.emit(event{Event: "diagnostics", File: file, Diagnostics: []string{err.Error()}})
+	return err
+}
+
+// warnings reports the deprecated constructs a program compiled with
+func (s *eventStream) warnings(file string, warnings []*lang.LanguageError) {
+	if len(warnings) == 0 {
+		return
+	}
+	diags := make([]string, len(warnings))
+	for i, warning := range warnings {
+		diags[i] = warning.Error()
+	}
+	s.emit(event{Event: "diagnostics", File: file, Status: "warning", Diagnostics: diags})
+}
+
+// Write makes the stream the destination of print, every write is one
+// print-output event
+func (s *eventStream) Write(p []byte) (int, error) {
+	s.emit(event{Event: "print-output", Output: string(p)})
+	return len(p), nil
+}
+
+// operations reports operations as they start and finish, it listens to
+// the spans the telemetry records
+func (s *eventStream) operations(span lang.Span, ended bool) {
+	if span.Kind != lang.SpanOperation {
+		return
+	}
+	if !ended {
+		s.emit(event{Event: "op-start", Operation: span.Name})
+		return
+	}
+	status := "ok"
+	if span.Error != "" {
+		status = "failed"
+	}
+	s.emit(event{
+		Event:      "op-finish",
+		Operation:  span.Name,
+		Status:     status,
+		Error:      span.Error,
+		DurationMS: span.End.Sub(span.Start).Milliseconds(),
+	})
+}
+
+func (s *eventStream) runFinished(err error, started time.Time) {
+	e := event{Event: "run-finish", Status: "ok", DurationMS: time.Since(started).Milliseconds()}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	s.emit(e)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"hadydotai/opdlang/lang"
+)
+
+type InternalsCommand struct{}
+
+type ISACommand struct{}
+
+type BuiltinsCommand struct{}
+
+var (
+	internalsCommand InternalsCommand
+	isaCommand       ISACommand
+	builtinsCommand  BuiltinsCommand
+)
+
+func (cmd *ISACommand) Execute(args []string) error {
+	for _, instr := range lang.Instructions() {
+		info, _ := instr.Info()
+
+		operands := make([]string, 0, len(info.Operands))
+		for _, op := range info.Operands {
+			operands = append(operands, fmt.Sprintf("%s:u%d", op.Name, op.Width*8))
+		}
+		if info.Variable {
+			operands = append(operands, "...")
+		}
+
+		fmt.Printf("\033[90m0x%02x\033[0m \033[1;33m%s\033[0m %s\n", byte(instr), info.Name, strings.Join(operands, " "))
+		fmt.Printf("    %s\n", info.Description)
+		fmt.Printf("    \033[1;32mstack:\033[0m   %s\n", info.StackEffect)
+		fmt.Printf("    \033[1;32mexample:\033[0m %s\n\n", info.Example)
+	}
+	return nil
+}
+
+func (cmd *BuiltinsCommand) Execute(args []string) error {
+	for i, builtin := range lang.Builtins() {
+		fmt.Printf("\033[90mfunc_%-3d\033[0m \033[1;33m%-14s\033[0m args: %s\n", i, builtin.Name, builtin.Arity())
+	}
+	return nil
+}
+
+func init() {
+	internals, err := flagsparser.AddCommand(
+		"internals",
+		"Inspect the internals of the compiler and VM",
+		"Tools for people working on the compiler, VM or bytecode tooling",
+		&internalsCommand,
+	)
+	if err != nil {
+		panic(err)
+	}
+	internals.AddCommand(
+		"isa",
+		"Print the VM instruction set",
+		"Prints every opcode with its operand layout, stack effect and an example disassembly line",
+		&isaCommand,
+	)
+	internals.AddCommand(
+		"builtins",
+		"Print the builtin function registry",
+		"Prints every builtin function with its call index and the number of arguments it accepts",
+		&builtinsCommand,
+	)
+	internals.AddCommand(
+		"bench",
+		"Benchmark the VM",
+		"Runs a set of small programs, each exercising a different part of the VM, and prints the time and allocations per run",
+		&benchCommand,
+	)
+}
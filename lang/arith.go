@@ -0,0 +1,73 @@
+package lang
+
+import (
+	"math"
+	"math/big"
+)
+
+// SetCheckedArithmetic switches integer arithmetic between wrapping on
+// overflow (the default) and raising a runtime error, SetPromoteOnOverflow
+// takes precedence over both
+func (vm *VM) SetCheckedArithmetic(checked bool) {
+	vm.checked = checked
+}
+
+// overflow handles an int64 operation that overflowed, depending on the
+// mode it wraps, promotes to a BigValue or fails
+func (vm *VM) overflow(op Instr, x, y int64, wrapped int64) (Value, error) {
+	switch {
+	case vm.promote:
+		return bigArith(op, big.NewInt(x), big.NewInt(y))
+	case vm.checked:
+		return nil, runtimeError(ErrIntOverflow, x, opSymbols[op], y)
+	default:
+		return IntValue(wrapped), nil
+	}
+}
+
+var opSymbols = map[Instr]string{
+	InstrAdd: "+",
+	InstrSub: "-",
+	InstrMul: "*",
+	InstrDiv: "/",
+	InstrEq:  "==",
+	InstrNeq: "!=",
+	InstrLt:  "<",
+	InstrGt:  ">",
+	InstrLte: "<=",
+	InstrGte: ">=",
+}
+
+func (vm *VM) addInts(x, y int64) (Value, error) {
+	sum := x + y
+	if x > 0 && y > 0 && sum < 0 || x < 0 && y < 0 && sum >= 0 {
+		return vm.overflow(InstrAdd, x, y, sum)
+	}
+	return IntValue(sum), nil
+}
+
+func (vm *VM) subInts(x, y int64) (Value, error) {
+	diff := x - y
+	if x >= 0 && y < 0 && diff < 0 || x < 0 && y > 0 && diff >= 0 {
+		return vm.overflow(InstrSub, x, y, diff)
+	}
+	return IntValue(diff), nil
+}
+
+func (vm *VM) mulInts(x, y int64) (Value, error) {
+	product := x * y
+	if x != 0 && (product/x != y || x == -1 && y == math.MinInt64) {
+		return vm.overflow(InstrMul, x, y, product)
+	}
+	return IntValue(product), nil
+}
+
+func (vm *VM) divInts(x, y int64) (Value, error) {
+	if y == 0 {
+		return nil, runtimeError(ErrDivisionByZero)
+	}
+	if x == math.MinInt64 && y == -1 {
+		return vm.overflow(InstrDiv, x, y, x/y)
+	}
+	return IntValue(x / y), nil
+}
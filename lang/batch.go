@@ -0,0 +1,161 @@
+package lang
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// maxPoolStrings is how many strings PUSH_STR can address
+const maxPoolStrings = maxIndices
+
+// BuiltinRegistry is the builtins a batch of snippets may call. Hosts
+// compiling rules written by their users narrow it down to what a rule
+// should be able to do
+type BuiltinRegistry struct {
+	allowed map[string]bool
+}
+
+// NewBuiltinRegistry allows the named builtins, or all of them when no
+// names are given
+func NewBuiltinRegistry(names ...string) (*BuiltinRegistry, error) {
+	reg := &BuiltinRegistry{}
+	if len(names) == 0 {
+		return reg, nil
+	}
+	reg.allowed = make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := builtinFunctions[name]; !ok {
+			return nil, fmt.Errorf("unknown builtin %s", name)
+		}
+		reg.allowed[name] = true
+	}
+	return reg, nil
+}
+
+// Allows reports whether snippets may call the builtin
+func (reg *BuiltinRegistry) Allows(name string) bool {
+	return reg == nil || reg.allowed == nil || reg.allowed[name]
+}
+
+// Module is one compiled snippet of a batch. Modules compiled together share
+// their string table where it fits, so a VM for one is cheap to set up
+type Module struct {
+	Name    string
+	Code    []byte
+	Checked bool
+	Promote bool
+
+	sourceMap map[int]int
+	constants map[int64]int
+	pool      *stringPool
+}
+
+// stringPool is a string table shared by several modules, strings are only
+// ever added so every module compiled against it keeps its indices
+type stringPool struct {
+	indices map[string]int
+	table   []string
+}
+
+// CompileBatch compiles many small sources, keyed by name, sharing one
+// string table between as many of them as it can hold. Calls to builtins
+// reg doesn't allow are compile errors, a nil reg allows every builtin
+func CompileBatch(sources map[string]string, reg *BuiltinRegistry) (map[string]*Module, error) {
+	modules := make(map[string]*Module, len(sources))
+	pool := &stringPool{indices: make(map[string]int)}
+	var pools []*stringPool
+
+	// In name order so the tables come out the same every time
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		program, err := Parse(name, sources[name])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBuiltins(program, reg); err != nil {
+			return nil, err
+		}
+
+		compiler := NewCompiler()
+		compiler.Strings, compiler.nextString = maps.Clone(pool.indices), len(pool.indices)
+		_, err = compiler.CompileProgram(program)
+		if err != nil && compiler.nextString <= maxPoolStrings {
+			return nil, err
+		}
+		if err != nil || len(compiler.Strings) > maxPoolStrings {
+			// Doesn't fit next to the others, this one gets a table of its own
+			pools = append(pools, pool)
+			pool = &stringPool{indices: make(map[string]int)}
+			compiler = NewCompiler()
+			if _, err := compiler.CompileProgram(program); err != nil {
+				return nil, err
+			}
+		}
+		pool.indices = compiler.Strings
+
+		modules[name] = &Module{
+			Name:      name,
+			Code:      compiler.Code,
+			Checked:   compiler.Checked,
+			Promote:   compiler.Promote,
+			sourceMap: compiler.GetSourceMap(),
+			constants: compiler.Constants,
+			pool:      pool,
+		}
+	}
+
+	for _, pool := range append(pools, pool) {
+		pool.table = make([]string, len(pool.indices))
+		for s, idx := range pool.indices {
+			pool.table[idx] = s
+		}
+	}
+	return modules, nil
+}
+
+// checkBuiltins rejects calls, and method calls, to builtins reg doesn't
+// allow
+func checkBuiltins(program *Program, reg *BuiltinRegistry) error {
+	var err error
+	check := func(call *Call) {
+		if _, builtin := builtinFunctions[call.Function]; builtin && !reg.Allows(call.Function) && err == nil {
+			err = fmt.Errorf("%s: %s is not available here", call.Pos, call.Function)
+		}
+	}
+	visitor{
+		stmt: func(stmt *Statement, _ *FnLit) {
+			if stmt.Call != nil {
+				check(stmt.Call)
+			}
+		},
+		term: func(term *Term, _ *FnLit) {
+			if term.Call != nil {
+				check(term.Call)
+			}
+			for _, sub := range term.Index {
+				if sub.Method != nil {
+					check(sub.Method)
+				}
+			}
+		},
+	}.statements(program.Statements, nil)
+	return err
+}
+
+// NewVM sets up a VM running the module, the string table is shared with
+// the other modules of its batch rather than copied
+func (m *Module) NewVM(debug bool) *VM {
+	vm := NewVM(m.Code, DefaultStackSize, DefaultLocalsSize, debug)
+	RegisterBuiltins(vm)
+	vm.SetCheckedArithmetic(m.Checked)
+	vm.SetPromoteOnOverflow(m.Promote)
+	for pc, line := range m.sourceMap {
+		vm.RegisterSourceMap(pc, line)
+	}
+	vm.RegisterConstants(m.constants)
+	// Full to capacity, strings the program makes are appended to a copy
+	vm.CurrentState.Strings = slices.Clip(m.pool.table)
+	// The bytecode refers to all of them by index, the collector keeps them
+	vm.pinnedStrings = len(m.pool.table)
+	return vm
+}
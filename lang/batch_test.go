@@ -0,0 +1,140 @@
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// runModule runs a module to the end and returns the VM and what it printed
+func runModule(t *testing.T, m *Module) (*VM, string) {
+	t.Helper()
+	vm := m.NewVM(false)
+	var out bytes.Buffer
+	vm.SetOutput(&out)
+	vm.Run()
+	<-vm.StateChan
+	if err := vm.Err(); err != nil {
+		t.Fatalf("%s: %v", m.Name, err)
+	}
+	return vm, out.String()
+}
+
+func TestModuleRunsPastCollection(t *testing.T) {
+	modules, err := CompileBatch(map[string]string{
+		"churn": `var s = ""
+for i = 1 to 3000 do
+	s = format("%d", i)
+	val p = [s, s]
+end
+print("hello ", "world", "\n")
+`,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, out := runModule(t, modules["churn"])
+	if vm.GCStats().Collections == 0 {
+		t.Fatal("churn never collected")
+	}
+	if out != "hello world\n" {
+		t.Errorf("churn printed %q, want %q", out, "hello world\n")
+	}
+}
+
+func TestBatchSharesStrings(t *testing.T) {
+	modules, err := CompileBatch(map[string]string{
+		"a": `print("shared ", "only a", "\n")`,
+		"b": `print("shared ", "only b", "\n")`,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := modules["a"], modules["b"]
+	if a.pool != b.pool {
+		t.Fatal("a and b got string tables of their own")
+	}
+	if n := strings.Count(strings.Join(a.pool.table, "\x00"), "shared "); n != 1 {
+		t.Errorf("the table holds %q %d times, want once", "shared ", n)
+	}
+	for name, want := range map[string]string{"a": "shared only a\n", "b": "shared only b\n"} {
+		if _, out := runModule(t, modules[name]); out != want {
+			t.Errorf("%s printed %q, want %q", name, out, want)
+		}
+	}
+}
+
+// manyStrings is a program with an array of n distinct string literals
+// starting with prefix, it prints how many there are and the last one
+func manyStrings(prefix string, n int) string {
+	var b strings.Builder
+	b.WriteString("val xs = [")
+	for i := range n {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q", fmt.Sprintf("%s%d", prefix, i))
+	}
+	b.WriteString("]\nprint(len(xs), \" \", xs[len(xs) - 1], \"\\n\")\n")
+	return b.String()
+}
+
+func TestBatchPoolOverflow(t *testing.T) {
+	modules, err := CompileBatch(map[string]string{
+		"a": manyStrings("a", 40000),
+		"b": manyStrings("b", 30000),
+		"c": `print("small\n")`,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := modules["a"], modules["b"], modules["c"]
+	if a.pool == b.pool {
+		t.Fatal("a and b share a table past what PUSH_STR can address")
+	}
+	if b.pool != c.pool {
+		t.Error("c didn't join the table b overflowed into")
+	}
+	for _, m := range []*Module{a, b, c} {
+		if len(m.pool.table) > maxPoolStrings {
+			t.Errorf("%s has a table of %d strings", m.Name, len(m.pool.table))
+		}
+	}
+	for name, want := range map[string]string{"a": "40000 a39999\n", "b": "30000 b29999\n", "c": "small\n"} {
+		if _, out := runModule(t, modules[name]); out != want {
+			t.Errorf("%s printed %q, want %q", name, out, want)
+		}
+	}
+}
+
+func TestBatchRegistryRejects(t *testing.T) {
+	reg, err := NewBuiltinRegistry("print", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBuiltinRegistry("print", "no_such_builtin"); err == nil {
+		t.Error("a registry naming an unknown builtin was made")
+	}
+
+	tests := map[string]string{
+		"call": `print(upper("x"))`,
+		"method": `val s = "x"
+print(s.upper())`,
+		"statement": `exit(1)`,
+	}
+	for name, source := range tests {
+		_, err := CompileBatch(map[string]string{name: source}, reg)
+		if err == nil || !strings.Contains(err.Error(), "is not available here") {
+			t.Errorf("%s: got %v, want the builtin refused", name, err)
+		}
+	}
+
+	modules, err := CompileBatch(map[string]string{"ok": `print(format("%d", 7))`}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, out := runModule(t, modules["ok"]); out != "7" {
+		t.Errorf("ok printed %q, want %q", out, "7")
+	}
+}
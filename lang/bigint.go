@@ -0,0 +1,89 @@
+package lang
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// BigValue is an arbitrary precision integer. The big.Int it points to is
+// never mutated after creation, so snapshots can share it
+type BigValue struct {
+	N *big.Int
+}
+
+func (b BigValue) Type() ValueType { return ValueTypeBig }
+
+// SetPromoteOnOverflow makes integer overflow produce a BigValue instead of
+// wrapping or raising an error
+func (vm *VM) SetPromoteOnOverflow(promote bool) {
+	vm.promote = promote
+}
+
+// bigOperands converts a pair of operands for big arithmetic, ok is only
+// set when at least one of them is a BigValue and the other is an integer
+func bigOperands(x, y Value) (bx, by *big.Int, ok bool) {
+	_, xBig := x.(BigValue)
+	_, yBig := y.(BigValue)
+	if !xBig && !yBig {
+		return nil, nil, false
+	}
+	bx, okX := toBig(x)
+	by, okY := toBig(y)
+	return bx, by, okX && okY
+}
+
+func toBig(v Value) (*big.Int, bool) {
+	switch val := v.(type) {
+	case IntValue:
+		return big.NewInt(int64(val)), true
+	case BigValue:
+		return val.N, true
+	}
+	return nil, false
+}
+
+// bigArith applies an arithmetic instruction to two big operands
+func bigArith(op Instr, x, y *big.Int) (Value, error) {
+	result := new(big.Int)
+	switch op {
+	case InstrAdd:
+		result.Add(x, y)
+	case InstrSub:
+		result.Sub(x, y)
+	case InstrMul:
+		result.Mul(x, y)
+	case InstrDiv, InstrMod:
+		if y.Sign() == 0 {
+			return nil, runtimeError(ErrDivisionByZero)
+		}
+		if op == InstrDiv {
+			result.Quo(x, y)
+		} else {
+			result.Rem(x, y)
+		}
+	default:
+		return nil, fmt.Errorf("invalid operand types for %s", op)
+	}
+	return BigValue{N: result}, nil
+}
+
+// bigCompare applies a comparison instruction to two big operands
+func bigCompare(op Instr, x, y *big.Int) BoolValue {
+	cmp := x.Cmp(y)
+	var result bool
+	switch op {
+	case InstrEq:
+		result = cmp == 0
+	case InstrNeq:
+		result = cmp != 0
+	case InstrLt:
+		result = cmp < 0
+	case InstrGt:
+		result = cmp > 0
+	case InstrLte:
+		result = cmp <= 0
+	case InstrGte:
+		result = cmp >= 0
+	}
+	return BoolValue(result)
+}
@@ -0,0 +1,42 @@
+package lang
+
+import "fmt"
+
+// BoolValue is what comparisons, `in` and the true and false literals
+// produce. Programs written when comparisons produced 1 and 0 may still do
+// arithmetic with them, so operations on numbers see a bool as the integer
+// it used to be
+type BoolValue bool
+
+func (b BoolValue) Type() ValueType { return ValueTypeBool }
+
+// intCompat is v with a bool turned into 1 or 0, for the operations that
+// took integers before there were bools
+func intCompat(v Value) Value {
+	if b, ok := v.(BoolValue); ok {
+		if b {
+			return IntValue(1)
+		}
+		return IntValue(0)
+	}
+	return v
+}
+
+func (vm *VM) executePushBool() error {
+	if vm.CurrentState.PC >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	b := vm.Bytecode[vm.CurrentState.PC] != 0
+	vm.CurrentState.PC++
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(b))
+	return nil
+}
+
+// compareError is the error for a comparison between values it can't
+// compare. The operands were just popped and are still past the end of the
+// stack, as they were before intCompat
+func (vm *VM) compareError(op Instr) error {
+	stack := vm.CurrentState.Stack
+	popped := stack[len(stack) : len(stack)+2]
+	return runtimeError(ErrCompareTypes, opSymbols[op], typeNames[popped[0].Type()], typeNames[popped[1].Type()])
+}
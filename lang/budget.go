@@ -0,0 +1,69 @@
+package lang
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// CompileBudget bounds the work of compiling a program, so tooling fed
+// generated or hostile sources can't be wedged by one. A zero field is
+// unlimited
+type CompileBudget struct {
+	// MaxNodes is how many statements and terms the program may have
+	MaxNodes int
+	// MaxBytes is the most bytecode it may compile to
+	MaxBytes int
+	Timeout  time.Duration
+}
+
+// SandboxBudget is the budget for compiling untrusted code. Jump addresses
+// are 16 bits, so no program can usefully be larger than MaxBytes anyway
+var SandboxBudget = CompileBudget{
+	MaxNodes: 1_000_000,
+	MaxBytes: 1 << 16,
+	Timeout:  5 * time.Second,
+}
+
+// SetBudget holds compiling to budget, it has to be set before compiling
+func (c *Compiler) SetBudget(budget CompileBudget) {
+	c.budget = &budget
+}
+
+// startBudget counts the nodes of the program and starts the clock
+func (c *Compiler) startBudget(program *Program) error {
+	if c.budget == nil {
+		return nil
+	}
+	if c.budget.Timeout > 0 {
+		c.deadline = time.Now().Add(c.budget.Timeout)
+	}
+	if c.budget.MaxNodes <= 0 {
+		return nil
+	}
+	nodes := 0
+	visitor{
+		stmt: func(*Statement, *FnLit) { nodes++ },
+		term: func(*Term, *FnLit) { nodes++ },
+	}.statements(program.Statements, nil)
+	if nodes > c.budget.MaxNodes {
+		return languageError(program.Statements[0].Pos(), ErrTooComplex, "",
+			fmt.Sprintf("%d nodes, the limit is %d", nodes, c.budget.MaxNodes))
+	}
+	return nil
+}
+
+// checkBudget stops compiling once the code or the time runs out
+func (c *Compiler) checkBudget(pos lexer.Position) error {
+	if c.budget == nil {
+		return nil
+	}
+	if max := c.budget.MaxBytes; max > 0 && len(c.Code) > max {
+		return languageError(pos, ErrTooComplex, "", fmt.Sprintf("over %d bytes of bytecode", max))
+	}
+	if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		return languageError(pos, ErrTooComplex, "", fmt.Sprintf("compiling took over %s", c.budget.Timeout))
+	}
+	return nil
+}
@@ -1,6 +1,15 @@
 package lang
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
 
 // RegisterBuiltins registers all built-in functions with the VM
 func RegisterBuiltins(vm *VM) {
@@ -12,11 +21,333 @@ func RegisterBuiltins(vm *VM) {
 		for _, arg := range args {
 			switch v := arg.(type) {
 			case IntValue:
-				fmt.Print(int(v))
+				fmt.Fprint(vm.output, int(v))
 			case StringValue:
-				fmt.Print(vm.CurrentState.Strings[v.Index])
+				if v.Secret {
+					fmt.Fprint(vm.output, SecretMask)
+					continue
+				}
+				vm.spendOutput(len(vm.CurrentState.Strings[v.Index]), false)
+				fmt.Fprint(vm.output, vm.CurrentState.Strings[v.Index])
+			case BoolValue, ArrayValue, NilValue, BigValue, BytesValue, FunctionValue, RangeValue, ResourceValue:
+				fmt.Fprint(vm.output, vm.formatted(v))
 			}
 		}
 		return IntValue(0)
 	})
+
+	// Progress reporting, progress(pct, msg)
+	vm.RegisterFunction(builtinFunctions["progress"], func(args []Value) Value {
+		if len(args) == 0 {
+			return IntValue(0)
+		}
+		pct, ok := args[0].(IntValue)
+		if !ok {
+			return IntValue(0)
+		}
+		pct = max(0, min(100, pct))
+
+		msg := ""
+		if len(args) > 1 {
+			if s, ok := args[1].(StringValue); ok {
+				msg = vm.CurrentState.Strings[s.Index]
+			}
+		}
+		vm.progressSink.Progress(int(pct), msg)
+		return IntValue(0)
+	})
+
+	// Secrets, secret(env_name) reads an environment variable into a string
+	// that is never displayed
+	vm.RegisterFunction(builtinFunctions["secret"], func(args []Value) Value {
+		value := ""
+		if len(args) > 0 {
+			if name, ok := args[0].(StringValue); ok {
+				value = os.Getenv(vm.CurrentState.Strings[name.Index])
+			}
+		}
+		return StringValue{Index: vm.RegisterString(value), Secret: true}
+	})
+
+	// Prompts, confirm(msg) returns true for yes and false for no, choose(msg, options)
+	// returns the picked element of the options array
+	vm.RegisterFunction(builtinFunctions["confirm"], func(args []Value) Value {
+		msg := ""
+		if len(args) > 0 {
+			msg = vm.displayString(args[0])
+		}
+		return BoolValue(vm.confirm(msg))
+	})
+
+	vm.RegisterFunction(builtinFunctions["choose"], func(args []Value) Value {
+		if len(args) < 2 {
+			return IntValue(0)
+		}
+		options, ok := args[1].(ArrayValue)
+		if !ok || len(vm.CurrentState.Arrays[options.Index]) == 0 {
+			return IntValue(0)
+		}
+		elems := vm.CurrentState.Arrays[options.Index]
+		labels := make([]string, len(elems))
+		for i, elem := range elems {
+			labels[i] = vm.displayString(elem)
+		}
+		return elems[vm.choose(vm.displayString(args[0]), labels)]
+	})
+
+	// Signals, on_interrupt(fn) has fn called when the host is interrupted,
+	// before the deferred blocks run and the program stops
+	vm.RegisterFunction(builtinFunctions["on_interrupt"], vm.registerInterruptHandler)
+
+	// Arbitrary precision, big(n) takes an integer or a decimal string
+	vm.RegisterFunction(builtinFunctions["big"], func(args []Value) Value {
+		if len(args) == 0 {
+			return BigValue{N: new(big.Int)}
+		}
+		switch v := intCompat(args[0]).(type) {
+		case IntValue:
+			return BigValue{N: big.NewInt(int64(v))}
+		case BigValue:
+			return v
+		case StringValue:
+			if n, ok := new(big.Int).SetString(vm.CurrentState.Strings[v.Index], 10); ok {
+				return BigValue{N: n}
+			}
+		}
+		return NilValue{}
+	})
+
+	// Binary data, hex and base64 encode bytes into strings,
+	// base64_decode returns nil on malformed input. Bytes can't be secret,
+	// so the builtins returning them refuse secret strings while the
+	// encodings stay secret
+	vm.RegisterFunction(builtinFunctions["hex"], func(args []Value) Value {
+		data, secret, ok := vm.bytesArg(args)
+		if !ok {
+			return NilValue{}
+		}
+		return StringValue{Index: vm.RegisterString(hex.EncodeToString(data)), Secret: secret}
+	})
+	vm.RegisterFunction(builtinFunctions["base64_encode"], func(args []Value) Value {
+		data, secret, ok := vm.bytesArg(args)
+		if !ok {
+			return NilValue{}
+		}
+		return StringValue{Index: vm.RegisterString(base64.StdEncoding.EncodeToString(data)), Secret: secret}
+	})
+	vm.RegisterFunction(builtinFunctions["base64_decode"], func(args []Value) Value {
+		encoded, secret, ok := vm.bytesArg(args)
+		if !ok || secret {
+			return NilValue{}
+		}
+		data, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			return NilValue{}
+		}
+		return vm.newBytes(data)
+	})
+	vm.RegisterFunction(builtinFunctions["hash_sha256"], func(args []Value) Value {
+		data, secret, ok := vm.bytesArg(args)
+		if !ok || secret {
+			return NilValue{}
+		}
+		sum := sha256.Sum256(data)
+		return vm.newBytes(sum[:])
+	})
+	vm.RegisterFunction(builtinFunctions["bytes"], func(args []Value) Value {
+		data, secret, ok := vm.bytesArg(args)
+		if !ok || secret {
+			return NilValue{}
+		}
+		return vm.newBytes(data)
+	})
+
+	// Lengths, len(x) compiles to the LEN instruction and this is only
+	// reached when it's given the wrong number of arguments
+	vm.RegisterFunction(builtinFunctions["len"], func(args []Value) Value {
+		if len(args) == 0 {
+			return NilValue{}
+		}
+		n, err := vm.length(args[0])
+		if err != nil {
+			return NilValue{}
+		}
+		return IntValue(n)
+	})
+
+	// Characters, these return nil for strings that aren't valid UTF-8
+	vm.RegisterFunction(builtinFunctions["len_runes"], func(args []Value) Value {
+		s, ok := vm.utf8Arg(args)
+		if !ok {
+			return NilValue{}
+		}
+		return IntValue(utf8.RuneCountInString(s))
+	})
+	vm.RegisterFunction(builtinFunctions["char_at"], func(args []Value) Value {
+		s, ok := vm.utf8Arg(args)
+		if !ok || len(args) < 2 {
+			return NilValue{}
+		}
+		n, ok := args[1].(IntValue)
+		if !ok || n < 0 {
+			return NilValue{}
+		}
+		for _, r := range s {
+			if n == 0 {
+				return StringValue{Index: vm.RegisterString(string(r))}
+			}
+			n--
+		}
+		return NilValue{}
+	})
+
+	// string(x) compiles to TO_STRING, like len this is only reached with
+	// the wrong number of arguments
+	vm.RegisterFunction(builtinFunctions["string"], func(args []Value) Value {
+		if len(args) == 0 {
+			return NilValue{}
+		}
+		s, err := vm.toString(args[0])
+		if err != nil {
+			return NilValue{}
+		}
+		return s
+	})
+
+	// Text, these are usually called as methods, s.upper() is upper(s).
+	// Results derived from a secret string are secret too
+	vm.RegisterFunction(builtinFunctions["upper"], vm.stringFunc(strings.ToUpper))
+	vm.RegisterFunction(builtinFunctions["lower"], vm.stringFunc(strings.ToLower))
+	vm.RegisterFunction(builtinFunctions["trim"], vm.stringFunc(strings.TrimSpace))
+	vm.RegisterFunction(builtinFunctions["replace"], func(args []Value) Value {
+		s, ok := args[0].(StringValue)
+		old, okOld := args[1].(StringValue)
+		repl, okRepl := args[2].(StringValue)
+		if !ok || !okOld || !okRepl {
+			return NilValue{}
+		}
+		strs := vm.CurrentState.Strings
+		replaced := strings.ReplaceAll(strs[s.Index], strs[old.Index], strs[repl.Index])
+		return StringValue{Index: vm.RegisterString(replaced), Secret: s.Secret || repl.Secret}
+	})
+	vm.RegisterFunction(builtinFunctions["split"], func(args []Value) Value {
+		s, ok := args[0].(StringValue)
+		sep, okSep := args[1].(StringValue)
+		if !ok || !okSep {
+			return NilValue{}
+		}
+		parts := strings.Split(vm.CurrentState.Strings[s.Index], vm.CurrentState.Strings[sep.Index])
+		elems := make([]Value, len(parts))
+		for i, part := range parts {
+			elems[i] = StringValue{Index: vm.RegisterString(part), Secret: s.Secret}
+		}
+		return vm.allocArray(elems)
+	})
+	vm.RegisterFunction(builtinFunctions["join"], func(args []Value) Value {
+		xs, ok := args[0].(ArrayValue)
+		sep, okSep := args[1].(StringValue)
+		if !ok || !okSep {
+			return NilValue{}
+		}
+		elems := vm.CurrentState.Arrays[xs.Index]
+		parts := make([]string, len(elems))
+		secret := false
+		for i, elem := range elems {
+			s, ok := elem.(StringValue)
+			if !ok {
+				return NilValue{}
+			}
+			parts[i], secret = vm.CurrentState.Strings[s.Index], secret || s.Secret
+		}
+		joined := strings.Join(parts, vm.CurrentState.Strings[sep.Index])
+		return StringValue{Index: vm.RegisterString(joined), Secret: secret}
+	})
+
+	// format(template, args...) fills in %d, %x, %b, %o, %s and %v verbs,
+	// returning nil when they don't match the arguments
+	vm.RegisterFunction(builtinFunctions["format"], func(args []Value) Value {
+		template, ok := args[0].(StringValue)
+		if !ok {
+			return NilValue{}
+		}
+		s, secret, err := vm.formatString(vm.CurrentState.Strings[template.Index], args[1:])
+		if err != nil {
+			return NilValue{}
+		}
+		return StringValue{Index: vm.RegisterString(s), Secret: secret || template.Secret}
+	})
+
+	// Arrays, array lists the integers of a range, arrays are returned as is
+	vm.RegisterFunction(builtinFunctions["array"], func(args []Value) Value {
+		if len(args) == 0 {
+			return NilValue{}
+		}
+		switch v := args[0].(type) {
+		case RangeValue:
+			// Checked up front, the memory limit only notices after the fact
+			if vm.limits != nil && vm.limits.MaxMemory > 0 && v.Len()*valueSize > vm.limits.MaxMemory {
+				return NilValue{}
+			}
+			elems := make([]Value, v.Len())
+			for i := range elems {
+				elems[i] = IntValue(v.From + i)
+			}
+			return vm.allocArray(elems)
+		case ArrayValue:
+			return v
+		}
+		return NilValue{}
+	})
+}
+
+// stringFunc makes a builtin of a function transforming one string
+func (vm *VM) stringFunc(f func(string) string) func(args []Value) Value {
+	return func(args []Value) Value {
+		s, ok := args[0].(StringValue)
+		if !ok {
+			return NilValue{}
+		}
+		return StringValue{Index: vm.RegisterString(f(vm.CurrentState.Strings[s.Index])), Secret: s.Secret}
+	}
+}
+
+// bytesArg reads the first argument as binary data, strings are taken as
+// their UTF-8 encoding. secret is set when it's a secret string, whatever
+// is made of the data must not show it
+func (vm *VM) bytesArg(args []Value) (data []byte, secret bool, ok bool) {
+	if len(args) == 0 {
+		return nil, false, false
+	}
+	switch v := args[0].(type) {
+	case BytesValue:
+		return vm.CurrentState.Bytes[v.Index], false, true
+	case StringValue:
+		return []byte(vm.CurrentState.Strings[v.Index]), v.Secret, true
+	}
+	return nil, false, false
+}
+
+// utf8Arg reads the first argument as a string, secret strings and invalid
+// UTF-8 are refused
+func (vm *VM) utf8Arg(args []Value) (string, bool) {
+	if len(args) == 0 {
+		return "", false
+	}
+	str, ok := args[0].(StringValue)
+	if !ok || str.Secret {
+		return "", false
+	}
+	s := vm.CurrentState.Strings[str.Index]
+	return s, utf8.ValidString(s)
+}
+
+// displayString is how print shows a value, strings are written as is
+func (vm *VM) displayString(v Value) string {
+	if s, ok := v.(StringValue); ok {
+		if s.Secret {
+			return SecretMask
+		}
+		return vm.CurrentState.Strings[s.Index]
+	}
+	return vm.formatted(v)
 }
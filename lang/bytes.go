@@ -0,0 +1,159 @@
+package lang
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// BytesValue is immutable binary data, it refers to VMState.Bytes the same
+// way StringValue refers to the string table
+type BytesValue struct {
+	Index int
+}
+
+func (b BytesValue) Type() ValueType { return ValueTypeBytes }
+
+// newBytes adds data to the bytes table, data must not be modified afterwards
+func (vm *VM) newBytes(data []byte) BytesValue {
+	vm.CurrentState.Bytes = append(vm.CurrentState.Bytes, data)
+	return BytesValue{Index: len(vm.CurrentState.Bytes) - 1}
+}
+
+// decodeBytesLiteral turns `b"..."` or `x"..."` into the data it describes,
+// b literals take the usual escapes plus \xNN and x literals are plain hex
+func decodeBytesLiteral(lit string) ([]byte, error) {
+	kind, body := lit[0], lit[2:len(lit)-1]
+	if kind == 'x' {
+		data, err := hex.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex literal %s", lit)
+		}
+		return data, nil
+	}
+
+	var data []byte
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' || i+1 == len(body) {
+			data = append(data, body[i])
+			continue
+		}
+		i++
+		switch body[i] {
+		case 'n':
+			data = append(data, '\n')
+		case 't':
+			data = append(data, '\t')
+		case 'r':
+			data = append(data, '\r')
+		case '0':
+			data = append(data, 0)
+		case '"', '\\':
+			data = append(data, body[i])
+		case 'x':
+			if i+2 >= len(body) {
+				return nil, fmt.Errorf("truncated \\x escape in %s", lit)
+			}
+			b, err := strconv.ParseUint(body[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \\x escape in %s", lit)
+			}
+			data = append(data, byte(b))
+			i += 2
+		default:
+			data = append(data, '\\', body[i])
+		}
+	}
+	return data, nil
+}
+
+func (vm *VM) executePushBytes() error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	strIdx := vm.index()
+	if strIdx >= len(vm.CurrentState.Strings) {
+		return fmt.Errorf("string index out of bounds: %d", strIdx)
+	}
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, vm.newBytes([]byte(vm.CurrentState.Strings[strIdx])))
+	vm.CurrentState.PC += 2
+	return nil
+}
+
+func (vm *VM) byteAt(data BytesValue, index Value) (IntValue, error) {
+	idx, ok := index.(IntValue)
+	if !ok {
+		return 0, fmt.Errorf("bytes index must be an integer")
+	}
+	b := vm.CurrentState.Bytes[data.Index]
+	if int(idx) < 0 || int(idx) >= len(b) {
+		return 0, fmt.Errorf("bytes index out of bounds: %d (length %d)", idx, len(b))
+	}
+	return IntValue(b[idx]), nil
+}
+
+// sliceBounds resolves the bounds of target[lo:hi], a nil bound means the
+// start or the end
+func sliceBounds(lo, hi Value, length int) (int, int, error) {
+	start, end := 0, length
+	if v, ok := lo.(IntValue); ok {
+		start = int(v)
+	} else if _, ok := lo.(NilValue); !ok {
+		return 0, 0, fmt.Errorf("slice bounds must be integers")
+	}
+	if v, ok := hi.(IntValue); ok {
+		end = int(v)
+	} else if _, ok := hi.(NilValue); !ok {
+		return 0, 0, fmt.Errorf("slice bounds must be integers")
+	}
+	if start < 0 || end > length || start > end {
+		return 0, 0, fmt.Errorf("slice bounds out of range: [%d:%d] (length %d)", start, end, length)
+	}
+	return start, end, nil
+}
+
+func (vm *VM) executeSlice() error {
+	if len(vm.CurrentState.Stack) < 3 {
+		return fmt.Errorf("stack underflow")
+	}
+	hi := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	lo := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	target := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-3]
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-3]
+
+	var result Value
+	switch t := target.(type) {
+	case BytesValue:
+		data := vm.CurrentState.Bytes[t.Index]
+		start, end, err := sliceBounds(lo, hi, len(data))
+		if err != nil {
+			return err
+		}
+		result = vm.newBytes(data[start:end:end])
+	case StringValue:
+		s := vm.CurrentState.Strings[t.Index]
+		start, end, err := sliceBounds(lo, hi, len(s))
+		if err != nil {
+			return err
+		}
+		if err := checkRuneBoundaries(s, start, end); err != nil {
+			return err
+		}
+		result = StringValue{Index: vm.RegisterString(s[start:end]), Secret: t.Secret}
+	case ArrayValue:
+		elems := vm.CurrentState.Arrays[t.Index]
+		start, end, err := sliceBounds(lo, hi, len(elems))
+		if err != nil {
+			return err
+		}
+		// The slice shares the elements, whichever of the two is written
+		// to first copies them
+		vm.CurrentState.disownArray(t.Index)
+		vm.CurrentState.Arrays = append(vm.CurrentState.Arrays, elems[start:end:end])
+		result = ArrayValue{Index: len(vm.CurrentState.Arrays) - 1}
+	default:
+		return fmt.Errorf("invalid operand type for slicing")
+	}
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
+	return nil
+}
@@ -0,0 +1,42 @@
+package lang
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severities of a diagnostic
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a problem Check found in a source file
+type Diagnostic struct {
+	Severity string
+	Err      error
+}
+
+// Check parses and compiles a source file without running it and reports
+// what it found, the compiled code is thrown away. Compiling is held to
+// SandboxBudget so one pathological file can't hold up checking the rest
+func Check(filename, source string) []Diagnostic {
+	program, err := Parse(filename, source)
+	if err != nil {
+		// Errors from the hand written parts of the parser carry no position
+		if !strings.Contains(err.Error(), filename) {
+			err = fmt.Errorf("%s: %w", filename, err)
+		}
+		return []Diagnostic{{Severity: SeverityError, Err: err}}
+	}
+	compiler := NewCompiler()
+	compiler.SetBudget(SandboxBudget)
+	if _, err := compiler.CompileProgram(program); err != nil {
+		return []Diagnostic{{Severity: SeverityError, Err: err}}
+	}
+	var diags []Diagnostic
+	for _, warning := range compiler.Warnings {
+		diags = append(diags, Diagnostic{Severity: SeverityWarning, Err: warning})
+	}
+	return diags
+}
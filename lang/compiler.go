@@ -2,6 +2,12 @@ package lang
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/alecthomas/participle/v2/lexer"
 )
@@ -10,15 +16,49 @@ type Compiler struct {
 	Code        []byte
 	labels      map[string]int
 	vars        map[string]int
-	funcs       map[string]int
+	globals     map[string]int // Names declared with global and their slots
+	funcs       map[string]int // Named functions and their code address
 	Strings     map[string]int
+	Constants   map[int64]int // Integer literals too wide for PUSH and their pool index
 	nextVar     int
 	nextLabel   int
-	nextFunc    int
 	nextString  int
 	currentPos  int
 	currentLine int
 	sourceMap   map[int]int
+	// enclosing holds the variables of the scopes around the function being
+	// compiled, the top level first. vars is always the innermost scope
+	enclosing []map[string]int
+	// consts are the constants of the innermost scope and where they were
+	// declared, enclosingConsts goes along with enclosing
+	consts          map[string]lexer.Position
+	enclosingConsts []map[string]lexer.Position
+	// decls are how the variables of the innermost scope were declared,
+	// enclosingDecls goes along with enclosing
+	decls          map[string]declaration
+	enclosingDecls []map[string]declaration
+	// fnScopes remembers the variables of every function body for DebugPrint
+	fnScopes []fnScope
+	// operations are the code of every operation, in the order they run
+	operations []CodeRange
+	// Checked is set by `#pragma checked`, the VM running the program should
+	// raise errors on integer overflow instead of wrapping
+	Checked bool
+	// Promote is set by `#pragma promote`, integer overflow should promote
+	// to arbitrary precision instead
+	Promote bool
+	// LangVersion is the language version the program is compiled as,
+	// Warnings are the deprecated constructs it still uses and Fixes the
+	// edits upgrading the ones that can be upgraded automatically
+	LangVersion string
+	Warnings    []*LanguageError
+	Fixes       []Fix
+	// Strict makes warnings about the program itself, like declaring a
+	// variable twice, errors. Deprecations go by LangVersion
+	Strict bool
+
+	budget   *CompileBudget
+	deadline time.Time
 }
 
 func NewCompiler() *Compiler {
@@ -26,15 +66,19 @@ func NewCompiler() *Compiler {
 		Code:        make([]byte, 0),
 		labels:      make(map[string]int),
 		vars:        make(map[string]int),
+		globals:     make(map[string]int),
+		consts:      make(map[string]lexer.Position),
+		decls:       make(map[string]declaration),
 		funcs:       make(map[string]int),
 		Strings:     make(map[string]int),
+		Constants:   make(map[int64]int),
 		nextVar:     0,
 		nextLabel:   0,
-		nextFunc:    0,
 		nextString:  0,
 		currentPos:  0,
 		currentLine: 1,
 		sourceMap:   make(map[int]int),
+		LangVersion: langVersion,
 	}
 }
 
@@ -51,22 +95,37 @@ func (c *Compiler) DebugPrint() {
 				fmt.Printf("    \033[1;32mvalue:\033[0m %-20d", c.Code[i+1])
 				i++
 			}
-		case InstrPushStr:
-			if i+1 < len(c.Code) {
-				strIdx := c.Code[i+1]
+		case InstrPushConst:
+			if i+2 < len(c.Code) {
+				constIdx := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+				value := "?"
+				for n, idx := range c.Constants {
+					if idx == constIdx {
+						value = strconv.FormatInt(n, 10)
+						break
+					}
+				}
+				fmt.Printf("    \033[1;32mvalue:\033[0m %-20s    \033[90m(const_%d)\033[0m", value, constIdx)
+				i += 2
+			}
+		case InstrPushStr, InstrPushBytes, InstrAssert:
+			if i+2 < len(c.Code) {
+				strIdx := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
 				var foundStr string
 				for str, idx := range c.Strings {
-					if idx == int(strIdx) {
+					if idx == strIdx {
 						foundStr = str
 						break
 					}
 				}
-				fmt.Printf("    \033[1;32mstring:\033[0m %-20q    \033[90m(str_%d)\033[0m", foundStr, strIdx)
-				i++
+				// The operand columns take 30, the index after it 13
+				quoted := fit(strconv.Quote(foundStr), 43, 20)
+				fmt.Printf("    \033[1;32mstring:\033[0m %-20s    \033[90m(str_%d)\033[0m", quoted, strIdx)
+				i += 2
 			}
 		case InstrCall:
-			if i+2 < len(c.Code) {
-				funcIdx := int(c.Code[i+1])
+			if i+3 < len(c.Code) {
+				funcIdx := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
 				funcName := "?"
 				for name, idx := range builtinFunctions {
 					if idx == funcIdx {
@@ -75,23 +134,104 @@ func (c *Compiler) DebugPrint() {
 					}
 				}
 				fmt.Printf("    \033[1;32mfunc:\033[0m   %-20s    \033[90m(func_%d, args=%d)\033[0m",
-					funcName, funcIdx, c.Code[i+2])
-				i += 2
+					funcName, funcIdx, c.Code[i+3])
+				i += 3
+			}
+		case InstrNewArray:
+			if i+1 < len(c.Code) {
+				fmt.Printf("    \033[1;32mcount:\033[0m  %-20d", c.Code[i+1])
+				i++
+			}
+		case InstrPushBool:
+			if i+1 < len(c.Code) {
+				fmt.Printf("    \033[1;32mvalue:\033[0m  %-20v", c.Code[i+1] != 0)
+				i++
+			}
+		case InstrAlloc:
+			if i+3 < len(c.Code) {
+				fmt.Printf("    \033[1;32mkind:\033[0m   %-20v    \033[90m(count=%d)\033[0m",
+					ObjectKind(c.Code[i+1]), (int(c.Code[i+2])<<8)|int(c.Code[i+3]))
+				i += 3
+			}
+		case InstrPushFn:
+			if i+3 < len(c.Code) {
+				addr := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+				fmt.Printf("    \033[1;32maddr:\033[0m   %-20d    \033[90m(arity %d)\033[0m", addr, c.Code[i+3])
+				i += 3
 			}
-		case InstrLoad, InstrStore:
+		case InstrCallValue:
 			if i+1 < len(c.Code) {
-				varIdx := c.Code[i+1]
+				fmt.Printf("    \033[1;32margs:\033[0m   %-20d", c.Code[i+1])
+				i++
+			}
+		case InstrLoad, InstrStore, InstrLoadGlobal, InstrStoreGlobal, InstrLoadShared, InstrStoreShared:
+			if i+2 < len(c.Code) {
+				varIdx := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+				scope := c.vars
+				switch instr {
+				case InstrLoad, InstrStore:
+					scope = c.scopeAt(i)
+				case InstrLoadShared, InstrStoreShared:
+					scope = c.globals
+				}
 				varName := "?"
-				for name, idx := range c.vars {
-					if idx == int(varIdx) {
+				for name, idx := range scope {
+					if idx == varIdx {
 						varName = name
 						break
 					}
 				}
-				fmt.Printf("    \033[1;32mvar:\033[0m    %-20s    \033[90m(var_%d)\033[0m", varName, varIdx)
-				i++
+				fmt.Printf("    \033[1;32mvar:\033[0m    %-20s    \033[90m(var_%d)\033[0m", fit(varName, 43, 20), varIdx)
+				i += 2
 			}
-		case InstrJmp, InstrJmpIfZero:
+		case InstrJmpTable:
+			if i+6 < len(c.Code) {
+				lo := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+				size := (int(c.Code[i+3]) << 8) | int(c.Code[i+4])
+				defaultAddr := (int(c.Code[i+5]) << 8) | int(c.Code[i+6])
+				fmt.Printf("    \033[1;32mtable:\033[0m  %d..%-17d    \033[90m(default %d)\033[0m", lo, lo+size-1, defaultAddr)
+				i += 6
+				for j := 0; j < size && i+2 < len(c.Code); j++ {
+					addr := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+					fmt.Printf("\n\033[90m%04d:\033[0m %-12s    \033[1;32mcase %d:\033[0m %-20d", i+1, "", lo+j, addr)
+					i += 2
+				}
+			}
+		case InstrTryOp:
+			if i+8 < len(c.Code) {
+				jumpAddr := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+				name := c.stringAt((int(c.Code[i+3]) << 8) | int(c.Code[i+4]))
+				ms := uint32(c.Code[i+5])<<24 | uint32(c.Code[i+6])<<16 | uint32(c.Code[i+7])<<8 | uint32(c.Code[i+8])
+				fmt.Printf("    \033[1;32mjump:\033[0m   %-20d    \033[90m(%s, timeout %dms)\033[0m", jumpAddr, name, ms)
+				i += 8
+			}
+		case InstrOpRetry:
+			if i+4 < len(c.Code) {
+				jumpAddr := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
+				fmt.Printf("    \033[1;32mjump:\033[0m   %-20d    \033[90m(retry %d, continue %t)\033[0m", jumpAddr, c.Code[i+3], c.Code[i+4] != 0)
+				i += 4
+			}
+		case InstrOpNeeds:
+			if i+6 < len(c.Code) {
+				dep := c.stringAt((int(c.Code[i+3]) << 8) | int(c.Code[i+4]))
+				skipAddr := (int(c.Code[i+5]) << 8) | int(c.Code[i+6])
+				fmt.Printf("    \033[1;32mdep:\033[0m    %-20s    \033[90m(skip to %d)\033[0m", dep, skipAddr)
+				i += 6
+			}
+		case InstrOpCached:
+			if i+7 < len(c.Code) {
+				name := c.stringAt((int(c.Code[i+1]) << 8) | int(c.Code[i+2]))
+				skipAddr := (int(c.Code[i+6]) << 8) | int(c.Code[i+7])
+				fmt.Printf("    \033[1;32mop:\033[0m     %-20s    \033[90m(skip to %d)\033[0m", name, skipAddr)
+				i += 7
+			}
+		case InstrOpRecord:
+			if i+2 < len(c.Code) {
+				name := c.stringAt((int(c.Code[i+1]) << 8) | int(c.Code[i+2]))
+				fmt.Printf("    \033[1;32mop:\033[0m     %s", name)
+				i += 2
+			}
+		case InstrJmp, InstrJmpIfZero, InstrDefer, InstrIterNext, InstrTry:
 			if i+2 < len(c.Code) {
 				jumpAddr := (int(c.Code[i+1]) << 8) | int(c.Code[i+2])
 				fmt.Printf("    \033[1;32mjump:\033[0m   %-20d", jumpAddr)
@@ -105,28 +245,33 @@ func (c *Compiler) DebugPrint() {
 	fmt.Println("\n\033[1;36mSymbol Tables:\033[0m")
 
 	fmt.Println("\n\033[1;35mVariables:\033[0m")
-	for name, idx := range c.vars {
+	for _, name := range slices.Sorted(maps.Keys(c.vars)) {
+		idx := c.vars[name]
 		fmt.Printf("    %-30s \033[90m-> var_%d\033[0m\n", name, idx)
 	}
 
 	fmt.Println("\n\033[1;35mFunctions:\033[0m")
-	for name, idx := range c.funcs {
-		fmt.Printf("    %-30s \033[90m-> func_%d\033[0m\n", name, idx)
+	for _, name := range slices.Sorted(maps.Keys(c.funcs)) {
+		addr := c.funcs[name]
+		fmt.Printf("    %-30s \033[90m-> addr_%d\033[0m\n", name, addr)
 	}
 
 	fmt.Println("\n\033[1;35mBuiltin Functions:\033[0m")
-	for name, idx := range builtinFunctions {
+	for _, name := range slices.Sorted(maps.Keys(builtinFunctions)) {
+		idx := builtinFunctions[name]
 		fmt.Printf("    %-30s \033[90m-> func_%d\033[0m\n", name, idx)
 	}
 
 	fmt.Println("\n\033[1;35mLabels:\033[0m")
-	for name, addr := range c.labels {
+	for _, name := range slices.Sorted(maps.Keys(c.labels)) {
+		addr := c.labels[name]
 		fmt.Printf("    %-30s \033[90m-> addr_%d\033[0m\n", name, addr)
 	}
 
 	fmt.Println("\n\033[1;35mStrings:\033[0m")
-	for str, idx := range c.Strings {
-		fmt.Printf("    %-30q \033[90m-> str_%d\033[0m\n", str, idx)
+	for _, str := range slices.Sorted(maps.Keys(c.Strings)) {
+		idx := c.Strings[str]
+		fmt.Printf("    %-30s \033[90m-> str_%d\033[0m\n", fit(strconv.Quote(str), 17, 30), idx)
 	}
 }
 
@@ -137,6 +282,28 @@ func (c *Compiler) emit(op Instr, operands ...byte) {
 	c.currentPos += len(operands)
 }
 
+// maxIndices is how many variables of a scope, or strings, the 2 byte
+// index operands can address
+const maxIndices = 1 << 16
+
+// emitIndex emits op with a variable, string or function index, which are
+// 2 byte operands
+func (c *Compiler) emitIndex(op Instr, idx int) {
+	c.emit(op, byte(idx>>8), byte(idx&0xff))
+}
+
+// checkIndices fails when the scope being compiled has more variables, or
+// the program more strings, than fit an index operand
+func (c *Compiler) checkIndices(pos lexer.Position) error {
+	if c.nextVar > maxIndices {
+		return fmt.Errorf("%s: too many variables, at most %d fit in one scope", pos, maxIndices)
+	}
+	if c.nextString > maxIndices {
+		return fmt.Errorf("%s: too many strings, at most %d fit in the string table", pos, maxIndices)
+	}
+	return nil
+}
+
 func (c *Compiler) getVarIdx(name string) int {
 	if idx, ok := c.vars[name]; ok {
 		return idx
@@ -146,16 +313,119 @@ func (c *Compiler) getVarIdx(name string) int {
 	return c.nextVar - 1
 }
 
-func (c *Compiler) getFuncIdx(name string) int {
-	if idx, ok := builtinFunctions[name]; ok {
-		return idx
+// allocVar reserves a variable slot that isn't bound to any name
+func (c *Compiler) allocVar() int {
+	c.nextVar++
+	return c.nextVar - 1
+}
+
+// fnScope is the code range of a function body and the variables declared
+// in it
+type fnScope struct {
+	start, end int
+	vars       map[string]int
+}
+
+// scopeAt returns the variables visible at pc, function bodies are recorded
+// innermost first
+func (c *Compiler) scopeAt(pc int) map[string]int {
+	for _, scope := range c.fnScopes {
+		if pc >= scope.start && pc < scope.end {
+			return scope.vars
+		}
 	}
-	if idx, ok := c.funcs[name]; ok {
-		return idx
+	return c.vars
+}
+
+// VariableAt finds the slot of a variable as seen by the code at pc, global
+// is set when it's a top level variable, which lives in the outermost
+// frame's locals during a call
+func (c *Compiler) VariableAt(pc int, name string) (idx int, global bool, ok bool) {
+	for _, scope := range c.fnScopes {
+		if pc >= scope.start && pc < scope.end {
+			if idx, ok := scope.vars[name]; ok {
+				return idx, false, true
+			}
+			break
+		}
+	}
+	idx, ok = c.vars[name]
+	return idx, true, ok
+}
+
+// varKind is where a variable lives
+type varKind int
+
+const (
+	// varLocal is a variable of the scope being compiled
+	varLocal varKind = iota
+	// varTopLevel is a top level variable seen from inside a function
+	varTopLevel
+	// varGlobal is declared with global
+	varGlobal
+)
+
+// resolveVar finds the slot of an existing variable and where it lives,
+// variables of the current scope shadow the top level and globals. Only
+// the function being compiled and the top level are looked in, a name of a
+// function in between can't be captured
+func (c *Compiler) resolveVar(pos lexer.Position, name string) (idx int, kind varKind, ok bool, err error) {
+	if idx, ok := c.vars[name]; ok {
+		return idx, varLocal, true, nil
+	}
+	for i := len(c.enclosing) - 1; i > 0; i-- {
+		if _, ok := c.enclosing[i][name]; ok {
+			return 0, varLocal, false, fmt.Errorf("%s: %s belongs to an enclosing function, functions cannot capture it", pos, name)
+		}
+	}
+	if len(c.enclosing) > 0 {
+		if idx, ok := c.enclosing[0][name]; ok {
+			return idx, varTopLevel, true, nil
+		}
+	}
+	if idx, ok := c.globals[name]; ok {
+		return idx, varGlobal, true, nil
 	}
-	c.funcs[name] = c.nextFunc
-	c.nextFunc++
-	return c.nextFunc - 1
+	return 0, varLocal, false, nil
+}
+
+// emitVar emits a LOAD or STORE of name, declaring it in the current scope
+// when it doesn't exist yet
+func (c *Compiler) emitVar(op Instr, pos lexer.Position, name string) error {
+	idx, kind, ok, err := c.resolveVar(pos, name)
+	if err != nil {
+		return err
+	}
+	if !ok && op == InstrLoad && len(c.enclosing) > 0 {
+		// Everything a function can see is declared before it's compiled
+		return fmt.Errorf("%s: %s is not declared in this function or at the top level", pos, name)
+	}
+	if !ok {
+		idx = c.getVarIdx(name)
+	}
+	if op == InstrStore && ok {
+		consts := c.consts
+		if kind == varTopLevel {
+			consts = c.enclosingConsts[0]
+		}
+		// The declaration itself is the one store a constant gets
+		if declared, isConst := consts[name]; isConst && declared != pos {
+			return languageError(pos, ErrConstAssign, helpConstAssign, name, declared)
+		}
+	}
+	switch kind {
+	case varTopLevel:
+		op = map[Instr]Instr{InstrLoad: InstrLoadGlobal, InstrStore: InstrStoreGlobal}[op]
+	case varGlobal:
+		op = map[Instr]Instr{InstrLoad: InstrLoadShared, InstrStore: InstrStoreShared}[op]
+	}
+	c.emitIndex(op, idx)
+	return nil
+}
+
+func (c *Compiler) getFuncIdx(name string) (int, bool) {
+	idx, ok := builtinFunctions[name]
+	return idx, ok
 }
 
 func (c *Compiler) createLabel() string {
@@ -169,12 +439,69 @@ func (c *Compiler) setLabel(label string) {
 }
 
 func (c *Compiler) CompileProgram(program *Program) ([]byte, error) {
+	for _, pragma := range program.Pragmas {
+		switch pragma.Name {
+		case "checked":
+			c.Checked = true
+		case "wrapping":
+			c.Checked = false
+		case "promote":
+			c.Promote = true
+		default:
+			return nil, fmt.Errorf("%s: unknown pragma %s", pragma.Pos, pragma.Name)
+		}
+	}
+
+	if err := c.startBudget(program); err != nil {
+		return nil, err
+	}
+
+	// Every top level variable is known up front, so function bodies can
+	// use globals declared further down
+	c.declareVars(program.Statements)
+	if err := c.declareGlobals(program); err != nil {
+		return nil, err
+	}
+
+	// Operations are pulled out and run after everything else, in
+	// dependency order
+	var ops []*Operation
+	var stmts []Statement
 	for _, stmt := range program.Statements {
-		if err := c.compileStatement(&stmt); err != nil {
+		if stmt.Operation != nil {
+			ops = append(ops, stmt.Operation)
+		} else {
+			stmts = append(stmts, stmt)
+		}
+	}
+	schedule, err := scheduleOperations(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	failing, err := failingDeps(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.compileBlock(stmts); err != nil {
+		return nil, err
+	}
+	for _, op := range schedule {
+		if err := c.compileOperation(op, failing[op.Name]); err != nil {
 			return nil, err
 		}
 	}
 	c.emit(InstrHalt)
+	if n := len(program.Statements); n > 0 {
+		// The last statement may have gone over
+		if err := c.checkBudget(program.Statements[n-1].Pos()); err != nil {
+			return nil, err
+		}
+		if err := c.checkIndices(program.Statements[n-1].Pos()); err != nil {
+			return nil, err
+		}
+	}
 	return c.Code, nil
 }
 
@@ -185,6 +512,10 @@ func (c *Compiler) compileExpr(expr *Expr) error {
 		return c.compileTerm(expr.Left)
 	}
 
+	if err := checkConcat(expr); err != nil {
+		return err
+	}
+
 	// Compile left operand
 	if err := c.compileTerm(expr.Left); err != nil {
 		return err
@@ -219,26 +550,123 @@ func (c *Compiler) compileExpr(expr *Expr) error {
 		c.emit(InstrGt)
 	case ">=":
 		c.emit(InstrGte)
+	case "..":
+		c.emit(InstrRange)
+	case "in":
+		c.emit(InstrContains)
 	}
 
 	return nil
 }
 
+// compileBlock compiles the statements of the program or a function body,
+// named functions go first so they can be called from anywhere in it
+func (c *Compiler) compileBlock(stmts []Statement) error {
+	for _, stmt := range stmts {
+		if stmt.FnDecl == nil {
+			continue
+		}
+		if _, _, ok, _ := c.resolveVar(stmt.FnDecl.Pos, stmt.FnDecl.Name); !ok {
+			c.getVarIdx(stmt.FnDecl.Name)
+		}
+	}
+	for _, stmt := range stmts {
+		if stmt.FnDecl != nil {
+			if err := c.compileStatement(&stmt); err != nil {
+				return err
+			}
+		}
+	}
+	for _, stmt := range stmts {
+		if stmt.FnDecl == nil {
+			if err := c.compileStatement(&stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// declareVars gives every variable assigned in stmts a slot, without going
+// into function bodies which have their own scope
+func (c *Compiler) declareVars(stmts []Statement) {
+	for _, stmt := range stmts {
+		switch {
+		case stmt.Assignment != nil:
+			c.declare(stmt.Assignment)
+			c.getVarIdx(stmt.Assignment.Variable)
+			for _, name := range stmt.Assignment.Extra {
+				c.getVarIdx(name)
+			}
+		case stmt.FnDecl != nil:
+			c.getVarIdx(stmt.FnDecl.Name)
+		case stmt.Operation != nil:
+			c.declareVars(stmt.Operation.Body)
+		case stmt.ConstDecl != nil:
+			// Recorded up front so hoisted functions can't assign to it either
+			c.getVarIdx(stmt.ConstDecl.Name)
+			if _, ok := c.consts[stmt.ConstDecl.Name]; !ok {
+				c.consts[stmt.ConstDecl.Name] = stmt.ConstDecl.Pos
+			}
+		case stmt.IfStmt != nil:
+			c.declareVars(stmt.IfStmt.Then)
+			c.declareVars(stmt.IfStmt.Else)
+		case stmt.WhileStmt != nil:
+			c.declareVars(stmt.WhileStmt.Body)
+		case stmt.ForStmt != nil:
+			c.declareVars(stmt.ForStmt.Body)
+		case stmt.DeferStmt != nil:
+			c.declareVars(stmt.DeferStmt.Body)
+		case stmt.TryStmt != nil:
+			c.declareVars(stmt.TryStmt.Body)
+			c.getVarIdx(stmt.TryStmt.ErrVar)
+			c.declareVars(stmt.TryStmt.Handler)
+		case stmt.MatchStmt != nil:
+			for _, arm := range stmt.MatchStmt.Arms {
+				c.declareVars(arm.Body)
+			}
+		}
+	}
+}
+
 func (c *Compiler) compileStatement(stmt *Statement) error {
+	if err := c.checkBudget(stmt.Pos()); err != nil {
+		return err
+	}
 	switch {
-	case stmt.Assignment != nil:
-		c.registerLine(stmt.Assignment.Pos)
-		if err := c.compileExpr(stmt.Assignment.Expr); err != nil {
+	case stmt.Operation != nil:
+		return languageError(stmt.Operation.Pos, ErrNestedOperation, "", stmt.Operation.Name)
+	case stmt.GlobalDecl != nil:
+		return c.compileGlobalDecl(stmt.GlobalDecl)
+	case stmt.ConstDecl != nil:
+		c.registerLine(stmt.ConstDecl.Pos)
+		if err := c.compileExpr(stmt.ConstDecl.Expr); err != nil {
 			return err
 		}
-		varIdx := c.getVarIdx(stmt.Assignment.Variable)
-		c.emit(InstrStore, byte(varIdx))
+		if err := c.emitVar(InstrStore, stmt.ConstDecl.Pos, stmt.ConstDecl.Name); err != nil {
+			return err
+		}
+		if _, ok := c.consts[stmt.ConstDecl.Name]; !ok {
+			c.consts[stmt.ConstDecl.Name] = stmt.ConstDecl.Pos
+		}
+	case stmt.FnDecl != nil:
+		c.registerLine(stmt.FnDecl.Pos)
+		c.funcs[stmt.FnDecl.Name] = c.currentPos + 3 // The body follows the JMP over it
+		if err := c.compileFnLit(stmt.FnDecl.Fn); err != nil {
+			return err
+		}
+		return c.emitVar(InstrStore, stmt.FnDecl.Pos, stmt.FnDecl.Name)
+	case stmt.Assignment != nil:
+		c.registerLine(stmt.Assignment.Pos)
+		return c.compileAssignment(stmt.Assignment)
 	case stmt.IfStmt != nil:
 		c.registerLine(stmt.IfStmt.Pos)
 		endLabel := c.createLabel()
 		elseLabel := c.createLabel()
 
-		c.compileExpr(stmt.IfStmt.Condition)
+		if err := c.compileExpr(stmt.IfStmt.Condition); err != nil {
+			return err
+		}
 		c.emit(InstrJmpIfZero)
 		jumpPos := c.currentPos
 		c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
@@ -285,7 +713,9 @@ func (c *Compiler) compileStatement(stmt *Statement) error {
 
 		// Start of loop
 		c.setLabel(startLabel)
-		c.compileExpr(stmt.WhileStmt.Condition)
+		if err := c.compileExpr(stmt.WhileStmt.Condition); err != nil {
+			return err
+		}
 
 		// Jump to end if condition is false
 		c.emit(InstrJmpIfZero)
@@ -314,55 +744,782 @@ func (c *Compiler) compileStatement(stmt *Statement) error {
 		c.Code[jumpToEndPos] = byte(endAddr >> 8)
 		c.Code[jumpToEndPos+1] = byte(endAddr & 0xff)
 
+	case stmt.ForStmt != nil:
+		c.registerLine(stmt.ForStmt.Pos)
+		return c.compileFor(stmt.ForStmt)
+
+	case stmt.MatchStmt != nil:
+		c.registerLine(stmt.MatchStmt.Pos)
+		return c.compileMatch(stmt.MatchStmt)
+
+	case stmt.DeferStmt != nil:
+		c.registerLine(stmt.DeferStmt.Pos)
+		// DEFER registers the body that follows it and jumps past it, the
+		// body runs later and hands control back with END_DEFER
+		c.emit(InstrDefer)
+		skipPos := c.currentPos
+		c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+		c.currentPos += 2
+
+		for _, s := range stmt.DeferStmt.Body {
+			if err := c.compileStatement(&s); err != nil {
+				return err
+			}
+		}
+		c.emit(InstrEndDefer)
+
+		skipAddr := c.currentPos
+		c.Code[skipPos] = byte(skipAddr >> 8)
+		c.Code[skipPos+1] = byte(skipAddr & 0xff)
+
+	case stmt.TryStmt != nil:
+		c.registerLine(stmt.TryStmt.Pos)
+		return c.compileTry(stmt.TryStmt)
+
+	case stmt.AssertStmt != nil:
+		c.registerLine(stmt.AssertStmt.Pos)
+		if err := c.compileExpr(stmt.AssertStmt.Cond); err != nil {
+			return err
+		}
+		if stmt.AssertStmt.Message != nil {
+			if err := c.compileExpr(stmt.AssertStmt.Message); err != nil {
+				return err
+			}
+		} else {
+			c.emit(InstrPushNil)
+		}
+		// The VM only gets the assertion as text, to show it on failure
+		c.emitIndex(InstrAssert, c.internRaw(stmt.AssertStmt.Cond.Parenthesized()))
+
+	case stmt.IndexAssignment != nil:
+		c.registerLine(stmt.IndexAssignment.Pos)
+		_, _, ok, err := c.resolveVar(stmt.IndexAssignment.Pos, stmt.IndexAssignment.Variable)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: cannot index undeclared variable %s", stmt.IndexAssignment.Pos, stmt.IndexAssignment.Variable)
+		}
+		if err := c.emitVar(InstrLoad, stmt.IndexAssignment.Pos, stmt.IndexAssignment.Variable); err != nil {
+			return err
+		}
+		if err := c.compileExpr(stmt.IndexAssignment.Index); err != nil {
+			return err
+		}
+		if err := c.compileExpr(stmt.IndexAssignment.Expr); err != nil {
+			return err
+		}
+		c.emit(InstrIndexSet)
+
+	case stmt.Reassignment != nil:
+		c.registerLine(stmt.Reassignment.Pos)
+		return c.compileReassignment(stmt.Reassignment)
+
+	case stmt.CompoundAssignment != nil:
+		c.registerLine(stmt.CompoundAssignment.Pos)
+		return c.compileCompoundAssignment(stmt.CompoundAssignment)
+
 	case stmt.Call != nil:
 		c.registerLine(stmt.Call.Pos)
-		return c.compileCall(stmt.Call)
+		if err := c.compileCall(stmt.Call); err != nil {
+			return err
+		}
+		// A call used as a statement has its result thrown away
+		c.emit(InstrDrop)
 	}
 	return nil
 }
 
+func (c *Compiler) compileFor(loop *ForStmt) error {
+	// The loop variable gets a fresh slot, shadowing any outer variable of
+	// the same name until the loop is done
+	prevIdx, hadPrev := c.vars[loop.Variable]
+	defer func() {
+		if hadPrev {
+			c.vars[loop.Variable] = prevIdx
+		} else {
+			delete(c.vars, loop.Variable)
+		}
+	}()
+
+	if loop.Iterable != nil {
+		return c.compileForEach(loop)
+	}
+
+	loopVar := c.allocVar()
+	limitVar := c.allocVar()
+
+	// The bounds are evaluated once, before the variable comes into scope
+	if err := c.compileExpr(loop.From); err != nil {
+		return err
+	}
+	c.emitIndex(InstrStore, loopVar)
+	if err := c.compileExpr(loop.To); err != nil {
+		return err
+	}
+	c.emitIndex(InstrStore, limitVar)
+	c.vars[loop.Variable] = loopVar
+
+	startLabel := c.createLabel()
+	endLabel := c.createLabel()
+
+	// Loop while var <= limit
+	c.setLabel(startLabel)
+	c.emitIndex(InstrLoad, loopVar)
+	c.emitIndex(InstrLoad, limitVar)
+	c.emit(InstrLte)
+	c.emit(InstrJmpIfZero)
+	jumpToEndPos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+
+	for _, s := range loop.Body {
+		if err := c.compileStatement(&s); err != nil {
+			return err
+		}
+	}
+
+	// Increment and jump back to the condition
+	c.emitIndex(InstrLoad, loopVar)
+	c.emit(InstrPush, 1)
+	c.emit(InstrAdd)
+	c.emitIndex(InstrStore, loopVar)
+	c.emit(InstrJmp)
+	startAddr := c.labels[startLabel]
+	c.Code = append(c.Code, byte(startAddr>>8), byte(startAddr&0xff))
+	c.currentPos += 2
+
+	c.setLabel(endLabel)
+	endAddr := c.labels[endLabel]
+	c.Code[jumpToEndPos] = byte(endAddr >> 8)
+	c.Code[jumpToEndPos+1] = byte(endAddr & 0xff)
+	return nil
+}
+
+func (c *Compiler) compileForEach(loop *ForStmt) error {
+	loopVar := c.allocVar()
+	iterVar := c.allocVar()
+
+	if err := c.compileExpr(loop.Iterable); err != nil {
+		return err
+	}
+	c.emit(InstrIterNew)
+	c.emitIndex(InstrStore, iterVar)
+	c.vars[loop.Variable] = loopVar
+
+	startLabel := c.createLabel()
+	endLabel := c.createLabel()
+
+	// ITER_NEXT pushes the next element or jumps to the end once the
+	// iterator is exhausted
+	c.setLabel(startLabel)
+	c.emitIndex(InstrLoad, iterVar)
+	c.emit(InstrIterNext)
+	jumpToEndPos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+	c.emitIndex(InstrStore, loopVar)
+
+	for _, s := range loop.Body {
+		if err := c.compileStatement(&s); err != nil {
+			return err
+		}
+	}
+
+	c.emit(InstrJmp)
+	startAddr := c.labels[startLabel]
+	c.Code = append(c.Code, byte(startAddr>>8), byte(startAddr&0xff))
+	c.currentPos += 2
+
+	c.setLabel(endLabel)
+	endAddr := c.labels[endLabel]
+	c.Code[jumpToEndPos] = byte(endAddr >> 8)
+	c.Code[jumpToEndPos+1] = byte(endAddr & 0xff)
+	return nil
+}
+
+// Integer arms are dispatched through a jump table when there are at least
+// jumpTableMinArms of them and they cover at least half of their range
+const jumpTableMinArms = 3
+
+func (c *Compiler) compileMatch(match *MatchStmt) error {
+	for i, arm := range match.Arms {
+		if arm.Wildcard && i != len(match.Arms)-1 {
+			return fmt.Errorf("%s: wildcard arm must be the last arm of a match", arm.Pos)
+		}
+	}
+
+	if c.isDenseIntMatch(match) {
+		return c.compileMatchTable(match)
+	}
+
+	subjectVar := c.allocVar()
+	if err := c.compileExpr(match.Subject); err != nil {
+		return err
+	}
+	c.emitIndex(InstrStore, subjectVar)
+
+	// Arms are tried in order, each one jumps to the end after its body
+	var endJumps []int
+	for _, arm := range match.Arms {
+		nextArmPos := -1
+		if !arm.Wildcard {
+			c.emitIndex(InstrLoad, subjectVar)
+			if arm.Number != nil {
+				if err := c.emitInt(*arm.Number); err != nil {
+					return fmt.Errorf("%s: %w", arm.Pos, err)
+				}
+			} else {
+				strIdx, err := c.internString(*arm.String)
+				if err != nil {
+					return fmt.Errorf("%s: %w", arm.Pos, err)
+				}
+				c.emitIndex(InstrPushStr, strIdx)
+			}
+			c.emit(InstrEq)
+			c.emit(InstrJmpIfZero)
+			nextArmPos = c.currentPos
+			c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+			c.currentPos += 2
+		}
+
+		for _, s := range arm.Body {
+			if err := c.compileStatement(&s); err != nil {
+				return err
+			}
+		}
+		c.emit(InstrJmp)
+		endJumps = append(endJumps, c.currentPos)
+		c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+		c.currentPos += 2
+
+		if nextArmPos >= 0 {
+			c.patchJump(nextArmPos, c.currentPos)
+		}
+	}
+
+	for _, pos := range endJumps {
+		c.patchJump(pos, c.currentPos)
+	}
+	return nil
+}
+
+func (c *Compiler) isDenseIntMatch(match *MatchStmt) bool {
+	count := 0
+	var lo, hi int64
+	for _, arm := range match.Arms {
+		if arm.Wildcard {
+			continue
+		}
+		if arm.Number == nil {
+			return false
+		}
+		if count == 0 || *arm.Number < lo {
+			lo = *arm.Number
+		}
+		if count == 0 || *arm.Number > hi {
+			hi = *arm.Number
+		}
+		count++
+	}
+	// The bounds are 2 byte operands of JMP_TABLE
+	return count >= jumpTableMinArms && hi-lo+1 <= int64(count*2) && lo >= 0 && hi <= 0xffff
+}
+
+// compileMatchTable emits JMP_TABLE min size default addr*size followed by
+// the arm bodies, values missing from the table go to the default address.
+// isDenseIntMatch made sure the arms are within 0..0xffff
+func (c *Compiler) compileMatchTable(match *MatchStmt) error {
+	lo := -1
+	hi := 0
+	for _, arm := range match.Arms {
+		if arm.Number == nil {
+			continue
+		}
+		if n := int(*arm.Number); lo < 0 || n < lo {
+			lo = n
+		}
+		hi = max(hi, int(*arm.Number))
+	}
+	size := hi - lo + 1
+
+	if err := c.compileExpr(match.Subject); err != nil {
+		return err
+	}
+	c.emit(InstrJmpTable, byte(lo>>8), byte(lo&0xff), byte(size>>8), byte(size&0xff))
+	defaultPos := c.currentPos
+	tablePos := c.currentPos + 2
+	c.Code = append(c.Code, make([]byte, 2+size*2)...) // Reserve the default and table addresses
+	c.currentPos += 2 + size*2
+
+	var endJumps []int
+	armAddrs := make(map[int]int)
+	defaultAddr := -1
+	for _, arm := range match.Arms {
+		if arm.Wildcard {
+			defaultAddr = c.currentPos
+		} else {
+			if _, dup := armAddrs[int(*arm.Number)]; dup {
+				return fmt.Errorf("%s: duplicate match arm %d", arm.Pos, *arm.Number)
+			}
+			armAddrs[int(*arm.Number)] = c.currentPos
+		}
+
+		for _, s := range arm.Body {
+			if err := c.compileStatement(&s); err != nil {
+				return err
+			}
+		}
+		c.emit(InstrJmp)
+		endJumps = append(endJumps, c.currentPos)
+		c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+		c.currentPos += 2
+	}
+
+	endAddr := c.currentPos
+	for _, pos := range endJumps {
+		c.patchJump(pos, endAddr)
+	}
+	if defaultAddr < 0 {
+		defaultAddr = endAddr
+	}
+	c.patchJump(defaultPos, defaultAddr)
+	for i := 0; i < size; i++ {
+		addr, ok := armAddrs[lo+i]
+		if !ok {
+			addr = defaultAddr
+		}
+		c.patchJump(tablePos+i*2, addr)
+	}
+	return nil
+}
+
+// compileTry lays out
+//
+//	TRY catch; body; END_TRY; JMP end; catch: STORE err; handler; end:
+//
+// The VM jumps to catch with the error message pushed when the body fails
+func (c *Compiler) compileTry(try *TryStmt) error {
+	c.emit(InstrTry)
+	catchPos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+
+	for _, s := range try.Body {
+		if err := c.compileStatement(&s); err != nil {
+			return err
+		}
+	}
+	c.emit(InstrEndTry)
+	c.emit(InstrJmp)
+	endPos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+
+	c.patchJump(catchPos, c.currentPos)
+	if err := c.emitVar(InstrStore, try.Pos, try.ErrVar); err != nil {
+		return err
+	}
+	for _, s := range try.Handler {
+		if err := c.compileStatement(&s); err != nil {
+			return err
+		}
+	}
+	c.patchJump(endPos, c.currentPos)
+	return nil
+}
+
+// patchJump writes a 2 byte jump address into a previously reserved slot
+func (c *Compiler) patchJump(pos, addr int) {
+	c.Code[pos] = byte(addr >> 8)
+	c.Code[pos+1] = byte(addr & 0xff)
+}
+
+// compoundOps maps a compound assignment operator to the arithmetic
+// instruction it expands into
+var compoundOps = map[string]Instr{
+	"+=": InstrAdd,
+	"-=": InstrSub,
+	"*=": InstrMul,
+	"/=": InstrDiv,
+}
+
+// compileAssignment binds the names, declaring the ones that don't exist
+func (c *Compiler) compileAssignment(assign *Assignment) error {
+	names := append([]string{assign.Variable}, assign.Extra...)
+	exprs := append([]*Expr{assign.Expr}, assign.ExtraExprs...)
+	if len(names) != len(exprs) {
+		return fmt.Errorf("%s: cannot assign %d values to %d names", assign.Pos, len(exprs), len(names))
+	}
+	if err := c.checkRedeclared(assign); err != nil {
+		return err
+	}
+	c.declare(assign)
+	for i, expr := range exprs {
+		// A function can refer to the name it's being assigned to, which
+		// makes recursion work
+		if expr.Op == nil && expr.Left.Fn != nil && len(expr.Left.Index) == 0 {
+			if _, _, ok, _ := c.resolveVar(assign.Pos, names[i]); !ok {
+				c.getVarIdx(names[i])
+			}
+		}
+	}
+	return c.compileStores(assign.Pos, names, exprs)
+}
+
+// compileReassignment stores into existing variables, unlike val it never
+// declares one
+func (c *Compiler) compileReassignment(assign *Reassignment) error {
+	if len(assign.Variables) != len(assign.Exprs) {
+		return fmt.Errorf("%s: cannot assign %d values to %d names", assign.Pos, len(assign.Exprs), len(assign.Variables))
+	}
+	for _, name := range assign.Variables {
+		_, kind, ok, err := c.resolveVar(assign.Pos, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return languageError(assign.Pos, ErrUndeclaredAssign, helpUndeclared, name)
+		}
+		if err := c.checkMutable(assign.Pos, name, kind); err != nil {
+			return err
+		}
+	}
+	return c.compileStores(assign.Pos, assign.Variables, assign.Exprs)
+}
+
+// compileStores pushes every value first and then stores them in reverse,
+// the last name takes the value on top of the stack
+func (c *Compiler) compileStores(pos lexer.Position, names []string, exprs []*Expr) error {
+	for _, expr := range exprs {
+		if err := c.compileExpr(expr); err != nil {
+			return err
+		}
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := c.emitVar(InstrStore, pos, names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) compileCompoundAssignment(assign *CompoundAssignment) error {
+	_, kind, ok, err := c.resolveVar(assign.Pos, assign.Variable)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: cannot apply %s to undeclared variable %s", assign.Pos, assign.Op, assign.Variable)
+	}
+	if err := c.checkMutable(assign.Pos, assign.Variable, kind); err != nil {
+		return err
+	}
+	op, ok := compoundOps[assign.Op]
+	if !ok {
+		return fmt.Errorf("%s: unknown compound assignment operator %s", assign.Pos, assign.Op)
+	}
+
+	// x op= expr is just x = x op expr
+	if err := c.emitVar(InstrLoad, assign.Pos, assign.Variable); err != nil {
+		return err
+	}
+	if err := c.compileExpr(assign.Expr); err != nil {
+		return err
+	}
+	c.emit(op)
+	return c.emitVar(InstrStore, assign.Pos, assign.Variable)
+}
+
 func (c *Compiler) compileTerm(term *Term) error {
+	if err := c.compileTermBase(term); err != nil {
+		return err
+	}
+	for _, sub := range term.Index {
+		if sub.Method != nil {
+			if err := c.compileMethod(sub.Method); err != nil {
+				return err
+			}
+			continue
+		}
+		if !sub.Slice {
+			if err := c.compileExpr(sub.Index); err != nil {
+				return err
+			}
+			c.emit(InstrIndexGet)
+			continue
+		}
+		for _, bound := range []*Expr{sub.Index, sub.High} {
+			if bound == nil {
+				c.emit(InstrPushNil)
+			} else if err := c.compileExpr(bound); err != nil {
+				return err
+			}
+		}
+		c.emit(InstrSlice)
+	}
+	return nil
+}
+
+func (c *Compiler) compileTermBase(term *Term) error {
 	switch {
 	case term.Number != nil:
-		c.emit(InstrPush, byte(*term.Number))
+		if err := c.emitInt(*term.Number); err != nil {
+			return fmt.Errorf("%s: %w", term.Pos, err)
+		}
 	case term.String != nil:
-		stringIdx := c.internString(*term.String)
-		c.emit(InstrPushStr, byte(stringIdx))
+		stringIdx, err := c.internString(*term.String)
+		if err != nil {
+			return fmt.Errorf("%s: %w", term.Pos, err)
+		}
+		c.emitIndex(InstrPushStr, stringIdx)
+	case term.Bytes != nil:
+		data, err := decodeBytesLiteral(*term.Bytes)
+		if err != nil {
+			return err
+		}
+		c.emitIndex(InstrPushBytes, c.internRaw(string(data)))
 	case term.Variable != nil:
-		varIdx := c.getVarIdx(*term.Variable)
-		c.emit(InstrLoad, byte(varIdx))
+		return c.emitVar(InstrLoad, term.Pos, *term.Variable)
 	case term.Call != nil:
 		return c.compileCall(term.Call)
 	case term.SubExpr != nil:
 		return c.compileExpr(term.SubExpr)
+	case term.Array != nil:
+		for _, elem := range term.Array.Elements {
+			if err := c.compileExpr(elem); err != nil {
+				return err
+			}
+		}
+		return c.emitArray(len(term.Array.Elements))
+	case term.Cond != nil:
+		return c.compileCondExpr(term.Cond)
+	case term.Fn != nil:
+		return c.compileFnLit(term.Fn)
+	case term.Block != nil:
+		return c.compileBlockExpr(term.Block)
+	case term.Bool != nil:
+		if *term.Bool {
+			c.emit(InstrPushBool, 1)
+		} else {
+			c.emit(InstrPushBool, 0)
+		}
+	case term.Nil:
+		c.emit(InstrPushNil)
 	}
 	return nil
 }
 
+// compileBlockExpr runs the statements in place and leaves the result, or
+// nil, as the one value on the stack. Statements never leave anything
+// behind, so the result sits right where the enclosing expression expects
+func (c *Compiler) compileBlockExpr(block *BlockExpr) error {
+	c.declareVars(block.Body)
+	if err := c.compileBlock(block.Body); err != nil {
+		return err
+	}
+	if block.Result == nil {
+		c.emit(InstrPushNil)
+		return nil
+	}
+	c.registerLine(block.Result.Left.Pos)
+	return c.compileExpr(block.Result)
+}
+
+// compileCondExpr compiles if-as-expression, each branch leaves exactly one
+// value on the stack
+func (c *Compiler) compileCondExpr(cond *CondExpr) error {
+	if err := c.compileExpr(cond.Condition); err != nil {
+		return err
+	}
+	c.emit(InstrJmpIfZero)
+	elsePos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+
+	if err := c.compileExpr(cond.Then); err != nil {
+		return err
+	}
+	c.emit(InstrJmp)
+	endPos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+
+	c.patchJump(elsePos, c.currentPos)
+	if err := c.compileExpr(cond.Else); err != nil {
+		return err
+	}
+	c.patchJump(endPos, c.currentPos)
+	return nil
+}
+
+// compileFnLit emits the function body in place, jumped over, followed by
+// a PUSH_FN of its address. The body gets a scope of its own where the
+// parameters are the first variables
+func (c *Compiler) compileFnLit(fn *FnLit) error {
+	if len(fn.Params) > 255 {
+		return fmt.Errorf("%s: too many parameters", fn.Pos)
+	}
+	c.emit(InstrJmp)
+	skipPos := c.currentPos
+	c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+	c.currentPos += 2
+	addr := c.currentPos
+
+	prevVars, prevNext, prevConsts, prevDecls := c.vars, c.nextVar, c.consts, c.decls
+	c.enclosing = append(c.enclosing, c.vars)
+	c.enclosingConsts = append(c.enclosingConsts, c.consts)
+	c.enclosingDecls = append(c.enclosingDecls, c.decls)
+	c.vars, c.nextVar, c.consts = make(map[string]int), 0, make(map[string]lexer.Position)
+	c.decls = make(map[string]declaration)
+	defer func() {
+		c.vars, c.nextVar, c.consts, c.decls = prevVars, prevNext, prevConsts, prevDecls
+		c.enclosing = c.enclosing[:len(c.enclosing)-1]
+		c.enclosingConsts = c.enclosingConsts[:len(c.enclosingConsts)-1]
+		c.enclosingDecls = c.enclosingDecls[:len(c.enclosingDecls)-1]
+	}()
+
+	for _, param := range fn.Params {
+		if _, ok := c.vars[param]; ok {
+			return fmt.Errorf("%s: duplicate parameter %s", fn.Pos, param)
+		}
+		c.getVarIdx(param)
+	}
+	// Declared up front like the top level, a val or var in the body is
+	// always a local of the function even when the top level has the name
+	c.declareVars(fn.Body)
+	if err := c.compileBlock(fn.Body); err != nil {
+		return err
+	}
+	if fn.Result != nil {
+		c.registerLine(fn.Result.Left.Pos)
+		if err := c.compileExpr(fn.Result); err != nil {
+			return err
+		}
+	} else {
+		c.emit(InstrPushNil)
+	}
+	c.emit(InstrRet)
+	if err := c.checkIndices(fn.Pos); err != nil {
+		return err
+	}
+
+	c.fnScopes = append(c.fnScopes, fnScope{start: addr, end: c.currentPos, vars: c.vars})
+	c.patchJump(skipPos, c.currentPos)
+	c.emit(InstrPushFn, byte(addr>>8), byte(addr&0xff), byte(len(fn.Params)))
+	return nil
+}
+
 func (c *Compiler) compileCall(call *Call) error {
+	// Calling a variable holding a function
+	if _, builtin := builtinFunctions[call.Function]; !builtin {
+		_, _, ok, err := c.resolveVar(call.Pos, call.Function)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := c.emitVar(InstrLoad, call.Pos, call.Function); err != nil {
+				return err
+			}
+			for _, arg := range call.Args {
+				if err := c.compileExpr(arg); err != nil {
+					return err
+				}
+			}
+			c.emit(InstrCallValue, byte(len(call.Args)))
+			return nil
+		}
+	}
+
 	for _, arg := range call.Args {
 		if err := c.compileExpr(arg); err != nil {
 			return err
 		}
 	}
 
-	// Get function index and emit call instruction
-	funcIdx := c.getFuncIdx(call.Function)
-	c.emit(InstrCall, byte(funcIdx), byte(len(call.Args)))
+	funcIdx, ok := c.getFuncIdx(call.Function)
+	if !ok {
+		return fmt.Errorf("%s: unknown function %s", call.Pos, call.Function)
+	}
+	c.emitBuiltinCall(funcIdx, len(call.Args))
 	return nil
 }
 
-func (c *Compiler) internString(s string) int {
-	unescaped := unescapeString(s)
+// compileMethod calls the builtin a method is named after, the receiver is
+// already on the stack and becomes the first argument
+func (c *Compiler) compileMethod(method *Call) error {
+	funcIdx, ok := c.getFuncIdx(method.Function)
+	if !ok {
+		return fmt.Errorf("%s: unknown method %s", method.Pos, method.Function)
+	}
+	if builtin := builtinTable[funcIdx]; !builtin.Accepts(len(method.Args) + 1) {
+		return fmt.Errorf("%s: %s expects %s args including the receiver, got %d", method.Pos, method.Function, builtin.Arity(), len(method.Args)+1)
+	}
+	for _, arg := range method.Args {
+		if err := c.compileExpr(arg); err != nil {
+			return err
+		}
+	}
+	c.emitBuiltinCall(funcIdx, len(method.Args)+1)
+	return nil
+}
+
+// emitBuiltinCall calls a builtin with its arguments on the stack
+func (c *Compiler) emitBuiltinCall(funcIdx, numArgs int) {
+	// len and string are instructions of their own so every type has one
+	// notion of size and one way of turning into a string, exit halts
+	if funcIdx == builtinFunctions["exit"] {
+		// exit() is exit(0), the status is the process exit code
+		if numArgs == 0 {
+			c.emit(InstrPush, 0)
+		}
+		c.emit(InstrExit)
+		return
+	}
+	if numArgs == 1 {
+		switch funcIdx {
+		case builtinFunctions["len"]:
+			c.emit(InstrLen)
+			return
+		case builtinFunctions["string"]:
+			c.emit(InstrToString)
+			return
+		}
+	}
+	c.emit(InstrCall, byte(funcIdx>>8), byte(funcIdx&0xff), byte(numArgs))
+}
+
+// internString adds a string literal to the string table by its contents,
+// so "a\n" and a raw string holding the same text share one entry
+func (c *Compiler) internString(s string) (int, error) {
+	contents, err := unescapeString(s)
+	if err != nil {
+		return 0, err
+	}
+	return c.internRaw(contents), nil
+}
 
-	if idx, ok := c.Strings[unescaped]; ok {
+// internRaw adds s to the string table as is, bytes literals are stored
+// there too
+func (c *Compiler) internRaw(s string) int {
+	if idx, ok := c.Strings[s]; ok {
 		return idx
 	}
-	c.Strings[unescaped] = c.nextString
+	c.Strings[s] = c.nextString
 	c.nextString++
 	return c.nextString - 1
 }
 
+// stringAt finds the string at idx in the table, for DebugPrint
+func (c *Compiler) stringAt(idx int) string {
+	for s, i := range c.Strings {
+		if i == idx {
+			return s
+		}
+	}
+	return "?"
+}
+
 func (c *Compiler) registerLine(pos lexer.Position) {
 	if pos.Line != c.currentLine {
 		c.currentLine = pos.Line
@@ -384,6 +1541,23 @@ func (c *Compiler) GetSourceMap() map[int]int {
 	return c.sourceMap
 }
 
+// CodeRange is the code of a named part of the program, from Start up to
+// but not including End
+type CodeRange struct {
+	Name       string
+	Start, End int
+}
+
+// GetOperations returns where each operation's code is, in the order they run
+func (c *Compiler) GetOperations() []CodeRange {
+	return c.operations
+}
+
+// GetFunctions returns the code address of every named function
+func (c *Compiler) GetFunctions() map[string]int {
+	return c.funcs
+}
+
 func (c *Compiler) GetLineForPC(pc int) int {
 	for srcPC, line := range c.sourceMap {
 		if srcPC == pc {
@@ -393,12 +1567,20 @@ func (c *Compiler) GetLineForPC(pc int) int {
 	return -1
 }
 
-// Add this helper function to handle string escapes
-func unescapeString(s string) string {
+// unescapeString turns a string literal into its contents, raw `...`
+// strings are taken as is. \uXXXX and \u{X...} are unicode code points,
+// written out as UTF-8, and \xNN is a single byte. A backslash at the end
+// of a line continues the string on the next one
+func unescapeString(s string) (string, error) {
+	if s[0] == '`' {
+		return s[1 : len(s)-1], nil
+	}
+	lit := s
 	// Remove surrounding quotes first
 	s = s[1 : len(s)-1]
 
-	var result []rune
+	// Work on bytes so multi-byte UTF-8 sequences are copied through intact
+	var result []byte
 	for i := 0; i < len(s); i++ {
 		if s[i] == '\\' && i+1 < len(s) {
 			i++ // Skip the backslash
@@ -413,13 +1595,64 @@ func unescapeString(s string) string {
 				result = append(result, '"')
 			case '\\':
 				result = append(result, '\\')
+			case '\n', '\r':
+				// A line continuation, the line break and the indentation
+				// of the next line are left out
+				rest := strings.TrimPrefix(s[i+1:], "\n")
+				if s[i] == '\r' {
+					rest = strings.TrimPrefix(rest, "\n")
+				}
+				rest = strings.TrimLeft(rest, " \t")
+				i = len(s) - len(rest) - 1
+			case 'x':
+				// A byte as is, the string doesn't have to stay valid UTF-8
+				if i+2 >= len(s) {
+					return "", fmt.Errorf("truncated \\x escape in %s", lit)
+				}
+				b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("invalid \\x escape in %s", lit)
+				}
+				result = append(result, byte(b))
+				i += 2
+			case 'u':
+				r, width, err := unicodeEscape(s[i+1:])
+				if err != nil {
+					return "", fmt.Errorf("%v in %s", err, lit)
+				}
+				result = utf8.AppendRune(result, r)
+				i += width
 			default:
 				// For unsupported escape sequences, keep them as-is
-				result = append(result, '\\', rune(s[i]))
+				result = append(result, '\\', s[i])
 			}
 		} else {
-			result = append(result, rune(s[i]))
+			result = append(result, s[i])
 		}
 	}
-	return string(result)
+	return string(result), nil
+}
+
+// unicodeEscape reads the code point after a \u, either exactly four hex
+// digits or one to six in braces, and how many bytes it took
+func unicodeEscape(s string) (rune, int, error) {
+	digits, width := "", 4
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 2 || end > 7 {
+			return 0, 0, fmt.Errorf("invalid \\u{...} escape")
+		}
+		digits, width = s[1:end], end+1
+	} else {
+		if len(s) < 4 {
+			return 0, 0, fmt.Errorf("truncated \\u escape")
+		}
+		digits = s[:4]
+	}
+
+	code, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || !utf8.ValidRune(rune(code)) {
+		return 0, 0, fmt.Errorf("invalid unicode escape \\u%s", s[:width])
+	}
+	return rune(code), width, nil
 }
@@ -0,0 +1,51 @@
+package lang
+
+import "fmt"
+
+// maxConstants is how many constants the 2 byte operand of PUSH_CONST can
+// address
+const maxConstants = 1 << 16
+
+// emitInt pushes the integer literal n. PUSH carries it in its operand when
+// it fits a byte, anything else goes in the constant pool and is pushed with
+// PUSH_CONST
+func (c *Compiler) emitInt(n int64) error {
+	if n >= 0 && n <= 0xff {
+		c.emit(InstrPush, byte(n))
+		return nil
+	}
+	idx, ok := c.Constants[n]
+	if !ok {
+		if len(c.Constants) >= maxConstants {
+			return fmt.Errorf("too many integer constants, at most %d fit in the constant pool", maxConstants)
+		}
+		idx = len(c.Constants)
+		c.Constants[n] = idx
+	}
+	c.emit(InstrPushConst, byte(idx>>8), byte(idx&0xff))
+	return nil
+}
+
+// RegisterConstants loads the constant pool the program was compiled with,
+// the same way RegisterStrings loads the string table. Like the string table
+// the pool only lives in the compile session, the bytecode file is just the
+// instructions and can't run without it
+func (vm *VM) RegisterConstants(constants map[int64]int) {
+	vm.constants = make([]Value, len(constants))
+	for n, idx := range constants {
+		vm.constants[idx] = IntValue(n)
+	}
+}
+
+func (vm *VM) executePushConst() error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	idx := vm.index()
+	if idx >= len(vm.constants) {
+		return fmt.Errorf("constant index out of bounds: %d", idx)
+	}
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, vm.constants[idx])
+	vm.CurrentState.PC += 2
+	return nil
+}
@@ -0,0 +1,31 @@
+package lang
+
+import "context"
+
+// cancelCheckInterval is how many instructions run between looks at the
+// context, often enough to stop promptly without slowing every instruction
+const cancelCheckInterval = 1024
+
+// RunContext is Run bounded by ctx, once it's done the program stops with
+// ErrCanceled at the line it got to. The error unwraps to ctx.Err(), so a
+// timeout can be told apart with errors.Is(err, context.DeadlineExceeded)
+func (vm *VM) RunContext(ctx context.Context) {
+	vm.ctx = ctx
+	vm.Run()
+}
+
+// checkContext looks at the context every cancelCheckInterval instructions
+func (vm *VM) checkContext() error {
+	vm.ticks++
+	if vm.ticks%cancelCheckInterval != 0 {
+		return nil
+	}
+	select {
+	case <-vm.ctx.Done():
+		err := runtimeError(ErrCanceled, vm.ctx.Err()).(*RuntimeError)
+		err.Err = vm.ctx.Err()
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,74 @@
+package lang
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Strings and numbers never mix implicitly. + adds two numbers or joins two
+// strings, anything else has to be converted first with string(x), which
+// compiles to TO_STRING. Mixing them is a compile error where both sides
+// are literals and a runtime error otherwise
+
+// literalType is the type of a term that's a plain literal
+func literalType(t *Term) (ValueType, bool) {
+	if len(t.Index) > 0 {
+		return 0, false
+	}
+	switch {
+	case t.Number != nil:
+		return ValueTypeInt, true
+	case t.String != nil:
+		return ValueTypeString, true
+	case t.Bytes != nil:
+		return ValueTypeBytes, true
+	case t.Array != nil:
+		return ValueTypeArray, true
+	case t.Bool != nil:
+		return ValueTypeBool, true
+	case t.Nil:
+		return ValueTypeNil, true
+	}
+	return 0, false
+}
+
+// checkConcat rejects + between a string literal and a literal of another
+// type, `"count: " + 3`
+func checkConcat(expr *Expr) error {
+	if *expr.Op != "+" || expr.Right.Op != nil {
+		return nil
+	}
+	x, okX := literalType(expr.Left)
+	y, okY := literalType(expr.Right.Left)
+	if !okX || !okY || x == y || x != ValueTypeString && y != ValueTypeString {
+		return nil
+	}
+	return languageError(expr.Left.Pos, ErrMixedConcat, helpStringConversion, typeNames[x], typeNames[y])
+}
+
+// toString converts v the way string(x) does, bytes have to be valid UTF-8
+func (vm *VM) toString(v Value) (StringValue, error) {
+	switch v := v.(type) {
+	case StringValue:
+		return v, nil
+	case BytesValue:
+		data := vm.CurrentState.Bytes[v.Index]
+		if !utf8.Valid(data) {
+			return StringValue{}, fmt.Errorf("bytes are not valid UTF-8")
+		}
+		return StringValue{Index: vm.RegisterString(string(data))}, nil
+	}
+	return StringValue{Index: vm.RegisterString(vm.formatted(v))}, nil
+}
+
+func (vm *VM) executeToString() error {
+	if len(vm.CurrentState.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	s, err := vm.toString(vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1])
+	if err != nil {
+		return err
+	}
+	vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1] = s
+	return nil
+}
@@ -0,0 +1,363 @@
+package lang
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+)
+
+// DefaultCoreTail is how many of the last instructions a core file keeps at
+// least, the debugger can step back through them
+const DefaultCoreTail = 1000
+
+// Core is the post-mortem of a program stopped by a runtime error. It holds
+// the bytecode, the state it stopped in and the tail of its history, opening
+// it in the debugger puts it back at the failing instruction
+type Core struct {
+	// Filename, Source and LangVersion are what the bytecode was compiled
+	// from, the debugger needs the compiler's view of the program too
+	Filename    string
+	Source      string
+	LangVersion string
+	Bytecode    []byte
+	Err         string
+	Final       coreState
+	// Checked is whether overflow was an error, from the pragma or asked
+	// for when running
+	Checked bool
+	// Keyframe is the state before the first step of the tail, Steps the
+	// PCs executed from there with the failing one last
+	Keyframe coreState
+	Steps    []int
+	Calls    map[int]coreCall
+}
+
+// coreValue is a Value written out, which fields are set depends on Type
+type coreValue struct {
+	Type   ValueType
+	Index  int
+	To     int
+	Secret bool
+	Big    []byte
+	Neg    bool
+	Kind   string
+}
+
+type coreIterator struct {
+	Target coreValue
+	Pos    int
+}
+
+type coreFrame struct {
+	ReturnPC  int
+	Locals    []coreValue
+	StackBase int
+	Defers    []int
+	Resume    int
+	Halt      bool
+}
+
+// coreState is a VMState written out, the pending error only keeps its
+// message
+type coreState struct {
+	PC           int
+	Stack        []coreValue
+	Locals       []coreValue
+	Memory       []byte
+	Strings      []string
+	Arrays       [][]coreValue
+	Bytes        [][]byte
+	Iterators    []coreIterator
+	Frames       []coreFrame
+	SourceLine   int
+	Defers       []int
+	Resume       int
+	Scopes       []int
+	PendingError string
+	Handlers     []Handler
+	Globals      []coreValue
+	NextGC       int
+}
+
+type coreCall struct {
+	Result  coreValue
+	Strings []string
+	Bytes   [][]byte
+	Arrays  [][]coreValue
+}
+
+// KeepTail records the last steps instructions outside of the debugger so a
+// core can be written when the program fails. Keyframes are taken every
+// steps instructions and only the last two are kept
+func (vm *VM) KeepTail(steps int) {
+	vm.history = newHistory(max(1, steps))
+	vm.history.tail = true
+}
+
+// Core captures the stopped program, it needs the tail kept by KeepTail or
+// the debugger's history
+func (vm *VM) Core() (*Core, error) {
+	h := vm.history
+	if h == nil || len(h.keyframes) == 0 {
+		return nil, fmt.Errorf("no history was recorded to write a core from")
+	}
+	start := h.keyframes[0]
+	core := &Core{
+		Bytecode: vm.Bytecode,
+		Checked:  vm.checked,
+		Final:    encodeState(vm.CurrentState),
+		Keyframe: encodeState(start.state),
+		Steps:    slices.Clone(h.pcs[start.step:]),
+		Calls:    make(map[int]coreCall),
+	}
+	if vm.err != nil {
+		core.Err = vm.err.Error()
+	}
+	for step, call := range h.calls {
+		if step >= start.step {
+			core.Calls[step-start.step] = coreCall{
+				Result:  encodeValue(call.result),
+				Strings: call.strings,
+				Bytes:   call.bytes,
+				Arrays:  encodeArrays(call.arrays),
+			}
+		}
+	}
+	return core, nil
+}
+
+// Restore puts a debugger VM back where core stopped, before the failing
+// instruction with the rest of the tail to step back through. Builtins,
+// strings and the source map have to be registered already
+func (vm *VM) Restore(core *Core) error {
+	if vm.history == nil {
+		return fmt.Errorf("a core can only be opened in the debugger")
+	}
+	if len(core.Steps) == 0 {
+		vm.CurrentState = decodeState(core.Final)
+		return nil
+	}
+
+	h := newHistory(vm.history.interval)
+	h.keyframes = []keyframe{{step: 0, state: decodeState(core.Keyframe)}}
+	h.pcs = slices.Clone(core.Steps)
+	for step, call := range core.Calls {
+		h.calls[step] = callRecord{
+			result:  decodeValue(call.Result),
+			strings: call.Strings,
+			bytes:   call.Bytes,
+			arrays:  decodeArrays(call.Arrays),
+		}
+	}
+	vm.history = h
+	vm.CurrentState = h.keyframes[0].state.Clone()
+	return vm.Rewind(len(h.pcs) - 1)
+}
+
+// WriteCore writes core to path
+func WriteCore(path string, core *Core) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(core); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write core %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// ReadCore reads a core written by WriteCore
+func ReadCore(path string) (*Core, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var core Core
+	if err := gob.NewDecoder(f).Decode(&core); err != nil {
+		return nil, fmt.Errorf("%s is not a core file: %w", path, err)
+	}
+	return &core, nil
+}
+
+// trim forgets the oldest keyframes and the steps they start, down to the
+// last two while keeping a tail and to within the limit otherwise. The steps
+// are renumbered from the first keyframe left
+func (h *history) trim() {
+	drop := 0
+	if h.tail {
+		drop = max(0, len(h.keyframes)-2)
+	}
+	if h.limit > 0 {
+		for drop < len(h.keyframes)-1 && h.step-h.keyframes[drop].step > h.limit {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+	h.keyframes = slices.Clone(h.keyframes[drop:])
+	offset := h.keyframes[0].step
+	for i := range h.keyframes {
+		h.keyframes[i].step -= offset
+	}
+	h.pcs = slices.Clone(h.pcs[offset:])
+	calls := make(map[int]callRecord, len(h.calls))
+	for step, call := range h.calls {
+		if step >= offset {
+			calls[step-offset] = call
+		}
+	}
+	h.calls = calls
+	h.step -= offset
+}
+
+func encodeValue(v Value) coreValue {
+	switch v := v.(type) {
+	case IntValue:
+		return coreValue{Type: ValueTypeInt, Index: int(v)}
+	case StringValue:
+		return coreValue{Type: ValueTypeString, Index: v.Index, Secret: v.Secret}
+	case ArrayValue:
+		return coreValue{Type: ValueTypeArray, Index: v.Index}
+	case IteratorValue:
+		return coreValue{Type: ValueTypeIterator, Index: v.Index}
+	case BigValue:
+		return coreValue{Type: ValueTypeBig, Big: v.N.Bytes(), Neg: v.N.Sign() < 0}
+	case BytesValue:
+		return coreValue{Type: ValueTypeBytes, Index: v.Index}
+	case FunctionValue:
+		return coreValue{Type: ValueTypeFunction, Index: v.Addr, To: v.Arity}
+	case RangeValue:
+		return coreValue{Type: ValueTypeRange, Index: v.From, To: v.To}
+	case BoolValue:
+		return coreValue{Type: ValueTypeBool, Index: int(intCompat(v).(IntValue))}
+	case ResourceValue:
+		return coreValue{Type: ValueTypeResource, Index: v.Handle, Kind: v.Kind}
+	}
+	return coreValue{Type: ValueTypeNil}
+}
+
+func decodeValue(v coreValue) Value {
+	switch v.Type {
+	case ValueTypeInt:
+		return IntValue(v.Index)
+	case ValueTypeString:
+		return StringValue{Index: v.Index, Secret: v.Secret}
+	case ValueTypeArray:
+		return ArrayValue{Index: v.Index}
+	case ValueTypeIterator:
+		return IteratorValue{Index: v.Index}
+	case ValueTypeBig:
+		n := new(big.Int).SetBytes(v.Big)
+		if v.Neg {
+			n.Neg(n)
+		}
+		return BigValue{N: n}
+	case ValueTypeBytes:
+		return BytesValue{Index: v.Index}
+	case ValueTypeFunction:
+		return FunctionValue{Addr: v.Index, Arity: v.To}
+	case ValueTypeRange:
+		return RangeValue{From: v.Index, To: v.To}
+	case ValueTypeResource:
+		return ResourceValue{Kind: v.Kind, Handle: v.Index}
+	case ValueTypeBool:
+		return BoolValue(v.Index != 0)
+	}
+	return NilValue{}
+}
+
+func encodeValues(vs []Value) []coreValue {
+	out := make([]coreValue, len(vs))
+	for i, v := range vs {
+		out[i] = encodeValue(v)
+	}
+	return out
+}
+
+func decodeValues(vs []coreValue) []Value {
+	out := make([]Value, len(vs))
+	for i, v := range vs {
+		out[i] = decodeValue(v)
+	}
+	return out
+}
+
+func encodeArrays(vss [][]Value) [][]coreValue {
+	out := make([][]coreValue, len(vss))
+	for i, vs := range vss {
+		out[i] = encodeValues(vs)
+	}
+	return out
+}
+
+func decodeArrays(vss [][]coreValue) [][]Value {
+	out := make([][]Value, len(vss))
+	for i, vs := range vss {
+		out[i] = decodeValues(vs)
+	}
+	return out
+}
+
+func encodeState(s *VMState) coreState {
+	state := coreState{
+		PC:         s.PC,
+		Stack:      encodeValues(s.Stack),
+		Locals:     encodeValues(s.Locals),
+		Memory:     s.Memory,
+		Strings:    s.Strings,
+		Arrays:     encodeArrays(s.Arrays),
+		Bytes:      s.Bytes,
+		SourceLine: s.SourceLine,
+		Defers:     s.Defers,
+		Resume:     s.Resume,
+		Scopes:     s.Scopes,
+		Handlers:   s.Handlers,
+		Globals:    encodeValues(s.Globals),
+		NextGC:     s.NextGC,
+	}
+	for _, it := range s.Iterators {
+		state.Iterators = append(state.Iterators, coreIterator{Target: encodeValue(it.Target), Pos: it.Pos})
+	}
+	for _, frame := range s.Frames {
+		state.Frames = append(state.Frames, coreFrame{ReturnPC: frame.ReturnPC, Locals: encodeValues(frame.Locals), StackBase: frame.StackBase, Defers: frame.Defers, Resume: frame.Resume, Halt: frame.Halt})
+	}
+	if s.PendingError != nil {
+		state.PendingError = s.PendingError.Error()
+	}
+	return state
+}
+
+func decodeState(s coreState) *VMState {
+	state := &VMState{
+		PC:         s.PC,
+		Stack:      decodeValues(s.Stack),
+		Locals:     decodeValues(s.Locals),
+		Memory:     s.Memory,
+		Strings:    s.Strings,
+		Arrays:     decodeArrays(s.Arrays),
+		Bytes:      s.Bytes,
+		SourceLine: s.SourceLine,
+		Defers:     s.Defers,
+		Resume:     s.Resume,
+		Scopes:     s.Scopes,
+		Handlers:   s.Handlers,
+		Globals:    decodeValues(s.Globals),
+		NextGC:     s.NextGC,
+	}
+	for _, it := range s.Iterators {
+		state.Iterators = append(state.Iterators, Iterator{Target: decodeValue(it.Target), Pos: it.Pos})
+	}
+	for _, frame := range s.Frames {
+		state.Frames = append(state.Frames, Frame{ReturnPC: frame.ReturnPC, Locals: decodeValues(frame.Locals), StackBase: frame.StackBase, Defers: frame.Defers, Resume: frame.Resume, Halt: frame.Halt})
+	}
+	if s.PendingError != "" {
+		state.PendingError = errors.New(s.PendingError)
+	}
+	return state
+}
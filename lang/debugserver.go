@@ -0,0 +1,300 @@
+package lang
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DebugAccess holds the shared tokens remote debugger clients authenticate
+// with. A client with the control token may step, continue and set
+// breakpoints, one with the read token may only look at the state. An empty
+// token turns that mode off
+type DebugAccess struct {
+	ControlToken string
+	ReadToken    string
+}
+
+// ServeDebugger lets remote clients debug vm over connections accepted from
+// listener, so an application embedding the VM can opt into debugging its
+// scripts at runtime. The VM has to be created in debug mode. ServeDebugger
+// blocks until the listener is closed.
+//
+// The protocol is line based. A client first sends "auth <token>", then
+// commands the same as the REPL's: step, back, continue, break <line>,
+// clear <line> and state. Every command is answered with one JSON object.
+//
+// Any client may also send "watch" to observe the session. From then on it
+// is sent a state event after every step or continue another client makes,
+// and an output event for everything the program prints. Events are
+// dropped for a watcher that falls too far behind rather than holding up
+// the program
+func ServeDebugger(vm *VM, listener net.Listener, access DebugAccess) error {
+	if vm.debugChan == nil {
+		return errors.New("the VM was not created in debug mode")
+	}
+	if access.ControlToken == "" && access.ReadToken == "" {
+		return errors.New("no debugger access token set")
+	}
+
+	server := &debugServer{vm: vm, access: access, watchers: make(map[chan debugReply]struct{})}
+	vm.SetOutput(io.MultiWriter(vm.output, debugOutput{server}))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go server.serve(conn)
+	}
+}
+
+type debugMode int
+
+const (
+	debugModeNone debugMode = iota
+	debugModeRead
+	debugModeControl
+)
+
+func (m debugMode) String() string {
+	switch m {
+	case debugModeRead:
+		return "read-only"
+	case debugModeControl:
+		return "control"
+	}
+	return "none"
+}
+
+type debugServer struct {
+	vm     *VM
+	access DebugAccess
+	// mu serializes the commands of all clients, the VM answers one debugger
+	// command at a time
+	mu sync.Mutex
+	// finished is set once a command ran the program to its end, the VM
+	// isn't reading commands anymore
+	finished bool
+
+	watchMu  sync.Mutex
+	watchers map[chan debugReply]struct{}
+}
+
+// watcherBacklog is how many events a watcher may have queued before newer
+// ones are dropped
+const watcherBacklog = 256
+
+// debugReply is the answer to one client command, or an event sent to the
+// watchers when Event is set
+type debugReply struct {
+	OK     bool             `json:"ok"`
+	Event  string           `json:"event,omitempty"`
+	Error  string           `json:"error,omitempty"`
+	Mode   string           `json:"mode,omitempty"`
+	State  *debugStateReply `json:"state,omitempty"`
+	Output string           `json:"output,omitempty"`
+}
+
+type debugStateReply struct {
+	PC       int      `json:"pc"`
+	Line     int      `json:"line"`
+	Stack    []string `json:"stack"`
+	Locals   []string `json:"locals"`
+	Finished bool     `json:"finished"`
+}
+
+// debugConn is a client connection, replies and events are written to it
+// from different goroutines
+type debugConn struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (c *debugConn) send(reply debugReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.encoder.Encode(reply)
+}
+
+func (s *debugServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	mode := debugModeNone
+	client := &debugConn{encoder: json.NewEncoder(conn)}
+	var events chan debugReply
+	defer func() {
+		if events != nil {
+			s.unwatch(events)
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		var reply debugReply
+		switch {
+		case args[0] == "auth":
+			if mode = s.authenticate(args[1:]); mode == debugModeNone {
+				client.send(debugReply{Error: "authentication failed"})
+				return
+			}
+			reply = debugReply{OK: true, Mode: mode.String()}
+		case args[0] == "watch" && mode != debugModeNone:
+			if events == nil {
+				events = s.watch()
+				go func() {
+					for event := range events {
+						client.send(event)
+					}
+				}()
+			}
+			s.mu.Lock()
+			reply = debugReply{OK: true, State: s.state()}
+			s.mu.Unlock()
+		default:
+			reply = s.command(mode, args)
+		}
+		if err := client.send(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *debugServer) watch() chan debugReply {
+	events := make(chan debugReply, watcherBacklog)
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.watchers[events] = struct{}{}
+	return events
+}
+
+func (s *debugServer) unwatch(events chan debugReply) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	delete(s.watchers, events)
+	close(events)
+}
+
+// broadcast queues an event for every watcher without waiting on them
+func (s *debugServer) broadcast(event debugReply) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for events := range s.watchers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// debugOutput forwards what the program prints to the watchers
+type debugOutput struct {
+	server *debugServer
+}
+
+func (o debugOutput) Write(p []byte) (int, error) {
+	o.server.broadcast(debugReply{OK: true, Event: "output", Output: string(p)})
+	return len(p), nil
+}
+
+func (s *debugServer) authenticate(args []string) debugMode {
+	if len(args) != 1 {
+		return debugModeNone
+	}
+	switch {
+	case tokenMatches(args[0], s.access.ControlToken):
+		return debugModeControl
+	case tokenMatches(args[0], s.access.ReadToken):
+		return debugModeRead
+	}
+	return debugModeNone
+}
+
+func tokenMatches(given, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func (s *debugServer) command(mode debugMode, args []string) debugReply {
+	if mode == debugModeNone {
+		return debugReply{Error: "not authenticated"}
+	}
+	switch args[0] {
+	case "state":
+	case "step", "back", "continue", "break", "clear":
+		if mode != debugModeControl {
+			return debugReply{Error: fmt.Sprintf("%s needs control access", args[0])}
+		}
+	default:
+		return debugReply{Error: fmt.Sprintf("unknown command: %s", args[0])}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm := s.vm
+	switch args[0] {
+	case "step", "back", "continue":
+		if s.finished {
+			return debugReply{Error: "program has finished execution"}
+		}
+		switch args[0] {
+		case "step":
+			vm.StepNext()
+		case "back":
+			vm.StepBack()
+		case "continue":
+			vm.Continue()
+		}
+		state := s.state()
+		s.finished = state.Finished
+		s.broadcast(debugReply{OK: true, Event: "state", State: state})
+		return debugReply{OK: true, State: state}
+
+	case "break", "clear":
+		if len(args) < 2 {
+			return debugReply{Error: fmt.Sprintf("usage: %s <line>", args[0])}
+		}
+		line, err := strconv.Atoi(args[1])
+		if err != nil {
+			return debugReply{Error: fmt.Sprintf("invalid line number: %s", args[1])}
+		}
+		vm.SetLineBreakpoint(line, args[0] == "break")
+	}
+	return debugReply{OK: true, State: s.state()}
+}
+
+// state is the VM's state for a reply, only call it holding mu so no
+// command is running the VM
+func (s *debugServer) state() *debugStateReply {
+	state := s.vm.State()
+	format := func(values []Value) []string {
+		formatted := make([]string, len(values))
+		for i, v := range values {
+			formatted[i] = state.FormatValue(v)
+		}
+		return formatted
+	}
+	// SourceLine is only kept up to date by stepping, a continue leaves it
+	// behind, so the line comes from the source map
+	return &debugStateReply{
+		PC:       state.PC,
+		Line:     s.vm.lineForPC(state.PC),
+		Stack:    format(state.Stack),
+		Locals:   format(state.Locals),
+		Finished: state.PC >= len(s.vm.Bytecode),
+	}
+}
@@ -0,0 +1,172 @@
+package lang
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// debugVM is a debug mode VM running source, ready to be served
+func debugVM(t *testing.T, source string) *VM {
+	t.Helper()
+	program, err := Parse("debug.dl", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := NewCompiler()
+	if _, err := compiler.CompileProgram(program); err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(compiler.Code, DefaultStackSize, DefaultLocalsSize, true)
+	RegisterBuiltins(vm)
+	vm.SetOutput(io.Discard)
+	for pc, line := range compiler.GetSourceMap() {
+		vm.RegisterSourceMap(pc, line)
+	}
+	vm.RegisterStrings(compiler.Strings)
+	vm.RegisterConstants(compiler.Constants)
+	return vm
+}
+
+// serveDebugVM serves vm on a loopback listener for the length of the test
+func serveDebugVM(t *testing.T, vm *VM, access DebugAccess) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- ServeDebugger(vm, listener, access) }()
+	t.Cleanup(func() {
+		listener.Close()
+		if err := <-served; err != nil {
+			t.Errorf("ServeDebugger: %v", err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+type debugClient struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Scanner
+}
+
+func dialDebugger(t *testing.T, addr string) *debugClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &debugClient{t: t, conn: conn, in: bufio.NewScanner(conn)}
+}
+
+// send sends a command and returns the reply to it
+func (c *debugClient) send(command string) debugReply {
+	c.t.Helper()
+	if _, err := fmt.Fprintln(c.conn, command); err != nil {
+		c.t.Fatal(err)
+	}
+	if !c.in.Scan() {
+		c.t.Fatalf("%s: connection closed without a reply", command)
+	}
+	var reply debugReply
+	if err := json.Unmarshal(c.in.Bytes(), &reply); err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+// next reads the next event sent to a watcher, skipping what was printed
+func (c *debugClient) next() debugReply {
+	c.t.Helper()
+	for c.in.Scan() {
+		var reply debugReply
+		if err := json.Unmarshal(c.in.Bytes(), &reply); err != nil {
+			c.t.Fatal(err)
+		}
+		if reply.Event != "output" {
+			return reply
+		}
+	}
+	c.t.Fatal("connection closed while waiting for an event")
+	return debugReply{}
+}
+
+var testDebugAccess = DebugAccess{ControlToken: "control-token", ReadToken: "read-token"}
+
+func TestDebuggerRefusesBadToken(t *testing.T) {
+	addr := serveDebugVM(t, debugVM(t, "val a = 1\n"), testDebugAccess)
+
+	client := dialDebugger(t, addr)
+	if reply := client.send("state"); reply.OK || reply.Error != "not authenticated" {
+		t.Errorf("state before auth: %+v", reply)
+	}
+	if reply := client.send("auth wrong-token"); reply.OK || reply.Error != "authentication failed" {
+		t.Errorf("auth with a bad token: %+v", reply)
+	}
+	if client.in.Scan() {
+		t.Errorf("the connection stayed open after a bad token, got %s", client.in.Text())
+	}
+}
+
+func TestDebuggerReadOnly(t *testing.T) {
+	addr := serveDebugVM(t, debugVM(t, "val a = 1\nval b = a + 1\n"), testDebugAccess)
+
+	client := dialDebugger(t, addr)
+	if reply := client.send("auth read-token"); !reply.OK || reply.Mode != "read-only" {
+		t.Fatalf("auth: %+v", reply)
+	}
+	for _, command := range []string{"step", "back", "continue", "break 2", "clear 2"} {
+		if reply := client.send(command); reply.OK {
+			t.Errorf("%s was allowed with read-only access", command)
+		}
+	}
+	reply := client.send("state")
+	if !reply.OK || reply.State == nil || reply.State.PC != 0 {
+		t.Errorf("state: %+v", reply)
+	}
+}
+
+func TestDebuggerControl(t *testing.T) {
+	addr := serveDebugVM(t, debugVM(t, "val a = 1\nval b = a + 1\nprint(b)\n"), testDebugAccess)
+
+	control := dialDebugger(t, addr)
+	if reply := control.send("auth control-token"); !reply.OK || reply.Mode != "control" {
+		t.Fatalf("auth: %+v", reply)
+	}
+	watcher := dialDebugger(t, addr)
+	watcher.send("auth read-token")
+	watcher.send("watch")
+
+	reply := control.send("step")
+	if !reply.OK || reply.State == nil || reply.State.Line != 2 {
+		t.Fatalf("step: %+v", reply)
+	}
+	if locals := reply.State.Locals; len(locals) == 0 || locals[0] != "1" {
+		t.Errorf("locals after a step: %v", reply.State.Locals)
+	}
+	if event := watcher.next(); event.Event != "state" || event.State.Line != 2 {
+		t.Errorf("watcher got %+v, want the state after the step", event)
+	}
+
+	if reply := control.send("continue"); !reply.OK || !reply.State.Finished {
+		t.Fatalf("continue: %+v", reply)
+	}
+	if reply := control.send("step"); reply.OK || reply.Error != "program has finished execution" {
+		t.Errorf("step once finished: %+v", reply)
+	}
+	if event := watcher.next(); event.Event != "state" || !event.State.Finished {
+		t.Errorf("watcher got %+v, want the state after the continue", event)
+	}
+
+	reader := dialDebugger(t, addr)
+	reader.send("auth read-token")
+	if reply := reader.send("state"); !reply.OK || reply.State == nil || !reply.State.Finished {
+		t.Errorf("state once finished: %+v", reply)
+	}
+}
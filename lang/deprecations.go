@@ -0,0 +1,136 @@
+package lang
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// LangVersions are the versions of the language, oldest first. Picking a
+// version decides which deprecated constructs still compile
+var LangVersions = []string{"0.2", "0.3"}
+
+// DefaultLangVersion is the version programs are compiled as unless told
+// otherwise, the newest one that keeps existing scripts compiling
+const DefaultLangVersion = "0.2"
+
+// langVersion is the version new compilers start out with
+var langVersion = DefaultLangVersion
+
+// SetLangVersion picks the language version programs are compiled as from
+// now on
+func SetLangVersion(version string) error {
+	if !slices.Contains(LangVersions, version) {
+		return fmt.Errorf("unknown language version %s, known versions are %v", version, LangVersions)
+	}
+	langVersion = version
+	return nil
+}
+
+// Deprecation is a construct on its way out of the language. It's warned
+// about up to the version it's removed in and an error from then on
+type Deprecation struct {
+	Code    MessageID
+	Help    MessageID
+	Removed string
+}
+
+// Deprecated constructs
+var (
+	// DeprecatedValReassign is assigning to a variable declared with val,
+	// val is becoming immutable and var declares what changes
+	DeprecatedValReassign = &Deprecation{Code: WarnValReassign, Help: helpValReassign, Removed: "0.3"}
+)
+
+// removedBy reports whether d no longer compiles in version
+func (d *Deprecation) removedBy(version string) bool {
+	return slices.Index(LangVersions, version) >= slices.Index(LangVersions, d.Removed)
+}
+
+// Fix is the edit upgrading a deprecated construct, the word at Pos is
+// replaced with New
+type Fix struct {
+	Deprecation *Deprecation
+	Pos         lexer.Position
+	New         string
+}
+
+// deprecated reports a use of d at pos, fix is how to upgrade it or nil. The
+// message and help are formatted with args followed by the version d is
+// removed in
+func (c *Compiler) deprecated(pos lexer.Position, d *Deprecation, fix *Fix, args ...any) error {
+	diag := languageError(pos, d.Code, d.Help, append(args, d.Removed)...)
+	if d.removedBy(c.LangVersion) {
+		return diag
+	}
+	c.Warnings = append(c.Warnings, diag)
+	if fix != nil {
+		c.Fixes = append(c.Fixes, *fix)
+	}
+	return nil
+}
+
+// declaration is how a variable was declared, Pos is the first val of it
+// and Mutable is set once it's declared with var anywhere. First is the
+// first declaration either way
+type declaration struct {
+	Pos     lexer.Position
+	Mutable bool
+	First   lexer.Position
+}
+
+// declare records how the names of assign were declared
+func (c *Compiler) declare(assign *Assignment) {
+	for _, name := range append([]string{assign.Variable}, assign.Extra...) {
+		decl, ok := c.decls[name]
+		if !ok {
+			decl.First = assign.Pos
+		}
+		switch {
+		case assign.Mutable:
+			decl.Mutable = true
+		case !ok:
+			decl.Pos = assign.Pos
+		}
+		c.decls[name] = decl
+	}
+}
+
+// checkRedeclared reports a val or var declaring a name its scope already
+// declared, both are the same variable. It's a warning unless compiling
+// strictly
+func (c *Compiler) checkRedeclared(assign *Assignment) error {
+	for _, name := range append([]string{assign.Variable}, assign.Extra...) {
+		// The top level is declared up front, the first declaration meets
+		// itself there
+		decl, ok := c.decls[name]
+		if !ok || decl.First == assign.Pos {
+			continue
+		}
+		diag := languageError(assign.Pos, WarnRedeclared, helpRedeclared, name, decl.First)
+		if c.Strict {
+			return diag
+		}
+		c.Warnings = append(c.Warnings, diag)
+	}
+	return nil
+}
+
+// checkMutable reports assigning again to a variable declared with val,
+// globals can always be assigned
+func (c *Compiler) checkMutable(pos lexer.Position, name string, kind varKind) error {
+	decls := c.decls
+	switch kind {
+	case varTopLevel:
+		decls = c.enclosingDecls[0]
+	case varGlobal:
+		return nil
+	}
+	if decl, ok := decls[name]; ok && !decl.Mutable {
+		// The val keyword of the declaration becomes var
+		fix := &Fix{Deprecation: DeprecatedValReassign, Pos: decl.Pos, New: "var"}
+		return c.deprecated(pos, DeprecatedValReassign, fix, name, decl.Pos)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package lang
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Dialect maps alternative spellings of keywords to the keywords they stand
+// for, so scripts written for another DSL can be migrated a piece at a time
+type Dialect map[string]string
+
+// ParseDialect reads a dialect file. Every line maps one alias to a keyword,
+// `let = val`, blank lines and lines starting with # are skipped
+func ParseDialect(filename, source string) (Dialect, error) {
+	dialect := make(Dialect)
+	for i, line := range strings.Split(source, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pos := lexer.Position{Filename: filename, Line: i + 1, Column: 1}
+		alias, keyword, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected alias = keyword", pos)
+		}
+		alias, keyword = strings.TrimSpace(alias), strings.TrimSpace(keyword)
+		switch {
+		case !identPattern.MatchString(alias):
+			return nil, fmt.Errorf("%s: %q is not a valid alias", pos, alias)
+		case keywordPattern.MatchString(alias):
+			return nil, fmt.Errorf("%s: %s is already a keyword", pos, alias)
+		case !keywordPattern.MatchString(keyword):
+			return nil, fmt.Errorf("%s: %s is not a keyword", pos, keyword)
+		}
+		if prev, ok := dialect[alias]; ok && prev != keyword {
+			return nil, fmt.Errorf("%s: %s is already an alias of %s", pos, alias, prev)
+		}
+		dialect[alias] = keyword
+	}
+	return dialect, nil
+}
+
+var keywordPattern = regexp.MustCompile(`^` + ruleNamed("Keyword").Pattern + `$`)
+
+func ruleNamed(name string) lexer.SimpleRule {
+	for _, rule := range lexerRules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	panic("no lexer rule " + name)
+}
+
+// dialect is consulted by the parser's lexer, an alias lexes as the keyword
+// it stands for
+var dialect Dialect
+
+// SetDialect makes programs parsed from now on accept the aliases of d, nil
+// goes back to the keywords alone
+func SetDialect(d Dialect) {
+	dialect = d
+}
+
+// dialectLexer is basicLexer with the aliases of the dialect turned into
+// their keywords
+type dialectLexer struct{}
+
+func (dialectLexer) Symbols() map[string]lexer.TokenType {
+	return basicLexer.Symbols()
+}
+
+func (dialectLexer) Lex(filename string, r io.Reader) (lexer.Lexer, error) {
+	lex, err := basicLexer.Lex(filename, r)
+	if err != nil || len(dialect) == 0 {
+		return lex, err
+	}
+	return &aliasLexer{Lexer: lex, dialect: dialect}, nil
+}
+
+type aliasLexer struct {
+	lexer.Lexer
+	dialect Dialect
+}
+
+func (l *aliasLexer) Next() (lexer.Token, error) {
+	token, err := l.Lexer.Next()
+	if err != nil || token.Type != basicLexer.Symbols()["Ident"] {
+		return token, err
+	}
+	if keyword, ok := l.dialect[token.Value]; ok {
+		token.Type = basicLexer.Symbols()["Keyword"]
+		token.Value = keyword
+	}
+	return token, nil
+}
@@ -0,0 +1,49 @@
+package lang
+
+// StateDiff is what changed between two VM states
+type StateDiff struct {
+	FromPC, ToPC     int
+	FromLine, ToLine int
+	Locals           []SlotChange
+	Stack            []SlotChange
+}
+
+// SlotChange is a local or stack slot whose value differs. Values are
+// formatted with their own state, Before is empty when the slot didn't
+// exist yet and After when it no longer does
+type SlotChange struct {
+	Index  int
+	Before string
+	After  string
+}
+
+// DiffStates compares two states slot by slot. Values are compared by how
+// they display, so equal strings at different table indices are the same
+func DiffStates(a, b *VMState) StateDiff {
+	return StateDiff{
+		FromPC:   a.PC,
+		ToPC:     b.PC,
+		FromLine: a.SourceLine,
+		ToLine:   b.SourceLine,
+		Locals:   diffSlots(a, b, a.Locals, b.Locals),
+		Stack:    diffSlots(a, b, a.Stack, b.Stack),
+	}
+}
+
+func diffSlots(a, b *VMState, before, after []Value) []SlotChange {
+	var changes []SlotChange
+	for i := 0; i < max(len(before), len(after)); i++ {
+		var change SlotChange
+		if i < len(before) && before[i] != nil {
+			change.Before = a.FormatValue(before[i])
+		}
+		if i < len(after) && after[i] != nil {
+			change.After = b.FormatValue(after[i])
+		}
+		if change.Before != change.After {
+			change.Index = i
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,126 @@
+package lang
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// LanguageError is a mistake in the program itself, as opposed to a failure
+// of the tooling. It points at the offending source and can carry a hint.
+// Code is the stable ID of the message, empty for errors not in the catalog
+type LanguageError struct {
+	Pos     lexer.Position
+	Code    MessageID
+	Message string
+	Help    string
+}
+
+func (e *LanguageError) Error() string {
+	if e.Help == "" {
+		return formatDiagnostic(e.Pos.String(), e.Message, e.Code)
+	}
+	return formatDiagnostic(e.Pos.String(), e.Message, e.Code, "help: "+e.Help)
+}
+
+// formatDiagnostic lays out an error the way they're all shown, where it
+// happened and the message with its code, then each note indented on a
+// line of its own
+func formatDiagnostic(where, message string, code MessageID, notes ...string) string {
+	var out strings.Builder
+	if where != "" {
+		out.WriteString(where + ": ")
+	}
+	out.WriteString(message)
+	if code != "" {
+		fmt.Fprintf(&out, " [%s]", code)
+	}
+	for _, note := range notes {
+		out.WriteString("\n  " + note)
+	}
+	return out.String()
+}
+
+// RuntimeError is an error raised by the program while it runs. Code is
+// the stable ID of the message, empty for errors not in the catalog. The
+// VM fills in where it happened once the failing instruction returns
+type RuntimeError struct {
+	Code    MessageID
+	Message string
+	// Line is the source line of the instruction at PC, 0 when the error
+	// didn't come from an instruction
+	Line  int
+	PC    int
+	Instr Instr
+	// Stack is the top of the stack as the instruction found it
+	Stack []string
+	// Notes go on the lines after the rest, like the locals of a failed
+	// assertion
+	Notes []string
+	// Err is the error this one was made from, when it isn't from the
+	// catalog or it's the context that stopped the program
+	Err error
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Line == 0 {
+		return formatDiagnostic("", e.Message, e.Code, e.Notes...)
+	}
+	notes := []string{fmt.Sprintf("at %04d: %s", e.PC, e.Instr)}
+	if len(e.Stack) > 0 {
+		notes = append(notes, "stack: ["+strings.Join(e.Stack, ", ")+"]")
+	}
+	return formatDiagnostic(e.where(), e.Message, e.Code, append(notes, e.Notes...)...)
+}
+
+// Summary is the first line of the error, what a catch block is handed
+func (e *RuntimeError) Summary() string {
+	return formatDiagnostic(e.where(), e.Message, e.Code)
+}
+
+func (e *RuntimeError) where() string {
+	if e.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("line %d", e.Line)
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// stackExcerpt is how many values from the top of the stack a runtime
+// error shows, each cut off past stackValueWidth bytes
+const (
+	stackExcerpt    = 4
+	stackValueWidth = 60
+)
+
+// locate makes err a RuntimeError at the instruction at pc, height is how
+// many values were on the stack before it ran
+func (vm *VM) locate(err error, pc, height int) error {
+	var rt *RuntimeError
+	if !errors.As(err, &rt) {
+		rt = &RuntimeError{Message: err.Error(), Err: err}
+	}
+	if rt.Line != 0 {
+		return rt
+	}
+	rt.Line, rt.PC = vm.lineForPC(pc), pc
+	if pc < len(vm.Bytecode) {
+		rt.Instr = Instr(vm.Bytecode[pc])
+	}
+	// The operands the instruction popped are still there past the end
+	stack := vm.CurrentState.Stack
+	if height <= cap(stack) {
+		stack = stack[:height]
+	}
+	if len(stack) > stackExcerpt {
+		rt.Stack = append(rt.Stack, "...")
+		stack = stack[len(stack)-stackExcerpt:]
+	}
+	for _, v := range stack {
+		rt.Stack = append(rt.Stack, vm.CurrentState.FormatValueWidth(v, stackValueWidth))
+	}
+	return rt
+}
@@ -0,0 +1,68 @@
+package lang
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Handler is an active try block, where its catch starts and how far to
+// unwind the calls and the stack to get back to it. Deadline is when the
+// attempt of an operation with a timeout fails
+type Handler struct {
+	Addr        int
+	Frames      int
+	StackHeight int
+	Deadline    time.Time
+}
+
+func (vm *VM) executeTry() error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("invalid jump address")
+	}
+	addr := (int(vm.Bytecode[vm.CurrentState.PC]) << 8) | int(vm.Bytecode[vm.CurrentState.PC+1])
+	vm.CurrentState.Handlers = append(vm.CurrentState.Handlers, Handler{
+		Addr:        addr,
+		Frames:      len(vm.CurrentState.Frames),
+		StackHeight: len(vm.CurrentState.Stack),
+	})
+	vm.CurrentState.PC += 2
+	return nil
+}
+
+func (vm *VM) executeEndTry() error {
+	if len(vm.CurrentState.Handlers) == 0 {
+		return fmt.Errorf("END_TRY without a try block")
+	}
+	vm.CurrentState.Handlers = vm.CurrentState.Handlers[:len(vm.CurrentState.Handlers)-1]
+	return nil
+}
+
+// catch hands a runtime error to the innermost try block, dropping the
+// calls made since it was entered. The catch block starts with the error
+// message on the stack
+func (vm *VM) catch(err error) bool {
+	state := vm.CurrentState
+	if len(state.Handlers) == 0 {
+		return false
+	}
+	handler := state.Handlers[len(state.Handlers)-1]
+	state.Handlers = state.Handlers[:len(state.Handlers)-1]
+
+	if len(state.Frames) > handler.Frames {
+		frame := state.Frames[handler.Frames]
+		state.Locals, state.Defers, state.Resume = frame.Locals, frame.Defers, frame.Resume
+		state.Frames = state.Frames[:handler.Frames]
+	}
+	if len(state.Stack) > handler.StackHeight {
+		state.Stack = state.Stack[:handler.StackHeight]
+	}
+	message := err.Error()
+	var rt *RuntimeError
+	if errors.As(err, &rt) {
+		message = rt.Summary()
+	}
+	state.Stack = append(state.Stack, StringValue{Index: vm.RegisterString(message)})
+	state.PC = handler.Addr
+	return true
+}
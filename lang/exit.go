@@ -0,0 +1,39 @@
+package lang
+
+import "fmt"
+
+// ExitStatusError is the status of a program stopped by a runtime error
+const ExitStatusError = 1
+
+// ExitCode is the status the process should exit with once the program
+// stopped, what it passed to exit or ExitStatusError when it failed. 0
+// when it ran to the end
+func (vm *VM) ExitCode() int {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	if vm.err != nil {
+		return ExitStatusError
+	}
+	return vm.exitCode
+}
+
+// executeExit ends the program with the status on top of the stack, the
+// deferred blocks still run first. A process status only has 8 bits, one
+// that doesn't fit is an error rather than wrapping around to another
+func (vm *VM) executeExit() error {
+	if len(vm.CurrentState.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	code, ok := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1].(IntValue)
+	if !ok {
+		return fmt.Errorf("exit status must be an integer")
+	}
+	if code < 0 || code > 255 {
+		return runtimeError(ErrExitStatus, int64(code))
+	}
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
+	vm.mu.Lock()
+	vm.exitCode = int(code)
+	vm.mu.Unlock()
+	return vm.executeHalt()
+}
@@ -0,0 +1,182 @@
+package lang
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Parenthesized renders the expression fully parenthesized, showing exactly
+// how the parser grouped it
+func (e *Expr) Parenthesized() string {
+	if e.Op == nil {
+		return e.Left.Parenthesized()
+	}
+	return fmt.Sprintf("(%s %s %s)", e.Left.Parenthesized(), *e.Op, e.Right.Parenthesized())
+}
+
+func (t *Term) Parenthesized() string {
+	var base string
+	switch {
+	case t.Number != nil:
+		base = fmt.Sprintf("%d", *t.Number)
+	case t.String != nil:
+		base = *t.String
+	case t.Bytes != nil:
+		base = *t.Bytes
+	case t.Variable != nil:
+		base = *t.Variable
+	case t.Call != nil:
+		base = t.Call.Parenthesized()
+	case t.SubExpr != nil:
+		base = t.SubExpr.Parenthesized()
+	case t.Array != nil:
+		base = "[" + joinExprs(t.Array.Elements) + "]"
+	case t.Cond != nil:
+		base = fmt.Sprintf("if %s then %s else %s end",
+			t.Cond.Condition.Parenthesized(), t.Cond.Then.Parenthesized(), t.Cond.Else.Parenthesized())
+	case t.Bool != nil:
+		base = fmt.Sprint(*t.Bool)
+	case t.Nil:
+		base = "nil"
+	case t.Fn != nil:
+		base = t.Fn.Parenthesized()
+	case t.Block != nil:
+		base = t.Block.Parenthesized()
+	}
+	for _, sub := range t.Index {
+		if sub.Method != nil {
+			base += "." + sub.Method.Parenthesized()
+			continue
+		}
+		base += "[" + sub.Parenthesized() + "]"
+	}
+	return base
+}
+
+func (s *Subscript) Parenthesized() string {
+	var lo, hi string
+	if s.Index != nil {
+		lo = s.Index.Parenthesized()
+	}
+	if !s.Slice {
+		return lo
+	}
+	if s.High != nil {
+		hi = s.High.Parenthesized()
+	}
+	return lo + ":" + hi
+}
+
+// Parenthesized shows a function literal with only its result expression,
+// the statements of the body are elided
+func (f *FnLit) Parenthesized() string {
+	body := "nil"
+	if f.Result != nil {
+		body = f.Result.Parenthesized()
+	}
+	if len(f.Body) > 0 {
+		body = "... " + body
+	}
+	return fmt.Sprintf("fn(%s) do %s end", strings.Join(f.Params, ", "), body)
+}
+
+// Parenthesized shows a block with only its result expression, like a
+// function literal
+func (b *BlockExpr) Parenthesized() string {
+	body := "nil"
+	if b.Result != nil {
+		body = b.Result.Parenthesized()
+	}
+	if len(b.Body) > 0 {
+		body = "... " + body
+	}
+	return fmt.Sprintf("do %s end", body)
+}
+
+func (c *Call) Parenthesized() string {
+	return c.Function + "(" + joinExprs(c.Args) + ")"
+}
+
+func joinExprs(exprs []*Expr) string {
+	parts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		parts[i] = expr.Parenthesized()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ExplainParse writes every expression of the program in its fully
+// parenthesized form under the source line it came from
+func ExplainParse(w io.Writer, program *Program, source string) {
+	lines := strings.Split(source, "\n")
+	explainStatements(w, program.Statements, lines)
+}
+
+func explainStatements(w io.Writer, stmts []Statement, lines []string) {
+	for _, stmt := range stmts {
+		switch {
+		case stmt.Assignment != nil:
+			explainLine(w, lines, stmt.Assignment.Pos.Line, append([]*Expr{stmt.Assignment.Expr}, stmt.Assignment.ExtraExprs...)...)
+		case stmt.Operation != nil:
+			explainStatements(w, stmt.Operation.Body, lines)
+		case stmt.ConstDecl != nil:
+			explainLine(w, lines, stmt.ConstDecl.Pos.Line, stmt.ConstDecl.Expr)
+		case stmt.GlobalDecl != nil:
+			explainLine(w, lines, stmt.GlobalDecl.Pos.Line, stmt.GlobalDecl.Expr)
+		case stmt.FnDecl != nil:
+			explainStatements(w, stmt.FnDecl.Fn.Body, lines)
+			if result := stmt.FnDecl.Fn.Result; result != nil {
+				explainLine(w, lines, result.Left.Pos.Line, result)
+			}
+		case stmt.IfStmt != nil:
+			explainLine(w, lines, stmt.IfStmt.Pos.Line, stmt.IfStmt.Condition)
+			explainStatements(w, stmt.IfStmt.Then, lines)
+			explainStatements(w, stmt.IfStmt.Else, lines)
+		case stmt.WhileStmt != nil:
+			explainLine(w, lines, stmt.WhileStmt.Pos.Line, stmt.WhileStmt.Condition)
+			explainStatements(w, stmt.WhileStmt.Body, lines)
+		case stmt.ForStmt != nil:
+			if stmt.ForStmt.Iterable != nil {
+				explainLine(w, lines, stmt.ForStmt.Pos.Line, stmt.ForStmt.Iterable)
+			} else {
+				explainLine(w, lines, stmt.ForStmt.Pos.Line, stmt.ForStmt.From, stmt.ForStmt.To)
+			}
+			explainStatements(w, stmt.ForStmt.Body, lines)
+		case stmt.DeferStmt != nil:
+			explainStatements(w, stmt.DeferStmt.Body, lines)
+		case stmt.AssertStmt != nil:
+			explainLine(w, lines, stmt.AssertStmt.Pos.Line, stmt.exprs()...)
+		case stmt.TryStmt != nil:
+			explainStatements(w, stmt.TryStmt.Body, lines)
+			explainStatements(w, stmt.TryStmt.Handler, lines)
+		case stmt.MatchStmt != nil:
+			explainLine(w, lines, stmt.MatchStmt.Pos.Line, stmt.MatchStmt.Subject)
+			for _, arm := range stmt.MatchStmt.Arms {
+				explainStatements(w, arm.Body, lines)
+			}
+		case stmt.IndexAssignment != nil:
+			explainLine(w, lines, stmt.IndexAssignment.Pos.Line, stmt.IndexAssignment.Index, stmt.IndexAssignment.Expr)
+		case stmt.Reassignment != nil:
+			explainLine(w, lines, stmt.Reassignment.Pos.Line, stmt.Reassignment.Exprs...)
+		case stmt.CompoundAssignment != nil:
+			explainLine(w, lines, stmt.CompoundAssignment.Pos.Line, stmt.CompoundAssignment.Expr)
+		case stmt.Call != nil:
+			explainLine(w, lines, stmt.Call.Pos.Line, stmt.Call.Args...)
+		}
+	}
+}
+
+func explainLine(w io.Writer, lines []string, line int, exprs ...*Expr) {
+	if len(exprs) == 0 {
+		return
+	}
+	source := ""
+	if line > 0 && line <= len(lines) {
+		source = strings.TrimSpace(lines[line-1])
+	}
+	fmt.Fprintf(w, "\033[90m%4d │\033[0m %s\n", line, fit(source, 7, 20))
+	for _, expr := range exprs {
+		fmt.Fprintf(w, "     \033[1;32m=>\033[0m %s\n", fit(expr.Parenthesized(), 8, 20))
+	}
+}
@@ -0,0 +1,160 @@
+package lang
+
+import (
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+
+	"github.com/alecthomas/participle/v2"
+)
+
+// exprSource is the grammar of a source holding a single expression
+type exprSource struct {
+	Expr *Expr `@@`
+}
+
+// ExprModule is a single compiled expression, for using opdlang as a rule or
+// filter language inside a Go program. The variables it refers to are
+// bound by the host every time it's evaluated
+type ExprModule struct {
+	Source    string
+	Code      []byte
+	strings   map[string]int
+	constants map[int64]int
+	// names are the variables the expression refers to, in slot order
+	names []string
+}
+
+// CompileExpr compiles an expression like `x > 3` on its own, without the
+// program around it
+func CompileExpr(source string) (*ExprModule, error) {
+	parser := participle.MustBuild[exprSource](
+		participle.Lexer(dialectLexer{}),
+	)
+	parsed, err := parser.ParseString("expr", source)
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %v", err)
+	}
+
+	// Every name is a slot of the top level, filled from the bindings
+	names := make(map[string]bool)
+	visitor{
+		term: func(term *Term, _ *FnLit) {
+			if term.Variable != nil {
+				names[*term.Variable] = true
+			}
+		},
+	}.expr(parsed.Expr, nil)
+
+	compiler := NewCompiler()
+	module := &ExprModule{Source: source}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		compiler.getVarIdx(name)
+		module.names = append(module.names, name)
+	}
+	if err := compiler.compileExpr(parsed.Expr); err != nil {
+		return nil, err
+	}
+	module.Code, module.strings, module.constants = compiler.Code, compiler.Strings, compiler.Constants
+	return module, nil
+}
+
+// EvalExpr evaluates the expression with its variables bound to the Go
+// values in bindings, names left out are nil. Integers, strings, booleans,
+// []byte, *big.Int and slices of those can be bound. It runs sandboxed and
+// the result comes back as the same kinds of Go values, with arrays as []any
+func EvalExpr(module *ExprModule, bindings map[string]any) (any, error) {
+	vm := NewVM(module.Code, DefaultStackSize, DefaultLocalsSize, false)
+	RegisterBuiltins(vm)
+	vm.EnableSandbox(SandboxLimits)
+	vm.RegisterStrings(module.strings)
+	vm.RegisterConstants(module.constants)
+	for _, name := range module.names {
+		v, err := vm.hostValue(bindings[name])
+		if err != nil {
+			return nil, fmt.Errorf("binding %s: %w", name, err)
+		}
+		vm.CurrentState.Locals = append(vm.CurrentState.Locals, v)
+	}
+
+	// Run in place, there's no one to hand the final state to
+	vm.running = true
+	for vm.running && vm.CurrentState.PC < len(vm.Bytecode) {
+		if err := vm.executeInstruction(); err != nil {
+			return nil, err
+		}
+	}
+	stack := vm.CurrentState.Stack
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	return vm.goValue(stack[len(stack)-1]), nil
+}
+
+// hostValue turns a Go value bound by the host into a Value
+func (vm *VM) hostValue(v any) (Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return NilValue{}, nil
+	case int:
+		return IntValue(v), nil
+	case int64:
+		return IntValue(v), nil
+	case bool:
+		return BoolValue(v), nil
+	case string:
+		return StringValue{Index: vm.RegisterString(v)}, nil
+	case []byte:
+		return vm.newBytes(v), nil
+	case *big.Int:
+		return BigValue{N: v}, nil
+	case []any:
+		return hostArrayOf(vm, v)
+	case []int:
+		return hostArrayOf(vm, v)
+	case []string:
+		return hostArrayOf(vm, v)
+	}
+	return nil, fmt.Errorf("cannot bind a %T", v)
+}
+
+// hostArrayOf binds a slice as an array
+func hostArrayOf[T any](vm *VM, xs []T) (Value, error) {
+	elems := make([]Value, len(xs))
+	for i, x := range xs {
+		elem, err := vm.hostValue(x)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = elem
+	}
+	return vm.allocArray(elems), nil
+}
+
+// goValue turns a Value back into a Go value for the host, what has no Go
+// counterpart comes back formatted the way print shows it
+func (vm *VM) goValue(v Value) any {
+	switch v := v.(type) {
+	case NilValue:
+		return nil
+	case IntValue:
+		return int(v)
+	case BoolValue:
+		return bool(v)
+	case StringValue:
+		return vm.displayString(v)
+	case BytesValue:
+		return vm.CurrentState.Bytes[v.Index]
+	case BigValue:
+		return v.N
+	case ArrayValue:
+		elems := vm.CurrentState.Arrays[v.Index]
+		out := make([]any, len(elems))
+		for i, elem := range elems {
+			out[i] = vm.goValue(elem)
+		}
+		return out
+	}
+	return vm.CurrentState.FormatValue(v)
+}
@@ -0,0 +1,18 @@
+package lang
+
+// SetInstructionLimit gives the program fuel for n instructions, running
+// out stops it with ErrFuelExhausted at the line it got to. 0 means no
+// limit. Unlike EnableSandbox the builtins keep all their effects, it's
+// for scripts that may just never finish
+func (vm *VM) SetInstructionLimit(n int) {
+	vm.maxInstructions = max(0, n)
+}
+
+// burnFuel counts an instruction against the limit
+func (vm *VM) burnFuel() error {
+	vm.executed++
+	if vm.executed > vm.maxInstructions {
+		return runtimeError(ErrFuelExhausted, vm.maxInstructions)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package lang
+
+import "fmt"
+
+// FunctionValue is a function literal, the code starts at Addr and expects
+// exactly Arity arguments
+type FunctionValue struct {
+	Addr  int
+	Arity int
+}
+
+func (f FunctionValue) Type() ValueType { return ValueTypeFunction }
+
+// Frame is what a call saves to get back to the caller, the caller's locals
+// and cleanups and the stack height to return to. Halt is set for an
+// interrupt handler, the program halts instead of going back
+type Frame struct {
+	ReturnPC  int
+	Locals    []Value
+	StackBase int
+	Defers    []int
+	Resume    int
+	Halt      bool
+}
+
+// globals are the top level variables, inside a call they're the locals
+// saved by the outermost frame
+func (vm *VM) globals() *[]Value {
+	if len(vm.CurrentState.Frames) > 0 {
+		return &vm.CurrentState.Frames[0].Locals
+	}
+	return &vm.CurrentState.Locals
+}
+
+// stackBase is where the stack of the running function starts, values below
+// it belong to its callers
+func (vm *VM) stackBase() int {
+	if len(vm.CurrentState.Frames) == 0 {
+		return 0
+	}
+	return vm.CurrentState.Frames[len(vm.CurrentState.Frames)-1].StackBase
+}
+
+func (vm *VM) executePushFn() error {
+	if vm.CurrentState.PC+2 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	addr := (int(vm.Bytecode[vm.CurrentState.PC]) << 8) | int(vm.Bytecode[vm.CurrentState.PC+1])
+	arity := int(vm.Bytecode[vm.CurrentState.PC+2])
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, FunctionValue{Addr: addr, Arity: arity})
+	vm.CurrentState.PC += 3
+	return nil
+}
+
+func (vm *VM) executeCallValue() error {
+	if vm.CurrentState.PC >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	numArgs := int(vm.Bytecode[vm.CurrentState.PC])
+	if len(vm.CurrentState.Stack) < numArgs+1 {
+		return fmt.Errorf("stack underflow while getting function arguments")
+	}
+	base := len(vm.CurrentState.Stack) - numArgs - 1
+	fn, ok := vm.CurrentState.Stack[base].(FunctionValue)
+	if !ok {
+		return runtimeError(ErrNotFunction)
+	}
+	if fn.Arity != numArgs {
+		return runtimeError(ErrArity, fn.Arity, numArgs)
+	}
+	if len(vm.CurrentState.Frames) >= vm.maxStack {
+		return runtimeError(ErrStackOverflow, vm.maxStack)
+	}
+
+	// The arguments become the first locals of the new frame
+	locals := make([]Value, numArgs)
+	copy(locals, vm.CurrentState.Stack[base+1:])
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:base]
+
+	vm.CurrentState.Frames = append(vm.CurrentState.Frames, Frame{
+		ReturnPC:  vm.CurrentState.PC + 1,
+		Locals:    vm.CurrentState.Locals,
+		StackBase: base,
+		Defers:    vm.CurrentState.Defers,
+		Resume:    vm.CurrentState.Resume,
+	})
+	vm.CurrentState.Locals = locals
+	vm.CurrentState.Defers, vm.CurrentState.Resume = nil, 0
+	vm.CurrentState.PC = fn.Addr
+	return nil
+}
+
+func (vm *VM) executeRet() error {
+	if len(vm.CurrentState.Frames) == 0 {
+		return fmt.Errorf("return outside of a function")
+	}
+	// The function's cleanups run first, each comes back here when done
+	if len(vm.CurrentState.Defers) > 0 {
+		vm.CurrentState.Resume = vm.CurrentState.PC - 1
+		vm.runNextDefer()
+		return nil
+	}
+	frame := vm.CurrentState.Frames[len(vm.CurrentState.Frames)-1]
+	vm.CurrentState.Frames = vm.CurrentState.Frames[:len(vm.CurrentState.Frames)-1]
+
+	var result Value = NilValue{}
+	if len(vm.CurrentState.Stack) > frame.StackBase {
+		result = vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	}
+	// Anything else the function left behind goes away with the frame
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack[:frame.StackBase], result)
+	vm.CurrentState.Locals = frame.Locals
+	vm.CurrentState.Defers, vm.CurrentState.Resume = frame.Defers, frame.Resume
+	vm.CurrentState.PC = frame.ReturnPC
+	if frame.Halt {
+		return vm.executeHalt()
+	}
+	return nil
+}
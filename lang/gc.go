@@ -0,0 +1,234 @@
+package lang
+
+// The collector reclaims the strings, arrays, bytes and iterators nothing
+// refers to any more. Handles are indices into the tables, so it compacts
+// them and renumbers every handle it finds in the state. It runs before an
+// instruction once the tables have grown past the threshold, what's left
+// after a collection sets the next one off at twice that. The trigger lives
+// in the state, replaying the history collects at the same steps and the
+// tables line up with what was recorded
+
+// DefaultGCThreshold is how many table entries a program makes before the
+// first collection
+const DefaultGCThreshold = 4096
+
+// GCStats is what the collector did so far, for the debugger
+type GCStats struct {
+	Collections int
+	// Freed counts the entries reclaimed over all collections
+	Freed HeapCounts
+	// Live is what was left after the last collection
+	Live HeapCounts
+}
+
+// HeapCounts is a number of entries in each of the state's tables
+type HeapCounts struct {
+	Strings, Arrays, Bytes, Iterators int
+}
+
+func (c HeapCounts) total() int {
+	return c.Strings + c.Arrays + c.Bytes + c.Iterators
+}
+
+func countHeap(s *VMState) HeapCounts {
+	return HeapCounts{len(s.Strings), len(s.Arrays), len(s.Bytes), len(s.Iterators)}
+}
+
+// SetGCThreshold sets how many table entries there can be before the
+// first collection, 0 turns the collector off
+func (vm *VM) SetGCThreshold(entries int) {
+	vm.gcThreshold = max(0, entries)
+}
+
+// GCStats is what the collector did so far, collections redone while
+// stepping back through the history aren't counted again
+func (vm *VM) GCStats() GCStats {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	return vm.gcStats
+}
+
+// maybeCollect runs a collection once the tables have grown enough
+func (vm *VM) maybeCollect() {
+	if vm.gcThreshold == 0 {
+		return
+	}
+	s := vm.CurrentState
+	if countHeap(s).total() < max(s.NextGC, vm.gcThreshold) {
+		return
+	}
+	before := countHeap(s)
+	vm.collect()
+	after := countHeap(s)
+	s.NextGC = 2 * after.total()
+	// The estimate the memory limit keeps is for the tables as they were
+	vm.heap = heapUsage{}
+
+	if vm.history != nil && vm.history.replaying {
+		return
+	}
+	vm.mu.Lock()
+	vm.gcStats.Collections++
+	vm.gcStats.Freed.Strings += before.Strings - after.Strings
+	vm.gcStats.Freed.Arrays += before.Arrays - after.Arrays
+	vm.gcStats.Freed.Bytes += before.Bytes - after.Bytes
+	vm.gcStats.Freed.Iterators += before.Iterators - after.Iterators
+	vm.gcStats.Live = after
+	vm.mu.Unlock()
+}
+
+// gcMark is what a collection found reachable, by old index
+type gcMark struct {
+	strings, arrays, bytes, iterators []bool
+	// pending are arrays and iterators marked but not looked into yet
+	pending []Value
+}
+
+func (m *gcMark) value(v Value) {
+	switch v := v.(type) {
+	case StringValue:
+		m.strings[v.Index] = true
+	case BytesValue:
+		m.bytes[v.Index] = true
+	case ArrayValue:
+		if !m.arrays[v.Index] {
+			m.arrays[v.Index] = true
+			m.pending = append(m.pending, v)
+		}
+	case IteratorValue:
+		if !m.iterators[v.Index] {
+			m.iterators[v.Index] = true
+			m.pending = append(m.pending, v)
+		}
+	}
+}
+
+func (m *gcMark) values(vs []Value) {
+	for _, v := range vs {
+		m.value(v)
+	}
+}
+
+// gcRemap is where every kept entry moved to, -1 for the ones reclaimed
+type gcRemap struct {
+	strings, arrays, bytes, iterators []int
+}
+
+// compact keeps the marked entries in order and numbers them from 0
+func compact(marked []bool) []int {
+	moved, next := make([]int, len(marked)), 0
+	for i, live := range marked {
+		moved[i] = -1
+		if live {
+			moved[i] = next
+			next++
+		}
+	}
+	return moved
+}
+
+func (r *gcRemap) value(v Value) Value {
+	switch v := v.(type) {
+	case StringValue:
+		v.Index = r.strings[v.Index]
+		return v
+	case BytesValue:
+		return BytesValue{Index: r.bytes[v.Index]}
+	case ArrayValue:
+		return ArrayValue{Index: r.arrays[v.Index]}
+	case IteratorValue:
+		return IteratorValue{Index: r.iterators[v.Index]}
+	}
+	return v
+}
+
+// values renumbers into a new slice, the old one may be shared with a
+// snapshot
+func (r *gcRemap) values(vs []Value) []Value {
+	if vs == nil {
+		return nil
+	}
+	out := make([]Value, len(vs), cap(vs))
+	for i, v := range vs {
+		out[i] = r.value(v)
+	}
+	return out
+}
+
+// collect marks from the stack, the locals of every frame and the globals,
+// then compacts the tables. The strings the program was compiled with are
+// always kept, the bytecode refers to them by index
+func (vm *VM) collect() {
+	s := vm.CurrentState
+	m := &gcMark{
+		strings:   make([]bool, len(s.Strings)),
+		arrays:    make([]bool, len(s.Arrays)),
+		bytes:     make([]bool, len(s.Bytes)),
+		iterators: make([]bool, len(s.Iterators)),
+	}
+	for i := 0; i < vm.pinnedStrings && i < len(m.strings); i++ {
+		m.strings[i] = true
+	}
+	m.values(s.Stack)
+	m.values(s.Locals)
+	m.values(s.Globals)
+	for _, frame := range s.Frames {
+		m.values(frame.Locals)
+	}
+	for len(m.pending) > 0 {
+		v := m.pending[len(m.pending)-1]
+		m.pending = m.pending[:len(m.pending)-1]
+		switch v := v.(type) {
+		case ArrayValue:
+			m.values(s.Arrays[v.Index])
+		case IteratorValue:
+			m.value(s.Iterators[v.Index].Target)
+		}
+	}
+
+	r := &gcRemap{
+		strings:   compact(m.strings),
+		arrays:    compact(m.arrays),
+		bytes:     compact(m.bytes),
+		iterators: compact(m.iterators),
+	}
+
+	strings := make([]string, 0, len(s.Strings))
+	for i, str := range s.Strings {
+		if m.strings[i] {
+			strings = append(strings, str)
+		}
+	}
+	bytes := make([][]byte, 0, len(s.Bytes))
+	for i, data := range s.Bytes {
+		if m.bytes[i] {
+			bytes = append(bytes, data)
+		}
+	}
+	iterators := make([]Iterator, 0, len(s.Iterators))
+	for i, it := range s.Iterators {
+		if m.iterators[i] {
+			iterators = append(iterators, Iterator{Target: r.value(it.Target), Pos: it.Pos})
+		}
+	}
+	// Arrays are rebuilt and owned by this state again, whatever shared
+	// them keeps the old ones
+	arrays := make([][]Value, 0, len(s.Arrays))
+	for i, elems := range s.Arrays {
+		if m.arrays[i] {
+			arrays = append(arrays, r.values(elems))
+		}
+	}
+	s.Strings, s.Bytes, s.Iterators, s.Arrays = strings, bytes, iterators, arrays
+	s.owned = make([]bool, len(arrays))
+	for i := range s.owned {
+		s.owned[i] = true
+	}
+
+	s.Stack = r.values(s.Stack)
+	s.Locals = r.values(s.Locals)
+	s.Globals = r.values(s.Globals)
+	for i := range s.Frames {
+		s.Frames[i].Locals = r.values(s.Frames[i].Locals)
+	}
+}
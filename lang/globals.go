@@ -0,0 +1,48 @@
+package lang
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// declareGlobals gives every name declared with global its slot before
+// anything is compiled, wherever the declaration is
+func (c *Compiler) declareGlobals(program *Program) error {
+	declared := make(map[string]lexer.Position)
+	var err error
+	visitor{stmt: func(stmt *Statement, _ *FnLit) {
+		decl := stmt.GlobalDecl
+		if decl == nil || err != nil {
+			return
+		}
+		if prev, ok := declared[decl.Name]; ok {
+			err = fmt.Errorf("%s: global %s is already declared at %s", decl.Pos, decl.Name, prev)
+			return
+		}
+		declared[decl.Name] = decl.Pos
+		c.globals[decl.Name] = len(c.globals)
+	}}.statements(program.Statements, nil)
+	return err
+}
+
+// compileGlobalDecl stores the initial value of a global, a variable of the
+// current scope can't share its name
+func (c *Compiler) compileGlobalDecl(decl *GlobalDecl) error {
+	if _, ok := c.vars[decl.Name]; ok {
+		return fmt.Errorf("%s: %s is already a variable of this scope, it can't be declared global", decl.Pos, decl.Name)
+	}
+	if len(c.globals) >= maxIndices {
+		return fmt.Errorf("%s: too many globals", decl.Pos)
+	}
+	c.registerLine(decl.Pos)
+	if err := c.compileExpr(decl.Expr); err != nil {
+		return err
+	}
+	return c.emitVar(InstrStore, decl.Pos, decl.Name)
+}
+
+// Globals are the names declared with global by their slots
+func (c *Compiler) Globals() map[string]int {
+	return c.globals
+}
@@ -0,0 +1,111 @@
+package lang
+
+import (
+	"fmt"
+	"slices"
+)
+
+// The heap is the state's tables of composite values. The stack, locals and
+// other objects only ever hold a handle into them, an ArrayValue is the
+// index of its elements in Arrays. Snapshots share what's on the heap, an
+// array is only copied when it's written to while another state can still
+// see it
+
+// ObjectKind is what ALLOC builds, the operand it's encoded in
+type ObjectKind byte
+
+const (
+	ObjectArray ObjectKind = iota
+)
+
+var objectKindNames = map[ObjectKind]string{
+	ObjectArray: "array",
+}
+
+func (k ObjectKind) String() string {
+	if name, ok := objectKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind(%d)", k)
+}
+
+// maxAllocCount is how many values the 2 byte count of ALLOC can take
+const maxAllocCount = 1<<16 - 1
+
+// allocArray puts elems on the heap, the caller hands them over and must
+// not keep using the slice
+func (vm *VM) allocArray(elems []Value) ArrayValue {
+	state := vm.CurrentState
+	state.Arrays = append(state.Arrays, elems)
+	state.ownArray(len(state.Arrays) - 1)
+	return ArrayValue{Index: len(state.Arrays) - 1}
+}
+
+// ownArray marks array i as belonging to this state alone
+func (s *VMState) ownArray(i int) {
+	if i >= len(s.owned) {
+		s.owned = append(s.owned, make([]bool, i+1-len(s.owned))...)
+	}
+	s.owned[i] = true
+}
+
+// disownArray marks array i as shared, it's copied before the next write
+func (s *VMState) disownArray(i int) {
+	if i < len(s.owned) {
+		s.owned[i] = false
+	}
+}
+
+// snapshot is a copy of s that keeps sharing its arrays, s copies one
+// before it writes to it again. Clone leaves s alone, a copy that s goes on
+// running from needs this instead
+func (s *VMState) snapshot() *VMState {
+	copied := s.Clone()
+	s.owned = nil
+	return copied
+}
+
+// writableArray is the elements of array i for writing, they're copied
+// first when a snapshot may still share them
+func (s *VMState) writableArray(i int) []Value {
+	if i >= len(s.owned) || !s.owned[i] {
+		s.Arrays[i] = slices.Clone(s.Arrays[i])
+		s.ownArray(i)
+	}
+	return s.Arrays[i]
+}
+
+// emitArray builds an array out of the count values the elements were
+// compiled to, NEW_ARRAY takes up to 255 and ALLOC the rest
+func (c *Compiler) emitArray(count int) error {
+	if count <= 0xff {
+		c.emit(InstrNewArray, byte(count))
+		return nil
+	}
+	if count > maxAllocCount {
+		return fmt.Errorf("array literal has %d elements, at most %d are allowed", count, maxAllocCount)
+	}
+	c.emit(InstrAlloc, byte(ObjectArray), byte(count>>8), byte(count&0xff))
+	return nil
+}
+
+func (vm *VM) executeAlloc() error {
+	if vm.CurrentState.PC+2 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	kind := ObjectKind(vm.Bytecode[vm.CurrentState.PC])
+	vm.CurrentState.PC++
+	count := vm.index()
+	vm.CurrentState.PC += 2
+	if len(vm.CurrentState.Stack) < count {
+		return fmt.Errorf("stack underflow")
+	}
+	switch kind {
+	case ObjectArray:
+		elems := slices.Clone(vm.CurrentState.Stack[len(vm.CurrentState.Stack)-count:])
+		vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-count]
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, vm.allocArray(elems))
+		return nil
+	}
+	return fmt.Errorf("cannot allocate a %s", kind)
+}
@@ -0,0 +1,245 @@
+package lang
+
+import (
+	"fmt"
+	"slices"
+)
+
+// DefaultKeyframeInterval is how many instructions apart full snapshots of
+// the VM state are taken for stepping back
+const DefaultKeyframeInterval = 100
+
+// DefaultHistoryLimit is how many steps the debugger keeps, the oldest are
+// forgotten past it
+const DefaultHistoryLimit = 4_000_000
+
+// history lets the debugger step back without a snapshot per instruction.
+// It keeps a snapshot every interval steps, the PC of every step and what
+// every builtin call returned. A state in between is rebuilt by replaying
+// from the keyframe before it, with builtins answered from the log so
+// nothing is printed or prompted twice
+type history struct {
+	interval  int
+	limit     int
+	keyframes []keyframe
+	pcs       []int
+	calls     map[int]callRecord
+	// step is the instruction being executed, counted from the start
+	step      int
+	replaying bool
+	// tail is set outside of the debugger, only the last steps are kept
+	tail bool
+}
+
+// keyframe is the state before step was executed
+type keyframe struct {
+	step  int
+	state *VMState
+}
+
+// callRecord is what a builtin call returned and the strings, bytes and
+// arrays it added to the tables, replaying adds them again so indices line up
+type callRecord struct {
+	result  Value
+	strings []string
+	bytes   [][]byte
+	arrays  [][]Value
+}
+
+func newHistory(interval int) *history {
+	return &history{interval: interval, limit: DefaultHistoryLimit, calls: make(map[int]callRecord)}
+}
+
+// SetKeyframeInterval sets how many instructions apart the debugger takes
+// full snapshots, lower is faster to step back and uses more memory
+func (vm *VM) SetKeyframeInterval(steps int) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.history.interval = max(1, steps)
+}
+
+// SetHistoryLimit sets how many steps the debugger keeps to step back
+// through, the oldest are forgotten once there are more. 0 keeps them all
+func (vm *VM) SetHistoryLimit(steps int) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.history.limit = max(0, steps)
+}
+
+// ResetHistory forgets every recorded step, for when execution starts over
+func (vm *VM) ResetHistory() {
+	h := newHistory(vm.history.interval)
+	h.limit = vm.history.limit
+	vm.history = h
+}
+
+// recordStep is called before each instruction the debugger executes, or
+// every instruction while keeping a tail
+func (vm *VM) recordStep() {
+	h := vm.history
+	h.step = len(h.pcs)
+	if h.step%h.interval == 0 {
+		h.keyframes = append(h.keyframes, keyframe{step: h.step, state: vm.CurrentState.snapshot()})
+		h.trim()
+	}
+	h.pcs = append(h.pcs, vm.CurrentState.PC)
+}
+
+// callBuiltin runs a builtin, logging the call while recording and
+// answering it from the log while replaying
+func (vm *VM) callBuiltin(fn GoFunction, args []Value) Value {
+	h := vm.history
+	if h == nil {
+		return fn(args)
+	}
+	if h.replaying {
+		call := h.calls[h.step]
+		vm.CurrentState.Strings = append(vm.CurrentState.Strings, call.strings...)
+		vm.CurrentState.Bytes = append(vm.CurrentState.Bytes, call.bytes...)
+		// Shared with the log, they're copied if the replay writes to them
+		vm.CurrentState.Arrays = append(vm.CurrentState.Arrays, call.arrays...)
+		return call.result
+	}
+
+	strings, bytes, arrays := len(vm.CurrentState.Strings), len(vm.CurrentState.Bytes), len(vm.CurrentState.Arrays)
+	result := fn(args)
+	call := callRecord{
+		result:  result,
+		strings: slices.Clone(vm.CurrentState.Strings[strings:]),
+		bytes:   slices.Clone(vm.CurrentState.Bytes[bytes:]),
+		arrays:  slices.Clone(vm.CurrentState.Arrays[arrays:]),
+	}
+	for i := arrays; i < len(vm.CurrentState.Arrays); i++ {
+		vm.CurrentState.disownArray(i)
+	}
+	h.calls[h.step] = call
+	return result
+}
+
+// keyframeBefore finds the last keyframe at or before step
+func (h *history) keyframeBefore(step int) int {
+	i, found := slices.BinarySearchFunc(h.keyframes, step, func(k keyframe, step int) int {
+		return k.step - step
+	})
+	if !found {
+		i--
+	}
+	return i
+}
+
+// replay rebuilds the states from the keyframe before from up to the one
+// before step to, handing the ones from from on to visit. The VM is left as
+// it was, the state before step to is returned
+func (vm *VM) replay(from, to int, visit func(step int, state *VMState)) *VMState {
+	h := vm.history
+	start := h.keyframes[h.keyframeBefore(from)]
+
+	saved, running, executed, heap, step := vm.CurrentState, vm.running, vm.executed, vm.heap, h.step
+	vm.CurrentState = start.state.Clone()
+	h.replaying = true
+	for h.step = start.step; ; h.step++ {
+		if visit != nil && h.step >= from {
+			vm.CurrentState.SourceLine = vm.lineForPC(vm.CurrentState.PC)
+			visit(h.step, vm.CurrentState)
+		}
+		if h.step == to {
+			break
+		}
+		// Replaying what already ran once, it can't fail differently
+		_ = vm.executeInstruction()
+	}
+	h.replaying = false
+
+	state := vm.CurrentState
+	state.SourceLine = vm.lineForPC(state.PC)
+	vm.CurrentState, vm.running, vm.executed, vm.heap, h.step = saved, running, executed, heap, step
+	return state
+}
+
+// rewindTo rebuilds the state from before step and forgets everything
+// recorded after it
+func (vm *VM) rewindTo(step int) {
+	h := vm.history
+	vm.CurrentState = vm.replay(step, step, nil)
+
+	i := h.keyframeBefore(step)
+	if h.keyframes[i].step == step {
+		// Recording the step again takes this keyframe again
+		i--
+	}
+	h.keyframes = h.keyframes[:i+1]
+	h.pcs = h.pcs[:step]
+	for s := range h.calls {
+		if s >= step {
+			delete(h.calls, s)
+		}
+	}
+}
+
+// StepCount is how many instructions the debugger has recorded, the
+// current state is the one before step StepCount
+func (vm *VM) StepCount() int {
+	if vm.history == nil {
+		return 0
+	}
+	return vm.history.steps()
+}
+
+// StateAt rebuilds the state from before the given step was executed, only
+// call it while the VM is paused
+func (vm *VM) StateAt(step int) (*VMState, error) {
+	if err := vm.checkStep(step); err != nil {
+		return nil, err
+	}
+	if step == vm.history.steps() {
+		return vm.CurrentState.snapshot(), nil
+	}
+	return vm.replay(step, step, nil), nil
+}
+
+// ReplayRange calls fn with the state before every step from from to to,
+// both included. The states are copies fn may keep, only call it while the
+// VM is paused
+func (vm *VM) ReplayRange(from, to int, fn func(step int, state *VMState)) error {
+	if err := vm.checkStep(from); err != nil {
+		return err
+	}
+	if err := vm.checkStep(to); err != nil {
+		return err
+	}
+	if from > to {
+		return fmt.Errorf("replay range %d..%d is backwards", from, to)
+	}
+	vm.replay(from, to, func(step int, state *VMState) {
+		fn(step, state.snapshot())
+	})
+	return nil
+}
+
+// Rewind moves the debugger back to before the given step, the steps after
+// it are forgotten and run again when execution continues. Only call it
+// while the VM is paused
+func (vm *VM) Rewind(step int) error {
+	if err := vm.checkStep(step); err != nil {
+		return err
+	}
+	if step < vm.history.steps() {
+		vm.rewindTo(step)
+	}
+	return nil
+}
+
+func (vm *VM) checkStep(step int) error {
+	if vm.history == nil {
+		return fmt.Errorf("no history is recorded outside of the debugger")
+	}
+	if step < 0 || step > vm.history.steps() {
+		return fmt.Errorf("step %d is out of range 0..%d", step, vm.history.steps())
+	}
+	return nil
+}
+
+// steps is how many instructions have been recorded
+func (h *history) steps() int {
+	return len(h.pcs)
+}
@@ -0,0 +1,152 @@
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// historySource calls builtins that add strings and arrays to the tables,
+// and writes to an array one of them returned
+const historySource = `var words = split("a b c", " ")
+var s = ""
+for i = 1 to 6 do
+	s = format("%s-%d", upper(words[i % 3]), i)
+	words[0] = s
+end
+print(s, "\n")
+`
+
+// recordLive runs vm to the end the way the debugger's continue does, and
+// returns a copy of the state before every step
+func recordLive(t *testing.T, vm *VM) []*VMState {
+	t.Helper()
+	var live []*VMState
+	for vm.CurrentState.PC < len(vm.Bytecode) {
+		vm.recordStep()
+		live = append(live, vm.CurrentState.snapshot())
+		if err := vm.executeInstruction(); err != nil {
+			t.Fatalf("step %d: %v", len(live)-1, err)
+		}
+	}
+	return live
+}
+
+// stateSummary is what a step's state holds, tables included, written out
+// so two states can be compared
+func stateSummary(s *VMState) string {
+	var b strings.Builder
+	values := func(name string, vs []Value) {
+		fmt.Fprintf(&b, "%s:", name)
+		for _, v := range vs {
+			fmt.Fprintf(&b, " %s", s.FormatValue(v))
+		}
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "pc: %d\n", s.PC)
+	values("stack", s.Stack)
+	values("locals", s.Locals)
+	values("globals", s.Globals)
+	for i, frame := range s.Frames {
+		values(fmt.Sprintf("frame %d", i), frame.Locals)
+	}
+	fmt.Fprintf(&b, "strings: %q\n", s.Strings)
+	for i := range s.Arrays {
+		fmt.Fprintf(&b, "array %d: %s\n", i, s.FormatValue(ArrayValue{Index: i}))
+	}
+	return b.String()
+}
+
+func historyVM(t *testing.T) (*VM, *bytes.Buffer) {
+	t.Helper()
+	vm := debugVM(t, historySource)
+	var out bytes.Buffer
+	vm.SetOutput(&out)
+	// Small enough that the steps cross several keyframes and collections
+	vm.SetKeyframeInterval(7)
+	vm.SetGCThreshold(16)
+	return vm, &out
+}
+
+func TestStateAtMatchesLive(t *testing.T) {
+	vm, out := historyVM(t)
+	live := recordLive(t, vm)
+	if vm.GCStats().Collections == 0 {
+		t.Fatal("the program never collected")
+	}
+	if got := vm.StepCount(); got != len(live) {
+		t.Fatalf("StepCount is %d, %d steps ran", got, len(live))
+	}
+
+	for step, want := range live {
+		state, err := vm.StateAt(step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stateSummary(state); got != stateSummary(want) {
+			t.Fatalf("state at step %d\n--- got\n%s--- want\n%s", step, got, stateSummary(want))
+		}
+	}
+	if _, err := vm.StateAt(len(live) + 1); err == nil {
+		t.Error("StateAt past the last step didn't fail")
+	}
+	if got := out.String(); got != "C-5-6\n" {
+		t.Errorf("printed %q, replaying must not print again", got)
+	}
+}
+
+func TestReplayRangeMatchesLive(t *testing.T) {
+	vm, _ := historyVM(t)
+	live := recordLive(t, vm)
+
+	from, to := 5, len(live)-5
+	next := from
+	err := vm.ReplayRange(from, to, func(step int, state *VMState) {
+		if step != next {
+			t.Fatalf("replayed step %d, want %d", step, next)
+		}
+		next++
+		if got, want := stateSummary(state), stateSummary(live[step]); got != want {
+			t.Fatalf("state at step %d\n--- got\n%s--- want\n%s", step, got, want)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != to+1 {
+		t.Errorf("replay stopped before step %d, want to go through %d", next, to)
+	}
+	if err := vm.ReplayRange(to, from, func(int, *VMState) {}); err == nil {
+		t.Error("a backwards range was replayed")
+	}
+}
+
+func TestRewindRunsAgain(t *testing.T) {
+	vm, out := historyVM(t)
+	live := recordLive(t, vm)
+	final := stateSummary(vm.CurrentState)
+
+	step := len(live) / 2
+	if err := vm.Rewind(step); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.StepCount(); got != step {
+		t.Fatalf("StepCount after rewinding to %d is %d", step, got)
+	}
+	if got, want := stateSummary(vm.CurrentState), stateSummary(live[step]); got != want {
+		t.Fatalf("state after rewinding to %d\n--- got\n%s--- want\n%s", step, got, want)
+	}
+
+	again := recordLive(t, vm)
+	if len(again) != len(live)-step {
+		t.Errorf("ran %d steps after rewinding, want %d", len(again), len(live)-step)
+	}
+	if got := stateSummary(vm.CurrentState); got != final {
+		t.Errorf("final state after running again\n--- got\n%s--- want\n%s", got, final)
+	}
+	// The print is past the rewind, it runs a second time
+	if got := out.String(); got != "C-5-6\nC-5-6\n" {
+		t.Errorf("printed %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package lang
+
+// Interrupt asks the program to stop at the next instruction with status,
+// 128 plus the signal's number for a signal the host caught. The handler
+// the program registered with on_interrupt runs first, then its deferred
+// blocks as they would on exit. It's safe to call from any goroutine and
+// returns false when there's no handler or one is already on its way, the
+// host should stop the process itself then
+func (vm *VM) Interrupt(status int) bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.onInterrupt == nil {
+		return false
+	}
+	return vm.interrupted.CompareAndSwap(0, int32(status))
+}
+
+// takeInterrupt calls the handler for an interrupt the host asked for, the
+// instruction at the PC doesn't run. Its frame halts the program once it
+// returns
+func (vm *VM) takeInterrupt() error {
+	// Taking the handler lets the next interrupt through to the host
+	vm.mu.Lock()
+	vm.exitCode = int(vm.interrupted.Swap(0))
+	handler := vm.onInterrupt
+	vm.onInterrupt = nil
+	vm.mu.Unlock()
+
+	vm.CurrentState.Frames = append(vm.CurrentState.Frames, Frame{
+		ReturnPC:  vm.CurrentState.PC,
+		Locals:    vm.CurrentState.Locals,
+		StackBase: len(vm.CurrentState.Stack),
+		Defers:    vm.CurrentState.Defers,
+		Resume:    vm.CurrentState.Resume,
+		Halt:      true,
+	})
+	vm.CurrentState.Locals = nil
+	vm.CurrentState.Defers, vm.CurrentState.Resume = nil, 0
+	vm.CurrentState.PC = handler.Addr
+	return nil
+}
+
+// registerInterruptHandler is on_interrupt, a handler takes no arguments
+func (vm *VM) registerInterruptHandler(args []Value) Value {
+	fn, ok := args[0].(FunctionValue)
+	if !ok || fn.Arity != 0 {
+		return NilValue{}
+	}
+	vm.mu.Lock()
+	vm.onInterrupt = &fn
+	vm.mu.Unlock()
+	return NilValue{}
+}
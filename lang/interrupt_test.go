@@ -0,0 +1,68 @@
+package lang
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const interruptSource = `defer print("top cleanup\n") end
+on_interrupt(fn() do
+	print("handler\n")
+end)
+operation work do
+	defer print("work cleanup\n") end
+	var i = 0
+	while true do
+		i = i + 1
+	end
+end
+`
+
+func TestInterruptRunsHandler(t *testing.T) {
+	modules, err := CompileBatch(map[string]string{"loop": interruptSource}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := modules["loop"].NewVM(false)
+	var out bytes.Buffer
+	vm.SetOutput(&out)
+	vm.Run()
+
+	// Refused until the program gets to on_interrupt
+	deadline := time.Now().Add(5 * time.Second)
+	for !vm.Interrupt(130) {
+		if time.Now().After(deadline) {
+			t.Fatal("the handler was never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-vm.StateChan
+	if err := vm.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "handler\nwork cleanup\ntop cleanup\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+	if code := vm.ExitCode(); code != 130 {
+		t.Errorf("exit code %d, want 130", code)
+	}
+	if vm.Interrupt(130) {
+		t.Error("a second interrupt was taken by the handler that already ran")
+	}
+}
+
+func TestInterruptWithoutHandler(t *testing.T) {
+	modules, err := CompileBatch(map[string]string{"plain": `on_interrupt(1)
+print("done\n")`}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, out := runModule(t, modules["plain"])
+	if out != "done\n" {
+		t.Errorf("printed %q", out)
+	}
+	if vm.Interrupt(130) {
+		t.Error("an interrupt was taken without a handler")
+	}
+}
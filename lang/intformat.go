@@ -0,0 +1,111 @@
+package lang
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// IntFormat is the base integers are displayed in
+type IntFormat int
+
+const (
+	IntFormatDec IntFormat = iota
+	IntFormatHex
+	IntFormatBin
+)
+
+var intFormatNames = map[string]IntFormat{
+	"dec": IntFormatDec,
+	"hex": IntFormatHex,
+	"bin": IntFormatBin,
+}
+
+// ParseIntFormat reads an integer format by its name, dec, hex or bin
+func ParseIntFormat(name string) (IntFormat, bool) {
+	f, ok := intFormatNames[name]
+	return f, ok
+}
+
+// format writes n in the base, with a 0x or 0b prefix after the sign so it
+// reads back as a literal
+func (f IntFormat) format(n *big.Int) string {
+	sign, abs := "", n
+	if n.Sign() < 0 {
+		sign, abs = "-", new(big.Int).Neg(n)
+	}
+	switch f {
+	case IntFormatHex:
+		return sign + "0x" + abs.Text(16)
+	case IntFormatBin:
+		return sign + "0b" + abs.Text(2)
+	}
+	return n.String()
+}
+
+// formatString fills in the verbs of template with args, the way the
+// format builtin does it:
+//
+//	%d %x %b %o  an integer in base 10, 16, 2 or 8, %x also takes bytes
+//	%s           a value the way print writes it
+//	%v           a value the way the debugger shows it
+//	%%           a percent sign
+//
+// The result is secret when a secret string went into it
+func (vm *VM) formatString(template string, args []Value) (string, bool, error) {
+	var out strings.Builder
+	secret := false
+	next := 0
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			out.WriteByte(template[i])
+			continue
+		}
+		i++
+		if i == len(template) {
+			return "", false, fmt.Errorf("format ends in a lone %%")
+		}
+		verb := template[i]
+		if verb == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if next == len(args) {
+			return "", false, fmt.Errorf("missing argument for %%%c", verb)
+		}
+		arg := args[next]
+		next++
+		if s, ok := arg.(StringValue); ok && s.Secret {
+			secret = true
+		}
+
+		switch verb {
+		case 's':
+			out.WriteString(vm.displayString(arg))
+		case 'v':
+			out.WriteString(vm.formatted(arg))
+		case 'd', 'x', 'b', 'o':
+			if b, ok := arg.(BytesValue); ok && verb == 'x' {
+				out.WriteString(hex.EncodeToString(vm.CurrentState.Bytes[b.Index]))
+				continue
+			}
+			var n *big.Int
+			switch v := intCompat(arg).(type) {
+			case IntValue:
+				n = big.NewInt(int64(v))
+			case BigValue:
+				n = v.N
+			default:
+				return "", false, fmt.Errorf("%%%c needs an integer, got %s", verb, typeNames[arg.Type()])
+			}
+			out.WriteString(n.Text(map[byte]int{'d': 10, 'x': 16, 'b': 2, 'o': 8}[verb]))
+		default:
+			return "", false, fmt.Errorf("unknown format verb %%%c", verb)
+		}
+	}
+	if next < len(args) {
+		return "", false, fmt.Errorf("%d arguments left over", len(args)-next)
+	}
+	return out.String(), secret, nil
+}
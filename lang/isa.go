@@ -0,0 +1,422 @@
+package lang
+
+// Operand describes one fixed width operand that follows an opcode
+type Operand struct {
+	Name  string
+	Width int // in bytes, 2 byte operands are big endian
+}
+
+// InstrInfo is the metadata for a single instruction, it's the source of
+// truth for instruction names, operand layout and documentation
+type InstrInfo struct {
+	Name     string
+	Operands []Operand
+	// Variable is set for instructions with trailing data beyond their
+	// fixed operands, like the address table of JMP_TABLE
+	Variable    bool
+	StackEffect string
+	Description string
+	Example     string
+}
+
+// Size is the encoded size of the instruction including its opcode, not
+// counting any variable length trailing data
+func (info InstrInfo) Size() int {
+	size := 1
+	for _, op := range info.Operands {
+		size += op.Width
+	}
+	return size
+}
+
+var instrTable = map[Instr]InstrInfo{
+	InstrPush: {
+		Name:        "PUSH",
+		Operands:    []Operand{{"value", 1}},
+		StackEffect: "-- n",
+		Description: "Push an integer literal from 0 to 255",
+		Example:     "0000: PUSH         value: 42",
+	},
+	InstrPushStr: {
+		Name:        "PUSH_STR",
+		Operands:    []Operand{{"str", 2}},
+		StackEffect: "-- s",
+		Description: "Push a string from the string table",
+		Example:     `0000: PUSH_STR     string: "hello"    (str_0)`,
+	},
+	InstrPop: {
+		Name:        "POP",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "v --",
+		Description: "Pop the top of the stack into an existing variable",
+		Example:     "0000: POP          var: x    (var_0)",
+	},
+	InstrAdd: {
+		Name:        "ADD",
+		StackEffect: "a b -- a+b",
+		Description: "Add two integers or concatenate two strings",
+		Example:     "0000: ADD",
+	},
+	InstrSub: {
+		Name:        "SUB",
+		StackEffect: "a b -- a-b",
+		Description: "Subtract two integers",
+		Example:     "0000: SUB",
+	},
+	InstrMul: {
+		Name:        "MUL",
+		StackEffect: "a b -- a*b",
+		Description: "Multiply two integers",
+		Example:     "0000: MUL",
+	},
+	InstrDiv: {
+		Name:        "DIV",
+		StackEffect: "a b -- a/b",
+		Description: "Divide two integers, truncating toward zero, dividing by zero is a runtime error",
+		Example:     "0000: DIV",
+	},
+	InstrMod: {
+		Name:        "MOD",
+		StackEffect: "a b -- a%b",
+		Description: "Remainder of truncating division, it has the sign of a, b of zero is a runtime error",
+		Example:     "0000: MOD",
+	},
+	InstrEq: {
+		Name:        "EQ",
+		StackEffect: "a b -- a==b",
+		Description: "Compare two integers or two strings for equality, pushes true or false",
+		Example:     "0000: EQ",
+	},
+	InstrNeq: {
+		Name:        "NEQ",
+		StackEffect: "a b -- a!=b",
+		Description: "Compare two integers or two strings for inequality, pushes true or false",
+		Example:     "0000: NEQ",
+	},
+	InstrLt: {
+		Name:        "LT",
+		StackEffect: "a b -- a<b",
+		Description: "Integer less than, pushes true or false",
+		Example:     "0000: LT",
+	},
+	InstrGt: {
+		Name:        "GT",
+		StackEffect: "a b -- a>b",
+		Description: "Integer greater than, pushes true or false",
+		Example:     "0000: GT",
+	},
+	InstrLte: {
+		Name:        "LTE",
+		StackEffect: "a b -- a<=b",
+		Description: "Integer less than or equal, pushes true or false",
+		Example:     "0000: LTE",
+	},
+	InstrGte: {
+		Name:        "GTE",
+		StackEffect: "a b -- a>=b",
+		Description: "Integer greater than or equal, pushes true or false",
+		Example:     "0000: GTE",
+	},
+	InstrLoad: {
+		Name:        "LOAD",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "-- v",
+		Description: "Push the value of a variable of the current frame",
+		Example:     "0000: LOAD         var: x    (var_0)",
+	},
+	InstrStore: {
+		Name:        "STORE",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "v --",
+		Description: "Pop a value into a variable, creating it if needed",
+		Example:     "0000: STORE        var: x    (var_0)",
+	},
+	InstrJmp: {
+		Name:        "JMP",
+		Operands:    []Operand{{"addr", 2}},
+		StackEffect: "--",
+		Description: "Jump to an absolute address",
+		Example:     "0000: JMP          jump: 16",
+	},
+	InstrJmpIfZero: {
+		Name:        "JMP_IF_ZERO",
+		Operands:    []Operand{{"addr", 2}},
+		StackEffect: "c --",
+		Description: "Pop a condition and jump when it's false: 0, \"\" or nil",
+		Example:     "0000: JMP_IF_ZERO  jump: 16",
+	},
+	InstrCall: {
+		Name:        "CALL",
+		Operands:    []Operand{{"func", 2}, {"argc", 1}},
+		StackEffect: "args... -- result",
+		Description: "Call a function with argc arguments from the stack",
+		Example:     "0000: CALL         func: print    (func_0, args=2)",
+	},
+	InstrRet: {
+		Name:        "RET",
+		StackEffect: "result --",
+		Description: "Return from a function call, dropping its frame and pushing result for the caller. The function's deferred blocks run first",
+		Example:     "0000: RET",
+	},
+	InstrHalt: {
+		Name:        "HALT",
+		StackEffect: "--",
+		Description: "Stop the program, running any deferred blocks first",
+		Example:     "0000: HALT",
+	},
+	InstrNewArray: {
+		Name:        "NEW_ARRAY",
+		Operands:    []Operand{{"count", 1}},
+		StackEffect: "elems... -- array",
+		Description: "Build an array out of the top count values",
+		Example:     "0000: NEW_ARRAY    count: 3",
+	},
+	InstrIndexGet: {
+		Name:        "INDEX_GET",
+		StackEffect: "array i -- array[i]",
+		Description: "Read an array element or a byte",
+		Example:     "0000: INDEX_GET",
+	},
+	InstrIndexSet: {
+		Name:        "INDEX_SET",
+		StackEffect: "array i v --",
+		Description: "Write an array element",
+		Example:     "0000: INDEX_SET",
+	},
+	InstrDefer: {
+		Name:        "DEFER",
+		Operands:    []Operand{{"addr", 2}},
+		StackEffect: "--",
+		Description: "Register the block that follows as a cleanup of the current frame and jump past it to addr",
+		Example:     "0000: DEFER        jump: 12",
+	},
+	InstrEndDefer: {
+		Name:        "END_DEFER",
+		StackEffect: "--",
+		Description: "End of a deferred block, goes back to the RET or END_SCOPE it ran for or carries on stopping the program",
+		Example:     "0000: END_DEFER",
+	},
+	InstrIterNew: {
+		Name:        "ITER_NEW",
+		StackEffect: "collection -- iterator",
+		Description: "Start iterating over a collection",
+		Example:     "0000: ITER_NEW",
+	},
+	InstrIterNext: {
+		Name:        "ITER_NEXT",
+		Operands:    []Operand{{"addr", 2}},
+		StackEffect: "iterator -- elem",
+		Description: "Push the next element, or jump to addr when exhausted",
+		Example:     "0000: ITER_NEXT    jump: 30",
+	},
+	InstrJmpTable: {
+		Name:        "JMP_TABLE",
+		Operands:    []Operand{{"min", 2}, {"size", 2}, {"default", 2}},
+		Variable:    true,
+		StackEffect: "n --",
+		Description: "Jump through a table of size 2 byte addresses indexed by n-min, or to default",
+		Example:     "0000: JMP_TABLE    table: 1..3    (default 40)",
+	},
+	InstrPushNil: {
+		Name:        "PUSH_NIL",
+		StackEffect: "-- nil",
+		Description: "Push nil",
+		Example:     "0000: PUSH_NIL",
+	},
+	InstrPushBytes: {
+		Name:        "PUSH_BYTES",
+		Operands:    []Operand{{"str", 2}},
+		StackEffect: "-- bytes",
+		Description: "Push binary data stored in the string table",
+		Example:     `0000: PUSH_BYTES   string: "\x00\x01"    (str_0)`,
+	},
+	InstrSlice: {
+		Name:        "SLICE",
+		StackEffect: "target lo hi -- target[lo:hi]",
+		Description: "Copy part of bytes, a string or an array, nil bounds mean start and end",
+		Example:     "0000: SLICE",
+	},
+	InstrPushFn: {
+		Name:        "PUSH_FN",
+		Operands:    []Operand{{"addr", 2}, {"arity", 1}},
+		StackEffect: "-- fn",
+		Description: "Push a function whose code starts at addr",
+		Example:     "0000: PUSH_FN      addr: 3    (arity 1)",
+	},
+	InstrCallValue: {
+		Name:        "CALL_VALUE",
+		Operands:    []Operand{{"argc", 1}},
+		StackEffect: "fn args... -- result",
+		Description: "Call a function value in a new frame, the arguments become its first locals",
+		Example:     "0000: CALL_VALUE   args: 1",
+	},
+	InstrLoadGlobal: {
+		Name:        "LOAD_GLOBAL",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "-- v",
+		Description: "Push the value of a top level variable from inside a function",
+		Example:     "0000: LOAD_GLOBAL  var: x    (var_0)",
+	},
+	InstrStoreGlobal: {
+		Name:        "STORE_GLOBAL",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "v --",
+		Description: "Pop a value into a top level variable from inside a function",
+		Example:     "0000: STORE_GLOBAL var: x    (var_0)",
+	},
+	InstrTry: {
+		Name:        "TRY",
+		Operands:    []Operand{{"addr", 2}},
+		StackEffect: "--",
+		Description: "Enter a try block, a runtime error unwinds back here and jumps to the catch at addr with the message pushed",
+		Example:     "0000: TRY          jump: 12",
+	},
+	InstrEndTry: {
+		Name:        "END_TRY",
+		StackEffect: "--",
+		Description: "Leave the innermost try block without an error",
+		Example:     "0000: END_TRY",
+	},
+	InstrAssert: {
+		Name:        "ASSERT",
+		Operands:    []Operand{{"text", 2}},
+		StackEffect: "cond msg --",
+		Description: "Fail with the assertion text, message and locals when cond is false, msg may be nil",
+		Example:     `0000: ASSERT       string: "(n > 0)"    (str_2)`,
+	},
+	InstrDrop: {
+		Name:        "DROP",
+		StackEffect: "v --",
+		Description: "Throw away the top of the stack, like the result of a call made as a statement",
+		Example:     "0000: DROP",
+	},
+	InstrRange: {
+		Name:        "RANGE",
+		StackEffect: "from to -- range",
+		Description: "Make the range of integers from..to, both included",
+		Example:     "0000: RANGE",
+	},
+	InstrContains: {
+		Name:        "CONTAINS",
+		StackEffect: "x xs -- bool",
+		Description: "Push true if xs holds x: an element of an array or range, a substring of a string, a byte or run of bytes of bytes",
+		Example:     "0000: CONTAINS",
+	},
+	InstrLen: {
+		Name:        "LEN",
+		StackEffect: "v -- n",
+		Description: "Push the length of v: characters of a string, bytes of bytes, elements of an array or range",
+		Example:     "0000: LEN",
+	},
+	InstrToString: {
+		Name:        "TO_STRING",
+		StackEffect: "v -- s",
+		Description: "Convert v to a string the way the debugger shows it, bytes are decoded as UTF-8 and strings are left as is",
+		Example:     "0000: TO_STRING",
+	},
+	InstrExit: {
+		Name:        "EXIT",
+		StackEffect: "code --",
+		Description: "Halt the program with the exit status code, after running the deferred blocks",
+		Example:     "0000: EXIT",
+	},
+	InstrLoadShared: {
+		Name:        "LOAD_SHARED",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "-- v",
+		Description: "Push the value of a variable declared with global",
+		Example:     "0000: LOAD_SHARED  var: x    (var_0)",
+	},
+	InstrStoreShared: {
+		Name:        "STORE_SHARED",
+		Operands:    []Operand{{"var", 2}},
+		StackEffect: "v --",
+		Description: "Pop v into a variable declared with global",
+		Example:     "0000: STORE_SHARED var: x    (var_0)",
+	},
+	InstrPushConst: {
+		Name:        "PUSH_CONST",
+		Operands:    []Operand{{"const", 2}},
+		StackEffect: "-- n",
+		Description: "Push an integer literal from the constant pool, for the ones PUSH can't hold. The pool isn't written to the bytecode file, the VM is handed it in the compile session like the string table",
+		Example:     "0000: PUSH_CONST   value: 300    (const_0)",
+	},
+	InstrAlloc: {
+		Name:        "ALLOC",
+		Operands:    []Operand{{"kind", 1}, {"count", 2}},
+		StackEffect: "elems... -- ref",
+		Description: "Allocate a heap object of the given kind out of the top count values, arrays past NEW_ARRAY's 255",
+		Example:     "0000: ALLOC        kind: array    count: 300",
+	},
+	InstrScope: {
+		Name:        "SCOPE",
+		StackEffect: "--",
+		Description: "Start an operation, the blocks it defers run when it ends",
+		Example:     "0000: SCOPE",
+	},
+	InstrEndScope: {
+		Name:        "END_SCOPE",
+		StackEffect: "--",
+		Description: "End an operation, running the blocks it deferred first",
+		Example:     "0000: END_SCOPE",
+	},
+	InstrPushBool: {
+		Name:        "PUSH_BOOL",
+		Operands:    []Operand{{"value", 1}},
+		StackEffect: "-- bool",
+		Description: "Push true when value is 1, false when it's 0",
+		Example:     "0000: PUSH_BOOL    value: true",
+	},
+	InstrTryOp: {
+		Name:        "TRY_OP",
+		Operands:    []Operand{{"addr", 2}, {"name", 2}, {"timeout", 4}},
+		StackEffect: "--",
+		Description: "Start an attempt of the named operation as a try block, it fails once the timeout in milliseconds has passed unless that's 0",
+		Example:     `0000: TRY_OP       jump: 40    op: "deploy"    (timeout 30000ms)`,
+	},
+	InstrOpRetry: {
+		Name:        "OP_RETRY",
+		Operands:    []Operand{{"addr", 2}, {"retry", 1}, {"continue", 1}},
+		StackEffect: "message --",
+		Description: "Run the cleanups of a failed operation attempt, then jump back to addr to try again while attempts are left. After the last one the program stops, or goes on when continue is 1",
+		Example:     "0000: OP_RETRY     jump: 12    (retry 3, continue)",
+	},
+	InstrOpNeeds: {
+		Name:        "OP_NEEDS",
+		Operands:    []Operand{{"name", 2}, {"dep", 2}, {"addr", 2}},
+		StackEffect: "--",
+		Description: "Skip the named operation by jumping to addr when the operation dep failed",
+		Example:     `0000: OP_NEEDS     op: "deploy"    dep: "build"    (skip to 80)`,
+	},
+	InstrOpCached: {
+		Name:        "OP_CACHED",
+		Operands:    []Operand{{"name", 2}, {"key", 2}, {"inputs", 1}, {"addr", 2}},
+		StackEffect: "inputs outputs --",
+		Description: "Start the named operation with the paths it reads and writes, when inputs is 1 skip it by jumping to addr if they and the code key hash to what its last successful run recorded and the outputs are there",
+		Example:     `0000: OP_CACHED    op: "build"    (skip to 80)`,
+	},
+	InstrOpRecord: {
+		Name:        "OP_RECORD",
+		Operands:    []Operand{{"name", 2}},
+		StackEffect: "--",
+		Description: "Record that the named operation succeeded with the inputs OP_CACHED hashed",
+		Example:     `0000: OP_RECORD    op: "build"`,
+	},
+}
+
+// Info returns the metadata of an instruction
+func (instr Instr) Info() (InstrInfo, bool) {
+	info, ok := instrTable[instr]
+	return info, ok
+}
+
+// Instructions lists every known instruction in opcode order
+func Instructions() []Instr {
+	instrs := make([]Instr, 0, len(instrTable))
+	for op := 0; op < 256; op++ {
+		if _, ok := instrTable[Instr(op)]; ok {
+			instrs = append(instrs, Instr(op))
+		}
+	}
+	return instrs
+}
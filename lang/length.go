@@ -0,0 +1,38 @@
+package lang
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// length is the size of a value the way len sees it: characters of a
+// string, bytes of bytes and elements of arrays and ranges
+func (vm *VM) length(v Value) (int, error) {
+	switch v := v.(type) {
+	case StringValue:
+		s := vm.CurrentState.Strings[v.Index]
+		if !utf8.ValidString(s) {
+			return 0, fmt.Errorf("cannot count the characters of a string with invalid UTF-8, use len(bytes(s))")
+		}
+		return utf8.RuneCountInString(s), nil
+	case BytesValue:
+		return len(vm.CurrentState.Bytes[v.Index]), nil
+	case ArrayValue:
+		return len(vm.CurrentState.Arrays[v.Index]), nil
+	case RangeValue:
+		return v.Len(), nil
+	}
+	return 0, fmt.Errorf("%s has no length", typeNames[v.Type()])
+}
+
+func (vm *VM) executeLen() error {
+	if len(vm.CurrentState.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	n, err := vm.length(vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1])
+	if err != nil {
+		return err
+	}
+	vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1] = IntValue(n)
+	return nil
+}
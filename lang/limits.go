@@ -0,0 +1,49 @@
+package lang
+
+import "math"
+
+// Every VM is bounded whether or not it's sandboxed. A runaway recursion or
+// a loop appending to a string fails with an error saying which bound it
+// hit, instead of taking the memory of the process with it
+
+const (
+	// DefaultStackSize is the stack size callers pass to NewVM, in values
+	// and in calls
+	DefaultStackSize = 1 << 16
+	// DefaultLocalsSize is the variables a frame can have
+	DefaultLocalsSize = 1 << 12
+	// DefaultStringLimit is how many bytes the string table may hold
+	DefaultStringLimit = 256 << 20
+)
+
+// initialCapacity is as much of the stack and locals as is made up front,
+// the rest grows when it's used
+const initialCapacity = 1024
+
+// unlimited is n as a bound, 0 or less is no bound at all
+func unlimited(n int) int {
+	if n <= 0 {
+		return math.MaxInt
+	}
+	return n
+}
+
+// SetStringLimit bounds the bytes in the string table, 0 means no limit.
+// Strings nothing refers to count until the collector reclaims them
+func (vm *VM) SetStringLimit(bytes int) {
+	vm.maxStringBytes = unlimited(bytes)
+}
+
+// checkBounds holds the program to the sizes it was given, it's called once
+// the stack is past its size or there are new strings to count. Calls are
+// checked as they're made, a recursion doesn't grow the stack
+func (vm *VM) checkBounds() error {
+	s := vm.CurrentState
+	if len(s.Stack) > vm.maxStack {
+		return runtimeError(ErrStackOverflow, vm.maxStack)
+	}
+	if used := vm.measureHeap().stringBytes; used > vm.maxStringBytes {
+		return runtimeError(ErrStringLimit, vm.maxStringBytes, used)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// executeContains answers `x in xs`, true when xs holds x. Arrays hold their
+// elements, ranges their integers, bytes their byte values and runs of
+// bytes, strings their substrings
+func (vm *VM) executeContains() error {
+	if len(vm.CurrentState.Stack) < 2 {
+		return fmt.Errorf("stack underflow")
+	}
+	haystack := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	needle := intCompat(vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2])
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+
+	found, err := vm.contains(haystack, needle)
+	if err != nil {
+		return err
+	}
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(found))
+	return nil
+}
+
+func (vm *VM) contains(haystack, needle Value) (bool, error) {
+	switch h := haystack.(type) {
+	case ArrayValue:
+		for _, elem := range vm.CurrentState.Arrays[h.Index] {
+			if vm.sameValue(elem, needle) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case RangeValue:
+		n, ok := needle.(IntValue)
+		return ok && int(n) >= h.From && int(n) <= h.To, nil
+	case StringValue:
+		if h.Secret {
+			return false, fmt.Errorf("cannot search a secret string")
+		}
+		n, ok := needle.(StringValue)
+		if !ok {
+			return false, fmt.Errorf("only a string can be in a string")
+		}
+		return strings.Contains(vm.CurrentState.Strings[h.Index], vm.CurrentState.Strings[n.Index]), nil
+	case BytesValue:
+		data := vm.CurrentState.Bytes[h.Index]
+		switch n := needle.(type) {
+		case IntValue:
+			return n >= 0 && n <= 255 && bytes.IndexByte(data, byte(n)) >= 0, nil
+		case BytesValue:
+			return bytes.Contains(data, vm.CurrentState.Bytes[n.Index]), nil
+		}
+		return false, fmt.Errorf("only an integer or bytes can be in bytes")
+	}
+	return false, fmt.Errorf("invalid operand type for in")
+}
+
+// sameValue is equality the way == sees it, values == refuses to compare
+// are simply different
+func (vm *VM) sameValue(a, b Value) bool {
+	a, b = intCompat(a), intCompat(b)
+	if x, y, ok := bigOperands(a, b); ok {
+		return x.Cmp(y) == 0
+	}
+	switch vb := b.(type) {
+	case IntValue:
+		va, ok := a.(IntValue)
+		return ok && va == vb
+	case StringValue:
+		va, ok := a.(StringValue)
+		return ok && vm.CurrentState.Strings[va.Index] == vm.CurrentState.Strings[vb.Index]
+	case NilValue:
+		return isNil(a)
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package lang
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// MessageID identifies an error message apart from its wording. Errors
+// carry their ID as a stable code, the same in every locale and across
+// releases, so tooling and catch handlers can match on it
+type MessageID string
+
+// Compile time errors
+const (
+	ErrConstAssign       MessageID = "E0001"
+	ErrNestedOperation   MessageID = "E0002"
+	ErrUndeclaredAssign  MessageID = "E0003"
+	ErrInvalidInt        MessageID = "E0004"
+	ErrDuplicateOp       MessageID = "E0005"
+	ErrOpCycle           MessageID = "E0006"
+	ErrUnknownDependency MessageID = "E0007"
+	ErrMixedConcat       MessageID = "E0008"
+	ErrTooComplex        MessageID = "E0009"
+	ErrInvalidChar       MessageID = "E0010"
+	ErrInvalidPolicy     MessageID = "E0011"
+)
+
+// Type errors
+const (
+	ErrImmutableAssign MessageID = "E0101"
+	ErrNotIndexable    MessageID = "E0102"
+	ErrNotIterable     MessageID = "E0103"
+	ErrIndexType       MessageID = "E0104"
+	ErrIndexNotInt     MessageID = "E0105"
+	ErrBoundsNotInt    MessageID = "E0106"
+	ErrOperandTypes    MessageID = "E0107"
+)
+
+// Runtime errors
+const (
+	ErrDivisionByZero MessageID = "R0001"
+	ErrNotFunction    MessageID = "R0002"
+	ErrArity          MessageID = "R0003"
+	ErrRangeBounds    MessageID = "R0004"
+	ErrUnassigned     MessageID = "R0005"
+	ErrAssertion      MessageID = "R0006"
+	ErrMixedAdd       MessageID = "R0007"
+	ErrIntOverflow    MessageID = "R0008"
+	ErrFuelExhausted  MessageID = "R0009"
+	ErrStackOverflow  MessageID = "R0010"
+	ErrTooManyLocals  MessageID = "R0011"
+	ErrStringLimit    MessageID = "R0012"
+	ErrCanceled       MessageID = "R0013"
+	ErrCompareTypes   MessageID = "R0014"
+	ErrExitStatus     MessageID = "R0015"
+	ErrOpFailed       MessageID = "R0016"
+	ErrOpTimeout      MessageID = "R0017"
+)
+
+// Deprecations, warnings until the construct is removed and errors after
+const (
+	WarnValReassign MessageID = "D0001"
+)
+
+// Warnings, errors under strict compilation
+const (
+	WarnRedeclared MessageID = "W0001"
+)
+
+// Help texts, they go along with an error rather than having a code
+const (
+	helpConstAssign      MessageID = "help.const-assign"
+	helpUndeclared       MessageID = "help.undeclared"
+	helpDuplicateOp      MessageID = "help.duplicate-op"
+	helpOpCycle          MessageID = "help.op-cycle"
+	helpStringConversion MessageID = "help.string-conversion"
+	helpValReassign      MessageID = "help.val-reassign"
+	helpRedeclared       MessageID = "help.redeclared"
+	helpIntRange         MessageID = "help.int-range"
+	helpPolicy           MessageID = "help.policy"
+)
+
+// catalogs hold the messages of every supported locale as format strings.
+// The arguments are the same in every language, so they're referred to by
+// position where the word order differs. English is complete, other
+// locales fall back to it for anything missing
+var catalogs = map[string]map[MessageID]string{
+	"en": {
+		ErrConstAssign:       "cannot assign to constant %[1]s",
+		ErrNestedOperation:   "operation %[1]s must be declared at the top level",
+		ErrUndeclaredAssign:  "cannot assign to undeclared variable %[1]s",
+		ErrInvalidInt:        "invalid integer literal %[1]s",
+		ErrDuplicateOp:       "operation %[1]s is declared twice",
+		ErrOpCycle:           "operation dependency cycle: %[1]s",
+		ErrUnknownDependency: "operation %[1]s depends on unknown operation %[2]s",
+		ErrMixedConcat:       "cannot add %[1]s and %[2]s, + only joins a string to another string",
+		ErrTooComplex:        "program too large or complex to compile: %[1]s",
+		ErrInvalidChar:       "invalid character literal %[1]s, it must hold exactly one character",
+		ErrInvalidPolicy:     "invalid policy %[2]s for operation %[1]s",
+
+		ErrImmutableAssign: "cannot assign into %[1]s, %[2]s values are immutable",
+		ErrNotIndexable:    "cannot index %[1]s, it is %[2]s",
+		ErrNotIterable:     "cannot iterate over %[1]s",
+		ErrIndexType:       "invalid operand type for indexing: %[1]s",
+		ErrIndexNotInt:     "an index must be an integer, got %[1]s",
+		ErrBoundsNotInt:    "for bounds must be an integer, got %[1]s",
+		ErrOperandTypes:    "invalid operand types for %[1]s: %[2]s and %[3]s",
+
+		ErrDivisionByZero: "division by zero",
+		ErrNotFunction:    "value is not a function",
+		ErrArity:          "function expects %[1]d arguments, got %[2]d",
+		ErrRangeBounds:    "range bounds must be integers",
+		ErrUnassigned:     "variable used before assignment",
+		ErrAssertion:      "assertion failed: %[1]s",
+		ErrMixedAdd:       "cannot add %[1]s and %[2]s, convert with string(...) first",
+		ErrIntOverflow:    "integer overflow in %[1]d %[2]s %[3]d",
+		ErrFuelExhausted:  "fuel exhausted after %[1]d instructions",
+		ErrStackOverflow:  "stack overflow, more than %[1]d values or calls",
+		ErrTooManyLocals:  "too many variables, a frame can have %[1]d",
+		ErrStringLimit:    "strings use %[2]d bytes, more than the limit of %[1]d",
+		ErrCanceled:       "execution stopped: %[1]v",
+		ErrCompareTypes:   "cannot compare %[2]s and %[3]s with %[1]s",
+		ErrExitStatus:     "exit status %[1]d is out of range, it must be 0 to 255",
+		ErrOpFailed:       "operation %[1]s failed on attempt %[2]d: %[3]s",
+		ErrOpTimeout:      "operation %[1]s timed out after %[2]v",
+
+		WarnValReassign: "%[1]s is declared with val at %[2]s and assigned again",
+		WarnRedeclared:  "%[1]s is declared again, it is already declared at %[2]s",
+
+		helpConstAssign:      "%[1]s was declared as a constant at %[2]s",
+		helpUndeclared:       "declare it first with val %[1]s = ...",
+		helpDuplicateOp:      "the first declaration is at %[2]s",
+		helpOpCycle:          "remove one of the depends so the operations can be ordered",
+		helpStringConversion: "use string(...) to turn the other side into a string",
+		helpValReassign:      "declare it with var %[1]s = ... instead, assigning to a val is an error from language version %[3]s",
+		helpRedeclared:       "both declarations are the same variable, assign with %[1]s = ... or pick another name",
+		helpIntRange:         "integers are 64 bit and go up to 9223372036854775807, #pragma promote lets arithmetic go past that",
+		helpPolicy:           "retry takes a count up to 255 and timeout a duration like 500ms, 30s or 2m",
+	},
+	"de": {
+		ErrConstAssign:       "Zuweisung an die Konstante %[1]s ist nicht möglich",
+		ErrNestedOperation:   "Operation %[1]s muss auf oberster Ebene deklariert werden",
+		ErrUndeclaredAssign:  "Zuweisung an die nicht deklarierte Variable %[1]s ist nicht möglich",
+		ErrInvalidInt:        "ungültiges Ganzzahl-Literal %[1]s",
+		ErrDuplicateOp:       "Operation %[1]s ist doppelt deklariert",
+		ErrOpCycle:           "zyklische Abhängigkeit zwischen Operationen: %[1]s",
+		ErrUnknownDependency: "Operation %[1]s hängt von der unbekannten Operation %[2]s ab",
+		ErrMixedConcat:       "%[1]s und %[2]s können nicht addiert werden, + verbindet nur einen String mit einem anderen String",
+		ErrTooComplex:        "Programm zu groß oder zu komplex zum Kompilieren: %[1]s",
+		ErrInvalidChar:       "ungültiges Zeichenliteral %[1]s, es muss genau ein Zeichen enthalten",
+		ErrInvalidPolicy:     "ungültige Richtlinie %[2]s für Operation %[1]s",
+
+		ErrImmutableAssign: "Zuweisung in %[1]s ist nicht möglich, Werte vom Typ %[2]s sind unveränderlich",
+		ErrNotIndexable:    "%[1]s kann nicht indiziert werden, es ist vom Typ %[2]s",
+		ErrNotIterable:     "über %[1]s kann nicht iteriert werden",
+		ErrIndexType:       "ungültiger Operandentyp für die Indizierung: %[1]s",
+		ErrIndexNotInt:     "ein Index muss eine Ganzzahl sein, erhalten: %[1]s",
+		ErrBoundsNotInt:    "die Grenzen einer for-Schleife müssen Ganzzahlen sein, erhalten: %[1]s",
+		ErrOperandTypes:    "ungültige Operandentypen für %[1]s: %[2]s und %[3]s",
+
+		ErrDivisionByZero: "Division durch null",
+		ErrNotFunction:    "der Wert ist keine Funktion",
+		ErrArity:          "die Funktion erwartet %[1]d Argumente, erhalten: %[2]d",
+		ErrRangeBounds:    "die Grenzen eines Bereichs müssen Ganzzahlen sein",
+		ErrUnassigned:     "Variable wird vor der Zuweisung verwendet",
+		ErrAssertion:      "Zusicherung fehlgeschlagen: %[1]s",
+		ErrMixedAdd:       "%[1]s und %[2]s können nicht addiert werden, zuerst mit string(...) umwandeln",
+		ErrIntOverflow:    "Ganzzahlüberlauf in %[1]d %[2]s %[3]d",
+		ErrFuelExhausted:  "Treibstoff nach %[1]d Anweisungen aufgebraucht",
+		ErrStackOverflow:  "Stapelüberlauf, mehr als %[1]d Werte oder Aufrufe",
+		ErrTooManyLocals:  "zu viele Variablen, ein Rahmen kann %[1]d haben",
+		ErrStringLimit:    "Zeichenketten belegen %[2]d Bytes, mehr als die Grenze von %[1]d",
+		ErrCanceled:       "Ausführung angehalten: %[1]v",
+		ErrCompareTypes:   "%[2]s und %[3]s können nicht mit %[1]s verglichen werden",
+		ErrExitStatus:     "Exit-Status %[1]d liegt außerhalb des Bereichs, er muss zwischen 0 und 255 liegen",
+		ErrOpFailed:       "Operation %[1]s ist beim Versuch %[2]d fehlgeschlagen: %[3]s",
+		ErrOpTimeout:      "Zeitüberschreitung der Operation %[1]s nach %[2]v",
+
+		WarnValReassign: "%[1]s ist bei %[2]s mit val deklariert und wird erneut zugewiesen",
+		WarnRedeclared:  "%[1]s wird erneut deklariert, es ist bereits bei %[2]s deklariert",
+
+		helpConstAssign:      "%[1]s wurde bei %[2]s als Konstante deklariert",
+		helpUndeclared:       "zuerst mit val %[1]s = ... deklarieren",
+		helpDuplicateOp:      "die erste Deklaration steht bei %[2]s",
+		helpOpCycle:          "eine der depends-Angaben entfernen, damit die Operationen geordnet werden können",
+		helpStringConversion: "mit string(...) die andere Seite in einen String umwandeln",
+		helpValReassign:      "stattdessen mit var %[1]s = ... deklarieren, ab Sprachversion %[3]s ist die Zuweisung an ein val ein Fehler",
+		helpRedeclared:       "beide Deklarationen sind dieselbe Variable, mit %[1]s = ... zuweisen oder einen anderen Namen wählen",
+		helpIntRange:         "Ganzzahlen haben 64 Bit und reichen bis 9223372036854775807, mit #pragma promote kann Arithmetik darüber hinausgehen",
+		helpPolicy:           "retry nimmt eine Anzahl bis 255 und timeout eine Dauer wie 500ms, 30s oder 2m",
+	},
+}
+
+// locale is the catalog messages are taken from
+var locale = "en"
+
+// SetLocale picks the language of error messages. Names like de_DE.UTF-8
+// are reduced to their language, it reports false and keeps English for
+// a language without a catalog
+func SetLocale(name string) bool {
+	lang, _, _ := strings.Cut(name, "_")
+	lang, _, _ = strings.Cut(lang, ".")
+	lang = strings.ToLower(lang)
+	if _, ok := catalogs[lang]; !ok {
+		locale = "en"
+		return lang == "" || lang == "c" || lang == "posix"
+	}
+	locale = lang
+	return true
+}
+
+// localize formats a message in the current locale
+func localize(id MessageID, args ...any) string {
+	format, ok := catalogs[locale][id]
+	if !ok {
+		format = catalogs["en"][id]
+	}
+	// Help texts without arguments would have them reported as extra
+	if !strings.Contains(format, "%") {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// languageError builds a LanguageError from the catalog, help is formatted
+// with the same arguments and left out when empty
+func languageError(pos lexer.Position, code, help MessageID, args ...any) *LanguageError {
+	err := &LanguageError{Pos: pos, Code: code, Message: localize(code, args...)}
+	if help != "" {
+		err.Help = localize(help, args...)
+	}
+	return err
+}
+
+// runtimeError builds a RuntimeError from the catalog
+func runtimeError(code MessageID, args ...any) error {
+	return &RuntimeError{Code: code, Message: localize(code, args...)}
+}
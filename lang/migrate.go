@@ -0,0 +1,73 @@
+package lang
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Edit is one change Migrate made, Old was replaced with New at Pos
+type Edit struct {
+	Fix
+	Old string
+}
+
+func (e Edit) String() string {
+	return fmt.Sprintf("%s: %s -> %s [%s]", e.Pos, e.Old, e.New, e.Deprecation.Code)
+}
+
+// Migrate upgrades source to language version to by rewriting the
+// deprecated constructs removed by then. The edited source has to compile
+// as version to, deprecations without an automatic fix are left for the
+// error they cause to point out
+func Migrate(filename, source, to string) (string, []Edit, error) {
+	if !slices.Contains(LangVersions, to) {
+		return "", nil, fmt.Errorf("unknown language version %s, known versions are %v", to, LangVersions)
+	}
+	program, err := Parse(filename, source)
+	if err != nil {
+		return "", nil, err
+	}
+	// Compiled as the oldest version every deprecation is a warning
+	compiler := NewCompiler()
+	compiler.LangVersion = LangVersions[0]
+	if _, err := compiler.CompileProgram(program); err != nil {
+		return "", nil, err
+	}
+
+	var edits []Edit
+	seen := make(map[int]bool)
+	for _, fix := range compiler.Fixes {
+		if !fix.Deprecation.removedBy(to) || seen[fix.Pos.Offset] {
+			continue
+		}
+		seen[fix.Pos.Offset] = true
+		end := fix.Pos.Offset
+		for end < len(source) && isWordByte(source[end]) {
+			end++
+		}
+		edits = append(edits, Edit{Fix: fix, Old: source[fix.Pos.Offset:end]})
+	}
+	slices.SortFunc(edits, func(a, b Edit) int { return a.Pos.Offset - b.Pos.Offset })
+
+	// Applied back to front so earlier offsets stay valid
+	edited := source
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		edited = edited[:e.Pos.Offset] + e.New + edited[e.Pos.Offset+len(e.Old):]
+	}
+
+	program, err = Parse(filename, edited)
+	if err != nil {
+		return "", nil, fmt.Errorf("the migrated source does not parse: %w", err)
+	}
+	compiler = NewCompiler()
+	compiler.LangVersion = to
+	if _, err := compiler.CompileProgram(program); err != nil {
+		return "", nil, fmt.Errorf("the migrated source does not compile as %s: %w", to, err)
+	}
+	return edited, edits, nil
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
@@ -0,0 +1,520 @@
+package lang
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// scheduleOperations orders operations so each comes after everything it
+// depends on. Independent operations keep their declaration order
+func scheduleOperations(ops []*Operation) ([]*Operation, error) {
+	byName := make(map[string]*Operation, len(ops))
+	for _, op := range ops {
+		if prev, ok := byName[op.Name]; ok {
+			return nil, languageError(op.Pos, ErrDuplicateOp, helpDuplicateOp, op.Name, prev.Pos)
+		}
+		byName[op.Name] = op
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(ops))
+	order := make([]*Operation, 0, len(ops))
+	var path []string
+
+	var visit func(op *Operation) error
+	visit = func(op *Operation) error {
+		switch state[op.Name] {
+		case done:
+			return nil
+		case visiting:
+			start := 0
+			for path[start] != op.Name {
+				start++
+			}
+			cycle := append(path[start:], op.Name)
+			return languageError(op.Pos, ErrOpCycle, helpOpCycle, strings.Join(cycle, " -> "))
+		}
+
+		state[op.Name] = visiting
+		path = append(path, op.Name)
+		for _, name := range op.Depends {
+			dep, ok := byName[name]
+			if !ok {
+				return languageError(op.Pos, ErrUnknownDependency, "", op.Name, name)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[op.Name] = done
+		order = append(order, op)
+		return nil
+	}
+
+	for _, op := range ops {
+		if err := visit(op); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// opPolicy is the policy clauses of an operation put together, the zero
+// value is what an operation without any does
+type opPolicy struct {
+	retry     int
+	timeout   time.Duration
+	keepGoing bool
+}
+
+// The largest retry count and timeout the operands of OP_RETRY and TRY_OP
+// hold, the timeout is in milliseconds
+const (
+	maxRetries = 255
+	maxTimeout = math.MaxUint32 * time.Millisecond
+)
+
+// parsePolicy checks the clauses of op, a later one overrides an earlier
+func parsePolicy(op *Operation) (opPolicy, error) {
+	var policy opPolicy
+	for _, clause := range op.Policy {
+		switch {
+		case clause.Retry != nil:
+			n, err := parseInt(*clause.Retry)
+			if err != nil || n < 0 || n > maxRetries {
+				return policy, languageError(clause.Pos, ErrInvalidPolicy, helpPolicy, op.Name, "retry "+*clause.Retry)
+			}
+			policy.retry = int(n)
+		case clause.Timeout != nil:
+			d, err := time.ParseDuration(*clause.Timeout)
+			if err != nil || d < time.Millisecond || d > maxTimeout {
+				return policy, languageError(clause.Pos, ErrInvalidPolicy, helpPolicy, op.Name, "timeout "+*clause.Timeout)
+			}
+			policy.timeout = d
+		case clause.OnFail != nil:
+			policy.keepGoing = *clause.OnFail == "continue"
+		}
+	}
+	return policy, nil
+}
+
+// failingDeps finds, for every operation, the operations it depends on
+// directly or through others that may fail without stopping the program.
+// It's skipped when one of them did
+func failingDeps(schedule []*Operation) (map[string][]string, error) {
+	checks := make(map[string][]string, len(schedule))
+	// reach is what an operation's dependents have to check, its own
+	// checks and itself when it may fail
+	reach := make(map[string][]string, len(schedule))
+	for _, op := range schedule {
+		var deps []string
+		for _, name := range op.Depends {
+			deps = append(deps, reach[name]...)
+		}
+		slices.Sort(deps)
+		deps = slices.Compact(deps)
+		checks[op.Name] = deps
+
+		policy, err := parsePolicy(op)
+		if err != nil {
+			return nil, err
+		}
+		if policy.keepGoing {
+			deps = append(slices.Clone(deps), op.Name)
+		}
+		reach[op.Name] = deps
+	}
+	return checks, nil
+}
+
+// opFingerprint is what an operation's code comes to, the tokens it's
+// written with. A run recorded for it only counts while it's the same
+func opFingerprint(op *Operation) string {
+	h := sha256.New()
+	for _, tok := range op.Tokens {
+		io.WriteString(h, tok.Value)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// compilePaths compiles the expressions of an inputs or outputs clause into
+// one array
+func (c *Compiler) compilePaths(exprs []*Expr) error {
+	for _, expr := range exprs {
+		if err := c.compileExpr(expr); err != nil {
+			return err
+		}
+	}
+	return c.emitArray(len(exprs))
+}
+
+// compileOperation compiles an operation to run in a scope of its own, a
+// defer in it runs when the operation is done rather than with the
+// program's. An operation with a policy runs in a try block, its catch
+// runs the cleanups and then tries again or gives up. It's skipped when
+// one of the failing operations it depends on did fail, or when its inputs
+// are unchanged since it last succeeded
+func (c *Compiler) compileOperation(op *Operation, failing []string) error {
+	policy, err := parsePolicy(op)
+	if err != nil {
+		return err
+	}
+	name := c.internRaw(op.Name)
+
+	start := c.currentPos
+	c.registerLine(op.Pos)
+	var skips []int
+	for _, dep := range failing {
+		dep := c.internRaw(dep)
+		// The last 2 bytes are the skip address, patched in at the end
+		c.emit(InstrOpNeeds, byte(name>>8), byte(name&0xff), byte(dep>>8), byte(dep&0xff), 0, 0)
+		skips = append(skips, c.currentPos-2)
+	}
+	if len(op.Inputs) > 0 || len(op.Outputs) > 0 {
+		if err := c.compilePaths(op.Inputs); err != nil {
+			return err
+		}
+		if err := c.compilePaths(op.Outputs); err != nil {
+			return err
+		}
+		key := c.internRaw(opFingerprint(op))
+		hasInputs := byte(0)
+		if len(op.Inputs) > 0 {
+			hasInputs = 1
+		}
+		c.emit(InstrOpCached, byte(name>>8), byte(name&0xff), byte(key>>8), byte(key&0xff), hasInputs, 0, 0)
+		skips = append(skips, c.currentPos-2)
+	}
+
+	attempt := c.currentPos
+	c.emit(InstrScope)
+	var catchPos int
+	if policy != (opPolicy{}) {
+		c.emit(InstrTryOp)
+		catchPos = c.currentPos
+		ms := policy.timeout.Milliseconds()
+		c.Code = append(c.Code, 0, 0, byte(name>>8), byte(name&0xff), byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms))
+		c.currentPos += 8
+	}
+	for _, stmt := range op.Body {
+		if err := c.compileStatement(&stmt); err != nil {
+			return err
+		}
+	}
+	if policy != (opPolicy{}) {
+		c.emit(InstrEndTry)
+		c.emit(InstrEndScope)
+		c.emitOpRecord(op, name)
+		c.emit(InstrJmp)
+		endPos := c.currentPos
+		c.Code = append(c.Code, 0, 0) // Reserve 2 bytes for jump address
+		c.currentPos += 2
+
+		c.patchJump(catchPos, c.currentPos)
+		// A failure is reported at the operation rather than its last line
+		c.registerLine(op.Pos)
+		keepGoing := byte(0)
+		if policy.keepGoing {
+			keepGoing = 1
+		}
+		c.emit(InstrOpRetry, byte(attempt>>8), byte(attempt&0xff), byte(policy.retry), keepGoing)
+		c.patchJump(endPos, c.currentPos)
+	} else {
+		c.emit(InstrEndScope)
+		c.emitOpRecord(op, name)
+	}
+	for _, pos := range skips {
+		c.patchJump(pos, c.currentPos)
+	}
+	c.operations = append(c.operations, CodeRange{Name: op.Name, Start: start, End: c.currentPos})
+	return nil
+}
+
+// emitOpRecord records the run of an operation with inputs once it has
+// succeeded
+func (c *Compiler) emitOpRecord(op *Operation, name int) {
+	if len(op.Inputs) > 0 {
+		c.emit(InstrOpRecord, byte(name>>8), byte(name&0xff))
+	}
+}
+
+// opRun is how an operation with a policy, inputs, outputs or failing
+// dependencies has done so far. hash is what its inputs came to when it
+// started, cached is set when that skipped it and skipped when a
+// dependency's failure did
+type opRun struct {
+	name     string
+	attempts int
+	timeout  time.Duration
+	failed   bool
+	outputs  []string
+	hash     string
+	cached   bool
+	skipped  bool
+}
+
+// opRun returns the record of the named operation, starting one the first
+// time
+func (vm *VM) opRun(name string) *opRun {
+	if vm.opRuns == nil {
+		vm.opRuns = make(map[string]*opRun)
+	}
+	run, ok := vm.opRuns[name]
+	if !ok {
+		run = &opRun{name: name}
+		vm.opRuns[name] = run
+	}
+	return run
+}
+
+func (vm *VM) executeTryOp() error {
+	state := vm.CurrentState
+	if state.PC+7 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	addr := vm.index()
+	state.PC += 2
+	nameIdx := vm.index()
+	if nameIdx >= len(state.Strings) {
+		return fmt.Errorf("string index out of bounds: %d", nameIdx)
+	}
+	code := vm.Bytecode[state.PC+2:]
+	timeout := time.Duration(uint32(code[0])<<24|uint32(code[1])<<16|uint32(code[2])<<8|uint32(code[3])) * time.Millisecond
+	state.PC += 6
+
+	run := vm.opRun(state.Strings[nameIdx])
+	run.attempts++
+	run.timeout = timeout
+	vm.runningOp = run
+
+	handler := Handler{Addr: addr, Frames: len(state.Frames), StackHeight: len(state.Stack)}
+	if timeout > 0 {
+		handler.Deadline = time.Now().Add(timeout)
+		vm.deadlineTicks = 0
+	}
+	state.Handlers = append(state.Handlers, handler)
+	return nil
+}
+
+// checkDeadline fails the attempt of the running operation once its
+// timeout has passed, it looks at the clock every cancelCheckInterval
+// instructions. Try blocks inside the operation don't get to catch it, the
+// error goes straight to the operation's handler
+func (vm *VM) checkDeadline() error {
+	vm.deadlineTicks++
+	if vm.deadlineTicks%cancelCheckInterval != 0 || time.Now().Before(vm.CurrentState.Handlers[0].Deadline) {
+		return nil
+	}
+	vm.CurrentState.Handlers = vm.CurrentState.Handlers[:1]
+	return runtimeError(ErrOpTimeout, vm.runningOp.name, vm.runningOp.timeout)
+}
+
+// executeOpRetry is the catch of an operation with a policy, it starts
+// with the error message on the stack. The attempt's cleanups run first,
+// each comes back here when done
+func (vm *VM) executeOpRetry() error {
+	state := vm.CurrentState
+	if state.PC+3 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	if len(state.Scopes) == 0 {
+		return fmt.Errorf("OP_RETRY without a SCOPE")
+	}
+	if len(state.Defers) > state.Scopes[len(state.Scopes)-1] {
+		state.Resume = state.PC - 1
+		vm.runNextDefer()
+		return nil
+	}
+	if len(state.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	state.Scopes = state.Scopes[:len(state.Scopes)-1]
+	attempt := vm.index()
+	retry, keepGoing := int(vm.Bytecode[state.PC+2]), vm.Bytecode[state.PC+3] != 0
+	state.PC += 4
+	message := vm.displayString(state.Stack[len(state.Stack)-1])
+	state.Stack = state.Stack[:len(state.Stack)-1]
+
+	run := vm.runningOp
+	if run.attempts <= retry {
+		state.PC = attempt
+		return nil
+	}
+	err := runtimeError(ErrOpFailed, run.name, run.attempts, message)
+	if !keepGoing {
+		return err
+	}
+	run.failed = true
+	fmt.Println("Continuing after:", err)
+	return nil
+}
+
+func (vm *VM) executeOpNeeds() error {
+	state := vm.CurrentState
+	if state.PC+5 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	nameIdx := vm.index()
+	state.PC += 2
+	depIdx := vm.index()
+	state.PC += 2
+	skip := vm.index()
+	state.PC += 2
+	if nameIdx >= len(state.Strings) || depIdx >= len(state.Strings) {
+		return fmt.Errorf("string index out of bounds")
+	}
+	if run, ok := vm.opRuns[state.Strings[depIdx]]; ok && run.failed {
+		fmt.Printf("Skipping operation %s, %s failed\n", state.Strings[nameIdx], run.name)
+		vm.opRun(state.Strings[nameIdx]).skipped = true
+		state.PC = skip
+	}
+	return nil
+}
+
+// RunStore keeps what the inputs of operations hashed to on their last
+// successful run, from one run of the program to the next
+type RunStore interface {
+	Lookup(op string) (hash string, ok bool)
+	Record(op, hash string) error
+}
+
+// SetRunStore has operations with inputs skipped while their inputs and
+// code hash to what the store has for them, without one they always run.
+// The inputs are read from the file system, a sandboxed program shouldn't
+// get one
+func (vm *VM) SetRunStore(store RunStore) {
+	vm.runStore = store
+}
+
+// paths are the paths a value of an inputs or outputs clause names, an
+// array names what its elements do
+func (vm *VM) paths(v Value, seen map[int]bool) []string {
+	array, ok := v.(ArrayValue)
+	if !ok {
+		return []string{vm.displayString(v)}
+	}
+	if seen[array.Index] {
+		return nil
+	}
+	seen[array.Index] = true
+	var paths []string
+	for _, elem := range vm.CurrentState.Arrays[array.Index] {
+		paths = append(paths, vm.paths(elem, seen)...)
+	}
+	return paths
+}
+
+// hashInputs hashes key along with the files at paths, a directory by every
+// file under it. A path that isn't there hashes as missing
+func hashInputs(key string, paths []string) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, key)
+	for _, path := range paths {
+		fmt.Fprintf(h, "\x00%s\x00", path)
+		err := filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%s\x00", file)
+			_, err = io.Copy(h, f)
+			return err
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			io.WriteString(h, "missing")
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// executeOpCached starts an operation with inputs or outputs, with the
+// arrays of both on the stack. It jumps past the operation when the store
+// has the hash its inputs come to and its outputs are all there
+func (vm *VM) executeOpCached() error {
+	state := vm.CurrentState
+	if state.PC+6 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	if len(state.Stack) < 2 {
+		return fmt.Errorf("stack underflow")
+	}
+	nameIdx := vm.index()
+	state.PC += 2
+	keyIdx := vm.index()
+	state.PC += 2
+	hasInputs := vm.Bytecode[state.PC] != 0
+	state.PC++
+	skip := vm.index()
+	state.PC += 2
+	if nameIdx >= len(state.Strings) || keyIdx >= len(state.Strings) {
+		return fmt.Errorf("string index out of bounds")
+	}
+	inputs := vm.paths(state.Stack[len(state.Stack)-2], map[int]bool{})
+	outputs := vm.paths(state.Stack[len(state.Stack)-1], map[int]bool{})
+	state.Stack = state.Stack[:len(state.Stack)-2]
+
+	run := vm.opRun(state.Strings[nameIdx])
+	run.outputs = outputs
+	if !hasInputs || vm.runStore == nil {
+		return nil
+	}
+	hash, err := hashInputs(state.Strings[keyIdx], inputs)
+	if err != nil {
+		return fmt.Errorf("failed to hash the inputs of operation %s: %w", run.name, err)
+	}
+	run.hash = hash
+	if last, ok := vm.runStore.Lookup(run.name); !ok || last != hash {
+		return nil
+	}
+	for _, output := range outputs {
+		if _, err := os.Stat(output); err != nil {
+			return nil
+		}
+	}
+	run.cached = true
+	fmt.Printf("Skipping operation %s, its inputs haven't changed\n", run.name)
+	state.PC = skip
+	return nil
+}
+
+func (vm *VM) executeOpRecord() error {
+	state := vm.CurrentState
+	if state.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	nameIdx := vm.index()
+	state.PC += 2
+	if nameIdx >= len(state.Strings) {
+		return fmt.Errorf("string index out of bounds: %d", nameIdx)
+	}
+	run, ok := vm.opRuns[state.Strings[nameIdx]]
+	if !ok || run.hash == "" {
+		return nil
+	}
+	if err := vm.runStore.Record(run.name, run.hash); err != nil {
+		return fmt.Errorf("failed to record the run of operation %s: %w", run.name, err)
+	}
+	return nil
+}
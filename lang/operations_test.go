@@ -0,0 +1,74 @@
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memRunStore is a RunStore that keeps the runs for as long as the test
+type memRunStore map[string]string
+
+func (s memRunStore) Lookup(op string) (string, bool) {
+	hash, ok := s[op]
+	return hash, ok
+}
+
+func (s memRunStore) Record(op, hash string) error {
+	s[op] = hash
+	return nil
+}
+
+func TestOperationSkippedWhileInputsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "src.txt")
+	output := filepath.Join(dir, "out.txt")
+	for _, path := range []string{input, output} {
+		if err := os.WriteFile(path, []byte("a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := fmt.Sprintf(`operation gen inputs %q outputs %q do
+	print("gen\n")
+end
+operation use depends gen do
+	print("use\n")
+end
+`, input, output)
+	modules, err := CompileBatch(map[string]string{"build": source}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := memRunStore{}
+	run := func(want string) {
+		t.Helper()
+		vm := modules["build"].NewVM(false)
+		vm.SetRunStore(store)
+		var out bytes.Buffer
+		vm.SetOutput(&out)
+		vm.Run()
+		<-vm.StateChan
+		if err := vm.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); got != want {
+			t.Errorf("printed %q, want %q", got, want)
+		}
+	}
+	run("gen\nuse\n")
+	run("use\n")
+
+	if err := os.WriteFile(input, []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run("gen\nuse\n")
+	run("use\n")
+
+	if err := os.Remove(output); err != nil {
+		t.Fatal(err)
+	}
+	run("gen\nuse\n")
+}
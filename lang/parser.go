@@ -1,19 +1,100 @@
 package lang
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
 )
 
 type Term struct {
-	Number   *int    `  @Int`
-	String   *string `| @String`
-	Call     *Call   `| @@`
-	Variable *string `| @Ident`
-	SubExpr  *Expr   `| "(" @@ ")"`
+	Pos      lexer.Position
+	Number   *int64       `  @Int`
+	String   *string      `| @String`
+	Bytes    *string      `| @Bytes`
+	Call     *Call        `| @@`
+	Variable *string      `| @Ident`
+	SubExpr  *Expr        `| "(" @@ ")"`
+	Array    *ArrayLit    `| @@`
+	Cond     *CondExpr    `| @@`
+	Fn       *FnLit       `| @@`
+	Block    *BlockExpr   `| @@`
+	Bool     *bool        `| @("true" | "false")`
+	Nil      bool         `| @"nil"`
+	Index    []*Subscript `@@*`
+}
+
+// Subscript is a trailing `[i]` or `[lo:hi]` on a term, either slice bound
+// can be left out. It's a method call `.name(args)` instead when Method is
+// set, which calls the builtin name with the value as its first argument
+type Subscript struct {
+	Index  *Expr `(   "[" @@?`
+	Slice  bool  `    @":"?`
+	High   *Expr `    @@? "]"`
+	Method *Call `) | "." @@`
+}
+
+// CondExpr is the expression form of if, `if c then a else b end`, the else
+// branch is required so it always produces a value
+type CondExpr struct {
+	Condition *Expr `"if" @@ "then"`
+	Then      *Expr `@@ "else"`
+	Else      *Expr `@@ "end"`
+}
+
+// FnLit is a function literal, `fn(x) do x * 2 end`. The body is a list of
+// statements and the function returns the value of a trailing expression,
+// or nil when there is none
+type FnLit struct {
+	Pos    lexer.Position
+	Params []string    `"fn" "(" ( @Ident ( "," @Ident )* )? ")" "do"`
+	Body   []Statement `@@*`
+	Result *Expr       `@@? "end"`
+}
+
+// BlockExpr is a block used as a value, `do ... end`. Like a function body
+// its value is a trailing expression, or nil when there is none, but it
+// runs in place and shares the variables around it
+type BlockExpr struct {
+	Pos    lexer.Position
+	Body   []Statement `"do" @@*`
+	Result *Expr       `@@? "end"`
+}
+
+// FnDecl is a named function, `fn name(x) do ... end`. Declarations are
+// hoisted to the top of the program or function body they're in, so
+// functions can call each other regardless of order
+type FnDecl struct {
+	Pos  lexer.Position
+	Name string
+	Fn   *FnLit
+}
+
+func (f *FnDecl) Parse(lex *lexer.PeekingLexer) error {
+	checkpoint := lex.MakeCheckpoint()
+	token := lex.Next()
+	if token.Value != "fn" {
+		lex.LoadCheckpoint(checkpoint)
+		return participle.NextMatch
+	}
+	name := lex.Next()
+	if name.Type != lexer.TokenType(basicLexer.Symbols()["Ident"]) {
+		lex.LoadCheckpoint(checkpoint)
+		return participle.NextMatch
+	}
+	f.Pos, f.Name = token.Pos, name.Value
+	f.Fn = &FnLit{Pos: token.Pos}
+	return parseFnRest(lex, f.Fn)
+}
+
+type ArrayLit struct {
+	Elements []*Expr `"[" (@@ ("," @@)*)? "]"`
 }
 
 type Call struct {
@@ -35,56 +116,218 @@ type WhileStmt struct {
 	Body      []Statement `@@+ "end"`
 }
 
+// MatchStmt is a multi-branch `match x case 1 then ... case _ then ... end`,
+// arms compare the subject against a literal and `_` matches anything
+type MatchStmt struct {
+	Pos     lexer.Position
+	Subject *Expr       `"match" @@`
+	Arms    []*MatchArm `@@+ "end"`
+}
+
+// MatchArm is one `case` of a match. A character literal arm is an integer
+// arm, Parse fills in Number from Char
+type MatchArm struct {
+	Pos      lexer.Position
+	Number   *int64      `"case" ( @Int`
+	Char     *string     `       | @Char`
+	String   *string     `       | @String`
+	Wildcard bool        `       | @"_" ) "then"`
+	Body     []Statement `@@+`
+}
+
+// DeferStmt is a `defer ... end` cleanup block, the body runs when the
+// function or operation it's in returns, or when the program finishes for
+// one at the top level, including on the way out of a runtime error
+type DeferStmt struct {
+	Pos  lexer.Position
+	Body []Statement `"defer" @@+ "end"`
+}
+
+// TryStmt runs Body and, if it fails with a runtime error, runs Handler
+// with the error message in ErrVar, `try ... catch err do ... end`
+type TryStmt struct {
+	Pos     lexer.Position
+	Body    []Statement `"try" @@+`
+	ErrVar  string      `"catch" @Ident "do"`
+	Handler []Statement `@@* "end"`
+}
+
+// AssertStmt stops the program when Cond is false, `assert n > 0, "msg"`
+type AssertStmt struct {
+	Pos     lexer.Position
+	Cond    *Expr `"assert" @@`
+	Message *Expr `( "," @@ )?`
+}
+
+// ForStmt is either the numeric loop `for i = 1 to 10 do ... end`, with both
+// bounds inclusive, or the for-each loop `for x in xs do ... end`. Either way
+// the loop variable only exists inside the body
+type ForStmt struct {
+	Pos      lexer.Position
+	Variable string      `"for" @Ident`
+	From     *Expr       `( "=" @@`
+	To       *Expr       `  "to" @@`
+	Iterable *Expr       `| "in" @@ ) "do"`
+	Body     []Statement `@@+ "end"`
+}
+
 var (
-	basicLexer = lexer.MustSimple([]lexer.SimpleRule{
-		{Name: "Keyword", Pattern: `\b(val|if|then|else|end|while|do)\b`},
+	lexerRules = []lexer.SimpleRule{
+		{Name: "Pragma", Pattern: `#pragma\b`},
+		{Name: "Keyword", Pattern: `\b(val|if|then|else|end|while|do|for|var|to|in|defer|match|case|nil|true|false|fn|const|global|operation|depends|try|catch|assert)\b`},
 		{Name: "comment", Pattern: `//.*|/\*.*?\*/`},
 		{Name: "whitespace", Pattern: `\s+`},
-		{Name: "String", Pattern: `"(?:[^"\\]|\\.)*"`},
+		{Name: "Bytes", Pattern: `[bx]"(?:[^"\\]|\\.)*"`},
+		{Name: "String", Pattern: `"(?:[^"\\]|\\(?s:.))*"|` + "`[^`]*`"},
+		{Name: "Char", Pattern: `'(?:[^'\\]|\\.)*'`},
 		{Name: "Ident", Pattern: `\b([a-zA-Z_][a-zA-Z0-9_]*)\b`},
-		{Name: "Punct", Pattern: `==|!=|<=|>=|[-,()*/+%{};&!=:<>\[\]]`},
-		{Name: "Int", Pattern: `\d+`},
-	})
-
-	builtinFunctions = map[string]int{
-		"print": 0,
-		"add":   1,
+		{Name: "Punct", Pattern: `\.\.|\+=|-=|\*=|/=|==|!=|<=|>=|[-,()*/+%{};&!=:<>\[\].]`},
+		{Name: "Int", Pattern: `\d\w*`},
 	}
+	basicLexer = lexer.MustSimple(lexerRules)
+
+	// triviaLexer keeps the comments basicLexer drops, for tooling that
+	// reads them
+	triviaLexer = lexer.MustSimple(keepTrivia(lexerRules))
 )
 
+func keepTrivia(rules []lexer.SimpleRule) []lexer.SimpleRule {
+	kept := slices.Clone(rules)
+	for i, rule := range kept {
+		if rule.Name == "comment" {
+			kept[i].Name = "Comment"
+		}
+	}
+	return kept
+}
+
 type Program struct {
+	Pragmas    []*Pragma   `@@*`
 	Statements []Statement `@@*`
 }
 
+// Pragma is a `#pragma name` directive at the top of a file, switching a
+// compilation mode for the whole program
+type Pragma struct {
+	Pos  lexer.Position
+	Name string `"#pragma" @Ident`
+}
+
+// Statement is one statement, optionally ended by a semicolon so several
+// fit on a line, `val a = 1; val b = 2`
 type Statement struct {
-	Assignment *Assignment ` 	@@`
-	IfStmt     *IfStmt     `| @@`
-	WhileStmt  *WhileStmt  `| @@`
-	Call       *Call       `| @@`
+	Assignment         *Assignment         `( @@`
+	FnDecl             *FnDecl             `| @@`
+	ConstDecl          *ConstDecl          `| @@`
+	GlobalDecl         *GlobalDecl         `| @@`
+	Operation          *Operation          `| @@`
+	IfStmt             *IfStmt             `| @@`
+	WhileStmt          *WhileStmt          `| @@`
+	ForStmt            *ForStmt            `| @@`
+	DeferStmt          *DeferStmt          `| @@`
+	TryStmt            *TryStmt            `| @@`
+	AssertStmt         *AssertStmt         `| @@`
+	MatchStmt          *MatchStmt          `| @@`
+	IndexAssignment    *IndexAssignment    `| @@`
+	Reassignment       *Reassignment       `| @@`
+	CompoundAssignment *CompoundAssignment `| @@`
+	Call               *Call               `| @@ ) ";"?`
 }
 
+// Assignment binds one or more names, `val a, b = 1, 2` evaluates every
+// expression before storing so `val a, b = b, a` swaps. Names declared with
+// var may be assigned again, ones declared with val are meant not to be
 type Assignment struct {
+	Pos        lexer.Position
+	Mutable    bool     `( "val" | @"var" )`
+	Variable   string   `@Ident`
+	Extra      []string `( "," @Ident )* "="`
+	Expr       *Expr    `@@`
+	ExtraExprs []*Expr  `( "," @@ )*`
+}
+
+// Operation is a named unit of work, `operation deploy depends build do
+// ... end`. Operations run once each after the rest of the program, every
+// one after the operations it depends on. One that lists its inputs, `inputs
+// "main.c", "Makefile" outputs "app"`, is skipped while the files it reads
+// are the same as on its last successful run and the ones it writes are
+// there
+type Operation struct {
+	Pos     lexer.Position
+	Name    string      `"operation" @Ident`
+	Depends []string    `( "depends" @Ident ( "," @Ident )* )?`
+	Inputs  []*Expr     `( "inputs" @@ ( "," @@ )* )?`
+	Outputs []*Expr     `( "outputs" @@ ( "," @@ )* )?`
+	Policy  []*OpPolicy `@@* "do"`
+	Body    []Statement `@@* "end"`
+	Tokens  []lexer.Token
+}
+
+// OpPolicy is a clause of what an operation does when it fails. `retry 3`
+// runs it up to 3 more times, `timeout 30s` fails an attempt that runs
+// longer and `on_fail continue` goes on with the operations that don't
+// depend on it once it has failed for good, abort stops the program. The
+// words are only keywords here, they're still free as names
+type OpPolicy struct {
+	Pos     lexer.Position
+	Retry   *string `  "retry" @Int`
+	Timeout *string `| "timeout" @Int`
+	OnFail  *string `| "on_fail" @( "continue" | "abort" )`
+}
+
+// ConstDecl is `const NAME = expr`, a variable that can't be assigned again
+type ConstDecl struct {
+	Pos  lexer.Position
+	Name string `"const" @Ident "="`
+	Expr *Expr  `@@`
+}
+
+// GlobalDecl is `global NAME = expr`, a variable shared by the whole program.
+// Globals have slots of their own apart from the locals of any function and
+// can be declared anywhere, functions see them before the declaration runs
+type GlobalDecl struct {
+	Pos  lexer.Position
+	Name string `"global" @Ident "="`
+	Expr *Expr  `@@`
+}
+
+// Reassignment is `x = expr` or `a, b = b, a`, storing into variables that
+// already exist
+type Reassignment struct {
+	Pos       lexer.Position
+	Variables []string `@Ident ( "," @Ident )* "="`
+	Exprs     []*Expr  `@@ ( "," @@ )*`
+}
+
+// IndexAssignment is `xs[i] = expr`, storing into an element of an array
+type IndexAssignment struct {
+	Pos      lexer.Position
+	Variable string `@Ident`
+	Index    *Expr  `"[" @@ "]"`
+	Expr     *Expr  `"=" @@`
+}
+
+// CompoundAssignment is `x += expr` and friends, the compiler expands it into
+// a load, the arithmetic op and a store back into the same variable.
+type CompoundAssignment struct {
 	Pos      lexer.Position
-	Variable string `"val" @Ident "="`
+	Variable string `@Ident`
+	Op       string `@("+=" | "-=" | "*=" | "/=")`
 	Expr     *Expr  `@@`
 }
 
 // First, let's define precedence levels for our operators
 const (
 	PREC_NONE    = 0
-	PREC_COMPARE = 1 // == != < <= > >=
-	PREC_TERM    = 2 // + -
-	PREC_FACTOR  = 3 // * / %
+	PREC_COMPARE = 1 // == != < <= > >= in
+	PREC_RANGE   = 2 // ..
+	PREC_TERM    = 3 // + -
+	PREC_FACTOR  = 4 // * / %
 )
 
-// Define a type for our parser functions
-// type prefixFn func(*Compiler) (*Expr, error)
-type infixFn func(*Compiler, *Expr) (*Expr, error)
-
 // Define operator info
 type operatorInfo struct {
 	precedence int
-	infix      infixFn
 }
 
 // Create operator precedence table
@@ -92,75 +335,70 @@ var operators map[string]operatorInfo
 
 func init() {
 	operators = map[string]operatorInfo{
-		"+":  {PREC_TERM, parseInfixOp},
-		"-":  {PREC_TERM, parseInfixOp},
-		"*":  {PREC_FACTOR, parseInfixOp},
-		"/":  {PREC_FACTOR, parseInfixOp},
-		"%":  {PREC_FACTOR, parseInfixOp},
-		"==": {PREC_COMPARE, parseInfixOp},
-		"!=": {PREC_COMPARE, parseInfixOp},
-		"<":  {PREC_COMPARE, parseInfixOp},
-		"<=": {PREC_COMPARE, parseInfixOp},
-		">":  {PREC_COMPARE, parseInfixOp},
-		">=": {PREC_COMPARE, parseInfixOp},
+		"+":  {PREC_TERM},
+		"-":  {PREC_TERM},
+		"*":  {PREC_FACTOR},
+		"/":  {PREC_FACTOR},
+		"%":  {PREC_FACTOR},
+		"==": {PREC_COMPARE},
+		"!=": {PREC_COMPARE},
+		"<":  {PREC_COMPARE},
+		"<=": {PREC_COMPARE},
+		">":  {PREC_COMPARE},
+		">=": {PREC_COMPARE},
+		"..": {PREC_RANGE},
+		"in": {PREC_COMPARE},
 	}
 }
 
-// First, update the Expr type to be simpler since we'll handle the parsing ourselves
+// Expr is a term, or a term and an operator applied to the rest of the
+// expression. An operation on the left is wrapped up as the term, so
+// `1 - 2 - 3` is `(1 - 2) - 3` with 1 - 2 as a SubExpr
 type Expr struct {
 	Left  *Term
 	Op    *string
 	Right *Expr
 }
 
-// Add the Parse method to implement the Parseable interface
+// Parse implements participle's Parseable with precedence climbing, every
+// operator is left associative
 func (e *Expr) Parse(lex *lexer.PeekingLexer) error {
-	// Parse the initial term
-	term := &Term{}
-	if err := term.Parse(lex); err != nil {
+	parsed, err := parseBinary(lex, PREC_COMPARE)
+	if err != nil {
 		return err
 	}
-	e.Left = term
+	*e = *parsed
+	return nil
+}
 
-	// Look for an operator
-	token := lex.Peek()
-	if token == nil {
-		return nil
+// parseBinary parses a term followed by operators binding at least as
+// tightly as minPrec, their right operands only take tighter ones
+func parseBinary(lex *lexer.PeekingLexer, minPrec int) (*Expr, error) {
+	term := &Term{}
+	if err := term.Parse(lex); err != nil {
+		return nil, err
 	}
+	left := &Expr{Left: term}
 
-	// Check if the token is an operator
-	if op, isOp := operators[token.Value]; isOp {
-		// Consume the operator token
+	for {
+		token := lex.Peek()
+		if token == nil {
+			return left, nil
+		}
+		op, isOp := operators[token.Value]
+		if !isOp || op.precedence < minPrec {
+			return left, nil
+		}
 		lex.Next()
-		e.Op = &token.Value
-
-		// Parse the right side with the appropriate precedence
-		right := &Expr{}
-		if err := right.Parse(lex); err != nil {
-			return err
+		right, err := parseBinary(lex, op.precedence+1)
+		if err != nil {
+			return nil, err
 		}
-
-		// If the right side has an operator with higher precedence,
-		// restructure the tree
-		if right.Op != nil {
-			rightOp := operators[*right.Op]
-			if rightOp.precedence > op.precedence {
-				// Create a new expression for the higher precedence operation
-				newExpr := &Expr{
-					Left:  right.Left,
-					Op:    right.Op,
-					Right: right.Right,
-				}
-
-				// Make the current expression use the higher precedence result
-				e.Right = newExpr
-				return nil
-			}
+		if left.Op != nil {
+			left = &Expr{Left: &Term{Pos: left.Left.Pos, SubExpr: left}}
 		}
-		e.Right = right
+		left = &Expr{Left: left.Left, Op: &token.Value, Right: right}
 	}
-
-	return nil
 }
 
 // func (t *Term) toExpr() *Expr {
@@ -172,51 +410,44 @@ func (t *Term) Parse(lex *lexer.PeekingLexer) error {
 	if token == nil {
 		return fmt.Errorf("unexpected end of input")
 	}
+	t.Pos = token.Pos
 
 	switch token.Type {
 	case lexer.TokenType(basicLexer.Symbols()["Int"]):
 		lex.Next()
-		num, err := strconv.Atoi(token.Value)
+		num, err := parseInt(token.Value)
+		if errors.Is(err, strconv.ErrRange) {
+			return languageError(token.Pos, ErrInvalidInt, helpIntRange, token.Value)
+		}
+		if err != nil {
+			return languageError(token.Pos, ErrInvalidInt, "", token.Value)
+		}
+		t.Number = &num
+
+	case lexer.TokenType(basicLexer.Symbols()["Char"]):
+		lex.Next()
+		code, err := parseChar(token.Pos, token.Value)
 		if err != nil {
 			return err
 		}
-		t.Number = &num
+		t.Number = &code
 
 	case lexer.TokenType(basicLexer.Symbols()["String"]):
 		lex.Next()
 		t.String = &token.Value
 
+	case lexer.TokenType(basicLexer.Symbols()["Bytes"]):
+		lex.Next()
+		t.Bytes = &token.Value
+
 	case lexer.TokenType(basicLexer.Symbols()["Ident"]):
 		lex.Next()
 		// Look ahead to see if this is a function call
 		next := lex.Peek()
 		if next != nil && next.Value == "(" {
-			// Parse function call
-			call := &Call{Function: token.Value}
-			call.Pos = token.Pos
-			lex.Next() // Consume '('
-
-			// Parse arguments
-			for {
-				next = lex.Peek()
-				if next == nil {
-					return fmt.Errorf("unexpected end of input in function call")
-				}
-				if next.Value == ")" {
-					lex.Next() // Consume ')'
-					break
-				}
-				if len(call.Args) > 0 {
-					if next.Value != "," {
-						return fmt.Errorf("expected ',' between arguments")
-					}
-					lex.Next() // Consume ','
-				}
-				arg := &Expr{}
-				if err := arg.Parse(lex); err != nil {
-					return err
-				}
-				call.Args = append(call.Args, arg)
+			call := &Call{Pos: token.Pos, Function: token.Value}
+			if err := parseCallArgs(lex, call); err != nil {
+				return err
 			}
 			t.Call = call
 		} else {
@@ -224,6 +455,61 @@ func (t *Term) Parse(lex *lexer.PeekingLexer) error {
 			t.Variable = &token.Value
 		}
 
+	case lexer.TokenType(basicLexer.Symbols()["Keyword"]):
+		if token.Value == "nil" {
+			lex.Next()
+			t.Nil = true
+			break
+		}
+		if token.Value == "true" || token.Value == "false" {
+			lex.Next()
+			b := token.Value == "true"
+			t.Bool = &b
+			break
+		}
+		if token.Value == "fn" {
+			fn, err := parseFnLit(lex)
+			if err != nil {
+				return err
+			}
+			t.Fn = fn
+			break
+		}
+		if token.Value == "do" {
+			block := &BlockExpr{Pos: lex.Next().Pos} // Consume 'do'
+			body, result, err := parseBody(lex, "block")
+			if err != nil {
+				return err
+			}
+			block.Body, block.Result = body, result
+			t.Block = block
+			break
+		}
+		if token.Value != "if" {
+			return fmt.Errorf("unexpected keyword: %s", token.Value)
+		}
+		lex.Next() // Consume 'if'
+		cond := &CondExpr{Condition: &Expr{}, Then: &Expr{}, Else: &Expr{}}
+		if err := cond.Condition.Parse(lex); err != nil {
+			return err
+		}
+		if err := expectKeyword(lex, "then"); err != nil {
+			return err
+		}
+		if err := cond.Then.Parse(lex); err != nil {
+			return err
+		}
+		if err := expectKeyword(lex, "else"); err != nil {
+			return err
+		}
+		if err := cond.Else.Parse(lex); err != nil {
+			return err
+		}
+		if err := expectKeyword(lex, "end"); err != nil {
+			return err
+		}
+		t.Cond = cond
+
 	case lexer.TokenType(basicLexer.Symbols()["Punct"]):
 		if token.Value == "(" {
 			lex.Next() // Consume '('
@@ -237,6 +523,31 @@ func (t *Term) Parse(lex *lexer.PeekingLexer) error {
 			}
 			lex.Next() // Consume ')'
 			t.SubExpr = expr
+		} else if token.Value == "[" {
+			lex.Next() // Consume '['
+			array := &ArrayLit{}
+			for {
+				next := lex.Peek()
+				if next == nil {
+					return fmt.Errorf("unexpected end of input in array literal")
+				}
+				if next.Value == "]" {
+					lex.Next() // Consume ']'
+					break
+				}
+				if len(array.Elements) > 0 {
+					if next.Value != "," {
+						return fmt.Errorf("expected ',' between array elements")
+					}
+					lex.Next() // Consume ','
+				}
+				elem := &Expr{}
+				if err := elem.Parse(lex); err != nil {
+					return err
+				}
+				array.Elements = append(array.Elements, elem)
+			}
+			t.Array = array
 		} else {
 			return fmt.Errorf("unexpected token: %s", token.Value)
 		}
@@ -245,81 +556,246 @@ func (t *Term) Parse(lex *lexer.PeekingLexer) error {
 		return fmt.Errorf("unexpected token type: %v", token.Type)
 	}
 
-	return nil
-}
-
-func Parse(sourceFile string, sourceCode string) (program *Program, err error) {
-	parser := participle.MustBuild[Program](
-		participle.Lexer(basicLexer),
-	)
-
-	program, err = parser.ParseString(sourceFile, sourceCode)
-	if err != nil {
-		err = fmt.Errorf("parse error: %v", err)
+	// Any number of trailing index, slice or method call operations, e.g.
+	// xs[0][1:] or s.split(",")[0]
+	for {
+		next := lex.Peek()
+		if next != nil && next.Value == "." {
+			lex.Next() // Consume '.'
+			name := lex.Next()
+			if name.Type != lexer.TokenType(basicLexer.Symbols()["Ident"]) {
+				return fmt.Errorf("expected method name after '.'")
+			}
+			if next = lex.Peek(); next == nil || next.Value != "(" {
+				return fmt.Errorf("expected '(' after method %s", name.Value)
+			}
+			method := &Call{Pos: name.Pos, Function: name.Value}
+			if err := parseCallArgs(lex, method); err != nil {
+				return err
+			}
+			t.Index = append(t.Index, &Subscript{Method: method})
+			continue
+		}
+		if next == nil || next.Value != "[" {
+			break
+		}
+		lex.Next() // Consume '['
+		sub := &Subscript{}
+		if next = lex.Peek(); next != nil && next.Value != ":" {
+			sub.Index = &Expr{}
+			if err := sub.Index.Parse(lex); err != nil {
+				return err
+			}
+		}
+		if next = lex.Peek(); next != nil && next.Value == ":" {
+			lex.Next() // Consume ':'
+			sub.Slice = true
+			if next = lex.Peek(); next != nil && next.Value != "]" {
+				sub.High = &Expr{}
+				if err := sub.High.Parse(lex); err != nil {
+					return err
+				}
+			}
+		}
+		if sub.Index == nil && !sub.Slice {
+			return fmt.Errorf("expected index")
+		}
+		next = lex.Peek()
+		if next == nil || next.Value != "]" {
+			return fmt.Errorf("expected closing bracket")
+		}
+		lex.Next() // Consume ']'
+		t.Index = append(t.Index, sub)
 	}
 
-	return
+	return nil
 }
 
-// Add parsing functions
-func parseInfixOp(c *Compiler, left *Expr) (*Expr, error) {
-	// Create a new expression with the left operand
-	expr := &Expr{
-		Left: left.Left,
-		Op:   left.Op,
+// parseCallArgs parses the parenthesized arguments of a call, the lexer is
+// at the '('
+func parseCallArgs(lex *lexer.PeekingLexer, call *Call) error {
+	lex.Next() // Consume '('
+	for {
+		next := lex.Peek()
+		if next == nil {
+			return fmt.Errorf("unexpected end of input in function call")
+		}
+		if next.Value == ")" {
+			lex.Next() // Consume ')'
+			return nil
+		}
+		if len(call.Args) > 0 {
+			if next.Value != "," {
+				return fmt.Errorf("expected ',' between arguments")
+			}
+			lex.Next() // Consume ','
+		}
+		arg := &Expr{}
+		if err := arg.Parse(lex); err != nil {
+			return err
+		}
+		call.Args = append(call.Args, arg)
 	}
+}
 
-	// Get the operator's precedence
-	op := *left.Op
-	precedence := operators[op].precedence
+// statementParser parses single statements of a function body, the body is
+// reached from Term.Parse which otherwise only knows about expressions
+var statementParser = participle.MustBuild[Statement](
+	participle.Lexer(dialectLexer{}),
+)
 
-	// Parse the right side with precedence
-	right, err := parsePrecedence(c, precedence+1)
-	if err != nil {
+func parseFnLit(lex *lexer.PeekingLexer) (*FnLit, error) {
+	fn := &FnLit{Pos: lex.Next().Pos} // Consume 'fn'
+	if err := parseFnRest(lex, fn); err != nil {
 		return nil, err
 	}
-
-	expr.Right = right
-	return expr, nil
+	return fn, nil
 }
 
-func parsePrecedence(c *Compiler, precedence int) (*Expr, error) {
-	// Parse the left-hand expression
-	left, err := parsePrimary(c)
+// parseFnRest parses what follows `fn` or `fn name`, the parameter list and
+// the body
+func parseFnRest(lex *lexer.PeekingLexer, fn *FnLit) error {
+	if next := lex.Peek(); next == nil || next.Value != "(" {
+		return fmt.Errorf("expected '(' after fn")
+	}
+	lex.Next() // Consume '('
+	for {
+		next := lex.Peek()
+		if next == nil {
+			return fmt.Errorf("unexpected end of input in parameter list")
+		}
+		if next.Value == ")" {
+			lex.Next() // Consume ')'
+			break
+		}
+		if len(fn.Params) > 0 {
+			if next.Value != "," {
+				return fmt.Errorf("expected ',' between parameters")
+			}
+			lex.Next() // Consume ','
+			next = lex.Peek()
+		}
+		if next.Type != lexer.TokenType(basicLexer.Symbols()["Ident"]) {
+			return fmt.Errorf("expected parameter name")
+		}
+		fn.Params = append(fn.Params, lex.Next().Value)
+	}
+	if err := expectKeyword(lex, "do"); err != nil {
+		return err
+	}
+
+	body, result, err := parseBody(lex, "function body")
 	if err != nil {
-		return nil, err
+		return err
 	}
+	fn.Body, fn.Result = body, result
+	return nil
+}
 
+// parseBody parses statements up to and including `end`, an expression
+// directly followed by `end` is the result rather than a statement
+func parseBody(lex *lexer.PeekingLexer, what string) ([]Statement, *Expr, error) {
+	var body []Statement
+	var result *Expr
 	for {
-		if left.Op == nil {
-			break
+		next := lex.Peek()
+		if next == nil || next.EOF() {
+			return nil, nil, fmt.Errorf("unexpected end of input in %s", what)
+		}
+		if next.Value == "end" {
+			lex.Next() // Consume 'end'
+			return body, result, nil
 		}
 
-		op := *left.Op
-		info, exists := operators[op]
-		if !exists || info.precedence < precedence {
-			break
+		checkpoint := lex.MakeCheckpoint()
+		expr := &Expr{}
+		if err := expr.Parse(lex); err == nil {
+			if next = lex.Peek(); next != nil && next.Value == ";" {
+				lex.Next()
+				next = lex.Peek()
+			}
+			if next != nil && next.Value == "end" {
+				result = expr
+				continue
+			}
 		}
+		lex.LoadCheckpoint(checkpoint)
 
-		// Parse the operator
-		expr, err := info.infix(c, left)
+		stmt, err := statementParser.ParseFromLexer(lex, participle.AllowTrailing(true))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		left = expr
+		body = append(body, *stmt)
 	}
+}
 
-	return left, nil
+func expectKeyword(lex *lexer.PeekingLexer, keyword string) error {
+	next := lex.Peek()
+	if next == nil || next.Value != keyword {
+		return fmt.Errorf("expected '%s'", keyword)
+	}
+	lex.Next()
+	return nil
 }
 
-func parsePrimary(c *Compiler) (*Expr, error) {
-	// This will parse a basic term (number, string, variable, etc.)
-	return &Expr{
-		Left: &Term{
-			Number:   nil, // Fill these in based on the token
-			String:   nil,
-			Variable: nil,
-			SubExpr:  nil,
+func Parse(sourceFile string, sourceCode string) (program *Program, err error) {
+	parser := participle.MustBuild[Program](
+		participle.Lexer(dialectLexer{}),
+	)
+
+	program, err = parser.ParseString(sourceFile, sourceCode)
+	if err != nil {
+		return program, fmt.Errorf("parse error: %v", err)
+	}
+	return program, charArms(program.Statements)
+}
+
+// charArms gives the character literal arms of every match their code point
+func charArms(stmts []Statement) error {
+	var err error
+	visitor{
+		stmt: func(stmt *Statement, _ *FnLit) {
+			if stmt.MatchStmt == nil {
+				return
+			}
+			for _, arm := range stmt.MatchStmt.Arms {
+				if arm.Char == nil || err != nil {
+					continue
+				}
+				code, charErr := parseChar(arm.Pos, *arm.Char)
+				arm.Number, err = &code, charErr
+			}
 		},
-	}, nil
+	}.statements(stmts, nil)
+	return err
+}
+
+// parseChar reads a character literal, `'a'` or an escape like `'\n'`, as
+// its code point
+func parseChar(pos lexer.Position, lit string) (int64, error) {
+	if lit == `'\''` {
+		return '\'', nil
+	}
+	s, err := unescapeString(lit)
+	if err != nil || utf8.RuneCountInString(s) != 1 || !utf8.ValidString(s) {
+		return 0, languageError(pos, ErrInvalidChar, "", lit)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return int64(r), nil
 }
+
+// parseInt reads an integer literal, 0x, 0o and 0b prefixes pick the base and
+// underscores may separate digits, as in 1_000_000. A plain leading zero
+// stays decimal.
+func parseInt(lit string) (int64, error) {
+	if len(lit) > 2 && lit[0] == '0' && strings.ContainsRune("xXoObB", rune(lit[1])) {
+		return strconv.ParseInt(lit, 0, 64)
+	}
+	if !decimalPattern.MatchString(lit) {
+		return 0, fmt.Errorf("invalid integer literal %s", lit)
+	}
+	return strconv.ParseInt(strings.ReplaceAll(lit, "_", ""), 10, 64)
+}
+
+// decimalPattern only allows underscores between digits
+var decimalPattern = regexp.MustCompile(`^\d+(_\d+)*$`)
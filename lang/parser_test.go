@@ -0,0 +1,44 @@
+package lang
+
+import "testing"
+
+// The trees are written the way ExplainParse prints them, every operation
+// in parentheses
+func TestParseExprGolden(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"1 - 2 - 3", "((1 - 2) - 3)"},
+		{"8 / 4 / 2", "((8 / 4) / 2)"},
+		{"2 * 3 + 1", "((2 * 3) + 1)"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"1 + 2 * 3 - 4", "((1 + (2 * 3)) - 4)"},
+		{"1 - 2 * 3 % 4 + 5", "((1 - ((2 * 3) % 4)) + 5)"},
+		{"(1 - 2) * 3", "((1 - 2) * 3)"},
+		{"1 - (2 - 3)", "(1 - (2 - 3))"},
+		{"a + 1 < b * 2", "((a + 1) < (b * 2))"},
+		{"a == b != c", "((a == b) != c)"},
+		{"x in xs == y", "((x in xs) == y)"},
+		{"1..10", "(1 .. 10)"},
+		{"1 + 1..n - 1", "((1 + 1) .. (n - 1))"},
+		{"a * 2..b * 2 + 1", "((a * 2) .. ((b * 2) + 1))"},
+		{"1..n == r", "((1 .. n) == r)"},
+		{"x in 1..n", "(x in (1 .. n))"},
+		{"x + 1 in 1..n * 2", "((x + 1) in (1 .. (n * 2)))"},
+		{"1..2..3", "((1 .. 2) .. 3)"},
+		{"a < 2 == false", "((a < 2) == false)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			program, err := Parse("golden.dl", "val r = "+tt.source)
+			if err != nil {
+				t.Fatalf("parse %q: %v", tt.source, err)
+			}
+			got := program.Statements[0].Assignment.Expr.Parenthesized()
+			if got != tt.want {
+				t.Errorf("parse %q\n got %s\nwant %s", tt.source, got, tt.want)
+			}
+		})
+	}
+}
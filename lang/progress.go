@@ -0,0 +1,68 @@
+package lang
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// ProgressSink receives the reports made by the `progress` builtin, the VM
+// renders progress bars on the terminal by default
+type ProgressSink interface {
+	Progress(pct int, msg string)
+}
+
+const progressBarWidth = 30
+
+// TTYProgressSink redraws a single progress bar line in place. When Out
+// isn't a terminal every report gets a line of its own instead
+type TTYProgressSink struct {
+	Out io.Writer
+}
+
+func (s *TTYProgressSink) Progress(pct int, msg string) {
+	filled := pct * progressBarWidth / 100
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+	if !isTerminal(s.Out) {
+		fmt.Fprintf(s.Out, "[%s] %3d%% %s\n", bar, pct, msg)
+		return
+	}
+	// Clear the rest of the line so a shorter message doesn't leave junk behind
+	fmt.Fprintf(s.Out, "\r[%s] %3d%% %s\033[K", bar, pct, msg)
+	if pct >= 100 {
+		fmt.Fprintln(s.Out)
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && readline.IsTerminal(int(f.Fd()))
+}
+
+// JSONProgressSink writes one JSON event per report, for CI systems that
+// consume machine readable output
+type JSONProgressSink struct {
+	Out io.Writer
+}
+
+type progressEvent struct {
+	Event   string `json:"event"`
+	Percent int    `json:"pct"`
+	Message string `json:"msg"`
+}
+
+func (s *JSONProgressSink) Progress(pct int, msg string) {
+	line, err := json.Marshal(progressEvent{Event: "progress", Percent: pct, Message: msg})
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(s.Out, string(line))
+}
+
+func (vm *VM) SetProgressSink(sink ProgressSink) {
+	vm.progressSink = sink
+}
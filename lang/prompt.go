@@ -0,0 +1,84 @@
+package lang
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PromptMode decides how the `confirm` and `choose` builtins get their
+// answers
+type PromptMode int
+
+const (
+	// PromptInteractive asks on the terminal, falling back to the defaults
+	// when stdin isn't one
+	PromptInteractive PromptMode = iota
+	// PromptAssumeYes answers yes to every confirmation and picks the first
+	// option of every choice
+	PromptAssumeYes
+	// PromptNoInput never reads input, confirmations are declined and
+	// choices pick their first option
+	PromptNoInput
+)
+
+func (vm *VM) SetPromptMode(mode PromptMode) {
+	vm.promptMode = mode
+}
+
+func (vm *VM) canPrompt() bool {
+	return vm.promptMode == PromptInteractive && isTerminal(os.Stdin)
+}
+
+func (vm *VM) readAnswer() (string, bool) {
+	if vm.input == nil {
+		vm.input = bufio.NewReader(os.Stdin)
+	}
+	line, err := vm.input.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimSpace(line), true
+}
+
+func (vm *VM) confirm(msg string) bool {
+	if !vm.canPrompt() {
+		return vm.promptMode == PromptAssumeYes
+	}
+	for {
+		fmt.Fprintf(vm.output, "%s [y/n] ", msg)
+		answer, ok := vm.readAnswer()
+		if !ok {
+			return false
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
+
+// choose returns the index of the picked option
+func (vm *VM) choose(msg string, options []string) int {
+	if !vm.canPrompt() || len(options) == 0 {
+		return 0
+	}
+	fmt.Fprintln(vm.output, msg)
+	for i, option := range options {
+		fmt.Fprintf(vm.output, "  %d) %s\n", i+1, option)
+	}
+	for {
+		fmt.Fprintf(vm.output, "choice [1-%d]: ", len(options))
+		answer, ok := vm.readAnswer()
+		if !ok {
+			return 0
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+			return n - 1
+		}
+	}
+}
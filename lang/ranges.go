@@ -0,0 +1,30 @@
+package lang
+
+import "fmt"
+
+// RangeValue is the integers from From to To, both included, as written
+// `1..10`. It's empty when From is past To
+type RangeValue struct {
+	From, To int
+}
+
+func (r RangeValue) Type() ValueType { return ValueTypeRange }
+
+// Len is how many integers the range holds
+func (r RangeValue) Len() int {
+	return max(0, r.To-r.From+1)
+}
+
+func (vm *VM) executeRange() error {
+	if len(vm.CurrentState.Stack) < 2 {
+		return fmt.Errorf("stack underflow")
+	}
+	to, okTo := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1].(IntValue)
+	from, okFrom := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2].(IntValue)
+	if !okFrom || !okTo {
+		return runtimeError(ErrRangeBounds)
+	}
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, RangeValue{From: int(from), To: int(to)})
+	return nil
+}
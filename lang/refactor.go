@@ -0,0 +1,159 @@
+package lang
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+var identPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ExtractVariable hoists the expression at source[start:end] into a `val`
+// declared right before the statement it appears in, and replaces it with
+// name. The rest of the source is left as written, the edit is refused
+// unless the program parses to the same expressions afterwards
+func ExtractVariable(filename, source string, start, end int, name string) (string, error) {
+	if start < 0 || end > len(source) || start >= end {
+		return "", fmt.Errorf("invalid range %d:%d for a source of %d bytes", start, end, len(source))
+	}
+	for start < end && isSpace(source[start]) {
+		start++
+	}
+	for end > start && isSpace(source[end-1]) {
+		end--
+	}
+	selected := source[start:end]
+
+	if !identPattern.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid variable name", name)
+	}
+	if err := checkNameUnused(filename, source, name); err != nil {
+		return "", err
+	}
+
+	decl, err := statementParser.ParseString(filename, "val "+name+" = "+selected)
+	if err != nil || decl.Assignment == nil || len(decl.Assignment.ExtraExprs) > 0 {
+		return "", fmt.Errorf("%q is not an expression", selected)
+	}
+
+	program, err := Parse(filename, source)
+	if err != nil {
+		return "", err
+	}
+
+	// The statement holding the selection is the last one starting before it
+	var target *Statement
+	visitor{stmt: func(stmt *Statement, _ *FnLit) {
+		if stmt.Pos().Offset <= start {
+			target = stmt
+		}
+	}}.statements(program.Statements, nil)
+	if target == nil {
+		return "", fmt.Errorf("the selection is not inside a statement")
+	}
+	pos := target.Pos()
+	if target.WhileStmt != nil {
+		return "", fmt.Errorf("%s: cannot extract from a while condition, it is evaluated on every iteration", pos)
+	}
+
+	// Declare on a line of its own when the statement starts a line,
+	// otherwise inline in front of it
+	insertAt := pos.Offset
+	lineStart := strings.LastIndexByte(source[:pos.Offset], '\n') + 1
+	indent := source[lineStart:pos.Offset]
+	declaration := "val " + name + " = " + selected + " "
+	if strings.TrimSpace(indent) == "" {
+		insertAt = lineStart
+		declaration = indent + "val " + name + " = " + selected + "\n"
+	}
+	edited := source[:insertAt] + declaration + source[insertAt:start] + name + source[end:]
+
+	if err := checkExtraction(filename, program, edited, name); err != nil {
+		return "", err
+	}
+	return edited, nil
+}
+
+// checkExtraction makes sure that substituting the extracted expression back
+// into the edited program gives the same expressions as the original, so
+// the selection was a whole expression and is still evaluated where it was
+func checkExtraction(filename string, original *Program, edited, name string) error {
+	program, err := Parse(filename, edited)
+	if err != nil {
+		return fmt.Errorf("the selection cannot be extracted, the edited program does not parse: %w", err)
+	}
+
+	var decl *Statement
+	var declOwner, useOwner *FnLit
+	var use *Term
+	visitor{
+		stmt: func(stmt *Statement, owner *FnLit) {
+			if stmt.Assignment != nil && stmt.Assignment.Variable == name {
+				decl, declOwner = stmt, owner
+			}
+		},
+		term: func(term *Term, owner *FnLit) {
+			if term.Variable != nil && *term.Variable == name {
+				use, useOwner = term, owner
+			}
+		},
+	}.statements(program.Statements, nil)
+	if decl == nil || use == nil {
+		return fmt.Errorf("the selection cannot be extracted here")
+	}
+	if declOwner != useOwner {
+		return fmt.Errorf("the selection is inside a function literal and cannot be moved out of it")
+	}
+
+	use.Variable = nil
+	use.SubExpr = decl.Assignment.Expr
+	before := expressionShapes(original, nil)
+	after := expressionShapes(program, decl)
+	if strings.Join(before, "\n") != strings.Join(after, "\n") {
+		return fmt.Errorf("the selection is not a complete expression")
+	}
+	return nil
+}
+
+// expressionShapes lists every expression of the program fully
+// parenthesized, leaving out the statement skip
+func expressionShapes(program *Program, skip *Statement) []string {
+	var shapes []string
+	visitor{stmt: func(stmt *Statement, _ *FnLit) {
+		if stmt == skip {
+			return
+		}
+		for _, expr := range stmt.exprs() {
+			shapes = append(shapes, expr.Parenthesized())
+		}
+	}}.statements(program.Statements, nil)
+	return shapes
+}
+
+func checkNameUnused(filename, source, name string) error {
+	lex, err := basicLexer.Lex(filename, strings.NewReader(source))
+	if err != nil {
+		return err
+	}
+	tokens, err := lexer.ConsumeAll(lex)
+	if err != nil {
+		return err
+	}
+	ident := basicLexer.Symbols()["Ident"]
+	for _, token := range tokens {
+		if token.Value != name {
+			continue
+		}
+		if token.Type != ident {
+			return fmt.Errorf("%s is a keyword", name)
+		}
+		return fmt.Errorf("%s: %s is already used", token.Pos, name)
+	}
+	return nil
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
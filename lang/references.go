@@ -0,0 +1,105 @@
+package lang
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Reference is one place a name appears. Declarations point at the start
+// of the declaring statement
+type Reference struct {
+	Pos  lexer.Position
+	Kind string
+}
+
+// FindReferences lists every place symbol is declared, assigned, read,
+// called or depended on across the programs, ordered by file and offset.
+// Names are matched as written, a parameter that shadows a global is
+// reported along with it
+func FindReferences(programs []*Program, symbol string) []Reference {
+	var refs []Reference
+	add := func(pos lexer.Position, kind string) {
+		refs = append(refs, Reference{Pos: pos, Kind: kind})
+	}
+	params := func(fn *FnLit) {
+		if slices.Contains(fn.Params, symbol) {
+			add(fn.Pos, "parameter")
+		}
+	}
+
+	v := visitor{
+		stmt: func(stmt *Statement, _ *FnLit) {
+			pos := stmt.Pos()
+			switch {
+			case stmt.Assignment != nil:
+				if stmt.Assignment.Variable == symbol || slices.Contains(stmt.Assignment.Extra, symbol) {
+					add(pos, "declaration")
+				}
+			case stmt.ConstDecl != nil:
+				if stmt.ConstDecl.Name == symbol {
+					add(pos, "declaration")
+				}
+			case stmt.GlobalDecl != nil:
+				if stmt.GlobalDecl.Name == symbol {
+					add(pos, "declaration")
+				}
+			case stmt.FnDecl != nil:
+				if stmt.FnDecl.Name == symbol {
+					add(pos, "declaration")
+				}
+				params(stmt.FnDecl.Fn)
+			case stmt.Operation != nil:
+				if stmt.Operation.Name == symbol {
+					add(pos, "declaration")
+				}
+				if slices.Contains(stmt.Operation.Depends, symbol) {
+					add(pos, "depends")
+				}
+			case stmt.ForStmt != nil:
+				if stmt.ForStmt.Variable == symbol {
+					add(pos, "declaration")
+				}
+			case stmt.TryStmt != nil:
+				if stmt.TryStmt.ErrVar == symbol {
+					add(pos, "declaration")
+				}
+			case stmt.Reassignment != nil:
+				if slices.Contains(stmt.Reassignment.Variables, symbol) {
+					add(pos, "assignment")
+				}
+			case stmt.IndexAssignment != nil:
+				if stmt.IndexAssignment.Variable == symbol {
+					add(pos, "assignment")
+				}
+			case stmt.CompoundAssignment != nil:
+				if stmt.CompoundAssignment.Variable == symbol {
+					add(pos, "assignment")
+				}
+			case stmt.Call != nil:
+				if stmt.Call.Function == symbol {
+					add(pos, "call")
+				}
+			}
+		},
+		term: func(term *Term, _ *FnLit) {
+			switch {
+			case term.Variable != nil && *term.Variable == symbol:
+				add(term.Pos, "use")
+			case term.Call != nil && term.Call.Function == symbol:
+				add(term.Call.Pos, "call")
+			case term.Fn != nil:
+				params(term.Fn)
+			}
+		},
+	}
+	for _, program := range programs {
+		v.statements(program.Statements, nil)
+	}
+
+	slices.SortStableFunc(refs, func(a, b Reference) int {
+		return cmp.Or(cmp.Compare(a.Pos.Filename, b.Pos.Filename), cmp.Compare(a.Pos.Offset, b.Pos.Offset))
+	})
+	return refs
+}
@@ -0,0 +1,75 @@
+package lang
+
+import "fmt"
+
+// Builtin is the metadata of a builtin function, MaxArgs is -1 when it takes
+// any number of arguments
+type Builtin struct {
+	Name    string
+	MinArgs int
+	MaxArgs int
+	// Effects is set for builtins that read the environment or interact
+	// with the user, they're unavailable in sandbox mode
+	Effects bool
+}
+
+// builtinTable lists the builtins in function index order, CALL refers to
+// them by their position
+var builtinTable = []Builtin{
+	{"print", 1, -1, false},
+	{"add", 2, 2, false},
+	{"progress", 1, 2, false},
+	{"secret", 1, 1, true},
+	{"confirm", 1, 1, true},
+	{"choose", 2, 2, true},
+	{"big", 1, 1, false},
+	{"hex", 1, 1, false},
+	{"base64_encode", 1, 1, false},
+	{"base64_decode", 1, 1, false},
+	{"hash_sha256", 1, 1, false},
+	{"bytes", 1, 1, false},
+	{"len", 1, 1, false},
+	{"len_runes", 1, 1, false},
+	{"char_at", 2, 2, false},
+	{"string", 1, 1, false},
+	{"array", 1, 1, false},
+	{"upper", 1, 1, false},
+	{"lower", 1, 1, false},
+	{"trim", 1, 1, false},
+	{"replace", 3, 3, false},
+	{"split", 2, 2, false},
+	{"join", 2, 2, false},
+	{"format", 1, -1, false},
+	{"exit", 0, 1, false},
+	{"on_interrupt", 1, 1, true},
+}
+
+var builtinFunctions = func() map[string]int {
+	indices := make(map[string]int, len(builtinTable))
+	for i, builtin := range builtinTable {
+		indices[builtin.Name] = i
+	}
+	return indices
+}()
+
+// Arity renders the accepted argument counts, e.g. "1", "1..2" or "1..N"
+func (b Builtin) Arity() string {
+	switch {
+	case b.MaxArgs < 0:
+		return fmt.Sprintf("%d..N", b.MinArgs)
+	case b.MinArgs == b.MaxArgs:
+		return fmt.Sprintf("%d", b.MinArgs)
+	default:
+		return fmt.Sprintf("%d..%d", b.MinArgs, b.MaxArgs)
+	}
+}
+
+// Accepts reports whether the builtin can be called with n arguments
+func (b Builtin) Accepts(n int) bool {
+	return n >= b.MinArgs && (b.MaxArgs < 0 || n <= b.MaxArgs)
+}
+
+// Builtins lists the metadata of every builtin function in index order
+func Builtins() []Builtin {
+	return builtinTable
+}
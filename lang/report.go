@@ -0,0 +1,57 @@
+package lang
+
+import "time"
+
+// The statuses of an operation in a run report
+const (
+	OpOK      = "ok"
+	OpFailed  = "failed"
+	OpSkipped = "skipped"
+	OpCached  = "cached"
+)
+
+// OpResult is how an operation went in a run. Outputs are what its outputs
+// clause named
+type OpResult struct {
+	Name     string
+	Status   string
+	Duration time.Duration
+	Outputs  []string
+}
+
+// OperationResults lists how every operation of the program went, in the
+// order they were scheduled. t is the telemetry recorded for the run, after
+// Finish. An operation the program never got to counts as skipped
+func (vm *VM) OperationResults(t *Telemetry) []OpResult {
+	spans := make(map[string]Span, len(t.operations))
+	for _, span := range t.Spans {
+		if span.Kind == SpanOperation {
+			spans[span.Name] = span
+		}
+	}
+
+	results := make([]OpResult, 0, len(t.operations))
+	for _, op := range t.operations {
+		result := OpResult{Name: op.Name, Status: OpOK}
+		span, ran := spans[op.Name]
+		if ran {
+			result.Duration = span.End.Sub(span.Start)
+		}
+		run := vm.opRuns[op.Name]
+		if run != nil {
+			result.Outputs = run.outputs
+		}
+		switch {
+		case run != nil && run.cached:
+			result.Status = OpCached
+		case !ran || run != nil && run.skipped:
+			result.Status = OpSkipped
+		case run != nil && run.failed:
+			result.Status = OpFailed
+		case span.Stopped && (vm.Err() != nil || vm.ExitCode() != 0):
+			result.Status = OpFailed
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,82 @@
+package lang
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOperationResults(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "gen.txt")
+	if err := os.WriteFile(output, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := fmt.Sprintf(`operation gen inputs "report_test.go" outputs %q do
+end
+operation build on_fail continue do
+	assert false, "broken"
+end
+operation test depends build do
+end
+operation lint do
+end
+operation crash depends lint do
+	assert false
+end
+operation deploy depends crash do
+end
+`, output)
+	program, err := Parse("report.dl", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := NewCompiler()
+	if _, err := compiler.CompileProgram(program); err != nil {
+		t.Fatal(err)
+	}
+
+	store := memRunStore{}
+	run := func() []OpResult {
+		t.Helper()
+		vm := NewVM(compiler.Code, DefaultStackSize, DefaultLocalsSize, false)
+		RegisterBuiltins(vm)
+		vm.SetOutput(io.Discard)
+		vm.RegisterStrings(compiler.Strings)
+		vm.RegisterConstants(compiler.Constants)
+		vm.SetRunStore(store)
+		trace := NewTelemetry(compiler)
+		vm.SetTelemetry(trace)
+		vm.Run()
+		<-vm.StateChan
+		if vm.Err() == nil {
+			t.Fatal("crash didn't stop the program")
+		}
+		trace.Finish()
+		return vm.OperationResults(trace)
+	}
+	run()
+	results := run()
+
+	want := []struct{ name, status string }{
+		{"gen", OpCached},
+		{"build", OpFailed},
+		{"test", OpSkipped},
+		{"lint", OpOK},
+		{"crash", OpFailed},
+		{"deploy", OpSkipped},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		if r := results[i]; r.Name != w.name || r.Status != w.status {
+			t.Errorf("result %d is %s %s, want %s %s", i, r.Name, r.Status, w.name, w.status)
+		}
+	}
+	if !slices.Equal(results[0].Outputs, []string{output}) {
+		t.Errorf("gen has outputs %v", results[0].Outputs)
+	}
+}
@@ -0,0 +1,44 @@
+package lang
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ResourceValue is a handle to something a Go host owns, like an open file
+// or a connection, returned by the functions the host registers. Kind says
+// what it is and Handle is the host's own reference to it
+type ResourceValue struct {
+	Kind   string
+	Handle int
+}
+
+func (r ResourceValue) Type() ValueType { return ValueTypeResource }
+
+// ResourceFormatter describes the resource behind a handle for display,
+// `/tmp/x.log` for a file
+type ResourceFormatter func(handle int) string
+
+var (
+	resourceFormattersMu sync.RWMutex
+	resourceFormatters   = make(map[string]ResourceFormatter)
+)
+
+// RegisterResourceFormatter sets how resources of kind are shown by print,
+// the debugger and anything else displaying values. Without one a resource
+// shows as its kind and handle number
+func RegisterResourceFormatter(kind string, format ResourceFormatter) {
+	resourceFormattersMu.Lock()
+	defer resourceFormattersMu.Unlock()
+	resourceFormatters[kind] = format
+}
+
+func (r ResourceValue) String() string {
+	resourceFormattersMu.RLock()
+	format, ok := resourceFormatters[r.Kind]
+	resourceFormattersMu.RUnlock()
+	if ok {
+		return fmt.Sprintf("<%s:%s>", r.Kind, format(r.Handle))
+	}
+	return fmt.Sprintf("<%s:%d>", r.Kind, r.Handle)
+}
@@ -0,0 +1,111 @@
+package lang
+
+import "fmt"
+
+// Limits bound the resources a program may use, a zero field is unlimited
+type Limits struct {
+	MaxInstructions int
+	MaxStack        int
+	// MaxMemory is an estimate in bytes of the strings, arrays and bytes
+	// the program holds on to
+	MaxMemory int
+	// MaxOutput is how many bytes the program may print and format values
+	// into over the whole run, formatting an array can take far longer
+	// than the instructions building it
+	MaxOutput int
+}
+
+// SandboxLimits are the conservative defaults for running untrusted code
+var SandboxLimits = Limits{
+	MaxInstructions: 10_000_000,
+	MaxStack:        1024,
+	MaxMemory:       16 << 20,
+	MaxOutput:       16 << 20,
+}
+
+// EnableSandbox turns on sandbox mode, builtins that read the environment or
+// the terminal fail instead of running and the program is held to limits
+func (vm *VM) EnableSandbox(limits Limits) {
+	vm.limits = &limits
+	vm.SetInstructionLimit(limits.MaxInstructions)
+}
+
+func (vm *VM) checkLimits() error {
+	if max := vm.limits.MaxStack; max > 0 && len(vm.CurrentState.Stack) > max {
+		return fmt.Errorf("stack limit of %d values exceeded", max)
+	}
+	if max := vm.limits.MaxOutput; max > 0 && vm.outputUsed > max {
+		return fmt.Errorf("output limit of %d bytes exceeded", max)
+	}
+	if max := vm.limits.MaxMemory; max > 0 {
+		if used := vm.memoryUsage(); used > max {
+			return fmt.Errorf("memory limit of %d bytes exceeded (using about %d)", max, used)
+		}
+	}
+	return nil
+}
+
+// valueSize is roughly what a Value takes in a slice
+const valueSize = 16
+
+// heapUsage keeps a running total of the string, array and bytes tables.
+// Entries are only removed by the collector, which starts the count over,
+// so only the ones added since the last look need counting
+type heapUsage struct {
+	strings, arrays, bytes int
+	total, stringBytes     int
+}
+
+// memoryUsage estimates the bytes the program holds on to
+func (vm *VM) memoryUsage() int {
+	state := vm.CurrentState
+	return vm.measureHeap().total + (len(state.Stack)+len(state.Locals))*valueSize
+}
+
+// measureHeap brings the running total up to date with the tables
+func (vm *VM) measureHeap() *heapUsage {
+	state, heap := vm.CurrentState, &vm.heap
+	if len(state.Strings) < heap.strings || len(state.Arrays) < heap.arrays || len(state.Bytes) < heap.bytes {
+		// The debugger stepped back to an earlier state, count again
+		*heap = heapUsage{}
+	}
+	for ; heap.strings < len(state.Strings); heap.strings++ {
+		heap.stringBytes += len(state.Strings[heap.strings])
+		heap.total += len(state.Strings[heap.strings])
+	}
+	for ; heap.arrays < len(state.Arrays); heap.arrays++ {
+		heap.total += len(state.Arrays[heap.arrays]) * valueSize
+	}
+	for ; heap.bytes < len(state.Bytes); heap.bytes++ {
+		heap.total += len(state.Bytes[heap.bytes])
+	}
+	return heap
+}
+
+// outputLeft is how many more bytes the program may print or format
+func (vm *VM) outputLeft() int {
+	if vm.limits == nil {
+		return unlimited(0)
+	}
+	return max(0, unlimited(vm.limits.MaxOutput)-vm.outputUsed)
+}
+
+// spendOutput counts n bytes printed or formatted against the output limit,
+// incomplete says formatting was cut short at the limit
+func (vm *VM) spendOutput(n int, incomplete bool) {
+	if vm.limits == nil || vm.limits.MaxOutput <= 0 {
+		return
+	}
+	vm.outputUsed += n
+	if incomplete {
+		vm.outputUsed = max(vm.outputUsed, vm.limits.MaxOutput+1)
+	}
+}
+
+// formatted is FormatValue held to the output limit. Past the limit the
+// text is cut short and the program stops before its next instruction
+func (vm *VM) formatted(v Value) string {
+	s, complete := vm.CurrentState.formatValue(v, IntFormatDec, vm.outputLeft())
+	vm.spendOutput(len(s), !complete)
+	return s
+}
@@ -0,0 +1,150 @@
+package lang
+
+import (
+	"fmt"
+	"time"
+)
+
+// Span kinds, what a span was recorded for
+const (
+	SpanOperation = "operation"
+	SpanFunction  = "function"
+)
+
+// Span is one operation or function call that ran. Parent is the index of
+// the span it ran in, -1 at the top
+type Span struct {
+	Kind       string
+	Name       string
+	Parent     int
+	Start, End time.Time
+	// Error is the runtime error raised while the span was innermost
+	Error string
+	// Stopped is set when the program stopped before the span ended
+	Stopped bool
+}
+
+// Telemetry records spans for every operation and function call a VM runs,
+// along with counters, for exporting to an observability stack
+type Telemetry struct {
+	Spans         []Span
+	Instructions  int
+	RuntimeErrors int
+	// Listener, when set, is told about every span as it starts and again
+	// once it has ended
+	Listener func(span Span, ended bool)
+
+	operations []CodeRange
+	functions  map[int]string
+	// open are the indices of the spans not ended yet, innermost last, op
+	// is the one of the running operation or -1
+	open []int
+	op   int
+}
+
+// NewTelemetry prepares recording for a program compiled by compiler, it
+// knows the operations and function names from it
+func NewTelemetry(compiler *Compiler) *Telemetry {
+	t := &Telemetry{
+		operations: compiler.GetOperations(),
+		functions:  make(map[int]string),
+		op:         -1,
+	}
+	for name, addr := range compiler.GetFunctions() {
+		t.functions[addr] = name
+	}
+	return t
+}
+
+// SetTelemetry starts recording into t, it has to be set before running
+func (vm *VM) SetTelemetry(t *Telemetry) {
+	vm.telemetry = t
+}
+
+// Finish ends the spans still open, for when the program stopped inside
+// them. Call it once the VM is done
+func (t *Telemetry) Finish() {
+	for len(t.open) > 0 {
+		t.Spans[t.open[len(t.open)-1]].Stopped = true
+		t.end()
+	}
+	t.op = -1
+}
+
+func (vm *VM) tracedInstruction() error {
+	t := vm.telemetry
+	t.Instructions++
+	depth := len(vm.CurrentState.Frames)
+	if depth == 0 {
+		t.enterOperation(vm.CurrentState.PC)
+	}
+
+	err := vm.dispatch()
+	if err != nil {
+		t.RuntimeErrors++
+		if len(t.open) > 0 {
+			t.Spans[t.open[len(t.open)-1]].Error = err.Error()
+		}
+	}
+	err = vm.handleError(err)
+
+	switch after := len(vm.CurrentState.Frames); {
+	case after > depth:
+		pc := vm.CurrentState.PC
+		name, ok := t.functions[pc]
+		if !ok {
+			name = fmt.Sprintf("fn at line %d", vm.lineForPC(pc))
+		}
+		t.start(SpanFunction, name)
+	case after < depth:
+		// A caught error can unwind several calls at once
+		for range depth - after {
+			t.end()
+		}
+	}
+	return err
+}
+
+// enterOperation ends and starts the operation spans as the top level code
+// moves from one operation to the next
+func (t *Telemetry) enterOperation(pc int) {
+	if t.op >= 0 {
+		current := t.operations[t.op]
+		if pc >= current.Start && pc < current.End {
+			return
+		}
+		t.end()
+		t.op = -1
+	}
+	for i, op := range t.operations {
+		if pc >= op.Start && pc < op.End {
+			t.start(SpanOperation, op.Name)
+			t.op = i
+			return
+		}
+	}
+}
+
+func (t *Telemetry) start(kind, name string) {
+	parent := -1
+	if len(t.open) > 0 {
+		parent = t.open[len(t.open)-1]
+	}
+	t.Spans = append(t.Spans, Span{Kind: kind, Name: name, Parent: parent, Start: time.Now()})
+	t.open = append(t.open, len(t.Spans)-1)
+	if t.Listener != nil {
+		t.Listener(t.Spans[len(t.Spans)-1], false)
+	}
+}
+
+func (t *Telemetry) end() {
+	if len(t.open) == 0 {
+		return
+	}
+	span := &t.Spans[t.open[len(t.open)-1]]
+	span.End = time.Now()
+	t.open = t.open[:len(t.open)-1]
+	if t.Listener != nil {
+		t.Listener(*span, true)
+	}
+}
@@ -0,0 +1,46 @@
+package lang
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Strings are UTF-8. Indexing and slicing work on byte offsets like they do
+// for bytes, s[i] is the byte at i and a slice has to start and end on a
+// character boundary. Character-wise access goes through len, len_runes,
+// char_at and for-each loops, which all refuse invalid UTF-8 instead of
+// guessing. The length in bytes is len(bytes(s))
+
+func (vm *VM) stringByteAt(str StringValue, index Value) (IntValue, error) {
+	if str.Secret {
+		return 0, fmt.Errorf("cannot index a secret string")
+	}
+	idx, ok := index.(IntValue)
+	if !ok {
+		return 0, fmt.Errorf("string index must be an integer")
+	}
+	s := vm.CurrentState.Strings[str.Index]
+	if int(idx) < 0 || int(idx) >= len(s) {
+		return 0, fmt.Errorf("string index out of bounds: %d (length %d)", idx, len(s))
+	}
+	return IntValue(s[idx]), nil
+}
+
+// checkRuneBoundaries makes sure s[start:end] doesn't cut a character in half
+func checkRuneBoundaries(s string, start, end int) error {
+	for _, pos := range []int{start, end} {
+		if pos < len(s) && !utf8.RuneStart(s[pos]) {
+			return fmt.Errorf("string slice splits a UTF-8 character at byte %d", pos)
+		}
+	}
+	return nil
+}
+
+// runeAt decodes the character starting at byte pos of s
+func runeAt(s string, pos int) (string, int, error) {
+	r, size := utf8.DecodeRuneInString(s[pos:])
+	if r == utf8.RuneError && size <= 1 {
+		return "", 0, fmt.Errorf("invalid UTF-8 in string at byte %d", pos)
+	}
+	return s[pos : pos+size], size, nil
+}
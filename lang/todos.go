@@ -0,0 +1,52 @@
+package lang
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+var todoPattern = regexp.MustCompile(`\b(TODO|FIXME)(?:\(([^)]*)\))?:?\s*(.*)`)
+
+// Todo is a TODO or FIXME left in a comment, `// TODO(owner): text`
+type Todo struct {
+	Pos   lexer.Position
+	Kind  string
+	Owner string
+	Text  string
+}
+
+// CollectTodos finds the TODO and FIXME directives in the comments of a
+// source file. Comments are dropped before parsing, so this lexes the source
+// again keeping them
+func CollectTodos(filename, source string) ([]Todo, error) {
+	lex, err := triviaLexer.Lex(filename, strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := lexer.ConsumeAll(lex)
+	if err != nil {
+		return nil, err
+	}
+
+	comment := triviaLexer.Symbols()["Comment"]
+	var todos []Todo
+	for _, token := range tokens {
+		if token.Type != comment {
+			continue
+		}
+		text := strings.TrimSuffix(token.Value, "*/")
+		match := todoPattern.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		todos = append(todos, Todo{
+			Pos:   token.Pos,
+			Kind:  match[1],
+			Owner: strings.TrimSpace(match[2]),
+			Text:  strings.TrimSpace(match[3]),
+		})
+	}
+	return todos, nil
+}
@@ -0,0 +1,19 @@
+package lang
+
+// truthy is whether a condition holds. false, 0, big 0, the empty string and nil
+// are false, every other value is true, an empty array included
+func (vm *VM) truthy(v Value) bool {
+	switch v := v.(type) {
+	case BoolValue:
+		return bool(v)
+	case IntValue:
+		return v != 0
+	case BigValue:
+		return v.N.Sign() != 0
+	case StringValue:
+		return vm.CurrentState.Strings[v.Index] != ""
+	case NilValue:
+		return false
+	}
+	return v != nil
+}
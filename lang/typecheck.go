@@ -0,0 +1,359 @@
+package lang
+
+import (
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// typeUnknown is a value the checker can't pin down, it never causes an
+// error
+const typeUnknown ValueType = -1
+
+var typeNames = map[ValueType]string{
+	ValueTypeInt:      "int",
+	ValueTypeBool:     "bool",
+	ValueTypeString:   "string",
+	ValueTypeArray:    "array",
+	ValueTypeIterator: "iterator",
+	ValueTypeNil:      "nil",
+	ValueTypeBig:      "big",
+	ValueTypeBytes:    "bytes",
+	ValueTypeFunction: "function",
+	ValueTypeRange:    "range",
+	ValueTypeResource: "resource",
+}
+
+// builtinResults is what the builtins return, the ones missing are unknown
+var builtinResults = map[string]ValueType{
+	"print":         ValueTypeInt,
+	"progress":      ValueTypeInt,
+	"secret":        ValueTypeString,
+	"confirm":       ValueTypeBool,
+	"on_interrupt":  ValueTypeNil,
+	"big":           ValueTypeBig,
+	"hex":           ValueTypeString,
+	"base64_encode": ValueTypeString,
+	"hash_sha256":   ValueTypeBytes,
+	"bytes":         ValueTypeBytes,
+	"len":           ValueTypeInt,
+	"len_runes":     ValueTypeInt,
+	"string":        ValueTypeString,
+	"upper":         ValueTypeString,
+	"lower":         ValueTypeString,
+	"trim":          ValueTypeString,
+	"replace":       ValueTypeString,
+	"split":         ValueTypeArray,
+	"join":          ValueTypeString,
+	"format":        ValueTypeString,
+	"array":         ValueTypeArray,
+}
+
+// Typecheck infers the types flowing through the program's expressions and
+// rejects operations the VM would fail on with invalid operand types.
+// Variables are typed by every value assigned to them anywhere, a name
+// given values of different types is unknown and never reported
+func Typecheck(program *Program) error {
+	tc := &typeChecker{env: make(map[string]ValueType)}
+
+	// Types only ever widen towards unknown, so this settles
+	for {
+		tc.changed = false
+		tc.statements(program.Statements)
+		if !tc.changed {
+			break
+		}
+	}
+
+	tc.report = true
+	tc.statements(program.Statements)
+	return tc.err
+}
+
+type typeChecker struct {
+	env     map[string]ValueType
+	changed bool
+	// report is off while the variable types settle
+	report bool
+	err    error
+}
+
+func (tc *typeChecker) bind(name string, t ValueType) {
+	prev, ok := tc.env[name]
+	switch {
+	case !ok:
+		tc.env[name] = t
+	case prev != t && prev != typeUnknown:
+		tc.env[name] = typeUnknown
+	default:
+		return
+	}
+	tc.changed = true
+}
+
+func (tc *typeChecker) lookup(name string) ValueType {
+	if t, ok := tc.env[name]; ok {
+		return t
+	}
+	return typeUnknown
+}
+
+func (tc *typeChecker) fail(pos lexer.Position, code, help MessageID, args ...any) {
+	if tc.report && tc.err == nil {
+		tc.err = languageError(pos, code, help, args...)
+	}
+}
+
+func (tc *typeChecker) statements(stmts []Statement) {
+	for i := range stmts {
+		tc.statement(&stmts[i])
+	}
+}
+
+func (tc *typeChecker) statement(stmt *Statement) {
+	switch {
+	case stmt.Assignment != nil:
+		names := append([]string{stmt.Assignment.Variable}, stmt.Assignment.Extra...)
+		for i, expr := range append([]*Expr{stmt.Assignment.Expr}, stmt.Assignment.ExtraExprs...) {
+			t := tc.expr(expr)
+			if i < len(names) {
+				tc.bind(names[i], t)
+			}
+		}
+	case stmt.ConstDecl != nil:
+		tc.bind(stmt.ConstDecl.Name, tc.expr(stmt.ConstDecl.Expr))
+	case stmt.GlobalDecl != nil:
+		tc.bind(stmt.GlobalDecl.Name, tc.expr(stmt.GlobalDecl.Expr))
+	case stmt.Reassignment != nil:
+		for i, expr := range stmt.Reassignment.Exprs {
+			t := tc.expr(expr)
+			if i < len(stmt.Reassignment.Variables) {
+				tc.bind(stmt.Reassignment.Variables[i], t)
+			}
+		}
+	case stmt.CompoundAssignment != nil:
+		assign := stmt.CompoundAssignment
+		op := assign.Op[:1]
+		t := tc.binary(assign.Pos, op, tc.lookup(assign.Variable), tc.expr(assign.Expr))
+		tc.bind(assign.Variable, t)
+	case stmt.IndexAssignment != nil:
+		assign := stmt.IndexAssignment
+		switch t := tc.lookup(assign.Variable); t {
+		case ValueTypeArray, typeUnknown:
+		case ValueTypeString, ValueTypeBytes:
+			tc.fail(assign.Pos, ErrImmutableAssign, "", assign.Variable, typeNames[t])
+		default:
+			tc.fail(assign.Pos, ErrNotIndexable, "", assign.Variable, typeNames[t])
+		}
+		tc.expr(assign.Index)
+		tc.expr(assign.Expr)
+	case stmt.FnDecl != nil:
+		tc.bind(stmt.FnDecl.Name, ValueTypeFunction)
+		tc.fn(stmt.FnDecl.Fn)
+	case stmt.ForStmt != nil:
+		loop := stmt.ForStmt
+		if loop.Iterable != nil {
+			switch t := tc.expr(loop.Iterable); t {
+			case ValueTypeBytes, ValueTypeRange:
+				tc.bind(loop.Variable, ValueTypeInt)
+			case ValueTypeString:
+				tc.bind(loop.Variable, ValueTypeString)
+			case ValueTypeArray, ValueTypeIterator, typeUnknown:
+				tc.bind(loop.Variable, typeUnknown)
+			default:
+				tc.fail(loop.Pos, ErrNotIterable, "", typeNames[t])
+			}
+		} else {
+			tc.numeric(loop.Pos, ErrBoundsNotInt, tc.expr(loop.From))
+			tc.numeric(loop.Pos, ErrBoundsNotInt, tc.expr(loop.To))
+			tc.bind(loop.Variable, ValueTypeInt)
+		}
+		tc.statements(loop.Body)
+	case stmt.TryStmt != nil:
+		tc.statements(stmt.TryStmt.Body)
+		tc.bind(stmt.TryStmt.ErrVar, ValueTypeString)
+		tc.statements(stmt.TryStmt.Handler)
+	case stmt.Call != nil:
+		tc.call(stmt.Call)
+	default:
+		for _, expr := range stmt.exprs() {
+			tc.expr(expr)
+		}
+		for _, block := range stmt.blocks() {
+			tc.statements(block)
+		}
+	}
+}
+
+func (tc *typeChecker) fn(fn *FnLit) {
+	// Arguments can be anything
+	for _, param := range fn.Params {
+		tc.bind(param, typeUnknown)
+	}
+	tc.statements(fn.Body)
+	if fn.Result != nil {
+		tc.expr(fn.Result)
+	}
+}
+
+func (tc *typeChecker) call(call *Call) ValueType {
+	for _, arg := range call.Args {
+		tc.expr(arg)
+	}
+	if t, ok := builtinResults[call.Function]; ok {
+		return t
+	}
+	return typeUnknown
+}
+
+func (tc *typeChecker) expr(e *Expr) ValueType {
+	left := tc.term(e.Left)
+	if e.Op == nil {
+		return left
+	}
+	return tc.binary(e.Left.Pos, *e.Op, left, tc.expr(e.Right))
+}
+
+func (tc *typeChecker) term(t *Term) ValueType {
+	var typ ValueType
+	switch {
+	case t.Number != nil:
+		typ = ValueTypeInt
+	case t.String != nil:
+		typ = ValueTypeString
+	case t.Bytes != nil:
+		typ = ValueTypeBytes
+	case t.Bool != nil:
+		typ = ValueTypeBool
+	case t.Nil:
+		typ = ValueTypeNil
+	case t.Variable != nil:
+		typ = tc.lookup(*t.Variable)
+	case t.Call != nil:
+		typ = tc.call(t.Call)
+	case t.SubExpr != nil:
+		typ = tc.expr(t.SubExpr)
+	case t.Array != nil:
+		for _, elem := range t.Array.Elements {
+			tc.expr(elem)
+		}
+		typ = ValueTypeArray
+	case t.Cond != nil:
+		tc.expr(t.Cond.Condition)
+		then, els := tc.expr(t.Cond.Then), tc.expr(t.Cond.Else)
+		typ = then
+		if then != els {
+			typ = typeUnknown
+		}
+	case t.Fn != nil:
+		tc.fn(t.Fn)
+		typ = ValueTypeFunction
+	case t.Block != nil:
+		tc.statements(t.Block.Body)
+		typ = ValueTypeNil
+		if t.Block.Result != nil {
+			typ = tc.expr(t.Block.Result)
+		}
+	}
+
+	for _, sub := range t.Index {
+		if sub.Method != nil {
+			for _, arg := range sub.Method.Args {
+				tc.expr(arg)
+			}
+			typ = typeUnknown
+			if result, ok := builtinResults[sub.Method.Function]; ok {
+				typ = result
+			}
+			continue
+		}
+		if sub.Index != nil {
+			tc.numeric(t.Pos, ErrIndexNotInt, tc.expr(sub.Index))
+		}
+		if sub.High != nil {
+			tc.numeric(t.Pos, ErrIndexNotInt, tc.expr(sub.High))
+		}
+		switch typ {
+		case ValueTypeArray:
+			if !sub.Slice {
+				typ = typeUnknown
+			}
+		case ValueTypeString, ValueTypeBytes:
+			if !sub.Slice {
+				// A single byte
+				typ = ValueTypeInt
+			}
+		case typeUnknown:
+		default:
+			tc.fail(t.Pos, ErrIndexType, "", typeNames[typ])
+			typ = typeUnknown
+		}
+	}
+	return typ
+}
+
+func isNumeric(t ValueType) bool {
+	return t == ValueTypeInt || t == ValueTypeBig || t == ValueTypeBool
+}
+
+func (tc *typeChecker) numeric(pos lexer.Position, code MessageID, t ValueType) {
+	if t != typeUnknown && !isNumeric(t) {
+		tc.fail(pos, code, "", typeNames[t])
+	}
+}
+
+// binary is the type of x op y, reporting the combinations the VM refuses
+func (tc *typeChecker) binary(pos lexer.Position, op string, x, y ValueType) ValueType {
+	if x == typeUnknown || y == typeUnknown {
+		if op == "+" || op == "-" || op == "*" || op == "/" || op == "%" {
+			return typeUnknown
+		}
+		if op == ".." {
+			return ValueTypeRange
+		}
+		return ValueTypeBool
+	}
+
+	switch op {
+	case "+", "-", "*", "/", "%":
+		if isNumeric(x) && isNumeric(y) {
+			if x == ValueTypeBig || y == ValueTypeBig {
+				return ValueTypeBig
+			}
+			return ValueTypeInt
+		}
+		if op == "+" && x == ValueTypeString && y == ValueTypeString {
+			return ValueTypeString
+		}
+	case "==", "!=":
+		if isNumeric(x) && isNumeric(y) || x == y && x == ValueTypeString || x == ValueTypeNil || y == ValueTypeNil {
+			return ValueTypeBool
+		}
+	case "<", "<=", ">", ">=":
+		if isNumeric(x) && isNumeric(y) {
+			return ValueTypeBool
+		}
+	case "..":
+		if x == ValueTypeInt && y == ValueTypeInt {
+			return ValueTypeRange
+		}
+	case "in":
+		switch y {
+		case ValueTypeArray:
+			return ValueTypeBool
+		case ValueTypeRange, ValueTypeBytes:
+			if isNumeric(x) || x == ValueTypeBytes && y == ValueTypeBytes {
+				return ValueTypeBool
+			}
+		case ValueTypeString:
+			if x == ValueTypeString {
+				return ValueTypeBool
+			}
+		}
+	}
+
+	var help MessageID
+	if op == "+" && (x == ValueTypeString || y == ValueTypeString) {
+		help = helpStringConversion
+	}
+	tc.fail(pos, ErrOperandTypes, help, op, typeNames[x], typeNames[y])
+	return typeUnknown
+}
@@ -1,8 +1,18 @@
 package lang
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 )
 
 type DebuggerCmd int
@@ -15,33 +25,79 @@ const (
 )
 
 type VMState struct {
-	PC          int
-	Stack       []Value
-	Locals      []Value
-	Memory      []byte
-	CallStack   []int
-	ReturnStack []int
-	Strings     []string
-	SourceLine  int
+	PC        int
+	Stack     []Value
+	Locals    []Value
+	Memory    []byte
+	Strings   []string
+	Arrays    [][]Value
+	Bytes     [][]byte
+	Iterators []Iterator
+	// Frames are the active function calls, Locals belongs to the innermost
+	Frames     []Frame
+	SourceLine int
+	// Defers is the cleanup stack of the innermost frame, addresses of
+	// deferred blocks still to run when it returns
+	Defers []int
+	// Resume is the instruction a cleanup block goes back to when it ends,
+	// the RET or END_SCOPE it ran for. 0 while the program is stopping, the
+	// cleanups of every frame run then
+	Resume int
+	// Scopes are the heights of Defers when the operations being run
+	// started, the cleanups above one run when its operation ends
+	Scopes []int
+	// PendingError is the runtime error being unwound while the deferred
+	// blocks run, it's raised again once they are done
+	PendingError error
+	// Handlers are the try blocks being executed, innermost last
+	Handlers []Handler
+	// Globals are the variables declared with global, apart from the
+	// locals of every frame
+	Globals []Value
+	// NextGC is how many table entries set off the next collection
+	NextGC int
+	// owned marks the arrays no snapshot shares, they can be written in
+	// place
+	owned []bool
 }
 
 func (vm *VMState) Clone() *VMState {
 	newState := &VMState{
-		PC:          vm.PC,
-		Stack:       make([]Value, len(vm.Stack)),
-		Locals:      make([]Value, len(vm.Locals)),
-		Memory:      make([]byte, len(vm.Memory)),
-		CallStack:   make([]int, len(vm.CallStack)),
-		ReturnStack: make([]int, len(vm.ReturnStack)),
-		Strings:     make([]string, len(vm.Strings)),
-		SourceLine:  vm.SourceLine,
+		PC:           vm.PC,
+		Stack:        make([]Value, len(vm.Stack)),
+		Locals:       make([]Value, len(vm.Locals)),
+		Memory:       make([]byte, len(vm.Memory)),
+		Strings:      make([]string, len(vm.Strings)),
+		Arrays:       make([][]Value, len(vm.Arrays)),
+		Bytes:        make([][]byte, len(vm.Bytes)),
+		Iterators:    make([]Iterator, len(vm.Iterators)),
+		Frames:       make([]Frame, len(vm.Frames)),
+		SourceLine:   vm.SourceLine,
+		Defers:       make([]int, len(vm.Defers)),
+		Resume:       vm.Resume,
+		Scopes:       append([]int(nil), vm.Scopes...),
+		PendingError: vm.PendingError,
+		Handlers:     make([]Handler, len(vm.Handlers)),
+		Globals:      make([]Value, len(vm.Globals)),
+		NextGC:       vm.NextGC,
 	}
 	copy(newState.Stack, vm.Stack)
 	copy(newState.Locals, vm.Locals)
 	copy(newState.Memory, vm.Memory)
-	copy(newState.CallStack, vm.CallStack)
-	copy(newState.ReturnStack, vm.ReturnStack)
 	copy(newState.Strings, vm.Strings)
+	copy(newState.Defers, vm.Defers)
+	copy(newState.Handlers, vm.Handlers)
+	copy(newState.Globals, vm.Globals)
+	copy(newState.Iterators, vm.Iterators)
+	for i, frame := range vm.Frames {
+		frame.Locals = append([]Value(nil), frame.Locals...)
+		frame.Defers = append([]int(nil), frame.Defers...)
+		newState.Frames[i] = frame
+	}
+	// Bytes are never modified, sharing them between snapshots is fine
+	copy(newState.Bytes, vm.Bytes)
+	// Arrays are shared too, whichever state writes to one first copies it
+	copy(newState.Arrays, vm.Arrays)
 	return newState
 }
 
@@ -69,16 +125,47 @@ const (
 	InstrCall
 	InstrRet
 	InstrHalt
+	InstrNewArray
+	InstrIndexGet
+	InstrIndexSet
+	InstrDefer
+	InstrEndDefer
+	InstrIterNew
+	InstrIterNext
+	InstrJmpTable
+	InstrPushNil
+	InstrPushBytes
+	InstrSlice
+	InstrPushFn
+	InstrCallValue
+	InstrLoadGlobal
+	InstrStoreGlobal
+	InstrTry
+	InstrEndTry
+	InstrAssert
+	InstrDrop
+	InstrRange
+	InstrContains
+	InstrLen
+	InstrToString
+	InstrExit
+	InstrLoadShared
+	InstrStoreShared
+	InstrPushConst
+	InstrAlloc
+	InstrScope
+	InstrEndScope
+	InstrPushBool
+	InstrTryOp
+	InstrOpRetry
+	InstrOpNeeds
+	InstrOpCached
+	InstrOpRecord
 )
 
 func (instr Instr) String() string {
-	names := []string{
-		"PUSH", "PUSH_STR", "POP", "ADD", "SUB", "MUL", "DIV", "MOD",
-		"EQ", "NEQ", "LT", "GT", "LTE", "GTE", "LOAD",
-		"STORE", "JMP", "JMP_IF_ZERO", "CALL", "RET", "HALT",
-	}
-	if int(instr) < len(names) {
-		return names[instr]
+	if info, ok := instrTable[instr]; ok {
+		return info.Name
 	}
 	return fmt.Sprintf("UNKNOWN(%d)", instr)
 }
@@ -88,27 +175,180 @@ type ValueType int
 const (
 	ValueTypeInt ValueType = iota
 	ValueTypeString
+	ValueTypeArray
+	ValueTypeIterator
+	ValueTypeNil
+	ValueTypeBig
+	ValueTypeBytes
+	ValueTypeFunction
+	ValueTypeRange
+	ValueTypeResource
+	ValueTypeBool
 )
 
 type Value interface {
 	Type() ValueType
 }
 
-type IntValue int
+type IntValue int64
 
 func (i IntValue) Type() ValueType { return ValueTypeInt }
 
 type StringValue struct {
 	Index int
+	// Secret strings come from the `secret` builtin, anything that displays
+	// values masks them and concatenation carries the flag along
+	Secret bool
 }
 
+// NilValue is the explicit absence of a value. Variables that were never
+// assigned are not nil, reading them is a runtime error
+type NilValue struct{}
+
+func (n NilValue) Type() ValueType { return ValueTypeNil }
+
+// SecretMask is what gets shown in place of a secret string
+const SecretMask = "*****"
+
 func (s StringValue) Type() ValueType { return ValueTypeString }
 
+// ArrayValue refers to an array by its index in VMState.Arrays, the same way
+// StringValue refers to the string table
+type ArrayValue struct {
+	Index int
+}
+
+func (a ArrayValue) Type() ValueType { return ValueTypeArray }
+
+// Iterator is the cursor of a for-each loop over Target
+type Iterator struct {
+	Target Value
+	Pos    int
+}
+
+// IteratorValue refers to an iterator by its index in VMState.Iterators
+type IteratorValue struct {
+	Index int
+}
+
+func (i IteratorValue) Type() ValueType { return ValueTypeIterator }
+
+// FormatValue renders a value the way the debugger shows it, strings are
+// quoted and arrays list their elements
+func (vm *VMState) FormatValue(v Value) string {
+	return vm.FormatValueAs(v, IntFormatDec)
+}
+
+// FormatValueAs is FormatValue with integers written in the given base
+func (vm *VMState) FormatValueAs(v Value, ints IntFormat) string {
+	s, _ := vm.formatValue(v, ints, unlimited(0))
+	return s
+}
+
+// FormatValueWidth is FormatValue cut off with "..." past width bytes. It
+// stops formatting there, a huge or deeply shared array costs no more than
+// a small one
+func (vm *VMState) FormatValueWidth(v Value, width int) string {
+	s, complete := vm.formatValue(v, IntFormatDec, width)
+	if complete {
+		return s
+	}
+	return s + "..."
+}
+
+// formatValue writes out v up to limit bytes, complete is false when it
+// didn't all fit
+func (vm *VMState) formatValue(v Value, ints IntFormat, limit int) (s string, complete bool) {
+	f := &valueFormatter{state: vm, ints: ints, limit: limit}
+	f.value(v)
+	if f.b.Len() <= limit {
+		return f.b.String(), true
+	}
+	s = f.b.String()[:limit]
+	// Don't leave half a character at the end
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s, false
+}
+
+// valueFormatter builds the text of a value, once it has more than limit
+// bytes it stops adding to it
+type valueFormatter struct {
+	state *VMState
+	ints  IntFormat
+	limit int
+	b     strings.Builder
+}
+
+func (f *valueFormatter) full() bool {
+	return f.b.Len() > f.limit
+}
+
+func (f *valueFormatter) value(v Value) {
+	if f.full() {
+		return
+	}
+	switch val := v.(type) {
+	case nil:
+		f.b.WriteString("<unassigned>")
+	case NilValue:
+		f.b.WriteString("nil")
+	case BigValue:
+		f.b.WriteString(f.ints.format(val.N))
+	case IntValue:
+		f.b.WriteString(f.ints.format(big.NewInt(int64(val))))
+	case BoolValue:
+		f.b.WriteString(strconv.FormatBool(bool(val)))
+	case StringValue:
+		if val.Secret {
+			f.b.WriteString(SecretMask)
+			return
+		}
+		// Quoting only makes it longer, what's past the limit isn't needed
+		str := f.state.Strings[val.Index]
+		if rest := f.limit - f.b.Len(); len(str) > rest {
+			for rest > 0 && !utf8.RuneStart(str[rest]) {
+				rest--
+			}
+			str = str[:rest]
+		}
+		f.b.WriteString(strconv.Quote(str))
+	case ArrayValue:
+		f.b.WriteByte('[')
+		for i, elem := range f.state.Arrays[val.Index] {
+			if f.full() {
+				return
+			}
+			if i > 0 {
+				f.b.WriteString(", ")
+			}
+			f.value(elem)
+		}
+		f.b.WriteByte(']')
+	case BytesValue:
+		data := f.state.Bytes[val.Index]
+		if rest := f.limit - f.b.Len(); len(data) > rest {
+			data = data[:rest]
+		}
+		fmt.Fprintf(&f.b, "x%q", hex.EncodeToString(data))
+	case IteratorValue:
+		fmt.Fprintf(&f.b, "<iterator %d>", val.Index)
+	case FunctionValue:
+		fmt.Fprintf(&f.b, "<fn/%d at %04d>", val.Arity, val.Addr)
+	case RangeValue:
+		fmt.Fprintf(&f.b, "%d..%d", val.From, val.To)
+	case ResourceValue:
+		f.b.WriteString(val.String())
+	default:
+		fmt.Fprintf(&f.b, "%v", v)
+	}
+}
+
 type GoFunction func(args []Value) Value
 
 type VM struct {
 	CurrentState *VMState
-	History      []*VMState
 	Bytecode     []byte
 
 	debugChan chan DebuggerCmd
@@ -117,24 +357,72 @@ type VM struct {
 	mu              sync.RWMutex
 	running         bool
 	functions       map[int]GoFunction
+	constants       []Value
 	sourceMap       map[int]int
 	lineBreakpoints map[int]bool
+	continueBudget  int
+	history         *history
+	progressSink    ProgressSink
+	telemetry       *Telemetry
+	output          io.Writer
+	checked         bool
+	promote         bool
+	limits          *Limits
+	outputUsed      int
+	invariants      *invariants
+	executed        int
+	maxInstructions int
+	ctx             context.Context
+	ticks           int
+	maxStack        int
+	maxLocals       int
+	maxStringBytes  int
+	heap            heapUsage
+	gcThreshold     int
+	gcStats         GCStats
+	promptMode      PromptMode
+	input           *bufio.Reader
 	wg              sync.WaitGroup
+
+	// err is the runtime error that stopped the program
+	err error
+	// exitCode is the status passed to exit
+	exitCode int
+	// pinnedStrings is the size of the string table the program was
+	// compiled with, the collector keeps all of it
+	pinnedStrings int
+	// onInterrupt is the handler registered with on_interrupt, interrupted
+	// the status of an interrupt the host asked for that wasn't taken yet
+	onInterrupt *FunctionValue
+	interrupted atomic.Int32
+	// opRuns are the records of the operations with a policy, inputs or
+	// outputs, by name, runningOp the one with a policy started last and
+	// deadlineTicks counts instructions to the next look at the clock for
+	// its timeout. runStore has the operation runs recorded before
+	opRuns        map[string]*opRun
+	runningOp     *opRun
+	deadlineTicks int
+	runStore      RunStore
 }
 
 func NewVmState(bytecode []byte, stackSize, localsSize int) *VMState {
 	return &VMState{
-		Stack:      make([]Value, 0, stackSize),
-		Locals:     make([]Value, 0, localsSize),
+		Stack:      make([]Value, 0, min(stackSize, initialCapacity)),
+		Locals:     make([]Value, 0, min(localsSize, initialCapacity)),
 		Memory:     make([]byte, 0, 1024),
 		Strings:    make([]string, 0),
 		SourceLine: 1,
 	}
 }
 
+// NewVM makes a VM for bytecode. The stack may hold up to stackSize values
+// and as many calls, a frame up to localsSize variables, 0 is no limit
 func NewVM(bytecode []byte, stackSize, localsSize int, debug bool) *VM {
 	debugChan := make(chan DebuggerCmd)
-	if !debug {
+	var hist *history
+	if debug {
+		hist = newHistory(DefaultKeyframeInterval)
+	} else {
 		debugChan = nil
 	}
 
@@ -143,14 +431,39 @@ func NewVM(bytecode []byte, stackSize, localsSize int, debug bool) *VM {
 		CurrentState:    NewVmState(bytecode, stackSize, localsSize),
 		debugChan:       debugChan,
 		StateChan:       make(chan *VMState),
-		History:         make([]*VMState, 0),
 		running:         false,
 		functions:       make(map[int]GoFunction),
 		sourceMap:       make(map[int]int),
 		lineBreakpoints: make(map[int]bool),
+		continueBudget:  DefaultContinueBudget,
+		gcThreshold:     DefaultGCThreshold,
+		maxStack:        unlimited(stackSize),
+		maxLocals:       unlimited(localsSize),
+		maxStringBytes:  DefaultStringLimit,
+		history:         hist,
+		progressSink:    &TTYProgressSink{Out: os.Stderr},
+		output:          os.Stdout,
 	}
 }
 
+// SetOutput redirects what the print builtin writes, stdout by default
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.output = w
+}
+
+// DefaultContinueBudget is how many instructions a debugger continue runs
+// before pausing on its own
+const DefaultContinueBudget = 1_000_000
+
+// SetContinueBudget caps the instructions a single debugger continue may
+// run, so an infinite loop pauses instead of growing the history without
+// bound. Zero removes the cap
+func (vm *VM) SetContinueBudget(steps int) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.continueBudget = steps
+}
+
 // func (vm *VM) SetBreakpoint(pc int, enabled bool) {
 // 	vm.mu.Lock()
 // 	defer vm.mu.Unlock()
@@ -188,7 +501,7 @@ func (vm *VM) Run() {
 		// Wait for all print operations
 		vm.wg.Wait()
 		// Signal completion
-		vm.StateChan <- vm.CurrentState.Clone()
+		vm.StateChan <- vm.State()
 	}()
 }
 
@@ -230,21 +543,35 @@ func (vm *VM) Continue() {
 	vm.Debug(DebuggerCmdContinue)
 }
 
-func (vm *VM) State() *VMState {
+// Err is the runtime error the program stopped with, nil when it ran to
+// the end or hasn't stopped yet
+func (vm *VM) Err() error {
 	vm.mu.RLock()
 	defer vm.mu.RUnlock()
-	return vm.CurrentState.Clone()
+	return vm.err
+}
+
+// State is a copy of the current state. It takes the write lock, the arrays
+// the copy shares stop being written in place
+func (vm *VM) State() *VMState {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.CurrentState.snapshot()
 }
 
 func (vm *VM) execute() {
 	// If debugChan is nil, run in non-debug mode
 	if vm.debugChan == nil {
 		for vm.running && vm.CurrentState.PC < len(vm.Bytecode) {
+			if vm.history != nil {
+				vm.recordStep()
+			}
 			err := vm.executeInstruction()
 			if err != nil {
+				vm.err = err
 				fmt.Println("Execution error:", err)
 				vm.running = false
-				vm.StateChan <- vm.CurrentState.Clone()
+				vm.StateChan <- vm.State()
 				return
 			}
 		}
@@ -252,7 +579,7 @@ func (vm *VM) execute() {
 		vm.mu.Lock()
 		vm.running = false
 		vm.mu.Unlock()
-		vm.StateChan <- vm.CurrentState.Clone()
+		vm.StateChan <- vm.State()
 		return
 	}
 
@@ -263,43 +590,47 @@ func (vm *VM) execute() {
 		switch cmd {
 		case DebuggerCmdPause:
 			vm.running = false
-			vm.StateChan <- vm.CurrentState.Clone()
+			vm.StateChan <- vm.State()
 			return
 
 		case DebuggerCmdStepNext:
 			err := vm.stepToNextLine()
 			if err != nil {
+				vm.err = err
 				fmt.Println("Execution error:", err)
 				vm.running = false
-				vm.StateChan <- vm.CurrentState.Clone()
+				vm.StateChan <- vm.State()
 				return
 			}
-			vm.StateChan <- vm.CurrentState.Clone()
+			vm.StateChan <- vm.State()
 
 		case DebuggerCmdStepBack:
-			if len(vm.History) > 0 {
-				vm.stepToPreviousLine()
-				vm.StateChan <- vm.CurrentState.Clone()
-			} else {
-				vm.StateChan <- vm.CurrentState.Clone()
-			}
+			vm.stepToPreviousLine()
+			vm.StateChan <- vm.State()
 
 		case DebuggerCmdContinue:
+			steps := 0
 			for vm.running && vm.CurrentState.PC < len(vm.Bytecode) {
 				currentLine := vm.sourceMap[vm.CurrentState.PC]
 				if vm.lineBreakpoints[currentLine] {
 					break
 				}
+				if vm.continueBudget > 0 && steps >= vm.continueBudget {
+					fmt.Printf("step budget exceeded at line %d\n", vm.lineForPC(vm.CurrentState.PC))
+					break
+				}
+				steps++
+				vm.recordStep()
 				err := vm.executeInstruction()
 				if err != nil {
+					vm.err = err
 					fmt.Println("Execution error:", err)
 					vm.running = false
-					vm.StateChan <- vm.CurrentState.Clone()
+					vm.StateChan <- vm.State()
 					return
 				}
-				vm.History = append(vm.History, vm.CurrentState.Clone())
 			}
-			vm.StateChan <- vm.CurrentState.Clone()
+			vm.StateChan <- vm.State()
 		}
 	}
 
@@ -307,10 +638,84 @@ func (vm *VM) execute() {
 	vm.mu.Lock()
 	vm.running = false
 	vm.mu.Unlock()
-	vm.StateChan <- vm.CurrentState.Clone()
+	vm.StateChan <- vm.State()
 }
 
 func (vm *VM) executeInstruction() error {
+	// A broken invariant means the bytecode can't be trusted, nothing gets
+	// to handle it
+	if vm.invariants != nil {
+		if err := vm.checkInvariants(); err != nil {
+			return err
+		}
+	}
+	// Collected first so the memory limit only counts what's reachable
+	vm.maybeCollect()
+	// Limits are a hard stop, deferred blocks don't get to run past them
+	if vm.maxInstructions > 0 {
+		if err := vm.burnFuel(); err != nil {
+			return vm.locate(err, vm.CurrentState.PC, len(vm.CurrentState.Stack))
+		}
+	}
+	if vm.ctx != nil {
+		if err := vm.checkContext(); err != nil {
+			return vm.locate(err, vm.CurrentState.PC, len(vm.CurrentState.Stack))
+		}
+	}
+	if s := vm.CurrentState; len(s.Stack) > vm.maxStack || len(s.Strings) != vm.heap.strings {
+		if err := vm.checkBounds(); err != nil {
+			return vm.locate(err, vm.CurrentState.PC, len(vm.CurrentState.Stack))
+		}
+	}
+	if vm.limits != nil {
+		if err := vm.checkLimits(); err != nil {
+			return vm.locate(err, vm.CurrentState.PC, len(vm.CurrentState.Stack))
+		}
+	}
+	// Only the top level has operations, so one's handler is the outermost
+	if hs := vm.CurrentState.Handlers; len(hs) > 0 && !hs[0].Deadline.IsZero() {
+		if err := vm.checkDeadline(); err != nil {
+			return vm.handleError(vm.locate(err, vm.CurrentState.PC, len(vm.CurrentState.Stack)))
+		}
+	}
+	// The handler runs instead of the instruction, the program halts once
+	// it returns
+	if vm.interrupted.Load() != 0 {
+		return vm.takeInterrupt()
+	}
+	if vm.telemetry != nil {
+		return vm.tracedInstruction()
+	}
+	return vm.handleError(vm.dispatch())
+}
+
+// dispatch executes the next instruction, an error comes back located at it
+func (vm *VM) dispatch() error {
+	pc, height := vm.CurrentState.PC, len(vm.CurrentState.Stack)
+	if err := vm.dispatchInstruction(); err != nil {
+		return vm.locate(err, pc, height)
+	}
+	return nil
+}
+
+// handleError hands a runtime error to the innermost try block, running
+// the deferred blocks of the frames it returns from first, or runs every
+// deferred block before it ends the program
+func (vm *VM) handleError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if vm.hasDefers() {
+		vm.CurrentState.PendingError = err
+		return vm.unwind()
+	}
+	if vm.catch(err) {
+		return nil
+	}
+	return err
+}
+
+func (vm *VM) dispatchInstruction() error {
 	instruction := vm.Bytecode[vm.CurrentState.PC]
 	// fmt.Printf("Executing instruction at PC=%d: %v\n", vm.currentState.PC, Instr(instruction))
 	// fmt.Printf("Stack before: %v\n", vm.currentState.Stack)
@@ -359,6 +764,80 @@ func (vm *VM) executeInstruction() error {
 		return vm.executeHalt()
 	case InstrPushStr:
 		return vm.executePushStr()
+	case InstrNewArray:
+		return vm.executeNewArray()
+	case InstrIndexGet:
+		return vm.executeIndexGet()
+	case InstrIndexSet:
+		return vm.executeIndexSet()
+	case InstrDefer:
+		return vm.executeDefer()
+	case InstrIterNew:
+		return vm.executeIterNew()
+	case InstrIterNext:
+		return vm.executeIterNext()
+	case InstrJmpTable:
+		return vm.executeJmpTable()
+	case InstrPushNil:
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, NilValue{})
+		return nil
+	case InstrPushBytes:
+		return vm.executePushBytes()
+	case InstrSlice:
+		return vm.executeSlice()
+	case InstrPushFn:
+		return vm.executePushFn()
+	case InstrCallValue:
+		return vm.executeCallValue()
+	case InstrLoadGlobal:
+		return vm.loadFrom(*vm.globals())
+	case InstrStoreGlobal:
+		return vm.storeInto(vm.globals())
+	case InstrTry:
+		return vm.executeTry()
+	case InstrEndTry:
+		return vm.executeEndTry()
+	case InstrAssert:
+		return vm.executeAssert()
+	case InstrDrop:
+		return vm.executeDrop()
+	case InstrRange:
+		return vm.executeRange()
+	case InstrContains:
+		return vm.executeContains()
+	case InstrLen:
+		return vm.executeLen()
+	case InstrToString:
+		return vm.executeToString()
+	case InstrExit:
+		return vm.executeExit()
+	case InstrLoadShared:
+		return vm.loadFrom(vm.CurrentState.Globals)
+	case InstrStoreShared:
+		return vm.storeInto(&vm.CurrentState.Globals)
+	case InstrPushConst:
+		return vm.executePushConst()
+	case InstrAlloc:
+		return vm.executeAlloc()
+	case InstrScope:
+		vm.CurrentState.Scopes = append(vm.CurrentState.Scopes, len(vm.CurrentState.Defers))
+		return nil
+	case InstrEndScope:
+		return vm.executeEndScope()
+	case InstrPushBool:
+		return vm.executePushBool()
+	case InstrTryOp:
+		return vm.executeTryOp()
+	case InstrOpRetry:
+		return vm.executeOpRetry()
+	case InstrOpNeeds:
+		return vm.executeOpNeeds()
+	case InstrOpCached:
+		return vm.executeOpCached()
+	case InstrOpRecord:
+		return vm.executeOpRecord()
+	case InstrEndDefer:
+		return vm.executeEndDefer()
 	default:
 		return fmt.Errorf("unknown instruction: %d", instruction)
 	}
@@ -367,6 +846,12 @@ func (vm *VM) executeInstruction() error {
 	// return nil
 }
 
+// index reads the 2 byte index operand at the PC, callers check it's in the
+// bytecode and move past it
+func (vm *VM) index() int {
+	return (int(vm.Bytecode[vm.CurrentState.PC]) << 8) | int(vm.Bytecode[vm.CurrentState.PC+1])
+}
+
 func (vm *VM) executePush() error {
 	if vm.CurrentState.PC >= len(vm.Bytecode) {
 		return fmt.Errorf("program counter out of bounds")
@@ -377,20 +862,28 @@ func (vm *VM) executePush() error {
 	return nil
 }
 
+func (vm *VM) executeDrop() error {
+	if len(vm.CurrentState.Stack) <= vm.stackBase() {
+		return fmt.Errorf("stack underflow")
+	}
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
+	return nil
+}
+
 func (vm *VM) executePop() error {
 	if len(vm.CurrentState.Stack) == 0 {
 		return fmt.Errorf("stack underflow")
 	}
-	if vm.CurrentState.PC >= len(vm.Bytecode) {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
 		return fmt.Errorf("program counter out of bounds")
 	}
-	varIdx := int(vm.Bytecode[vm.CurrentState.PC])
+	varIdx := vm.index()
 	if varIdx >= len(vm.CurrentState.Locals) {
 		return fmt.Errorf("variable index out of bounds: %d", varIdx)
 	}
 	vm.CurrentState.Locals[varIdx] = vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
-	vm.CurrentState.PC++
+	vm.CurrentState.PC += 2
 	return nil
 }
 
@@ -401,11 +894,25 @@ func (vm *VM) executeAdd() error {
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		result, err := bigArith(InstrAdd, x, y)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
+		return nil
+	}
 
 	switch va := a.(type) {
 	case IntValue:
 		if vb, ok := b.(IntValue); ok {
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(int(vb)+int(va)))
+			sum, err := vm.addInts(int64(va), int64(vb))
+			if err != nil {
+				return err
+			}
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, sum)
 			return nil
 		}
 	case StringValue:
@@ -413,10 +920,15 @@ func (vm *VM) executeAdd() error {
 			// String concatenation
 			newStr := vm.CurrentState.Strings[va.Index] + vm.CurrentState.Strings[vb.Index]
 			newIdx := vm.RegisterString(newStr)
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, StringValue{Index: newIdx})
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, StringValue{Index: newIdx, Secret: va.Secret || vb.Secret})
 			return nil
 		}
 	}
+	_, aString := a.(StringValue)
+	_, bString := b.(StringValue)
+	if aString || bString {
+		return runtimeError(ErrMixedAdd, typeNames[a.Type()], typeNames[b.Type()])
+	}
 	return fmt.Errorf("invalid operand types for add")
 }
 
@@ -427,10 +939,24 @@ func (vm *VM) executeSub() error {
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(b, a); ok {
+		result, err := bigArith(InstrSub, x, y)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
+		return nil
+	}
 
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(int(vb)-int(va)))
+			diff, err := vm.subInts(int64(vb), int64(va))
+			if err != nil {
+				return err
+			}
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, diff)
 			return nil
 		}
 	}
@@ -444,10 +970,24 @@ func (vm *VM) executeMul() error {
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		result, err := bigArith(InstrMul, x, y)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
+		return nil
+	}
 
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(int(vb)*int(va)))
+			product, err := vm.mulInts(int64(va), int64(vb))
+			if err != nil {
+				return err
+			}
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, product)
 			return nil
 		}
 	}
@@ -461,10 +1001,24 @@ func (vm *VM) executeDiv() error {
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(b, a); ok {
+		result, err := bigArith(InstrDiv, x, y)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
+		return nil
+	}
 
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(int(vb)/int(va)))
+			quotient, err := vm.divInts(int64(vb), int64(va))
+			if err != nil {
+				return err
+			}
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, quotient)
 			return nil
 		}
 	}
@@ -478,10 +1032,23 @@ func (vm *VM) executeMod() error {
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(b, a); ok {
+		result, err := bigArith(InstrMod, x, y)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
+		return nil
+	}
 
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(int(vb)%int(va)))
+			if va == 0 {
+				return runtimeError(ErrDivisionByZero)
+			}
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, vb%va)
 			return nil
 		}
 	}
@@ -495,28 +1062,31 @@ func (vm *VM) executeEq() error {
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, bigCompare(InstrEq, x, y))
+		return nil
+	}
+
+	if isNil(a) || isNil(b) {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(isNil(a) && isNil(b)))
+		return nil
+	}
 
 	switch vb := b.(type) {
 	case IntValue:
 		if va, ok := a.(IntValue); ok {
-			result := 0
-			if int(va) == int(vb) {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(int(va) == int(vb)))
 			return nil
 		}
 	case StringValue:
 		if va, ok := a.(StringValue); ok {
-			result := 0
-			if vm.CurrentState.Strings[vb.Index] == vm.CurrentState.Strings[va.Index] {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(vm.CurrentState.Strings[vb.Index] == vm.CurrentState.Strings[va.Index]))
 			return nil
 		}
 	}
-	return fmt.Errorf("invalid operand types for equality")
+	return vm.compareError(InstrEq)
 }
 
 func (vm *VM) executeNeq() error {
@@ -526,27 +1096,36 @@ func (vm *VM) executeNeq() error {
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
-	switch va := a.(type) {
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, bigCompare(InstrNeq, x, y))
+		return nil
+	}
+
+	if isNil(a) || isNil(b) {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(!(isNil(a) && isNil(b))))
+		return nil
+	}
+
+	switch vb := b.(type) {
 	case IntValue:
-		if vb, ok := b.(IntValue); ok {
-			result := 0
-			if int(va) != int(vb) {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+		if va, ok := a.(IntValue); ok {
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(int(va) != int(vb)))
 			return nil
 		}
 	case StringValue:
-		if vb, ok := b.(StringValue); ok {
-			result := 0
-			if vm.CurrentState.Strings[va.Index] != vm.CurrentState.Strings[vb.Index] {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+		if va, ok := a.(StringValue); ok {
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(vm.CurrentState.Strings[vb.Index] != vm.CurrentState.Strings[va.Index]))
 			return nil
 		}
 	}
-	return nil
+	return vm.compareError(InstrNeq)
+}
+
+func isNil(v Value) bool {
+	_, ok := v.(NilValue)
+	return ok
 }
 
 func (vm *VM) executeLt() error {
@@ -556,107 +1135,128 @@ func (vm *VM) executeLt() error {
 	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, bigCompare(InstrLt, x, y))
+		return nil
+	}
 
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			result := 0
-			if int(va) < int(vb) {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(int(va) < int(vb)))
 			return nil
 		}
 	}
-	return fmt.Errorf("invalid operand types for less than")
+	return vm.compareError(InstrLt)
 }
 
 func (vm *VM) executeGt() error {
 	if len(vm.CurrentState.Stack) < 2 {
 		return fmt.Errorf("stack underflow")
 	}
-	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
-	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, bigCompare(InstrGt, x, y))
+		return nil
+	}
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			result := 0
-			if int(va) > int(vb) {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(int(va) > int(vb)))
 			return nil
 		}
 	}
-	return nil
+	return vm.compareError(InstrGt)
 }
 
 func (vm *VM) executeLte() error {
 	if len(vm.CurrentState.Stack) < 2 {
 		return fmt.Errorf("stack underflow")
 	}
-	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
-	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, bigCompare(InstrLte, x, y))
+		return nil
+	}
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			result := 0
-			if int(va) <= int(vb) {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(int(va) <= int(vb)))
 			return nil
 		}
 	}
-	return nil
+	return vm.compareError(InstrLte)
 }
 
 func (vm *VM) executeGte() error {
 	if len(vm.CurrentState.Stack) < 2 {
 		return fmt.Errorf("stack underflow")
 	}
-	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
-	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	b := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	a := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+	a, b = intCompat(a), intCompat(b)
+
+	if x, y, ok := bigOperands(a, b); ok {
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, bigCompare(InstrGte, x, y))
+		return nil
+	}
 	if va, ok := a.(IntValue); ok {
 		if vb, ok := b.(IntValue); ok {
-			result := 0
-			if int(va) >= int(vb) {
-				result = 1
-			}
-			vm.CurrentState.Stack = append(vm.CurrentState.Stack, IntValue(result))
+			vm.CurrentState.Stack = append(vm.CurrentState.Stack, BoolValue(int(va) >= int(vb)))
 			return nil
 		}
 	}
-	return nil
+	return vm.compareError(InstrGte)
 }
 
 func (vm *VM) executeLoad() error {
-	if vm.CurrentState.PC >= len(vm.Bytecode) {
+	return vm.loadFrom(vm.CurrentState.Locals)
+}
+
+func (vm *VM) loadFrom(locals []Value) error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
 		return fmt.Errorf("program counter out of bounds")
 	}
-	varIdx := int(vm.Bytecode[vm.CurrentState.PC])
-	if varIdx >= len(vm.CurrentState.Locals) {
-		return fmt.Errorf("variable index out of bounds: %d", varIdx)
+	varIdx := vm.index()
+	if varIdx >= len(locals) || locals[varIdx] == nil {
+		return runtimeError(ErrUnassigned)
 	}
-	vm.CurrentState.Stack = append(vm.CurrentState.Stack, vm.CurrentState.Locals[varIdx])
-	vm.CurrentState.PC++
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, locals[varIdx])
+	vm.CurrentState.PC += 2
 	return nil
 }
 
 func (vm *VM) executeStore() error {
-	if vm.CurrentState.PC >= len(vm.Bytecode) {
+	return vm.storeInto(&vm.CurrentState.Locals)
+}
+
+func (vm *VM) storeInto(locals *[]Value) error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
 		return fmt.Errorf("program counter out of bounds")
 	}
 	if len(vm.CurrentState.Stack) == 0 {
 		return fmt.Errorf("stack underflow")
 	}
-	varIdx := int(vm.Bytecode[vm.CurrentState.PC])
-	if varIdx >= len(vm.CurrentState.Locals) {
-		vm.CurrentState.Locals = append(vm.CurrentState.Locals, nil)
+	varIdx := vm.index()
+	if varIdx >= vm.maxLocals {
+		return runtimeError(ErrTooManyLocals, vm.maxLocals)
 	}
-	vm.CurrentState.Locals[varIdx] = vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	// Variables are numbered in compile order, a branch that never ran can
+	// leave a gap below this one
+	for varIdx >= len(*locals) {
+		*locals = append(*locals, nil)
+	}
+	(*locals)[varIdx] = vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
-	vm.CurrentState.PC++
+	vm.CurrentState.PC += 2
 	return nil
 }
 
@@ -688,7 +1288,7 @@ func (vm *VM) executeJmpIfZero() error {
 	// Pop the condition value
 	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
 
-	if condition == IntValue(0) {
+	if !vm.truthy(condition) {
 		vm.CurrentState.PC = jumpAddr
 	} else {
 		vm.CurrentState.PC += 2 // Skip over jump address
@@ -696,61 +1296,395 @@ func (vm *VM) executeJmpIfZero() error {
 	return nil
 }
 
+func (vm *VM) executeAssert() error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	if len(vm.CurrentState.Stack) < 2 {
+		return fmt.Errorf("stack underflow")
+	}
+	textIdx := vm.index()
+	vm.CurrentState.PC += 2
+	cond := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	msg := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+
+	if vm.truthy(cond) {
+		return nil
+	}
+	if textIdx >= len(vm.CurrentState.Strings) {
+		return fmt.Errorf("string index out of bounds: %d", textIdx)
+	}
+	failure := runtimeError(ErrAssertion, vm.CurrentState.Strings[textIdx]).(*RuntimeError)
+	if !isNil(msg) {
+		failure.Message += ": " + vm.displayString(msg)
+	}
+	locals := make([]string, len(vm.CurrentState.Locals))
+	for i, v := range vm.CurrentState.Locals {
+		locals[i] = vm.CurrentState.FormatValue(v)
+	}
+	failure.Notes = append(failure.Notes, "locals: ["+strings.Join(locals, ", ")+"]")
+	return failure
+}
+
 func (vm *VM) executeCall() error {
-	funcIdx := int(vm.Bytecode[vm.CurrentState.PC])
-	numArgs := int(vm.Bytecode[vm.CurrentState.PC+1])
+	if vm.CurrentState.PC+2 >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	funcIdx := vm.index()
+	numArgs := int(vm.Bytecode[vm.CurrentState.PC+2])
+	// Only a failing call needs its line, finding it walks the source map
+	line := func() int { return vm.lineForPC(vm.CurrentState.PC - 1) }
+
+	// Check before popping anything, a bad call must not eat into values
+	// that belong to someone else
+	if funcIdx < len(builtinTable) {
+		builtin := builtinTable[funcIdx]
+		if !builtin.Accepts(numArgs) {
+			return fmt.Errorf("%s expects %s args, got %d (line %d)", builtin.Name, builtin.Arity(), numArgs, line())
+		}
+		if builtin.Effects && vm.limits != nil {
+			return fmt.Errorf("%s is not available in sandbox mode (line %d)", builtin.Name, line())
+		}
+	}
+	if numArgs > len(vm.CurrentState.Stack)-vm.stackBase() {
+		return fmt.Errorf("stack underflow while getting function arguments (line %d)", line())
+	}
 
 	if fn, ok := vm.functions[funcIdx]; ok {
 		// Get arguments in the correct order
 		args := make([]Value, numArgs)
 		for i := numArgs - 1; i >= 0; i-- {
-			if len(vm.CurrentState.Stack) == 0 {
-				return fmt.Errorf("stack underflow while getting function arguments")
-			}
 			args[i] = vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
 			vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
 		}
 
-		result := fn(args)
+		result := vm.callBuiltin(fn, args)
 		vm.CurrentState.Stack = append(vm.CurrentState.Stack, result)
-		vm.CurrentState.PC += 2
+		vm.CurrentState.PC += 3
 		return nil
 	}
-
-	vm.CurrentState.CallStack = append(vm.CurrentState.CallStack, vm.CurrentState.PC)
-	vm.CurrentState.PC = int(vm.CurrentState.Locals[vm.CurrentState.PC].(IntValue))
-	vm.CurrentState.PC++
+	// User functions are values and go through CALL_VALUE
 	return fmt.Errorf("unknown function index: %d", funcIdx)
 }
 
-func (vm *VM) executeRet() error {
-	if len(vm.CurrentState.CallStack) == 0 {
-		return fmt.Errorf("call stack underflow")
+func (vm *VM) executeHalt() error {
+	return vm.unwind()
+}
+
+// unwind runs the cleanups of the innermost frame that has any, dropping
+// the frames in between. An error being unwound is caught once it reaches
+// the frame of a try block, otherwise the program stops when no cleanups
+// are left and the error comes back then
+func (vm *VM) unwind() error {
+	state := vm.CurrentState
+	for {
+		if err := state.PendingError; err != nil && len(state.Handlers) > 0 &&
+			state.Handlers[len(state.Handlers)-1].Frames >= len(state.Frames) {
+			state.PendingError = nil
+			vm.catch(err)
+			return nil
+		}
+		if len(state.Defers) > 0 {
+			state.Resume = 0
+			vm.runNextDefer()
+			return nil
+		}
+		if len(state.Frames) == 0 {
+			break
+		}
+		frame := state.Frames[len(state.Frames)-1]
+		state.Frames = state.Frames[:len(state.Frames)-1]
+		if len(state.Stack) > frame.StackBase {
+			state.Stack = state.Stack[:frame.StackBase]
+		}
+		state.Locals, state.Defers = frame.Locals, frame.Defers
+	}
+	vm.running = false
+	// Nothing runs after a halt, exit can come from the middle of the code
+	state.PC = len(vm.Bytecode)
+	if err := state.PendingError; err != nil {
+		state.PendingError = nil
+		return err
 	}
-	vm.CurrentState.PC = vm.CurrentState.CallStack[len(vm.CurrentState.CallStack)-1]
-	vm.CurrentState.CallStack = vm.CurrentState.CallStack[:len(vm.CurrentState.CallStack)-1]
-	vm.CurrentState.PC++
 	return nil
 }
 
-func (vm *VM) executeHalt() error {
-	vm.running = false
+// hasDefers is whether any frame has cleanups still to run
+func (vm *VM) hasDefers() bool {
+	if len(vm.CurrentState.Defers) > 0 {
+		return true
+	}
+	for _, frame := range vm.CurrentState.Frames {
+		if len(frame.Defers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (vm *VM) executeDefer() error {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("invalid jump address")
+	}
+	highByte := int(vm.Bytecode[vm.CurrentState.PC])
+	lowByte := int(vm.Bytecode[vm.CurrentState.PC+1])
+	// The deferred block starts right after the operand
+	vm.CurrentState.Defers = append(vm.CurrentState.Defers, vm.CurrentState.PC+2)
+	vm.CurrentState.PC = (highByte << 8) | lowByte
+	return nil
+}
+
+// executeEndDefer goes back to the RET the cleanup ran for, which runs the
+// next one or returns, or carries on stopping the program
+func (vm *VM) executeEndDefer() error {
+	if resume := vm.CurrentState.Resume; resume != 0 {
+		vm.CurrentState.Resume = 0
+		vm.CurrentState.PC = resume
+		return nil
+	}
+	return vm.unwind()
+}
+
+// executeEndScope runs the cleanups registered since the matching SCOPE,
+// each comes back here when done
+func (vm *VM) executeEndScope() error {
+	state := vm.CurrentState
+	if len(state.Scopes) == 0 {
+		return fmt.Errorf("END_SCOPE without a SCOPE")
+	}
+	if len(state.Defers) > state.Scopes[len(state.Scopes)-1] {
+		state.Resume = state.PC - 1
+		vm.runNextDefer()
+		return nil
+	}
+	state.Scopes = state.Scopes[:len(state.Scopes)-1]
 	return nil
 }
 
+// runNextDefer pops the most recently registered cleanup block of the
+// innermost frame and jumps into it, it runs with that frame's locals
+func (vm *VM) runNextDefer() {
+	last := len(vm.CurrentState.Defers) - 1
+	vm.CurrentState.PC = vm.CurrentState.Defers[last]
+	vm.CurrentState.Defers = vm.CurrentState.Defers[:last]
+}
+
 func (vm *VM) executePushStr() error {
-	if vm.CurrentState.PC >= len(vm.Bytecode) {
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
 		return fmt.Errorf("program counter out of bounds")
 	}
-	strIdx := int(vm.Bytecode[vm.CurrentState.PC])
+	strIdx := vm.index()
 	if strIdx >= len(vm.CurrentState.Strings) {
 		return fmt.Errorf("string index out of bounds: %d", strIdx)
 	}
 	vm.CurrentState.Stack = append(vm.CurrentState.Stack, StringValue{Index: strIdx})
+	vm.CurrentState.PC += 2
+	return nil
+}
+
+func (vm *VM) executeNewArray() error {
+	if vm.CurrentState.PC >= len(vm.Bytecode) {
+		return fmt.Errorf("program counter out of bounds")
+	}
+	count := int(vm.Bytecode[vm.CurrentState.PC])
+	if len(vm.CurrentState.Stack) < count {
+		return fmt.Errorf("stack underflow")
+	}
+	elems := make([]Value, count)
+	copy(elems, vm.CurrentState.Stack[len(vm.CurrentState.Stack)-count:])
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-count]
+
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, vm.allocArray(elems))
 	vm.CurrentState.PC++
 	return nil
 }
 
+// arrayElement validates an array/index operand pair and returns the
+// array's elements along with the checked index
+func (vm *VM) arrayElement(target, index Value) ([]Value, int, error) {
+	array, ok := target.(ArrayValue)
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid operand type for indexing")
+	}
+	idx, ok := index.(IntValue)
+	if !ok {
+		return nil, 0, fmt.Errorf("array index must be an integer")
+	}
+	elems := vm.CurrentState.Arrays[array.Index]
+	if int(idx) < 0 || int(idx) >= len(elems) {
+		return nil, 0, fmt.Errorf("array index out of bounds: %d (length %d)", idx, len(elems))
+	}
+	return elems, int(idx), nil
+}
+
+func (vm *VM) executeIndexGet() error {
+	if len(vm.CurrentState.Stack) < 2 {
+		return fmt.Errorf("stack underflow")
+	}
+	index := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	target := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-2]
+
+	if str, ok := target.(StringValue); ok {
+		b, err := vm.stringByteAt(str, index)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, b)
+		return nil
+	}
+	if data, ok := target.(BytesValue); ok {
+		b, err := vm.byteAt(data, index)
+		if err != nil {
+			return err
+		}
+		vm.CurrentState.Stack = append(vm.CurrentState.Stack, b)
+		return nil
+	}
+
+	elems, idx, err := vm.arrayElement(target, index)
+	if err != nil {
+		return err
+	}
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, elems[idx])
+	return nil
+}
+
+func (vm *VM) executeIndexSet() error {
+	if len(vm.CurrentState.Stack) < 3 {
+		return fmt.Errorf("stack underflow")
+	}
+	value := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	index := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-2]
+	target := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-3]
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-3]
+
+	switch target.(type) {
+	case BytesValue:
+		return fmt.Errorf("bytes are immutable")
+	case StringValue:
+		return fmt.Errorf("strings are immutable")
+	}
+	_, idx, err := vm.arrayElement(target, index)
+	if err != nil {
+		return err
+	}
+	vm.CurrentState.writableArray(target.(ArrayValue).Index)[idx] = value
+	return nil
+}
+
+func (vm *VM) executeIterNew() error {
+	if len(vm.CurrentState.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	target := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1]
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
+
+	switch t := target.(type) {
+	case ArrayValue, BytesValue, RangeValue:
+	case StringValue:
+		if t.Secret {
+			return fmt.Errorf("cannot iterate over a secret string")
+		}
+	default:
+		return fmt.Errorf("value is not iterable")
+	}
+	vm.CurrentState.Iterators = append(vm.CurrentState.Iterators, Iterator{Target: target})
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, IteratorValue{Index: len(vm.CurrentState.Iterators) - 1})
+	return nil
+}
+
+func (vm *VM) executeIterNext() error {
+	if len(vm.CurrentState.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	if vm.CurrentState.PC+1 >= len(vm.Bytecode) {
+		return fmt.Errorf("invalid jump address")
+	}
+	highByte := int(vm.Bytecode[vm.CurrentState.PC])
+	lowByte := int(vm.Bytecode[vm.CurrentState.PC+1])
+	jumpAddr := (highByte << 8) | lowByte
+
+	iterValue, ok := vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1].(IteratorValue)
+	if !ok {
+		return fmt.Errorf("invalid operand type for iteration")
+	}
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
+
+	iter := &vm.CurrentState.Iterators[iterValue.Index]
+	var elem Value
+	switch target := iter.Target.(type) {
+	case ArrayValue:
+		elems := vm.CurrentState.Arrays[target.Index]
+		if iter.Pos >= len(elems) {
+			vm.CurrentState.PC = jumpAddr
+			return nil
+		}
+		elem = elems[iter.Pos]
+		iter.Pos++
+	case BytesValue:
+		data := vm.CurrentState.Bytes[target.Index]
+		if iter.Pos >= len(data) {
+			vm.CurrentState.PC = jumpAddr
+			return nil
+		}
+		elem = IntValue(data[iter.Pos])
+		iter.Pos++
+	case StringValue:
+		// Strings go a character at a time, Pos is a byte offset
+		s := vm.CurrentState.Strings[target.Index]
+		if iter.Pos >= len(s) {
+			vm.CurrentState.PC = jumpAddr
+			return nil
+		}
+		char, size, err := runeAt(s, iter.Pos)
+		if err != nil {
+			return err
+		}
+		elem = StringValue{Index: vm.RegisterString(char)}
+		iter.Pos += size
+	case RangeValue:
+		if iter.Pos >= target.Len() {
+			vm.CurrentState.PC = jumpAddr
+			return nil
+		}
+		elem = IntValue(target.From + iter.Pos)
+		iter.Pos++
+	}
+	vm.CurrentState.Stack = append(vm.CurrentState.Stack, elem)
+	vm.CurrentState.PC += 2 // Skip over jump address
+	return nil
+}
+
+func (vm *VM) executeJmpTable() error {
+	if len(vm.CurrentState.Stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	pc := vm.CurrentState.PC
+	if pc+5 >= len(vm.Bytecode) {
+		return fmt.Errorf("invalid jump table")
+	}
+	lo := (int(vm.Bytecode[pc]) << 8) | int(vm.Bytecode[pc+1])
+	size := (int(vm.Bytecode[pc+2]) << 8) | int(vm.Bytecode[pc+3])
+	defaultAddr := (int(vm.Bytecode[pc+4]) << 8) | int(vm.Bytecode[pc+5])
+	table := pc + 6
+	if table+size*2 > len(vm.Bytecode) {
+		return fmt.Errorf("invalid jump table")
+	}
+
+	subject := intCompat(vm.CurrentState.Stack[len(vm.CurrentState.Stack)-1])
+	vm.CurrentState.Stack = vm.CurrentState.Stack[:len(vm.CurrentState.Stack)-1]
+
+	// Anything that isn't an int within the table takes the default arm
+	vm.CurrentState.PC = defaultAddr
+	if v, ok := subject.(IntValue); ok && int(v) >= lo && int(v) < lo+size {
+		entry := table + (int(v)-lo)*2
+		vm.CurrentState.PC = (int(vm.Bytecode[entry]) << 8) | int(vm.Bytecode[entry+1])
+	}
+	return nil
+}
+
 func (vm *VM) RegisterFunction(idx int, fn GoFunction) {
 	vm.functions[idx] = fn
 }
@@ -780,18 +1714,31 @@ func (vm *VM) RegisterStrings(strings map[string]int) {
 	for str, idx := range strings {
 		vm.CurrentState.Strings[idx] = str
 	}
+	vm.pinnedStrings = max(vm.pinnedStrings, maxIdx+1)
 }
 
 func (vm *VM) RegisterSourceMap(pc, line int) {
 	vm.sourceMap[pc] = line
 }
 
+// lineForPC finds the source line of the statement an instruction belongs
+// to, the source map only has entries where a new line starts
+func (vm *VM) lineForPC(pc int) int {
+	line, best := 1, -1
+	for srcPC, srcLine := range vm.sourceMap {
+		if srcPC <= pc && srcPC > best {
+			best, line = srcPC, srcLine
+		}
+	}
+	return line
+}
+
 func (vm *VM) stepToNextLine() error {
 	currentLine := vm.sourceMap[vm.CurrentState.PC]
 
 	for vm.CurrentState.PC < len(vm.Bytecode) {
-		// Store the current state BEFORE executing the instruction
-		vm.History = append(vm.History, vm.CurrentState.Clone())
+		// Record the step BEFORE executing the instruction
+		vm.recordStep()
 
 		err := vm.executeInstruction()
 		if err != nil {
@@ -808,21 +1755,15 @@ func (vm *VM) stepToNextLine() error {
 }
 
 func (vm *VM) stepToPreviousLine() {
-	if len(vm.History) == 0 {
-		return
-	}
-
+	h := vm.history
 	currentLine := vm.sourceMap[vm.CurrentState.PC]
-	var previousState *VMState
 
-	for len(vm.History) > 0 {
-		previousState = vm.History[len(vm.History)-1].Clone()
-		vm.History = vm.History[:len(vm.History)-1]
-
-		if newLine := vm.sourceMap[previousState.PC]; newLine != currentLine && newLine != 0 {
-			vm.CurrentState = previousState
+	// Back to the last recorded step that was on another line
+	for step := h.steps() - 1; step >= 0; step-- {
+		if newLine := vm.sourceMap[h.pcs[step]]; newLine != currentLine && newLine != 0 {
+			vm.rewindTo(step)
 			vm.CurrentState.SourceLine = newLine
-			break
+			return
 		}
 	}
 }
@@ -0,0 +1,194 @@
+package lang
+
+import "fmt"
+
+// unknownDepth marks code the analysis can't give a stack depth, deferred
+// blocks run on whatever stack the program halted with
+const unknownDepth = -1
+
+// invariants are what the bytecode says must hold before every instruction,
+// worked out once up front for the assertion mode
+type invariants struct {
+	// boundaries are the offsets instructions start at
+	boundaries map[int]bool
+	// depths are the stack depths above the frame's base every instruction
+	// starts with, unknownDepth where paths disagree or can't be followed
+	depths map[int]int
+	// owners are the function every instruction belongs to by its entry
+	// address, the top level is 0, and slots how many locals each one uses
+	owners map[int]int
+	slots  map[int]int
+}
+
+// EnableAsserts makes the VM check itself before every instruction, for
+// catching compiler bugs: the PC is on an instruction boundary, the stack is
+// as deep as the bytecode says it is there and the locals fit the frame. A
+// violation stops the program, try blocks don't get to catch it
+func (vm *VM) EnableAsserts() {
+	vm.invariants = analyzeBytecode(vm.Bytecode)
+}
+
+func (vm *VM) checkInvariants() error {
+	inv, pc := vm.invariants, vm.CurrentState.PC
+	if !inv.boundaries[pc] {
+		return fmt.Errorf("vm assert: PC %d is not on an instruction boundary", pc)
+	}
+	if want, ok := inv.depths[pc]; ok && want != unknownDepth {
+		if got := len(vm.CurrentState.Stack) - vm.stackBase(); got != want {
+			return fmt.Errorf("vm assert: stack depth %d at PC %d (%s), the bytecode expects %d", got, pc, Instr(vm.Bytecode[pc]), want)
+		}
+	}
+	if owner, ok := inv.owners[pc]; ok {
+		if n := len(vm.CurrentState.Locals); n > inv.slots[owner] {
+			return fmt.Errorf("vm assert: %d locals at PC %d, the function at %04d has %d", n, pc, owner, inv.slots[owner])
+		}
+	}
+	if n := len(*vm.globals()); n > inv.slots[0] {
+		return fmt.Errorf("vm assert: %d top level variables at PC %d, the program has %d", n, pc, inv.slots[0])
+	}
+	return nil
+}
+
+// analyzeBytecode follows every path through the code from the start and
+// from every function, the way the VM would run it
+func analyzeBytecode(code []byte) *invariants {
+	inv := &invariants{
+		boundaries: make(map[int]bool),
+		depths:     make(map[int]int),
+		owners:     make(map[int]int),
+		slots:      map[int]int{0: 0},
+	}
+	for pc := 0; pc < len(code); pc += instrLength(code, pc) {
+		inv.boundaries[pc] = true
+	}
+	// Running off the end finishes the program
+	inv.boundaries[len(code)] = true
+
+	type entry struct{ pc, depth, owner int }
+	work := []entry{{0, 0, 0}}
+	visit := func(pc, depth, owner int) {
+		if pc >= len(code) || !inv.boundaries[pc] {
+			return
+		}
+		prev, seen := inv.depths[pc]
+		switch {
+		case !seen:
+			inv.depths[pc] = depth
+		case prev == depth || prev == unknownDepth:
+			return
+		default:
+			// The paths disagree, nothing can be said from here on
+			inv.depths[pc] = unknownDepth
+			depth = unknownDepth
+		}
+		if _, ok := inv.owners[pc]; !ok {
+			inv.owners[pc] = owner
+		}
+		work = append(work, entry{pc, depth, owner})
+	}
+	inv.depths[0], inv.owners[0] = 0, 0
+
+	for len(work) > 0 {
+		e := work[len(work)-1]
+		work = work[:len(work)-1]
+		pc, owner := e.pc, e.owner
+		op := Instr(code[pc])
+		next := pc + instrLength(code, pc)
+		after := func(delta int) int {
+			if e.depth == unknownDepth {
+				return unknownDepth
+			}
+			return max(0, e.depth+delta)
+		}
+		operand := func(i int) int {
+			if pc+i >= len(code) {
+				return 0
+			}
+			return int(code[pc+i])
+		}
+		addr := func(i int) int {
+			return operand(i)<<8 | operand(i+1)
+		}
+
+		switch op {
+		case InstrLoad, InstrStore, InstrPop:
+			inv.slots[owner] = max(inv.slots[owner], addr(1)+1)
+		case InstrLoadGlobal, InstrStoreGlobal:
+			inv.slots[0] = max(inv.slots[0], addr(1)+1)
+		}
+
+		switch op {
+		case InstrPush, InstrPushConst, InstrPushStr, InstrPushNil, InstrPushBool, InstrPushBytes, InstrLoad, InstrLoadGlobal, InstrLoadShared:
+			visit(next, after(1), owner)
+		case InstrPushFn:
+			fn := addr(1)
+			inv.slots[fn] = max(inv.slots[fn], operand(3))
+			visit(fn, 0, fn)
+			visit(next, after(1), owner)
+		case InstrAdd, InstrSub, InstrMul, InstrDiv, InstrMod, InstrEq, InstrNeq, InstrLt, InstrGt, InstrLte, InstrGte,
+			InstrStore, InstrPop, InstrStoreGlobal, InstrStoreShared, InstrIndexGet, InstrDrop, InstrRange, InstrContains:
+			visit(next, after(-1), owner)
+		case InstrSlice, InstrAssert:
+			visit(next, after(-2), owner)
+		case InstrIndexSet:
+			visit(next, after(-3), owner)
+		case InstrIterNew, InstrLen, InstrToString, InstrEndTry, InstrScope, InstrEndScope, InstrOpRecord:
+			visit(next, after(0), owner)
+		case InstrCall:
+			visit(next, after(1-operand(3)), owner)
+		case InstrCallValue:
+			visit(next, after(-operand(1)), owner)
+		case InstrNewArray:
+			visit(next, after(1-operand(1)), owner)
+		case InstrAlloc:
+			visit(next, after(1-addr(2)), owner)
+		case InstrJmp:
+			visit(addr(1), after(0), owner)
+		case InstrJmpIfZero:
+			visit(next, after(-1), owner)
+			visit(addr(1), after(-1), owner)
+		case InstrIterNext:
+			visit(next, after(0), owner)
+			visit(addr(1), after(-1), owner)
+		case InstrJmpTable:
+			visit(addr(5), after(-1), owner)
+			for i := 0; i < addr(3); i++ {
+				visit(addr(7+2*i), after(-1), owner)
+			}
+		case InstrTry, InstrTryOp:
+			// The catch starts with the error message pushed
+			visit(addr(1), after(1), owner)
+			visit(next, after(0), owner)
+		case InstrOpRetry:
+			visit(addr(1), after(-1), owner)
+			visit(next, after(-1), owner)
+		case InstrOpNeeds:
+			visit(addr(5), after(0), owner)
+			visit(next, after(0), owner)
+		case InstrOpCached:
+			visit(addr(6), after(-2), owner)
+			visit(next, after(-2), owner)
+		case InstrDefer:
+			// The block runs at the end, on the stack the program ends with
+			visit(next, unknownDepth, owner)
+			visit(addr(1), after(0), owner)
+		case InstrRet, InstrHalt, InstrEndDefer, InstrExit:
+			// Execution doesn't go on to the next instruction
+		}
+	}
+	return inv
+}
+
+// instrLength is the encoded size of the instruction at pc, with the
+// address table of a JMP_TABLE
+func instrLength(code []byte, pc int) int {
+	info, ok := Instr(code[pc]).Info()
+	if !ok {
+		return 1
+	}
+	size := info.Size()
+	if Instr(code[pc]) == InstrJmpTable && pc+4 < len(code) {
+		size += 2 * (int(code[pc+3])<<8 | int(code[pc+4]))
+	}
+	return size
+}
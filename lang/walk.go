@@ -0,0 +1,197 @@
+package lang
+
+import (
+	"slices"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Pos is where the statement starts
+func (s *Statement) Pos() lexer.Position {
+	switch {
+	case s.Assignment != nil:
+		return s.Assignment.Pos
+	case s.FnDecl != nil:
+		return s.FnDecl.Pos
+	case s.ConstDecl != nil:
+		return s.ConstDecl.Pos
+	case s.GlobalDecl != nil:
+		return s.GlobalDecl.Pos
+	case s.Operation != nil:
+		return s.Operation.Pos
+	case s.IfStmt != nil:
+		return s.IfStmt.Pos
+	case s.WhileStmt != nil:
+		return s.WhileStmt.Pos
+	case s.ForStmt != nil:
+		return s.ForStmt.Pos
+	case s.DeferStmt != nil:
+		return s.DeferStmt.Pos
+	case s.TryStmt != nil:
+		return s.TryStmt.Pos
+	case s.AssertStmt != nil:
+		return s.AssertStmt.Pos
+	case s.MatchStmt != nil:
+		return s.MatchStmt.Pos
+	case s.IndexAssignment != nil:
+		return s.IndexAssignment.Pos
+	case s.Reassignment != nil:
+		return s.Reassignment.Pos
+	case s.CompoundAssignment != nil:
+		return s.CompoundAssignment.Pos
+	case s.Call != nil:
+		return s.Call.Pos
+	}
+	return lexer.Position{}
+}
+
+// exprs are the expressions the statement evaluates itself, not the ones of
+// the statements nested in it
+func (s *Statement) exprs() []*Expr {
+	switch {
+	case s.Assignment != nil:
+		return append([]*Expr{s.Assignment.Expr}, s.Assignment.ExtraExprs...)
+	case s.FnDecl != nil:
+		if s.FnDecl.Fn.Result != nil {
+			return []*Expr{s.FnDecl.Fn.Result}
+		}
+	case s.ConstDecl != nil:
+		return []*Expr{s.ConstDecl.Expr}
+	case s.GlobalDecl != nil:
+		return []*Expr{s.GlobalDecl.Expr}
+	case s.IfStmt != nil:
+		return []*Expr{s.IfStmt.Condition}
+	case s.WhileStmt != nil:
+		return []*Expr{s.WhileStmt.Condition}
+	case s.ForStmt != nil:
+		if s.ForStmt.Iterable != nil {
+			return []*Expr{s.ForStmt.Iterable}
+		}
+		return []*Expr{s.ForStmt.From, s.ForStmt.To}
+	case s.MatchStmt != nil:
+		return []*Expr{s.MatchStmt.Subject}
+	case s.AssertStmt != nil:
+		if s.AssertStmt.Message != nil {
+			return []*Expr{s.AssertStmt.Cond, s.AssertStmt.Message}
+		}
+		return []*Expr{s.AssertStmt.Cond}
+	case s.IndexAssignment != nil:
+		return []*Expr{s.IndexAssignment.Index, s.IndexAssignment.Expr}
+	case s.Reassignment != nil:
+		return s.Reassignment.Exprs
+	case s.CompoundAssignment != nil:
+		return []*Expr{s.CompoundAssignment.Expr}
+	case s.Operation != nil:
+		return append(slices.Clone(s.Operation.Inputs), s.Operation.Outputs...)
+	case s.Call != nil:
+		return s.Call.Args
+	}
+	return nil
+}
+
+// blocks are the statement lists nested directly in the statement
+func (s *Statement) blocks() [][]Statement {
+	switch {
+	case s.FnDecl != nil:
+		return [][]Statement{s.FnDecl.Fn.Body}
+	case s.Operation != nil:
+		return [][]Statement{s.Operation.Body}
+	case s.IfStmt != nil:
+		return [][]Statement{s.IfStmt.Then, s.IfStmt.Else}
+	case s.WhileStmt != nil:
+		return [][]Statement{s.WhileStmt.Body}
+	case s.ForStmt != nil:
+		return [][]Statement{s.ForStmt.Body}
+	case s.DeferStmt != nil:
+		return [][]Statement{s.DeferStmt.Body}
+	case s.TryStmt != nil:
+		return [][]Statement{s.TryStmt.Body, s.TryStmt.Handler}
+	case s.MatchStmt != nil:
+		blocks := make([][]Statement, len(s.MatchStmt.Arms))
+		for i, arm := range s.MatchStmt.Arms {
+			blocks[i] = arm.Body
+		}
+		return blocks
+	}
+	return nil
+}
+
+// visitor is called for every statement and term in source order along with
+// the function they belong to, owner is nil at the top level
+type visitor struct {
+	stmt func(stmt *Statement, owner *FnLit)
+	term func(term *Term, owner *FnLit)
+}
+
+func (v visitor) statements(stmts []Statement, owner *FnLit) {
+	for i := range stmts {
+		stmt := &stmts[i]
+		if v.stmt != nil {
+			v.stmt(stmt, owner)
+		}
+		inner := owner
+		if stmt.FnDecl != nil {
+			inner = stmt.FnDecl.Fn
+		}
+		blocks := stmt.blocks()
+		if stmt.FnDecl != nil {
+			// The body comes before the result
+			v.statements(blocks[0], inner)
+			blocks = nil
+		}
+		for _, expr := range stmt.exprs() {
+			v.expr(expr, inner)
+		}
+		for _, block := range blocks {
+			v.statements(block, inner)
+		}
+	}
+}
+
+func (v visitor) expr(e *Expr, owner *FnLit) {
+	for ; e != nil; e = e.Right {
+		v.termTree(e.Left, owner)
+	}
+}
+
+func (v visitor) termTree(t *Term, owner *FnLit) {
+	if t == nil {
+		return
+	}
+	if v.term != nil {
+		v.term(t, owner)
+	}
+	switch {
+	case t.Call != nil:
+		for _, arg := range t.Call.Args {
+			v.expr(arg, owner)
+		}
+	case t.SubExpr != nil:
+		v.expr(t.SubExpr, owner)
+	case t.Array != nil:
+		for _, elem := range t.Array.Elements {
+			v.expr(elem, owner)
+		}
+	case t.Cond != nil:
+		v.expr(t.Cond.Condition, owner)
+		v.expr(t.Cond.Then, owner)
+		v.expr(t.Cond.Else, owner)
+	case t.Fn != nil:
+		v.statements(t.Fn.Body, t.Fn)
+		v.expr(t.Fn.Result, t.Fn)
+	case t.Block != nil:
+		v.statements(t.Block.Body, owner)
+		v.expr(t.Block.Result, owner)
+	}
+	for _, sub := range t.Index {
+		if sub.Method != nil {
+			for _, arg := range sub.Method.Args {
+				v.expr(arg, owner)
+			}
+		}
+	}
+	for _, sub := range t.Index {
+		v.expr(sub.Index, owner)
+		v.expr(sub.High, owner)
+	}
+}
@@ -0,0 +1,40 @@
+package lang
+
+import "unicode/utf8"
+
+// Ellipsis marks where text was cut to fit the display
+const Ellipsis = "…"
+
+// displayWidth is how many columns output is fit to, 0 leaves it uncut
+var displayWidth int
+
+// SetDisplayWidth sets the number of columns bytecode dumps and parse
+// explanations are fit to, long strings and names are cut with an ellipsis
+// to keep the columns aligned. Zero turns cutting off
+func SetDisplayWidth(width int) {
+	displayWidth = max(0, width)
+}
+
+// DisplayWidth is the width set with SetDisplayWidth
+func DisplayWidth() int {
+	return displayWidth
+}
+
+// Ellipsize cuts s to at most width runes, the last one being an ellipsis
+// when it had to be cut. A width of 0 or less leaves s alone
+func Ellipsize(s string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max(0, width-1)]) + Ellipsis
+}
+
+// fit cuts s to what's left of the display after used columns, never below
+// floor so there is always something to read
+func fit(s string, used, floor int) string {
+	if displayWidth == 0 {
+		return s
+	}
+	return Ellipsize(s, max(floor, displayWidth-used))
+}
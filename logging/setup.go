@@ -14,9 +14,16 @@ const (
 	LogLevelDebug LogLevel = "debug"
 )
 
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
 var logger *slog.Logger
 
-func Setup(optslevel LogLevel) {
+func Setup(optslevel LogLevel, format LogFormat) {
 	sink := io.Discard
 	if optslevel != LogLevelNone {
 		sink = os.Stderr
@@ -26,8 +33,12 @@ func Setup(optslevel LogLevel) {
 	if optslevel == LogLevelInfo {
 		level = slog.LevelInfo
 	}
-	handler := slog.NewTextHandler(sink, &slog.HandlerOptions{
+	handlerOpts := &slog.HandlerOptions{
 		Level: level,
-	})
+	}
+	var handler slog.Handler = slog.NewTextHandler(sink, handlerOpts)
+	if format == LogFormatJSON {
+		handler = slog.NewJSONHandler(sink, handlerOpts)
+	}
 	logger = slog.New(handler)
 }
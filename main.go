@@ -1,15 +1,50 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
+	"hadydotai/opdlang/lang"
 	"hadydotai/opdlang/logging"
 
 	"github.com/jessevdk/go-flags"
 )
 
 type Options struct {
-	LogLevel logging.LogLevel `short:"l" long:"loglevel" description:"Set the level of logging" choice:"none" choice:"info" choice:"debug" default:"info"`
+	LogLevel  logging.LogLevel  `short:"l" long:"loglevel" description:"Set the level of logging" choice:"none" choice:"info" choice:"debug" default:"info"`
+	LogFormat logging.LogFormat `long:"log-format" description:"Set the format of logs and progress events" choice:"text" choice:"json" default:"text"`
+	Yes       bool              `long:"yes" description:"Answer yes to every confirm prompt and pick the first option of every choice"`
+	NoInput   bool              `long:"no-input" description:"Never prompt, confirm prompts answer no and choices pick their first option"`
+	Locale    string            `long:"locale" env:"OPDLANG_LOCALE" description:"Set the language of error messages, defaults to the system locale"`
+	Dialect   string            `long:"dialect" env:"OPDLANG_DIALECT" description:"Dialect file of keyword aliases to accept, one alias = keyword per line"`
+	Version   string            `long:"lang-version" env:"OPDLANG_LANG_VERSION" description:"Language version to compile as, deprecated constructs are errors from the version they're removed in" default:"0.2"`
+	Artifacts string            `long:"artifacts-dir" env:"OPDLANG_ARTIFACTS_DIR" description:"Directory compiled bytecode goes to unless given a path, clean removes it" default:".opd"`
+	Width     int               `long:"width" env:"COLUMNS" description:"Columns to fit debugger and dump output to, the terminal's width by default"`
+}
+
+// locale is the language error messages are shown in, the system locale
+// unless one was picked explicitly
+func (o *Options) locale() string {
+	if o.Locale != "" {
+		return o.Locale
+	}
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (o *Options) promptMode() lang.PromptMode {
+	switch {
+	case o.Yes:
+		return lang.PromptAssumeYes
+	case o.NoInput:
+		return lang.PromptNoInput
+	default:
+		return lang.PromptInteractive
+	}
 }
 
 var (
@@ -17,9 +52,36 @@ var (
 	flagsparser = flags.NewParser(&opts, flags.Default)
 )
 
+// loadDialect makes the parser accept the keyword aliases of a dialect file
+func loadDialect(file string) error {
+	if file == "" {
+		return nil
+	}
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read dialect file %s: %w", file, err)
+	}
+	dialect, err := lang.ParseDialect(file, string(source))
+	if err != nil {
+		return fmt.Errorf("invalid dialect file: %w", err)
+	}
+	lang.SetDialect(dialect)
+	return nil
+}
+
 func main() {
 	flagsparser.CommandHandler = func(command flags.Commander, args []string) error {
-		logging.Setup(opts.LogLevel)
+		logging.Setup(opts.LogLevel, opts.LogFormat)
+		if !lang.SetLocale(opts.locale()) && opts.Locale != "" {
+			logging.Log(logging.LogLevelInfo, "No error messages for locale, using English", "locale", opts.Locale)
+		}
+		if err := loadDialect(opts.Dialect); err != nil {
+			return err
+		}
+		if err := lang.SetLangVersion(opts.Version); err != nil {
+			return err
+		}
+		lang.SetDisplayWidth(displayWidth())
 		return command.Execute(args)
 	}
 
@@ -35,7 +97,7 @@ func main() {
 		}
 	}
 
-	logging.Setup(opts.LogLevel)
+	logging.Setup(opts.LogLevel, opts.LogFormat)
 }
 
 // func runCompiledFile(filename string, debug bool) int {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"hadydotai/opdlang/lang"
+)
+
+type MigrateCommand struct {
+	To     string `long:"to" description:"Language version to upgrade to, the newest by default"`
+	DryRun bool   `long:"dry-run" description:"Print the edits without writing them"`
+	Args   struct {
+		Files []string `positional-arg-name:"FILES" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+var migrateCommand MigrateCommand
+
+func (cmd *MigrateCommand) Execute(args []string) error {
+	to := cmd.To
+	if to == "" {
+		to = lang.LangVersions[len(lang.LangVersions)-1]
+	}
+
+	for _, file := range cmd.Args.Files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read source file %s: %w", file, err)
+		}
+		edited, edits, err := lang.Migrate(file, string(source), to)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", file, err)
+		}
+
+		fmt.Printf("%s: %d edits\n", file, len(edits))
+		for _, edit := range edits {
+			fmt.Printf("  %v\n", edit)
+		}
+		if cmd.DryRun || len(edits) == 0 {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, []byte(edited), info.Mode()); err != nil {
+			return fmt.Errorf("failed to write migrated source file %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	flagsparser.AddCommand(
+		"migrate",
+		"Upgrade source files to a newer language version",
+		"Rewrites the deprecated constructs of FILES that are removed by the --to language version, in place, and prints the edits made to every file",
+		&migrateCommand,
+	)
+}
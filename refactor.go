@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"hadydotai/opdlang/lang"
+)
+
+type RefactorCommand struct{}
+
+type ExtractCommand struct {
+	Args struct {
+		File  string `positional-arg-name:"FILE" required:"yes"`
+		Range string `positional-arg-name:"START:END" required:"yes"`
+		Name  string `positional-arg-name:"NAME" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+var (
+	refactorCommand RefactorCommand
+	extractCommand  ExtractCommand
+)
+
+func (cmd *ExtractCommand) Execute(args []string) error {
+	from, to, ok := strings.Cut(cmd.Args.Range, ":")
+	start, err := strconv.Atoi(from)
+	if err != nil || !ok {
+		return fmt.Errorf("range must be START:END byte offsets, got %q", cmd.Args.Range)
+	}
+	end, err := strconv.Atoi(to)
+	if err != nil {
+		return fmt.Errorf("range must be START:END byte offsets, got %q", cmd.Args.Range)
+	}
+
+	source, err := os.ReadFile(cmd.Args.File)
+	if err != nil {
+		return fmt.Errorf("failed to read source file %s: %w", cmd.Args.File, err)
+	}
+	edited, err := lang.ExtractVariable(cmd.Args.File, string(source), start, end, cmd.Args.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Print(edited)
+	return nil
+}
+
+func init() {
+	refactor, err := flagsparser.AddCommand(
+		"refactor",
+		"Rewrite source code",
+		"Source to source rewrites, the edited program is printed to stdout",
+		&refactorCommand,
+	)
+	if err != nil {
+		panic(err)
+	}
+	refactor.AddCommand(
+		"extract",
+		"Extract an expression into a variable",
+		"Moves the expression between the START and END byte offsets into a val named NAME, declared right before the statement it was in",
+		&extractCommand,
+	)
+}
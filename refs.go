@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"hadydotai/opdlang/lang"
+)
+
+type RefsCommand struct {
+	Args struct {
+		Symbol string   `positional-arg-name:"SYMBOL" required:"yes"`
+		Files  []string `positional-arg-name:"FILES" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+var refsCommand RefsCommand
+
+func (cmd *RefsCommand) Execute(args []string) error {
+	programs := make([]*lang.Program, 0, len(cmd.Args.Files))
+	for _, file := range cmd.Args.Files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read source file %s: %w", file, err)
+		}
+		program, err := lang.Parse(file, string(source))
+		if err != nil {
+			return err
+		}
+		programs = append(programs, program)
+	}
+
+	for _, ref := range lang.FindReferences(programs, cmd.Args.Symbol) {
+		fmt.Printf("%s \033[90m%s\033[0m\n", ref.Pos, ref.Kind)
+	}
+	return nil
+}
+
+func init() {
+	flagsparser.AddCommand(
+		"refs",
+		"Find the references to a name",
+		"Lists every place SYMBOL is declared, assigned, read, called or depended on across the given files",
+		&refsCommand,
+	)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,8 +17,26 @@ type REPL struct {
 	compiler   *lang.Compiler
 	rl         *readline.Instance
 	sourceCode string
+	// intFormat is the base integers are shown in, set int-format changes it
+	intFormat lang.IntFormat
+
+	// sessions holds the programs loaded with "load <file> as <name>", the
+	// current one lives in the fields above and is saved back on switch
+	sessions map[string]*session
+	current  string
 }
 
+// session is a loaded program with its own VM, and so its own breakpoints
+// and history
+type session struct {
+	vm         *lang.VM
+	compiler   *lang.Compiler
+	sourceCode string
+}
+
+// mainSession names the program the debugger was started with
+const mainSession = "main"
+
 func NewREPL(vm *lang.VM, compiler *lang.Compiler) *REPL {
 	// Configure readline with nice defaults
 	rlConfig := &readline.Config{
@@ -38,6 +57,8 @@ func NewREPL(vm *lang.VM, compiler *lang.Compiler) *REPL {
 		vm:       vm,
 		compiler: compiler,
 		rl:       rl,
+		sessions: make(map[string]*session),
+		current:  mainSession,
 	}
 }
 
@@ -50,11 +71,16 @@ func (c completer) Do(line []rune, pos int) (newLine [][]rune, length int) {
 		"back", "b",
 		"continue", "c",
 		"break",
+		"set",
+		"diff",
+		"whence",
 		"stack",
 		"locals",
 		"pc",
+		"gc",
 		"restart", "r",
 		"load",
+		"switch",
 		"source",
 		"quit", "q",
 		"help", "h",
@@ -82,11 +108,23 @@ Available Commands:
   back, b          Step back to previous state
   continue, c      Continue execution
   break <line>     Set breakpoint at line number
+  set <opt> <n>    Change a debugger setting:
+                     max-continue-steps         instructions a continue runs before pausing, 0 for no limit
+                     history-keyframe-interval  instructions between snapshots kept for stepping back
+                     history-limit              steps kept for stepping back, 0 keeps them all
+                     int-format                 base integers are shown in, hex, dec or bin
+                     gc-threshold               table entries before the first collection, 0 turns it off
+  diff <a> <b>     Show what changed between two recorded steps, a step
+                   can name a session as <session>:<step>
+  whence <var>     Go back to the last step that changed a variable
   stack            Show current stack
-  locals           Show local variables
+  locals           Show local variables, and the ones declared global
   pc               Show current program counter
+  gc               Show what the garbage collector reclaimed so far
   restart, r       Restart program execution
-  load <file>      Load and execute a source file
+  load <file> [as <name>]
+                   Load a source file, into a new session when named
+  switch [<name>]  Switch to a session, or list them
   source           Display source code with line numbers
   help, h          Show this help message
   quit, q          Exit debugger
@@ -158,6 +196,27 @@ func (r *REPL) Start() {
 			r.vm.SetLineBreakpoint(line, true)
 			fmt.Printf("Breakpoint set at line %d\n", line)
 
+		case "set":
+			if len(args) < 3 {
+				fmt.Println("Usage: set <option> <value>")
+				continue
+			}
+			r.setOption(args[1], args[2])
+
+		case "diff":
+			if len(args) < 3 {
+				fmt.Printf("Usage: diff <stepA> <stepB>, steps 0..%d\n", r.vm.StepCount())
+				continue
+			}
+			r.diffSteps(args[1], args[2])
+
+		case "whence":
+			if len(args) < 2 {
+				fmt.Println("Usage: whence <variable>")
+				continue
+			}
+			r.whence(args[1])
+
 		case "stack":
 			state := r.vm.State()
 			fmt.Println("Stack:", r.formatStack(state.Stack))
@@ -165,28 +224,54 @@ func (r *REPL) Start() {
 		case "locals":
 			state := r.vm.State()
 			fmt.Println("Locals:", r.formatStack(state.Locals))
+			if len(r.compiler.Globals()) > 0 {
+				fmt.Println("Globals:", r.formatStack(state.Globals))
+			}
 
 		case "pc":
 			state := r.vm.State()
 			fmt.Printf("PC: %d (Instruction: %s)\n", state.PC, lang.Instr(r.vm.Bytecode[state.PC]))
 
+		case "gc":
+			stats := r.vm.GCStats()
+			fmt.Printf("GC: %d collections, freed %d strings, %d arrays, %d bytes, %d iterators\n",
+				stats.Collections, stats.Freed.Strings, stats.Freed.Arrays, stats.Freed.Bytes, stats.Freed.Iterators)
+			fmt.Printf("Live after the last: %d strings, %d arrays, %d bytes, %d iterators\n",
+				stats.Live.Strings, stats.Live.Arrays, stats.Live.Bytes, stats.Live.Iterators)
+
 		case "restart", "r":
 			r.restartVM()
 			fmt.Println("Program restarted")
 
 		case "load":
-			if len(args) < 2 {
-				fmt.Println("Usage: load <filename>")
+			if len(args) != 2 && (len(args) != 4 || args[2] != "as") {
+				fmt.Println("Usage: load <filename> [as <name>]")
 				continue
 			}
+			prev := r.current
+			if len(args) == 4 {
+				r.saveSession()
+				r.current = args[3]
+			}
 			err := r.loadFile(args[1])
 			if err != nil {
 				fmt.Printf("\033[31mError loading file: %v\033[0m\n", err)
+				if len(args) == 4 {
+					r.useSession(prev)
+				}
 				continue
 			}
-			fmt.Printf("\033[32mLoaded file: %s\033[0m\n", args[1])
+			r.saveSession()
+			fmt.Printf("\033[32mLoaded file: %s\033[0m into session %s\n", args[1], r.current)
 			r.printState(r.vm.State())
 
+		case "switch":
+			if len(args) < 2 {
+				r.listSessions()
+				continue
+			}
+			r.switchSession(args[1])
+
 		case "source":
 			r.displaySource()
 
@@ -200,13 +285,200 @@ func (r *REPL) Start() {
 	}
 }
 
+// setOption changes a debugger setting, numbers can be written as 1e6
+func (r *REPL) setOption(name, value string) {
+	if name == "int-format" {
+		format, ok := lang.ParseIntFormat(value)
+		if !ok {
+			fmt.Printf("Invalid value: %s, expected hex, dec or bin\n", value)
+			return
+		}
+		r.intFormat = format
+		fmt.Printf("Integers are shown in %s\n", value)
+		return
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		fmt.Printf("Invalid value: %s\n", value)
+		return
+	}
+
+	switch name {
+	case "max-continue-steps":
+		r.vm.SetContinueBudget(int(n))
+		fmt.Printf("Continue stops after %d steps\n", int(n))
+	case "history-keyframe-interval":
+		r.vm.SetKeyframeInterval(int(n))
+		fmt.Printf("Snapshots are taken every %d steps\n", max(1, int(n)))
+	case "history-limit":
+		r.vm.SetHistoryLimit(int(n))
+		fmt.Printf("Keeping the last %d steps\n", int(n))
+	case "gc-threshold":
+		r.vm.SetGCThreshold(int(n))
+		fmt.Printf("Collecting from %d table entries\n", int(n))
+	default:
+		fmt.Printf("\033[31mUnknown option: %s\033[0m\n", name)
+	}
+}
+
+// diffSteps prints what changed between the states before two steps, a
+// step written as session:step is read from that session's history
+func (r *REPL) diffSteps(from, to string) {
+	steps := make([]*lang.VMState, 2)
+	for i, arg := range []string{from, to} {
+		vm := r.vm
+		if name, rest, ok := strings.Cut(arg, ":"); ok {
+			if vm = r.sessionVM(name); vm == nil {
+				fmt.Printf("\033[31mUnknown session: %s\033[0m\n", name)
+				return
+			}
+			arg = rest
+		}
+		step, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Printf("Invalid step: %s\n", arg)
+			return
+		}
+		if steps[i], err = vm.StateAt(step); err != nil {
+			fmt.Printf("\033[31m%v\033[0m\n", err)
+			return
+		}
+	}
+
+	diff := lang.DiffStates(steps[0], steps[1])
+	fmt.Printf("\033[1;35mPC:\033[0m %d -> %d  \033[1;34mLine:\033[0m %d -> %d\n", diff.FromPC, diff.ToPC, diff.FromLine, diff.ToLine)
+	printSlotChanges("Locals", diff.Locals)
+	printSlotChanges("Stack", diff.Stack)
+}
+
+// whence replays the history looking for the last step that changed name
+// and rewinds to right before it
+func (r *REPL) whence(name string) {
+	read := func(state *lang.VMState) string {
+		idx, global, ok := r.compiler.VariableAt(state.PC, name)
+		if !ok {
+			return ""
+		}
+		locals := state.Locals
+		if global && len(state.Frames) > 0 {
+			locals = state.Frames[0].Locals
+		}
+		if idx >= len(locals) || locals[idx] == nil {
+			return ""
+		}
+		return state.FormatValueAs(locals[idx], r.intFormat)
+	}
+
+	last, prev := -1, ""
+	err := r.vm.ReplayRange(0, r.vm.StepCount(), func(step int, state *lang.VMState) {
+		value := read(state)
+		if step > 0 && value != prev {
+			last = step - 1
+		}
+		prev = value
+	})
+	if err != nil {
+		fmt.Printf("\033[31m%v\033[0m\n", err)
+		return
+	}
+	if last < 0 {
+		fmt.Printf("%s has not changed in the recorded history\n", name)
+		return
+	}
+
+	if err := r.vm.Rewind(last); err != nil {
+		fmt.Printf("\033[31m%v\033[0m\n", err)
+		return
+	}
+	state := r.vm.State()
+	source := ""
+	if lines := strings.Split(r.sourceCode, "\n"); state.SourceLine > 0 && state.SourceLine <= len(lines) {
+		source = strings.TrimSpace(lines[state.SourceLine-1])
+	}
+	fmt.Printf("%s last changed at step %d, line %d: \033[1m%s\033[0m\n", name, last, state.SourceLine, source)
+	r.printState(state)
+}
+
+// saveSession records the current program under the current session name
+func (r *REPL) saveSession() {
+	r.sessions[r.current] = &session{vm: r.vm, compiler: r.compiler, sourceCode: r.sourceCode}
+}
+
+// useSession makes a saved session current
+func (r *REPL) useSession(name string) {
+	s := r.sessions[name]
+	r.vm, r.compiler, r.sourceCode = s.vm, s.compiler, s.sourceCode
+	r.current = name
+}
+
+func (r *REPL) switchSession(name string) {
+	if name == r.current {
+		fmt.Printf("Already in session %s\n", name)
+		return
+	}
+	if _, ok := r.sessions[name]; !ok {
+		fmt.Printf("\033[31mUnknown session: %s\033[0m\n", name)
+		return
+	}
+	r.saveSession()
+	r.useSession(name)
+	fmt.Printf("Switched to session %s\n", name)
+	r.printState(r.vm.State())
+}
+
+func (r *REPL) listSessions() {
+	r.saveSession()
+	names := make([]string, 0, len(r.sessions))
+	for name := range r.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		marker := " "
+		if name == r.current {
+			marker = "*"
+		}
+		fmt.Printf("%s %s  step %d\n", marker, name, r.sessions[name].vm.StepCount())
+	}
+}
+
+// sessionVM finds the VM of a session by name, the current one included
+func (r *REPL) sessionVM(name string) *lang.VM {
+	if name == r.current {
+		return r.vm
+	}
+	if s, ok := r.sessions[name]; ok {
+		return s.vm
+	}
+	return nil
+}
+
+func printSlotChanges(title string, changes []lang.SlotChange) {
+	if len(changes) == 0 {
+		fmt.Printf("\033[1;36m%s:\033[0m unchanged\n", title)
+		return
+	}
+	fmt.Printf("\033[1;36m%s:\033[0m\n", title)
+	for _, change := range changes {
+		switch {
+		case change.Before == "":
+			fmt.Printf("  \033[32m+ [%d] %s\033[0m\n", change.Index, change.After)
+		case change.After == "":
+			fmt.Printf("  \033[31m- [%d] %s\033[0m\n", change.Index, change.Before)
+		default:
+			fmt.Printf("  ~ [%d] %s -> %s\n", change.Index, change.Before, change.After)
+		}
+	}
+}
+
 func (r *REPL) restartVM() {
 	r.vm.Stop()
 	newState := lang.NewVmState(r.vm.Bytecode, cap(r.vm.CurrentState.Stack), cap(r.vm.CurrentState.Locals))
 	newState.Strings = make([]string, len(r.vm.CurrentState.Strings))
 	copy(newState.Strings, r.vm.CurrentState.Strings)
 	r.vm.CurrentState = newState
-	r.vm.History = make([]*lang.VMState, 0)
+	r.vm.ResetHistory()
 	r.vm.Run()
 	<-r.vm.StateChan
 }
@@ -226,21 +498,17 @@ func (r *REPL) printState(state *lang.VMState) {
 		state.SourceLine,
 		state.PC,
 		lang.Instr(r.vm.Bytecode[state.PC]))
-	fmt.Printf("\033[1;32mStack:\033[0m %s\n", r.formatStack(state.Stack))
-	fmt.Printf("\033[1;36mLocals:\033[0m %s\n", r.formatStack(state.Locals))
+	// Shown after every step so it's kept to a line each, the stack and
+	// locals commands print them in full
+	width := lang.DisplayWidth()
+	fmt.Printf("\033[1;32mStack:\033[0m %s\n", lang.Ellipsize(r.formatStack(state.Stack), width-len("Stack: ")))
+	fmt.Printf("\033[1;36mLocals:\033[0m %s\n", lang.Ellipsize(r.formatStack(state.Locals), width-len("Locals: ")))
 }
 
 func (r *REPL) formatStack(stack []lang.Value) string {
 	var values []string
 	for _, v := range stack {
-		switch val := v.(type) {
-		case lang.IntValue:
-			values = append(values, fmt.Sprintf("%d", val))
-		case lang.StringValue:
-			values = append(values, fmt.Sprintf("%q", r.vm.CurrentState.Strings[val.Index]))
-		default:
-			values = append(values, fmt.Sprintf("%v", v))
-		}
+		values = append(values, r.vm.CurrentState.FormatValueAs(v, r.intFormat))
 	}
 	return "[" + strings.Join(values, ", ") + "]"
 }
@@ -263,8 +531,10 @@ func (r *REPL) loadFile(filename string) error {
 	}
 
 	// Create new VM with the compiled bytecode
-	r.vm = lang.NewVM(bytecode, 1024, 1024, true)
+	r.vm = lang.NewVM(bytecode, lang.DefaultStackSize, lang.DefaultLocalsSize, true)
 	lang.RegisterBuiltins(r.vm)
+	r.vm.SetCheckedArithmetic(r.compiler.Checked)
+	r.vm.SetPromoteOnOverflow(r.compiler.Promote)
 
 	// Register source map from compiler
 	for pc, line := range r.compiler.GetSourceMap() {
@@ -273,6 +543,7 @@ func (r *REPL) loadFile(filename string) error {
 
 	// Register the strings from the compiler
 	r.vm.RegisterStrings(r.compiler.Strings)
+	r.vm.RegisterConstants(r.compiler.Constants)
 
 	// Set initial breakpoint at first line
 	r.vm.SetLineBreakpoint(1, true)
@@ -287,6 +558,9 @@ type SourceView struct {
 	currentLine  int
 	selectedLine int
 	maxWidth     int
+	// scroll is the column lines are shown from, lines wider than the
+	// terminal are scrolled with ←/→
+	scroll int
 }
 
 // Add new method to handle interactive source viewing
@@ -320,7 +594,8 @@ func (r *REPL) interactiveSource() {
 		fmt.Print("\033[H")
 
 		// Print header
-		fmt.Println("\033[1;36mInteractive Source View - Use ↑/↓ to navigate, Space to toggle breakpoint, q to quit\033[0m")
+		header := "Interactive Source View - Use ↑/↓ to navigate, ←/→ to scroll, Space to toggle breakpoint, q to quit"
+		fmt.Printf("\033[1;36m%s\033[0m\033[K\n", lang.Ellipsize(header, lang.DisplayWidth()))
 
 		view.render(r.vm)
 
@@ -346,6 +621,10 @@ func (r *REPL) interactiveSource() {
 					if view.selectedLine < len(view.lines) {
 						view.selectedLine++
 					}
+				case 67: // Right arrow
+					view.scroll += 8
+				case 68: // Left arrow
+					view.scroll = max(0, view.scroll-8)
 				}
 			}
 		}
@@ -354,32 +633,53 @@ func (r *REPL) interactiveSource() {
 
 // Add render method for SourceView
 func (v *SourceView) render(vm *lang.VM) {
+	// The line number and gutter take maxWidth+3 columns, the current line
+	// is padded with a space on either side
+	width := lang.DisplayWidth() - v.maxWidth - 5
 	for i, line := range v.lines {
 		lineNum := i + 1
 		lineNumStr := fmt.Sprintf("%*d", v.maxWidth, lineNum)
+		line = window(line, v.scroll, width)
 
-		// Determine line styling
+		// Determine line styling, every line clears what an earlier render
+		// left to its right
 		if lineNum == v.selectedLine {
 			if lineNum == v.currentLine {
 				// Selected + current line (cyan background + yellow background + bold)
-				fmt.Printf("\033[46m%s │\033[43;1m %s \033[0m\n", lineNumStr, line)
+				fmt.Printf("\033[46m%s │\033[43;1m %s \033[0m\033[K\n", lineNumStr, line)
 			} else {
 				// Selected line (cyan background + bold)
-				fmt.Printf("\033[46m%s │\033[0m\033[1m %s\033[0m\n", lineNumStr, line)
+				fmt.Printf("\033[46m%s │\033[0m\033[1m %s\033[0m\033[K\n", lineNumStr, line)
 			}
 		} else if lineNum == v.currentLine {
 			// Current execution line (yellow background)
-			fmt.Printf("\033[90m%s │\033[0m\033[43m %s \033[0m\n", lineNumStr, line)
+			fmt.Printf("\033[90m%s │\033[0m\033[43m %s \033[0m\033[K\n", lineNumStr, line)
 		} else if vm.HasBreakpoint(lineNum) {
 			// Breakpoint (red dot)
-			fmt.Printf("\033[31m%s ● \033[0m%s\n", lineNumStr, line)
+			fmt.Printf("\033[31m%s ● \033[0m%s\033[K\n", lineNumStr, line)
 		} else {
 			// Normal line
-			fmt.Printf("\033[90m%s │\033[0m %s\n", lineNumStr, line)
+			fmt.Printf("\033[90m%s │\033[0m %s\033[K\n", lineNumStr, line)
 		}
 	}
 }
 
+// window is the part of line from column from on that fits in width
+// columns, an ellipsis replaces the first and last visible rune on each side
+// that was cut. Lines are left whole when width isn't positive
+func window(line string, from, width int) string {
+	runes := []rune(line)
+	visible := runes[min(from, len(runes)):]
+	if width > 0 && len(visible) > width {
+		visible = visible[:width]
+		visible[width-1] = []rune(lang.Ellipsis)[0]
+	}
+	if from > 0 && len(visible) > 0 {
+		visible[0] = []rune(lang.Ellipsis)[0]
+	}
+	return string(visible)
+}
+
 // Update the displaySource method to call interactiveSource
 func (r *REPL) displaySource() {
 	r.interactiveSource()
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"hadydotai/opdlang/lang"
+)
+
+// reportEntry is one operation in a JSON run report
+type reportEntry struct {
+	Operation  string   `json:"operation"`
+	Status     string   `json:"status"`
+	DurationMS int64    `json:"duration_ms"`
+	Outputs    []string `json:"outputs,omitempty"`
+}
+
+// writeReport writes how each operation went to path, as JSON when it ends
+// in .json and as a table otherwise
+func writeReport(path string, results []lang.OpResult) error {
+	var buf bytes.Buffer
+	if filepath.Ext(path) == ".json" {
+		entries := make([]reportEntry, len(results))
+		for i, r := range results {
+			entries[i] = reportEntry{Operation: r.Name, Status: r.Status, DurationMS: r.Duration.Milliseconds(), Outputs: r.Outputs}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	} else {
+		width := len("operation")
+		for _, r := range results {
+			width = max(width, len(r.Name))
+		}
+		fmt.Fprintf(&buf, "%-*s  %-8s  %-10s  %s\n", width, "operation", "status", "duration", "outputs")
+		for _, r := range results {
+			line := fmt.Sprintf("%-*s  %-8s  %-10s  %s", width, r.Name, r.Status, r.Duration.Round(time.Millisecond), strings.Join(r.Outputs, ", "))
+			buf.WriteString(strings.TrimRight(line, " ") + "\n")
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	return nil
+}
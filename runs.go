@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// runRecord is the last successful run of an operation with inputs
+type runRecord struct {
+	Hash     string    `json:"hash"`
+	Finished time.Time `json:"finished"`
+}
+
+// runDB is the operation runs of a program, kept as JSON in runs/ in the
+// artifacts directory. With rerun set nothing recorded counts, every
+// operation runs and records again
+type runDB struct {
+	path  string
+	rerun bool
+	runs  map[string]runRecord
+}
+
+func openRunDB(path string, rerun bool) (*runDB, error) {
+	db := &runDB{path: path, rerun: rerun, runs: make(map[string]runRecord)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operation runs: %w", err)
+	}
+	if err := json.Unmarshal(data, &db.runs); err != nil {
+		return nil, fmt.Errorf("failed to read operation runs from %s: %w", path, err)
+	}
+	return db, nil
+}
+
+func (db *runDB) Lookup(op string) (string, bool) {
+	run, ok := db.runs[op]
+	if !ok || db.rerun {
+		return "", false
+	}
+	return run.Hash, true
+}
+
+func (db *runDB) Record(op, hash string) error {
+	db.runs[op] = runRecord{Hash: hash, Finished: time.Now().UTC()}
+	data, err := json.MarshalIndent(db.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(db.path, data, 0644)
+}
@@ -0,0 +1,199 @@
+package telemetry
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hadydotai/opdlang/lang"
+)
+
+// OTLPExporter sends what a run recorded to an OpenTelemetry collector over
+// OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	// Endpoint is the collector's base URL, /v1/traces and /v1/metrics are
+	// appended to it
+	Endpoint string
+	Service  string
+	Client   *http.Client
+}
+
+// Export sends the spans as one trace and the counters as cumulative sums.
+// The run started at start
+func (e *OTLPExporter) Export(t *lang.Telemetry, start time.Time) error {
+	t.Finish()
+	resource := otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", e.Service)}}
+
+	traces := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "opdlang"}, Spans: convertSpans(t.Spans)}},
+	}}}
+	if err := e.post("/v1/traces", traces); err != nil {
+		return err
+	}
+
+	now := unixNano(time.Now())
+	counter := func(name string, value int) otlpMetric {
+		return otlpMetric{Name: name, Sum: otlpSum{
+			DataPoints:             []otlpDataPoint{{AsInt: strconv.Itoa(value), StartTimeUnixNano: unixNano(start), TimeUnixNano: now}},
+			AggregationTemporality: 2, // Cumulative
+			IsMonotonic:            true,
+		}}
+	}
+	metrics := otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "opdlang"}, Metrics: []otlpMetric{
+			counter("opdlang.instructions", t.Instructions),
+			counter("opdlang.runtime_errors", t.RuntimeErrors),
+		}}},
+	}}}
+	return e.post("/v1/metrics", metrics)
+}
+
+func (e *OTLPExporter) post(path string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	url := strings.TrimSuffix(e.Endpoint, "/") + path
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to export telemetry: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export telemetry: %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func convertSpans(spans []lang.Span) []otlpSpan {
+	traceID := randomID(16)
+	ids := make([]string, len(spans))
+	converted := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		ids[i] = randomID(8)
+		converted[i] = otlpSpan{
+			TraceID:           traceID,
+			SpanID:            ids[i],
+			Name:              span.Name,
+			Kind:              1, // Internal
+			StartTimeUnixNano: unixNano(span.Start),
+			EndTimeUnixNano:   unixNano(span.End),
+			Attributes:        []otlpAttribute{stringAttribute("opdlang.kind", span.Kind)},
+		}
+		// Parents are always recorded before their children
+		if span.Parent >= 0 {
+			converted[i].ParentSpanID = ids[span.Parent]
+		}
+		if span.Error != "" {
+			converted[i].Status = &otlpStatus{Code: 2, Message: span.Error} // Error
+		}
+	}
+	return converted
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// The OTLP JSON encoding, only the fields this exporter fills in
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name string  `json:"name"`
+	Sum  otlpSum `json:"sum"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	AsInt             string `json:"asInt"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	TimeUnixNano      string `json:"timeUnixNano"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"hadydotai/opdlang/lang"
+)
+
+type TodosCommand struct {
+	Args struct {
+		Patterns []string `positional-arg-name:"PATTERNS"`
+	} `positional-args:"yes"`
+}
+
+var todosCommand TodosCommand
+
+func (cmd *TodosCommand) Execute(args []string) error {
+	patterns := cmd.Args.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+
+	for _, pattern := range patterns {
+		files, err := discoverSources(pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			source, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("failed to read source file %s: %w", file, err)
+			}
+			todos, err := lang.CollectTodos(file, string(source))
+			if err != nil {
+				return err
+			}
+			for _, todo := range todos {
+				owner := ""
+				if todo.Owner != "" {
+					owner = "(" + todo.Owner + ")"
+				}
+				fmt.Printf("%s \033[1;33m%s%s\033[0m %s\n", todo.Pos, todo.Kind, owner, todo.Text)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	flagsparser.AddCommand(
+		"todos",
+		"List the TODO and FIXME comments",
+		"Lists every TODO and FIXME comment with its position and owner in the source files matched by PATTERNS, ./... by default",
+		&todosCommand,
+	)
+}
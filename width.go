@@ -0,0 +1,13 @@
+package main
+
+import "github.com/chzyer/readline"
+
+// displayWidth is the number of columns output is fit to, --width or COLUMNS
+// when set and otherwise the terminal's. It's 0 when output doesn't go to a
+// terminal, nothing is cut then
+func displayWidth() int {
+	if opts.Width > 0 {
+		return opts.Width
+	}
+	return max(0, readline.GetScreenWidth())
+}